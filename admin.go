@@ -0,0 +1,288 @@
+package sj
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrNotAdmin     = errors.New("Admin rights required")
+	ErrUserDisabled = errors.New("Account is disabled")
+)
+
+// AdminOnly wraps a handler like SignedIn does and lets only requests of
+// enabled admin users pass. It has to be used inside of SignedIn.
+func AdminOnly(app AppCtx) func(gin.HandlerFunc) gin.HandlerFunc {
+	return func(h gin.HandlerFunc) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			err := checkAdmin(app, c)
+			if err != nil {
+				c.JSON(http.StatusForbidden, NewFailResponse(err))
+				c.Abort()
+				return
+			}
+
+			h(c)
+		}
+	}
+}
+
+// AdminRoutes registers the admin API in the group. signedIn is the
+// SignedIn wrapper of the app.
+func AdminRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	admin := func(fn AppHandler) gin.HandlerFunc {
+		return signedIn(AdminOnly(app)(NewAppHandler(app, fn)))
+	}
+
+	r.GET("/users", admin(ListUsersHandler))
+	r.DELETE("/users/:id", admin(AdminRemoveUserHandler))
+	r.POST("/users/:id/password", admin(ResetPasswordHandler))
+	r.POST("/users/:id/role", admin(SetUserRoleHandler))
+	r.POST("/users/:id/disabled", admin(DisableUserHandler))
+	r.POST("/users/:id/unlock", admin(UnlockUserHandler))
+	r.DELETE("/users/:id/2fa", admin(AdminResetTOTPHandler))
+	r.POST("/invites", admin(NewInviteCodeHandler))
+	r.POST("/series/:id/merge", admin(MergeSeriesHandler))
+	r.DELETE("/series/:id", admin(AdminRemoveSeriesHandler))
+}
+
+func checkAdmin(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	user, err := ReadUserContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	if user.Disabled {
+		return ErrUserDisabled
+	}
+
+	if user.Role != RoleAdmin {
+		return ErrNotAdmin
+	}
+
+	return nil
+}
+
+func ListUsersHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	uList, err := ReadUserListContext(ctx, app.DB)
+	if err != nil {
+		return err
+	}
+
+	for i := range uList {
+		uList[i].Password = ""
+	}
+
+	resp := NewSuccessResponse(uList)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func ResetPasswordHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseAdminUserRequest(c, "NewPassword")
+	if err != nil {
+		return err
+	}
+
+	err = ValidatePassword(app.Specs, data.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	err = UpdateUserPasswordContext(ctx, app.DB, userID, data.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	err = RemoveUserSessionsContext(ctx, app.DB, userID, "")
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func SetUserRoleHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseAdminUserRequest(c, "Role")
+	if err != nil {
+		return err
+	}
+
+	if data.Role != RoleUser && data.Role != RoleAdmin {
+		m := fmt.Sprintf("Unknown role %v", data.Role)
+		return errors.New(m)
+	}
+
+	err = UpdateUserRoleContext(ctx, app.DB, userID, data.Role)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func DisableUserHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseAdminUserRequest(c, "Disabled")
+	if err != nil {
+		return err
+	}
+
+	err = UpdateUserDisabledContext(ctx, app.DB, userID, data.Disabled)
+	if err != nil {
+		return err
+	}
+
+	// A disabled user must not keep using the sessions it already has
+	if data.Disabled {
+		err = RemoveUserSessionsContext(ctx, app.DB, userID, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func AdminRemoveUserHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	removed, err := RemoveUserContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	err = removeUnusedImages(ctx, app, removed)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func MergeSeriesHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	src, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseAdminUserRequest(c, "TargetID")
+	if err != nil {
+		return err
+	}
+
+	if src == data.TargetID {
+		return errors.New("Cannot merge series with itself")
+	}
+
+	srcSeries, err := ReadSeriesContext(ctx, app.DB, src)
+	if err != nil {
+		return err
+	}
+
+	dstSeries, err := ReadSeriesContext(ctx, app.DB, data.TargetID)
+	if err != nil {
+		return err
+	}
+
+	err = MergeSeriesContext(ctx, app.DB, src, data.TargetID)
+	if err != nil {
+		return err
+	}
+
+	err = removeUnusedImages(ctx, app, SeriesList{srcSeries})
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(dstSeries)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func AdminRemoveSeriesHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	seriesID, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	series, err := ReadSeriesContext(ctx, app.DB, seriesID)
+	if err != nil {
+		return err
+	}
+
+	err = PurgeSeriesContext(ctx, app.DB, seriesID)
+	if err != nil {
+		return err
+	}
+
+	err = removeUnusedImages(ctx, app, SeriesList{series})
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(series)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func readIDParam(c *gin.Context) (int64, error) {
+	return strconv.ParseInt(c.Params.ByName("id"), 10, 64)
+}
@@ -0,0 +1,177 @@
+package sj
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+	"github.com/tochti/smem"
+)
+
+func Test_GET_AdminUsers_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := int64(1)
+
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v"
+	q := fmt.Sprintf(m, UserTable)
+	rows := sqlmock.NewRows([]string{"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email"}).
+		AddRow(userID, "boss", NewSha512Password("123"), RoleAdmin, false, 0, nil, "")
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	rows = sqlmock.NewRows([]string{"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email"}).
+		AddRow(userID, "boss", NewSha512Password("123"), RoleAdmin, false, 0, nil, "").
+		AddRow(2, "spammer", NewSha512Password("456"), RoleUser, true, 0, nil, "")
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	sessionStore := smem.NewStore()
+	expires := time.Now().Add(1 * time.Hour)
+	tmp := strconv.FormatInt(userID, 10)
+	session, err := sessionStore.NewSession(tmp, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	AdminRoutes(srv.Group("/admin"), app, kauth.SignedIn(&sessionStore))
+
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("GET", "/admin/users", session.Token())
+
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code)
+	}
+
+	expect := NewSuccessResponse(UserList{
+		{ID: userID, Name: "boss", Role: RoleAdmin},
+		{ID: 2, Name: "spammer", Role: RoleUser, Disabled: true},
+	})
+	err = EqualResponse(expect, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_GET_AdminUsers_NotAdmin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := int64(2)
+
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v"
+	q := fmt.Sprintf(m, UserTable)
+	rows := sqlmock.NewRows([]string{"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email"}).
+		AddRow(userID, "devilXX", NewSha512Password("123"), RoleUser, false, 0, nil, "")
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	sessionStore := smem.NewStore()
+	expires := time.Now().Add(1 * time.Hour)
+	tmp := strconv.FormatInt(userID, 10)
+	session, err := sessionStore.NewSession(tmp, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	AdminRoutes(srv.Group("/admin"), app, kauth.SignedIn(&sessionStore))
+
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("GET", "/admin/users", session.Token())
+
+	if http.StatusForbidden != resp.Code {
+		t.Fatal("Expect 403 was", resp.Code)
+	}
+
+	expect := NewFailResponse(ErrNotAdmin)
+	err = EqualResponse(expect, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_AdminDisableUser_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := int64(1)
+	spammerID := int64(2)
+
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v"
+	q := fmt.Sprintf(m, UserTable)
+	rows := sqlmock.NewRows([]string{"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email"}).
+		AddRow(userID, "boss", NewSha512Password("123"), RoleAdmin, false, 0, nil, "")
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	q = fmt.Sprintf("UPDATE %v SET Disabled = \\? WHERE ID = \\?", UserTable)
+	mock.ExpectExec(q).WithArgs(true, spammerID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	q = fmt.Sprintf("DELETE FROM %v WHERE User_ID = \\?", SessionTable)
+	mock.ExpectExec(q).WithArgs(spammerID).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	sessionStore := smem.NewStore()
+	expires := time.Now().Add(1 * time.Hour)
+	tmp := strconv.FormatInt(userID, 10)
+	session, err := sessionStore.NewSession(tmp, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	AdminRoutes(srv.Group("/admin"), app, kauth.SignedIn(&sessionStore))
+
+	req := TestRequest{
+		Body:    `{"Data": {"Disabled": true}}`,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	url := fmt.Sprintf("/admin/users/%v/disabled", spammerID)
+	resp := req.SendWithToken("POST", url, session.Token())
+
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code, resp.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,304 @@
+package sj
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+)
+
+const (
+	apiTokenPrefix = "sj_"
+	apiTokenKey    = "sj.apitoken"
+)
+
+var (
+	ErrInvalidAPIToken    = errors.New("Invalid API token")
+	ErrReadOnlyAPIToken   = errors.New("API token is read-only")
+	ErrAPITokenNotAllowed = errors.New("Not allowed with an API token")
+)
+
+type (
+	APIToken struct {
+		ID       int64
+		UserID   int64
+		Name     string
+		ReadOnly bool
+		Created  time.Time
+	}
+
+	APITokenList []APIToken
+)
+
+// SignedIn wraps a handler like kauth.SignedIn does. Requests with an
+// Authorization: Bearer header are authenticated by their API token, all
+// other requests by the kauth session of the store.
+func SignedIn(app AppCtx, sessionStore kauth.SessionStore) func(gin.HandlerFunc) gin.HandlerFunc {
+	sessionSignedIn := kauth.SignedIn(sessionStore)
+
+	return func(h gin.HandlerFunc) gin.HandlerFunc {
+		withSession := sessionSignedIn(h)
+
+		return func(c *gin.Context) {
+			raw, ok := bearerToken(c)
+			if !ok {
+				withSession(c)
+				return
+			}
+
+			ctx := requestContext(app, c)
+			token, err := FindAPITokenContext(ctx, app.DB, raw)
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusUnauthorized, NewFailResponse(ErrInvalidAPIToken))
+				c.Abort()
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusOK, NewFailResponse(err))
+				c.Abort()
+				return
+			}
+
+			if token.ReadOnly && !isReadMethod(c.Request.Method) {
+				c.JSON(http.StatusForbidden, NewFailResponse(ErrReadOnlyAPIToken))
+				c.Abort()
+				return
+			}
+
+			c.Set(apiTokenKey, token)
+			h(c)
+		}
+	}
+}
+
+// APITokenRoutes registers the endpoints to manage the API tokens of the
+// signed in user.
+func APITokenRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	r.GET("/tokens", signedIn(NewAppHandler(app, ListAPITokensHandler)))
+	r.POST("/tokens", signedIn(NewAppHandler(app, NewAPITokenHandler)))
+	r.DELETE("/tokens/:id", signedIn(NewAppHandler(app, RemoveAPITokenHandler)))
+}
+
+func HashAPIToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// NewAPIToken creates a token for the user. Only the hash of the token is
+// stored, the returned token can't be read again.
+func NewAPIToken(db *sql.DB, userID int64, name string, readOnly bool) (APIToken, string, error) {
+	return NewAPITokenContext(context.Background(), db, userID, name, readOnly)
+}
+
+func NewAPITokenContext(ctx context.Context, db *sql.DB, userID int64, name string, readOnly bool) (APIToken, string, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	tmp, err := newSecretToken()
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	raw := apiTokenPrefix + tmp
+
+	token := APIToken{
+		UserID:   userID,
+		Name:     name,
+		ReadOnly: readOnly,
+		Created:  time.Now().UTC().Truncate(time.Second),
+	}
+
+	m := "INSERT INTO %v (User_ID,Name,Token_Hash,Read_Only,Created) VALUES(?, ?, ?, ?, ?)"
+	q := fmt.Sprintf(m, quote(APITokenTable))
+	token.ID, err = dbInsertID(ctx, db, q, userID, name, HashAPIToken(raw), readOnly, token.Created)
+	if err != nil {
+		return APIToken{}, "", err
+	}
+
+	return token, raw, nil
+}
+
+// FindAPIToken returns the token if it exists and its user is not
+// disabled, otherwise sql.ErrNoRows.
+func FindAPIToken(db *sql.DB, raw string) (APIToken, error) {
+	return FindAPITokenContext(context.Background(), db, raw)
+}
+
+func FindAPITokenContext(ctx context.Context, db *sql.DB, raw string) (APIToken, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `
+	SELECT t.ID, t.User_ID, t.Name, t.Read_Only, t.Created
+	FROM %v as t, %v as u
+	WHERE t.Token_Hash = ?
+	AND u.ID = t.User_ID
+	AND u.Disabled = ?
+	`
+	q := fmt.Sprintf(m, quote(APITokenTable), quote(UserTable))
+
+	token := APIToken{}
+	err := dbQueryRow(ctx, db, q, HashAPIToken(raw), false).
+		Scan(&token.ID, &token.UserID, &token.Name, &token.ReadOnly, &token.Created)
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	return token, nil
+}
+
+func ReadAPITokenList(db *sql.DB, userID int64) (APITokenList, error) {
+	return ReadAPITokenListContext(context.Background(), db, userID)
+}
+
+func ReadAPITokenListContext(ctx context.Context, db *sql.DB, userID int64) (APITokenList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT ID, Name, Read_Only, Created FROM %v WHERE User_ID = ? ORDER BY ID"
+	q := fmt.Sprintf(m, quote(APITokenTable))
+	rows, err := dbQuery(ctx, db, q, userID)
+	if err != nil {
+		return APITokenList{}, err
+	}
+	defer rows.Close()
+
+	tList := APITokenList{}
+	for rows.Next() {
+		token := APIToken{UserID: userID}
+		err := rows.Scan(&token.ID, &token.Name, &token.ReadOnly, &token.Created)
+		if err != nil {
+			return APITokenList{}, err
+		}
+
+		tList = append(tList, token)
+	}
+
+	return tList, rows.Err()
+}
+
+func RemoveAPIToken(db *sql.DB, userID, id int64) (int64, error) {
+	return RemoveAPITokenContext(context.Background(), db, userID, id)
+}
+
+func RemoveAPITokenContext(ctx context.Context, db *sql.DB, userID, id int64) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "DELETE FROM %v WHERE ID = ? AND User_ID = ?"
+	q := fmt.Sprintf(s, quote(APITokenTable))
+	rsrc, err := dbExec(ctx, db, q, id, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return rsrc.RowsAffected()
+}
+
+func ListAPITokensHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	tList, err := ReadAPITokenListContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(tList)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// NewAPITokenHandler responds with the token once. Tokens can only be
+// created by a session, so a leaked token can't create new ones.
+func NewAPITokenHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	if _, ok := readAPIToken(c); ok {
+		return ErrAPITokenNotAllowed
+	}
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseNewAPITokenRequest(c)
+	if err != nil {
+		return err
+	}
+
+	token, raw, err := NewAPITokenContext(ctx, app.DB, userID, data.Name, data.ReadOnly)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(struct {
+		APIToken
+		Token string
+	}{token, raw})
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func RemoveAPITokenHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	affected, err := RemoveAPITokenContext(ctx, app.DB, userID, id)
+	if err != nil {
+		return err
+	}
+
+	if affected < 1 {
+		return errors.New("Cannot found API token")
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func bearerToken(c *gin.Context) (string, bool) {
+	h := c.Request.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(h[7:]), true
+}
+
+func readAPIToken(c *gin.Context) (APIToken, bool) {
+	v, ok := c.Get(apiTokenKey)
+	if !ok {
+		return APIToken{}, false
+	}
+
+	token, ok := v.(APIToken)
+	return token, ok
+}
+
+func isReadMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
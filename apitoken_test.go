@@ -0,0 +1,252 @@
+package sj
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/smem"
+)
+
+var apiTokenColumns = []string{"ID", "User_ID", "Name", "Read_Only", "Created"}
+
+func expectAPIToken(mock sqlmock.Sqlmock, raw string, userID int64, readOnly bool) {
+	q := fmt.Sprintf("SELECT t.ID, t.User_ID, t.Name, t.Read_Only, t.Created FROM %v as t", APITokenTable)
+	rows := sqlmock.NewRows(apiTokenColumns).
+		AddRow(1, userID, "kodi", readOnly, time.Now())
+	mock.ExpectQuery(q).
+		WithArgs(HashAPIToken(raw), false).
+		WillReturnRows(rows)
+}
+
+func Test_NewAPIToken_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("INSERT INTO %v", APITokenTable)
+	mock.ExpectExec(q).
+		WithArgs(1, "kodi", sqlmock.AnyArg(), true, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+
+	token, raw, err := NewAPIToken(db, 1, "kodi", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.ID != 3 || !token.ReadOnly || token.Name != "kodi" {
+		t.Fatal("Unexpected token", token)
+	}
+
+	if len(raw) != len(apiTokenPrefix)+64 {
+		t.Fatal("Unexpected raw token", raw)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_SignedIn_APIToken_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := "sj_secret"
+	userID := int64(3)
+	expectAPIToken(mock, raw, userID, true)
+	expectSyncState(mock, userID, 0, time.Time{})
+
+	q := fmt.Sprintf("SELECT Series_ID, Session, Episode FROM %v", LastWatchedTable)
+	rows := sqlmock.NewRows([]string{"Series_ID", "Session", "Episode"}).
+		AddRow(1, 2, 3)
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	sessionStore := smem.NewStore()
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	signedIn := SignedIn(app, &sessionStore)
+	srv.GET("/lastwatched", signedIn(NewAppHandler(app, LastWatchedListHandler)))
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+raw)
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  header,
+	}
+	resp := req.SendWithToken("GET", "/lastwatched", "")
+
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code)
+	}
+
+	expect := NewSuccessResponse(LastWatchedList{
+		{UserID: userID, SeriesID: 1, Session: 2, Episode: 3},
+	})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_SignedIn_APIToken_ReadOnly(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := "sj_secret"
+	expectAPIToken(mock, raw, 3, true)
+
+	sessionStore := smem.NewStore()
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	signedIn := SignedIn(app, &sessionStore)
+	srv.POST("/lastwatched", signedIn(NewAppHandler(app, UpdateLastWatchedHandler)))
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+raw)
+	req := TestRequest{
+		Body:    `{"Data": {"SeriesID": 1, "Session": 1, "Episode": 2}}`,
+		Handler: srv,
+		Header:  header,
+	}
+	resp := req.SendWithToken("POST", "/lastwatched", "")
+
+	if 403 != resp.Code {
+		t.Fatal("Expect 403 was", resp.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_SignedIn_APIToken_Invalid(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := fmt.Sprintf("FROM %v as t", APITokenTable)
+	mock.ExpectQuery(q).
+		WithArgs(HashAPIToken("sj_wrong"), false).
+		WillReturnRows(sqlmock.NewRows(apiTokenColumns))
+
+	sessionStore := smem.NewStore()
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	signedIn := SignedIn(app, &sessionStore)
+	srv.GET("/lastwatched", signedIn(NewAppHandler(app, LastWatchedListHandler)))
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer sj_wrong")
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  header,
+	}
+	resp := req.SendWithToken("GET", "/lastwatched", "")
+
+	if 401 != resp.Code {
+		t.Fatal("Expect 401 was", resp.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_APIToken_WithAPIToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := "sj_secret"
+	expectAPIToken(mock, raw, 3, false)
+
+	sessionStore := smem.NewStore()
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	APITokenRoutes(srv.Group("/"), app, SignedIn(app, &sessionStore))
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+raw)
+	req := TestRequest{
+		Body:    `{"Data": {"Name": "evil"}}`,
+		Handler: srv,
+		Header:  header,
+	}
+	resp := req.SendWithToken("POST", "/tokens", "")
+
+	expect := NewFailResponse(ErrAPITokenNotAllowed)
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_APIToken_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := int64(3)
+	q := fmt.Sprintf("INSERT INTO %v", APITokenTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, "kodi", sqlmock.AnyArg(), false, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	sessionStore := smem.NewStore()
+	expires := time.Now().Add(1 * time.Hour)
+	session, err := sessionStore.NewSession(strconv.FormatInt(userID, 10), expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	APITokenRoutes(srv.Group("/"), app, SignedIn(app, &sessionStore))
+
+	req := TestRequest{
+		Body:    `{"Data": {"Name": "kodi"}}`,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("POST", "/tokens", session.Token())
+
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,186 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	BatchAppendSeriesList  = "serieslist.append"
+	BatchUpdateLastWatched = "lastwatched.update"
+
+	batchMaxOperations = 500
+)
+
+type (
+	BatchOperation struct {
+		Op       string
+		SeriesID int64
+		Session  int
+		Episode  int
+	}
+
+	BatchItemResult struct {
+		Op       string
+		SeriesID int64
+		OK       bool
+		Err      string `json:",omitempty"`
+	}
+
+	// BatchResult tells per operation if it succeeded. Nothing is stored
+	// if Committed is false.
+	BatchResult struct {
+		Committed bool
+		Results   []BatchItemResult
+	}
+)
+
+// BatchRoutes registers the batch endpoint which runs many list and last
+// watched operations in one transaction.
+func BatchRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	r.POST("/batch", signedIn(NewAppHandler(app, BatchHandler)))
+}
+
+func RunBatch(db *sql.DB, userID int64, ops []BatchOperation, allOrNothing bool) (BatchResult, []Event, error) {
+	return RunBatchContext(context.Background(), db, userID, ops, allOrNothing)
+}
+
+// RunBatchContext runs every operation in a savepoint, a failing operation
+// is rolled back alone and the others are committed. With allOrNothing
+// the whole batch is rolled back if one operation fails. The events of
+// the committed operations are returned to be emitted by the caller.
+func RunBatchContext(ctx context.Context, db *sql.DB, userID int64, ops []BatchOperation, allOrNothing bool) (BatchResult, []Event, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return BatchResult{}, nil, err
+	}
+
+	result := BatchResult{Results: []BatchItemResult{}}
+	events := []Event{}
+	failed := false
+	for _, op := range ops {
+		item := BatchItemResult{Op: op.Op, SeriesID: op.SeriesID}
+
+		_, err := dbExec(ctx, tx, "SAVEPOINT batch_item")
+		if err != nil {
+			tx.Rollback()
+			return BatchResult{}, nil, err
+		}
+
+		e, err := runBatchOperation(ctx, tx, userID, op)
+		if err != nil {
+			failed = true
+			item.Err = err.Error()
+			_, err = dbExec(ctx, tx, "ROLLBACK TO SAVEPOINT batch_item")
+		} else {
+			item.OK = true
+			if e != nil {
+				events = append(events, *e)
+			}
+			_, err = dbExec(ctx, tx, "RELEASE SAVEPOINT batch_item")
+		}
+		if err != nil {
+			tx.Rollback()
+			return BatchResult{}, nil, err
+		}
+
+		result.Results = append(result.Results, item)
+	}
+
+	if failed && allOrNothing {
+		return result, nil, tx.Rollback()
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return BatchResult{}, nil, err
+	}
+	result.Committed = true
+
+	return result, events, nil
+}
+
+// runBatchOperation returns the event of the change, nil if nothing
+// changed.
+func runBatchOperation(ctx context.Context, tx *sql.Tx, userID int64, op BatchOperation) (*Event, error) {
+	switch op.Op {
+	case BatchAppendSeriesList:
+		_, err := ReadSeriesContext(ctx, tx, op.SeriesID)
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Cannot found Series")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		exists, err := ExistsSeriesListContext(ctx, tx, userID, op.SeriesID)
+		if err != nil || exists {
+			return nil, err
+		}
+
+		err = AppendSeriesListContext(ctx, tx, userID, op.SeriesID)
+		if err != nil {
+			return nil, err
+		}
+
+		e := NewEvent(EventSeriesAdded, userID, SeriesListEvent{op.SeriesID})
+		return &e, nil
+
+	case BatchUpdateLastWatched:
+		_, err := ReadSeriesContext(ctx, tx, op.SeriesID)
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Cannot found Series")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		lastWatched := LastWatched{
+			UserID:   userID,
+			SeriesID: op.SeriesID,
+			Session:  op.Session,
+			Episode:  op.Episode,
+		}
+		err = UpdateLastWatchedContext(ctx, tx, lastWatched)
+		if err != nil {
+			return nil, err
+		}
+
+		e := NewEvent(EventEpisodeWatched, userID, lastWatched)
+		return &e, nil
+	}
+
+	return nil, errors.New("Wrong value in Op")
+}
+
+func BatchHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseBatchRequest(c)
+	if err != nil {
+		return err
+	}
+
+	result, events, err := RunBatchContext(ctx, app.DB, userID, data.Operations, data.AllOrNothing)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		emit(ctx, app, e)
+	}
+
+	resp := NewSuccessResponse(result)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package sj
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func expectBatchAppend(mock sqlmock.Sqlmock, userID, seriesID int64, found bool) {
+	mock.ExpectExec("SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	q := fmt.Sprintf("SELECT Title, Image, Description FROM %v", SeriesTable)
+	if !found {
+		mock.ExpectQuery(q).WithArgs(seriesID).WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec("ROLLBACK TO SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+		return
+	}
+
+	rows := sqlmock.NewRows([]string{"Title", "Image", "Description"}).
+		AddRow("Mr. Robot", "robot.png", "")
+	mock.ExpectQuery(q).WithArgs(seriesID).WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT COUNT\\(\\*\\) FROM %v", SeriesListTable)
+	rows = sqlmock.NewRows([]string{"Count"}).AddRow(0)
+	mock.ExpectQuery(q).WithArgs(userID, seriesID).WillReturnRows(rows)
+
+	q = fmt.Sprintf("INSERT INTO %v", SeriesListTable)
+	mock.ExpectExec(q).WithArgs(userID, seriesID).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncSeries, seriesID)
+	mock.ExpectExec("RELEASE SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func expectBatchLastWatched(mock sqlmock.Sqlmock, userID, seriesID int64, session, episode int, found bool) {
+	mock.ExpectExec("SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	q := fmt.Sprintf("SELECT Title, Image, Description FROM %v", SeriesTable)
+	if !found {
+		mock.ExpectQuery(q).WithArgs(seriesID).WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec("ROLLBACK TO SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+		return
+	}
+
+	rows := sqlmock.NewRows([]string{"Title", "Image", "Description"}).
+		AddRow("Mr. Robot", "robot.png", "")
+	mock.ExpectQuery(q).WithArgs(seriesID).WillReturnRows(rows)
+
+	q = fmt.Sprintf("INTO %v", LastWatchedTable)
+	mock.ExpectExec(q).WithArgs(userID, seriesID, session, episode).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 2, SyncWatched, seriesID)
+	mock.ExpectExec("RELEASE SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+const batchBody = `{"Data": {"AllOrNothing": %v, "Operations": [
+	{"Op": "serieslist.append", "SeriesID": 3},
+	{"Op": "serieslist.append", "SeriesID": 9},
+	{"Op": "lastwatched.update", "SeriesID": 3, "Session": 2, "Episode": 1},
+	{"Op": "lastwatched.update", "SeriesID": 9, "Session": 1, "Episode": 1}
+]}}`
+
+func Test_POST_Batch_Partial(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+	mock.ExpectBegin()
+	expectBatchAppend(mock, userID, 3, true)
+	expectBatchAppend(mock, userID, 9, false)
+	expectBatchLastWatched(mock, userID, 3, 2, 1, true)
+	expectBatchLastWatched(mock, userID, 9, 1, 1, false)
+	mock.ExpectCommit()
+
+	recorder := &eventRecorder{}
+	app := AppCtx{DB: db, Events: []EventSink{recorder}}
+	srv, token := newSignedInServer(t, app, userID, BatchRoutes)
+
+	req := TestRequest{
+		Body:    fmt.Sprintf(batchBody, false),
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("POST", "/batch", token)
+
+	expect := NewSuccessResponse(BatchResult{
+		Committed: true,
+		Results: []BatchItemResult{
+			{Op: BatchAppendSeriesList, SeriesID: 3, OK: true},
+			{Op: BatchAppendSeriesList, SeriesID: 9, Err: "Cannot found Series"},
+			{Op: BatchUpdateLastWatched, SeriesID: 3, OK: true},
+			{Op: BatchUpdateLastWatched, SeriesID: 9, Err: "Cannot found Series"},
+		},
+	})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.events) != 2 ||
+		recorder.events[0].Type != EventSeriesAdded ||
+		recorder.events[1].Type != EventEpisodeWatched {
+		t.Fatal("Unexpected events", recorder.events)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_Batch_AllOrNothing(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+	mock.ExpectBegin()
+	expectBatchAppend(mock, userID, 3, true)
+	expectBatchAppend(mock, userID, 9, false)
+	expectBatchLastWatched(mock, userID, 3, 2, 1, true)
+	expectBatchLastWatched(mock, userID, 9, 1, 1, false)
+	mock.ExpectRollback()
+
+	recorder := &eventRecorder{}
+	app := AppCtx{DB: db, Events: []EventSink{recorder}}
+	srv, token := newSignedInServer(t, app, userID, BatchRoutes)
+
+	req := TestRequest{
+		Body:    fmt.Sprintf(batchBody, true),
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("POST", "/batch", token)
+
+	expect := NewSuccessResponse(BatchResult{
+		Committed: false,
+		Results: []BatchItemResult{
+			{Op: BatchAppendSeriesList, SeriesID: 3, OK: true},
+			{Op: BatchAppendSeriesList, SeriesID: 9, Err: "Cannot found Series"},
+			{Op: BatchUpdateLastWatched, SeriesID: 3, OK: true},
+			{Op: BatchUpdateLastWatched, SeriesID: 9, Err: "Cannot found Series"},
+		},
+	})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.events) != 0 {
+		t.Fatal("Expect no events was", recorder.events)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
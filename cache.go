@@ -0,0 +1,106 @@
+package sj
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Images are named by the SHA1 of their content, see SaveImage, so they
+// never change and can be cached forever.
+var (
+	imageNameRegexp = regexp.MustCompile(`^[0-9a-f]{40}(\.[0-9A-Za-z]+)?$`)
+
+	ErrInvalidImageName = errors.New("Invalid image name")
+)
+
+// ImageRoutes serves the images of ImageDir.
+func ImageRoutes(r *gin.RouterGroup, app AppCtx) {
+	r.GET("/images/:name", ImageHandler(app))
+}
+
+func ImageHandler(app AppCtx) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Params.ByName("name")
+		if !imageNameRegexp.MatchString(name) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		// A missing image must not be cached as immutable
+		file := path.Join(app.Specs.ImageDir, name)
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		hash := strings.TrimSuffix(name, path.Ext(name))
+		c.Header("ETag", `"`+hash+`"`)
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+		c.File(file)
+	}
+}
+
+// versionETag returns a strong ETag of the version of the data of a
+// response, so it can be checked before the data is loaded.
+func versionETag(kind string, id, version int64) string {
+	return fmt.Sprintf(`"%v-%d-%d"`, kind, id, version)
+}
+
+// respondNotModified sets the ETag and Last-Modified of the version of a
+// response and responds 304 Not Modified if the client already has it. It
+// returns false if the handler has to respond with the data. Last-Modified
+// is left out while the change is in the current second, another change in
+// the same second would get the same time.
+func respondNotModified(c *gin.Context, etag string, updated time.Time) bool {
+	header := c.Writer.Header()
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", "private, no-cache")
+
+	if !updated.IsZero() && updated.Before(time.Now().Truncate(time.Second)) {
+		header.Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	}
+
+	if !notModified(c.Request, etag, updated) {
+		return false
+	}
+
+	c.Status(http.StatusNotModified)
+
+	return true
+}
+
+// notModified checks If-None-Match and If-Modified-Since of the request like
+// RFC 9110, If-Modified-Since only counts without If-None-Match.
+func notModified(r *http.Request, etag string, updated time.Time) bool {
+	inm := r.Header.Get("If-None-Match")
+	if inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if updated.IsZero() {
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !updated.Truncate(time.Second).After(since)
+}
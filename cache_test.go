@@ -0,0 +1,222 @@
+package sj
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+	"github.com/tochti/smem"
+)
+
+func Test_GET_Series_NotModified(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	updated := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	q := fmt.Sprintf("SELECT Updated FROM %v WHERE ID", SeriesTable)
+	for i := 0; i < 3; i++ {
+		rows := sqlmock.NewRows([]string{"Updated"}).AddRow(updated)
+		mock.ExpectQuery(q).WithArgs(3).WillReturnRows(rows)
+
+		// Only the first request loads the series
+		if i == 0 {
+			q := fmt.Sprintf("SELECT Title, Image, Description FROM %v WHERE ID", SeriesTable)
+			rows := sqlmock.NewRows([]string{"Title", "Image", "Description"}).
+				AddRow("Mr. Robot", "robot.png", "")
+			mock.ExpectQuery(q).WithArgs(3).WillReturnRows(rows)
+		}
+	}
+
+	srv := gin.New()
+	srv.GET("/series/:id", NewAppHandler(AppCtx{DB: db}, ReadSeriesHandler))
+
+	resp := httptest.NewRecorder()
+	srv.ServeHTTP(resp, httptest.NewRequest("GET", "/series/3", nil))
+
+	etag := resp.Header().Get("ETag")
+	if resp.Code != http.StatusOK || etag != `"series-3-1456833600"` {
+		t.Fatal("Expect 200 with ETag was", resp.Code, etag)
+	}
+
+	lastModified := resp.Header().Get("Last-Modified")
+	if lastModified != "Tue, 01 Mar 2016 12:00:00 GMT" {
+		t.Fatal("Unexpected Last-Modified", lastModified)
+	}
+
+	req := httptest.NewRequest("GET", "/series/3", nil)
+	req.Header.Set("If-None-Match", `"other", W/`+etag)
+	resp = httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusNotModified || resp.Body.Len() != 0 {
+		t.Fatal("Expect 304 without body was", resp.Code, resp.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/series/3", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	resp = httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusNotModified {
+		t.Fatal("Expect 304 was", resp.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_GET_LastWatchedList_ETag(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(1)
+	old := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	watched := fmt.Sprintf("SELECT Series_ID, Session, Episode FROM %v", LastWatchedTable)
+	expectSyncState(mock, userID, 4, old)
+	rows := sqlmock.NewRows([]string{"Series_ID", "Session", "Episode"}).AddRow(2, 1, 4)
+	mock.ExpectQuery(watched).WithArgs(userID).WillReturnRows(rows)
+
+	// The list is not loaded while the version is the same
+	expectSyncState(mock, userID, 4, old)
+
+	expectSyncState(mock, userID, 5, time.Now())
+	rows = sqlmock.NewRows([]string{"Series_ID", "Session", "Episode"}).AddRow(2, 1, 5)
+	mock.ExpectQuery(watched).WithArgs(userID).WillReturnRows(rows)
+
+	sessionStore := smem.NewStore()
+	session, err := sessionStore.NewSession(strconv.FormatInt(userID, 10), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := gin.New()
+	signedIn := kauth.SignedIn(&sessionStore)
+	srv.GET("/", signedIn(NewAppHandler(AppCtx{DB: db}, LastWatchedListHandler)))
+
+	cases := []struct {
+		code         int
+		etag         string
+		lastModified string
+	}{
+		{http.StatusOK, `"watched-1-4"`, "Tue, 01 Mar 2016 12:00:00 GMT"},
+		{http.StatusNotModified, `"watched-1-4"`, "Tue, 01 Mar 2016 12:00:00 GMT"},
+		// A change in the current second has no Last-Modified yet
+		{http.StatusOK, `"watched-1-5"`, ""},
+	}
+
+	etag := ""
+	for _, expect := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-XSRF-TOKEN", session.Token())
+		req.Header.Set("If-None-Match", etag)
+		resp := httptest.NewRecorder()
+		srv.ServeHTTP(resp, req)
+
+		if resp.Code != expect.code {
+			t.Fatal("Expect", expect.code, "was", resp.Code)
+		}
+
+		etag = resp.Header().Get("ETag")
+		if etag != expect.etag {
+			t.Fatal("Expect ETag", expect.etag, "was", etag)
+		}
+
+		if lm := resp.Header().Get("Last-Modified"); lm != expect.lastModified {
+			t.Fatal("Expect Last-Modified", expect.lastModified, "was", lm)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_NotModified_IfModifiedSince(t *testing.T) {
+	updated := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		header http.Header
+		expect bool
+	}{
+		{http.Header{"If-Modified-Since": {"Tue, 01 Mar 2016 12:00:00 GMT"}}, true},
+		{http.Header{"If-Modified-Since": {"Tue, 01 Mar 2016 11:59:59 GMT"}}, false},
+		{http.Header{"If-Modified-Since": {"yesterday"}}, false},
+		// If-None-Match wins over If-Modified-Since
+		{http.Header{
+			"If-None-Match":     {`"other"`},
+			"If-Modified-Since": {"Tue, 01 Mar 2016 12:00:00 GMT"},
+		}, false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header = c.header
+		if result := notModified(r, `"watched-1-4"`, updated); result != c.expect {
+			t.Fatal("Expect", c.expect, "was", result, "for", c.header)
+		}
+	}
+}
+
+func Test_GET_Image_Immutable(t *testing.T) {
+	dir := t.TempDir()
+	name := NewSha1Hash([]byte("png")) + ".png"
+	err := os.WriteFile(path.Join(dir, name), []byte("png"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := gin.New()
+	ImageRoutes(srv.Group("/"), AppCtx{Specs: Specs{ImageDir: dir}})
+
+	resp := httptest.NewRecorder()
+	srv.ServeHTTP(resp, httptest.NewRequest("GET", "/images/"+name, nil))
+
+	if resp.Code != http.StatusOK || resp.Body.String() != "png" {
+		t.Fatal("Expect image was", resp.Code, resp.Body.String())
+	}
+
+	if cc := resp.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Fatal("Unexpected Cache-Control", cc)
+	}
+
+	req := httptest.NewRequest("GET", "/images/"+name, nil)
+	req.Header.Set("If-None-Match", resp.Header().Get("ETag"))
+	resp = httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusNotModified {
+		t.Fatal("Expect 304 was", resp.Code)
+	}
+
+	resp = httptest.NewRecorder()
+	srv.ServeHTTP(resp, httptest.NewRequest("GET", "/images/..%2Fsecret", nil))
+
+	if resp.Code != http.StatusNotFound {
+		t.Fatal("Expect 404 was", resp.Code)
+	}
+
+	missing := NewSha1Hash([]byte("gif")) + ".gif"
+	resp = httptest.NewRecorder()
+	srv.ServeHTTP(resp, httptest.NewRequest("GET", "/images/"+missing, nil))
+
+	if resp.Code != http.StatusNotFound || resp.Header().Get("Cache-Control") != "" {
+		t.Fatal("Expect uncached 404 was", resp.Code, resp.Header())
+	}
+}
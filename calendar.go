@@ -0,0 +1,335 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DefaultUpcomingDays = 30
+	MaxUpcomingDays     = 366
+
+	// The feed shows the last weeks too, so calendar apps keep the
+	// episodes which aired recently.
+	calendarFeedPast   = 30 * 24 * time.Hour
+	calendarFeedFuture = 180 * 24 * time.Hour
+
+	dateLayout = "2006-01-02"
+)
+
+type (
+	UpcomingEpisode struct {
+		SeriesTitle string
+		Episode     Episode
+	}
+
+	UpcomingEpisodeList []UpcomingEpisode
+)
+
+// CalendarRoutes registers the calendar endpoints in the group. The ICS
+// feed is authenticated by its secret token only, so calendar apps can
+// subscribe to it.
+func CalendarRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	r.GET("/upcoming", signedIn(NewAppHandler(app, UpcomingEpisodesHandler)))
+	r.POST("/calendar/token", signedIn(NewAppHandler(app, NewCalendarTokenHandler)))
+	r.GET("/calendar/feed/:token", NewAppHandler(app, CalendarFeedHandler))
+}
+
+func NewEpisode(db *sql.DB, e Episode) (int64, error) {
+	return NewEpisodeContext(context.Background(), db, e)
+}
+
+func NewEpisodeContext(ctx context.Context, db *sql.DB, e Episode) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	airDate := sql.NullTime{
+		Time:  e.AirDate,
+		Valid: !e.AirDate.IsZero(),
+	}
+
+	m := "INSERT INTO %v (Series_ID,Title,Session,Episode,AirDate) VALUES(?, ?, ?, ?, ?)"
+	q := fmt.Sprintf(m, quote(EpisodesTable))
+	id, err := dbInsertID(ctx, db, q, e.SeriesID, e.Title, e.Session, e.Episode, airDate)
+	if err != nil {
+		return -1, err
+	}
+
+	return id, nil
+}
+
+// ReadUpcomingEpisodes returns the episodes of the series in the users list
+// which air in [from, to).
+func ReadUpcomingEpisodes(db *sql.DB, userID int64, from, to time.Time) (UpcomingEpisodeList, error) {
+	return ReadUpcomingEpisodesContext(context.Background(), db, userID, from, to)
+}
+
+func ReadUpcomingEpisodesContext(ctx context.Context, db *sql.DB, userID int64, from, to time.Time) (UpcomingEpisodeList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `
+	SELECT e.ID, e.Series_ID, e.Title, e.Session, e.Episode, e.AirDate,
+	series.Title
+	FROM %v as e, %v as list, %v as series
+	WHERE list.User_ID = ?
+	AND e.Series_ID = list.Series_ID
+	AND series.ID = e.Series_ID
+	AND e.AirDate >= ? AND e.AirDate < ?
+	ORDER BY e.AirDate, series.Title, e.Session, e.Episode
+	`
+	q := fmt.Sprintf(m, quote(EpisodesTable), quote(SeriesListTable), quote(SeriesTable))
+
+	rows, err := dbQuery(ctx, db, q, userID, from, to)
+	if err != nil {
+		return UpcomingEpisodeList{}, err
+	}
+	defer rows.Close()
+
+	uList := UpcomingEpisodeList{}
+	for rows.Next() {
+		u := UpcomingEpisode{}
+		var title sql.NullString
+		var airDate sql.NullTime
+
+		err := rows.Scan(&u.Episode.ID, &u.Episode.SeriesID, &title,
+			&u.Episode.Session, &u.Episode.Episode, &airDate, &u.SeriesTitle)
+		if err != nil {
+			return UpcomingEpisodeList{}, err
+		}
+
+		u.Episode.Title = title.String
+		u.Episode.AirDate = airDate.Time
+		uList = append(uList, u)
+	}
+
+	return uList, rows.Err()
+}
+
+// NewCalendarToken creates the secret token of the users ICS feed. Only the
+// hash of the token is stored. An existing token is replaced, so the old
+// feed URL stops working.
+func NewCalendarToken(db *sql.DB, userID int64) (string, error) {
+	return NewCalendarTokenContext(context.Background(), db, userID)
+}
+
+func NewCalendarTokenContext(ctx context.Context, db *sql.DB, userID int64) (string, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	token, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	q := dialect.Upsert(quote(CalendarFeedTable),
+		[]string{"User_ID"},
+		[]string{"Token_Hash"},
+	)
+	_, err = dbExec(ctx, db, q, userID, HashAPIToken(token))
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func FindCalendarTokenUser(db *sql.DB, token string) (int64, error) {
+	return FindCalendarTokenUserContext(context.Background(), db, token)
+}
+
+func FindCalendarTokenUserContext(ctx context.Context, db *sql.DB, token string) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "SELECT User_ID FROM %v WHERE Token_Hash = ?"
+	q := fmt.Sprintf(s, quote(CalendarFeedTable))
+
+	var userID int64
+	err := dbQueryRow(ctx, db, q, HashAPIToken(token)).Scan(&userID)
+	if err != nil {
+		return -1, err
+	}
+
+	return userID, nil
+}
+
+// WriteICS writes the episodes as all-day events of an iCalendar (RFC 5545).
+func WriteICS(w io.Writer, name string, uList UpcomingEpisodeList, now time.Time) error {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//sj//calendar//EN",
+		"CALSCALE:GREGORIAN",
+		"X-WR-CALNAME:" + icsEscape(name),
+	}
+
+	stamp := now.UTC().Format("20060102T150405Z")
+	for _, u := range uList {
+		e := u.Episode
+		day := e.AirDate.Format("20060102")
+		next := e.AirDate.AddDate(0, 0, 1).Format("20060102")
+
+		summary := fmt.Sprintf("%v S%02dE%02d", u.SeriesTitle, e.Session, e.Episode)
+		if e.Title != "" {
+			summary = fmt.Sprintf("%v - %v", summary, e.Title)
+		}
+
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:episode-%v@sj", e.ID),
+			"DTSTAMP:"+stamp,
+			"DTSTART;VALUE=DATE:"+day,
+			"DTEND;VALUE=DATE:"+next,
+			"SUMMARY:"+icsEscape(summary),
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, l := range lines {
+		_, err := io.WriteString(w, icsFold(l)+"\r\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func icsEscape(s string) string {
+	r := strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	)
+	return r.Replace(s)
+}
+
+// icsFold splits lines longer than 75 octets without breaking runes.
+func icsFold(l string) string {
+	buf := strings.Builder{}
+	n := 0
+	for _, r := range l {
+		size := len(string(r))
+		if n+size > 75 {
+			buf.WriteString("\r\n ")
+			n = 1
+		}
+		buf.WriteRune(r)
+		n += size
+	}
+
+	return buf.String()
+}
+
+func UpcomingEpisodesHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	from, to, err := parseDateRange(c, time.Now())
+	if err != nil {
+		return err
+	}
+
+	uList, err := ReadUpcomingEpisodesContext(ctx, app.DB, userID, from, to)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(uList)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func NewCalendarTokenHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	token, err := NewCalendarTokenContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(token)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func CalendarFeedHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	token := strings.TrimSuffix(c.Params.ByName("token"), ".ics")
+	userID, err := FindCalendarTokenUserContext(ctx, app.DB, token)
+	if err == sql.ErrNoRows {
+		c.Status(http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	from := now.Add(-calendarFeedPast)
+	to := now.Add(calendarFeedFuture)
+	uList, err := ReadUpcomingEpisodesContext(ctx, app.DB, userID, from, to)
+	if err != nil {
+		return err
+	}
+
+	c.Header("Content-Type", "text/calendar; charset=utf-8")
+	c.Status(http.StatusOK)
+	return WriteICS(c.Writer, "sj", uList, now)
+}
+
+// parseDateRange reads the from and to query parameters, both days are
+// included. from defaults to today and the range to DefaultUpcomingDays.
+func parseDateRange(c *gin.Context, now time.Time) (time.Time, time.Time, error) {
+	params := c.Request.URL.Query()
+
+	y, m, d := now.Date()
+	from := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	if v := params.Get("from"); v != "" {
+		tmp, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("Wrong value in from")
+		}
+		from = tmp
+	}
+
+	to := from.AddDate(0, 0, DefaultUpcomingDays)
+	if v := params.Get("to"); v != "" {
+		tmp, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("Wrong value in to")
+		}
+		to = tmp.AddDate(0, 0, 1)
+	}
+
+	if !to.After(from) || to.Sub(from) > MaxUpcomingDays*24*time.Hour {
+		m := fmt.Sprintf("Date range has to be between 1 and %v days", MaxUpcomingDays)
+		return time.Time{}, time.Time{}, errors.New(m)
+	}
+
+	return from, to, nil
+}
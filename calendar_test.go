@@ -0,0 +1,236 @@
+package sj
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+	"github.com/tochti/smem"
+)
+
+var upcomingColumns = []string{
+	"ID", "Series_ID", "Title", "Session", "Episode", "AirDate", "Title",
+}
+
+func Test_ReadUpcomingEpisodes_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	from := time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 30)
+	airDate := from.AddDate(0, 0, 2)
+
+	m := "SELECT e.ID, e.Series_ID, e.Title, e.Session, e.Episode, e.AirDate, series.Title FROM %v as e, %v as list, %v as series"
+	q := fmt.Sprintf(m, EpisodesTable, SeriesListTable, SeriesTable)
+	rows := sqlmock.NewRows(upcomingColumns).
+		AddRow(7, series.ID, "eps2.0", 2, 1, airDate, series.Title)
+	mock.ExpectQuery(q).WithArgs(1, from, to).WillReturnRows(rows)
+
+	uList, err := ReadUpcomingEpisodes(db, 1, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uList) != 1 {
+		t.Fatal("Expect 1 episode was", len(uList))
+	}
+
+	u := uList[0]
+	if u.SeriesTitle != series.Title || u.Episode.ID != 7 ||
+		!u.Episode.AirDate.Equal(airDate) {
+		t.Fatal("Unexpected episode", u)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_WriteICS(t *testing.T) {
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	uList := UpcomingEpisodeList{
+		{
+			SeriesTitle: "Law, Order; SVU",
+			Episode: Episode{
+				ID:      7,
+				Title:   "A very long episode title which does not fit into one line of the calendar",
+				Session: 2,
+				Episode: 1,
+				AirDate: time.Date(2016, 3, 3, 0, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	err := WriteICS(buf, "sj", uList, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ics := buf.String()
+	for _, l := range strings.Split(strings.TrimSuffix(ics, "\r\n"), "\r\n") {
+		if len(l) > 75 {
+			t.Fatal("Expect folded line was", l)
+		}
+	}
+
+	unfolded := strings.Replace(ics, "\r\n ", "", -1)
+	for _, expect := range []string{
+		"UID:episode-7@sj\r\n",
+		"DTSTAMP:20160301T120000Z\r\n",
+		"DTSTART;VALUE=DATE:20160303\r\n",
+		"DTEND;VALUE=DATE:20160304\r\n",
+		`SUMMARY:Law\, Order\; SVU S02E01 - A very long episode title`,
+	} {
+		if !strings.Contains(unfolded, expect) {
+			t.Fatalf("Expect %q in %v", expect, ics)
+		}
+	}
+}
+
+func Test_GET_Upcoming_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := int64(1)
+	from := time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2016, 3, 8, 0, 0, 0, 0, time.UTC)
+
+	q := fmt.Sprintf("FROM %v as e", EpisodesTable)
+	rows := sqlmock.NewRows(upcomingColumns).
+		AddRow(7, series.ID, "eps2.0", 2, 1, from, series.Title)
+	mock.ExpectQuery(q).WithArgs(userID, from, to).WillReturnRows(rows)
+
+	sessionStore := smem.NewStore()
+	expires := time.Now().Add(1 * time.Hour)
+	session, err := sessionStore.NewSession(strconv.FormatInt(userID, 10), expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	CalendarRoutes(srv.Group("/"), app, kauth.SignedIn(&sessionStore))
+
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("GET", "/upcoming?from=2016-03-01&to=2016-03-07", session.Token())
+
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code)
+	}
+
+	expectResp := NewSuccessResponse(UpcomingEpisodeList{
+		{
+			SeriesTitle: series.Title,
+			Episode: Episode{
+				ID:       7,
+				SeriesID: series.ID,
+				Title:    "eps2.0",
+				Session:  2,
+				Episode:  1,
+				AirDate:  from,
+			},
+		},
+	})
+	if err := EqualResponse(expectResp, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_GET_CalendarFeed_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := "secret"
+	q := fmt.Sprintf("SELECT User_ID FROM %v WHERE Token_Hash", CalendarFeedTable)
+	rows := sqlmock.NewRows([]string{"User_ID"}).AddRow(1)
+	mock.ExpectQuery(q).WithArgs(HashAPIToken(token)).WillReturnRows(rows)
+
+	airDate := time.Now().UTC().Truncate(24 * time.Hour)
+	q = fmt.Sprintf("FROM %v as e", EpisodesTable)
+	rows = sqlmock.NewRows(upcomingColumns).
+		AddRow(7, series.ID, "", 2, 1, airDate, series.Title)
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	sessionStore := smem.NewStore()
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	CalendarRoutes(srv.Group("/"), app, kauth.SignedIn(&sessionStore))
+
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.Send("GET", "/calendar/feed/"+token+".ics")
+
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code)
+	}
+
+	if ct := resp.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/calendar") {
+		t.Fatal("Expect text/calendar was", ct)
+	}
+
+	summary := fmt.Sprintf("SUMMARY:%v S02E01\r\n", series.Title)
+	if !strings.Contains(resp.Body.String(), summary) {
+		t.Fatal("Expect", summary, "in", resp.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_GET_CalendarFeed_UnknownToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := fmt.Sprintf("SELECT User_ID FROM %v WHERE Token_Hash", CalendarFeedTable)
+	rows := sqlmock.NewRows([]string{"User_ID"})
+	mock.ExpectQuery(q).WithArgs(HashAPIToken("nope")).WillReturnRows(rows)
+
+	sessionStore := smem.NewStore()
+	srv := gin.New()
+	CalendarRoutes(srv.Group("/"), AppCtx{DB: db}, kauth.SignedIn(&sessionStore))
+
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.Send("GET", "/calendar/feed/nope.ics")
+
+	if 404 != resp.Code {
+		t.Fatal("Expect 404 was", resp.Code)
+	}
+}
@@ -1,26 +1,53 @@
 package sj
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/tochti/gin-angular-kauth"
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 const (
 	SeriesTable           = "Series"
-	EpisodesResourceTable = "EpisodeResource"
+	EpisodesResourceTable = "EpisodesResource"
+	EpisodesTable         = "Episodes"
 	UserTable             = "User"
 	SeriesListTable       = "SeriesList"
 	LastWatchedTable      = "LastWatched"
+	InviteCodeTable       = "InviteCode"
+	CalendarFeedTable     = "CalendarFeed"
+	APITokenTable         = "APIToken"
+	SeriesExternalIDTable = "SeriesExternalID"
+	ScrobbleInboxTable    = "ScrobbleInbox"
+	WebhookTable          = "Webhook"
+	WebhookDeliveryTable  = "WebhookDelivery"
+	TOTPTable             = "TOTP"
+	RecoveryCodeTable     = "RecoveryCode"
+	SessionTable          = "UserSession"
+	UserIdentityTable     = "UserIdentity"
+	PasswordResetTable    = "PasswordReset"
+
+	NotificationPreferenceTable = "NotificationPreference"
+	PushSubscriptionTable       = "PushSubscription"
+	SyncChangeTable             = "SyncChange"
+	WatchedEpisodeTable         = "WatchedEpisode"
+	EmailVerificationTable      = "EmailVerification"
 )
 
 type (
 	Series struct {
-		ID    int64
-		Title string
-		Image string
+		ID          int64
+		Title       string
+		Image       string
+		Description string
 	}
 
 	SeriesList []Series
@@ -38,22 +65,40 @@ type (
 		Title    string
 		Episode  int
 		Session  int
+		AirDate  time.Time
 	}
 
 	User struct {
 		ID       int64
 		Name     string
 		Password string
+		Role     string
+		Disabled bool
+
+		// FailedLogins counts the failed logins since the last successful
+		// one, the account is locked until LockedUntil.
+		FailedLogins int
+		LockedUntil  time.Time
+
+		// Email is optional, it is used for password resets. It is only
+		// set once the user opened the link of the verification mail.
+		Email string
 	}
 
+	UserList []User
+
 	kauthUser struct {
 		id       string
 		password string
+		db       *sql.DB
+		user     User
+		policy   LoginPolicy
 	}
 
 	userStore struct {
-		db   *sql.DB
-		user User
+		db     *sql.DB
+		user   User
+		policy LoginPolicy
 	}
 
 	LastWatched struct {
@@ -64,21 +109,66 @@ type (
 	}
 
 	LastWatchedList []LastWatched
+
+	InviteCode struct {
+		Code      string
+		CreatedBy int64
+		UsedBy    int64
+		Created   time.Time
+	}
 )
 
-func NewSeries(db *sql.DB, s Series) (int64, error) {
-	err := db.Ping()
+type queryTimeoutKey struct{}
+
+// WithQueryTimeout returns a context which limits every single query of the
+// data functions to the duration d.
+func WithQueryTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, queryTimeoutKey{}, d)
+}
+
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	d, ok := ctx.Value(queryTimeoutKey{}).(time.Duration)
+	if !ok || d <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, d)
+}
+
+// inTx runs fn in a new transaction of db. If db already is a transaction
+// fn runs in it and the caller commits.
+func inTx(ctx context.Context, db querier, fn func(tx querier) error) error {
+	conn, ok := db.(*sql.DB)
+	if !ok {
+		return fn(db)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
-		return -1, err
+		return err
 	}
 
-	q := fmt.Sprintf("INSERT INTO %v (Title,Image) VALUES(?, ?)", SeriesTable)
-	res, err := db.Exec(q, s.Title, s.Image)
+	err = fn(tx)
 	if err != nil {
-		return -1, err
+		tx.Rollback()
+		return err
 	}
 
-	id, err := res.LastInsertId()
+	return tx.Commit()
+}
+
+func NewSeries(db *sql.DB, s Series) (int64, error) {
+	return NewSeriesContext(context.Background(), db, s)
+}
+
+func NewSeriesContext(ctx context.Context, db querier, s Series) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "INSERT INTO %v (Title,Image,Description,Search_Title,Search_Description,Updated) VALUES(?, ?, ?, ?, ?, ?)"
+	q := fmt.Sprintf(m, quote(SeriesTable))
+	id, err := dbInsertID(ctx, db, q, s.Title, s.Image, s.Description,
+		FoldText(s.Title), FoldText(s.Description), time.Now().UTC().Truncate(time.Second))
 	if err != nil {
 		return -1, err
 	}
@@ -87,36 +177,66 @@ func NewSeries(db *sql.DB, s Series) (int64, error) {
 }
 
 func ReadSeries(db *sql.DB, id int64) (Series, error) {
-	err := db.Ping()
-	if err != nil {
-		return Series{}, err
-	}
+	return ReadSeriesContext(context.Background(), db, id)
+}
+
+func ReadSeriesContext(ctx context.Context, db querier, id int64) (Series, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
 
 	var title string
 	var image string
-	q := fmt.Sprintf("SELECT Title, Image FROM %v WHERE ID = ?", SeriesTable)
-	err = db.QueryRow(q, id).Scan(&title, &image)
+	var desc string
+	m := "SELECT Title, Image, Description FROM %v WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(SeriesTable))
+	err := dbQueryRow(ctx, db, q, id).Scan(&title, &image, &desc)
 	if err != nil {
 		return Series{}, err
 	}
 
 	s := Series{
-		ID:    id,
-		Title: title,
-		Image: image,
+		ID:          id,
+		Title:       title,
+		Image:       image,
+		Description: desc,
 	}
 
 	return s, nil
 }
 
-func RemoveSeries(db *sql.DB, id int64) error {
-	if err := db.Ping(); err != nil {
-		return err
+func ReadSeriesUpdated(db *sql.DB, id int64) (time.Time, error) {
+	return ReadSeriesUpdatedContext(context.Background(), db, id)
+}
+
+// ReadSeriesUpdatedContext returns when the series was changed last, the
+// zero time for series which are older than the column.
+func ReadSeriesUpdatedContext(ctx context.Context, db querier, id int64) (time.Time, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT Updated FROM %v WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(SeriesTable))
+
+	var updated sql.NullTime
+	err := dbQueryRow(ctx, db, q, id).Scan(&updated)
+	if err != nil {
+		return time.Time{}, err
 	}
 
+	return updated.Time, nil
+}
+
+func RemoveSeries(db *sql.DB, id int64) error {
+	return RemoveSeriesContext(context.Background(), db, id)
+}
+
+func RemoveSeriesContext(ctx context.Context, db *sql.DB, id int64) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
 	s := "DELETE FROM %v WHERE ID = ?"
-	q := fmt.Sprintf(s, SeriesTable)
-	if _, err := db.Exec(q, id); err != nil {
+	q := fmt.Sprintf(s, quote(SeriesTable))
+	if _, err := dbExec(ctx, db, q, id); err != nil {
 		return err
 	}
 
@@ -124,39 +244,46 @@ func RemoveSeries(db *sql.DB, id int64) error {
 }
 
 func FindSeriesByTitle(db *sql.DB, t string) (Series, error) {
+	return FindSeriesByTitleContext(context.Background(), db, t)
+}
+
+func FindSeriesByTitleContext(ctx context.Context, db querier, t string) (Series, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
 
 	var id int64
 	var title string
 	var image string
+	var desc string
 
-	q := fmt.Sprintf("SELECT ID, Title, Image FROM %v WHERE Title = ?", SeriesTable)
-	err := db.QueryRow(q, t).Scan(&id, &title, &image)
+	m := "SELECT ID, Title, Image, Description FROM %v WHERE Title = ?"
+	q := fmt.Sprintf(m, quote(SeriesTable))
+	err := dbQueryRow(ctx, db, q, t).Scan(&id, &title, &image, &desc)
 	if err != nil {
 		return Series{}, err
 	}
 
 	s := Series{
-		ID:    id,
-		Title: title,
-		Image: image,
+		ID:          id,
+		Title:       title,
+		Image:       image,
+		Description: desc,
 	}
 
 	return s, nil
 }
 
 func NewEpisodeResource(db *sql.DB, r EpisodeResource) (int64, error) {
-	err := db.Ping()
-	if err != nil {
-		return -1, err
-	}
+	return NewEpisodeResourceContext(context.Background(), db, r)
+}
 
-	q := fmt.Sprintf("INSERT INTO %v VALUES(?, ?)", EpisodesResourceTable)
-	rsrc, err := db.Exec(q, r.Name, r.URL)
-	if err != nil {
-		return -1, err
-	}
+func NewEpisodeResourceContext(ctx context.Context, db *sql.DB, r EpisodeResource) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
 
-	id, err := rsrc.LastInsertId()
+	m := "INSERT INTO %v (Name,URL) VALUES(?, ?)"
+	q := fmt.Sprintf(m, quote(EpisodesResourceTable))
+	id, err := dbInsertID(ctx, db, q, r.Name, r.URL)
 	if err != nil {
 		return -1, err
 	}
@@ -166,17 +293,19 @@ func NewEpisodeResource(db *sql.DB, r EpisodeResource) (int64, error) {
 }
 
 func ReadEpisodeResource(db *sql.DB, id int64) (EpisodeResource, error) {
-	err := db.Ping()
-	if err != nil {
-		return EpisodeResource{}, err
-	}
+	return ReadEpisodeResourceContext(context.Background(), db, id)
+}
+
+func ReadEpisodeResourceContext(ctx context.Context, db *sql.DB, id int64) (EpisodeResource, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
 
 	m := "SELECT Series_ID, Name, URL FROM %v WHERE ID = ?"
-	q := fmt.Sprintf(m, EpisodesResourceTable)
+	q := fmt.Sprintf(m, quote(EpisodesResourceTable))
 	var seriesID int64
 	var name string
 	var url string
-	err = db.QueryRow(q, id).Scan(&seriesID, &name, &url)
+	err := dbQueryRow(ctx, db, q, id).Scan(&seriesID, &name, &url)
 	if err != nil {
 		return EpisodeResource{}, err
 	}
@@ -193,20 +322,17 @@ func ReadEpisodeResource(db *sql.DB, id int64) (EpisodeResource, error) {
 }
 
 func NewUser(db *sql.DB, user User) (int64, error) {
-	err := db.Ping()
-	if err != nil {
-		return -1, err
-	}
+	return NewUserContext(context.Background(), db, user)
+}
 
-	m := "INSERT INTO %v (Name,Password) VALUES (?,?)"
-	q := fmt.Sprintf(m, UserTable)
-	pass := NewSha512Password(user.Password)
-	rsrc, err := db.Exec(q, user.Name, pass)
-	if err != nil {
-		return -1, err
-	}
+func NewUserContext(ctx context.Context, db *sql.DB, user User) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
 
-	id, err := rsrc.LastInsertId()
+	m := "INSERT INTO %v (Name,Password,Email) VALUES (?,?,?)"
+	q := fmt.Sprintf(m, quote(UserTable))
+	pass := NewSha512Password(user.Password)
+	id, err := dbInsertID(ctx, db, q, user.Name, pass, user.Email)
 	if err != nil {
 		return -1, err
 	}
@@ -215,85 +341,594 @@ func NewUser(db *sql.DB, user User) (int64, error) {
 }
 
 func ReadUser(db *sql.DB, id int64) (User, error) {
-	err := db.Ping()
+	return ReadUserContext(context.Background(), db, id)
+}
+
+func ReadUserContext(ctx context.Context, db *sql.DB, id int64) (User, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+
+	return scanUser(dbQueryRow(ctx, db, q, id))
+}
+
+func FindUserByName(db *sql.DB, name string) (User, error) {
+	return FindUserByNameContext(context.Background(), db, name)
+}
+
+func FindUserByNameContext(ctx context.Context, db *sql.DB, name string) (User, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v WHERE Name = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+
+	return scanUser(dbQueryRow(ctx, db, q, name))
+}
+
+func ReadUserList(db *sql.DB) (UserList, error) {
+	return ReadUserListContext(context.Background(), db)
+}
+
+func ReadUserListContext(ctx context.Context, db *sql.DB) (UserList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v ORDER BY ID"
+	q := fmt.Sprintf(m, quote(UserTable))
+	rows, err := dbQuery(ctx, db, q)
 	if err != nil {
-		return User{}, err
+		return UserList{}, err
+	}
+	defer rows.Close()
+
+	uList := UserList{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return UserList{}, err
+		}
+		uList = append(uList, user)
 	}
 
-	m := "SELECT ID,Name,Password FROM %v WHERE ID = ?"
-	q := fmt.Sprintf(m, UserTable)
+	if err := rows.Err(); err != nil {
+		return UserList{}, err
+	}
+
+	return uList, nil
+}
 
-	var idTmp int64
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row scanner) (User, error) {
+	var id int64
 	var name string
 	var pass string
+	var role string
+	var disabled bool
+	var failed int
+	var locked sql.NullTime
+	var email string
 
-	err = db.QueryRow(q, id).Scan(&idTmp, &name, &pass)
+	err := row.Scan(&id, &name, &pass, &role, &disabled, &failed, &locked, &email)
 	if err != nil {
 		return User{}, err
 	}
 
 	user := User{
-		ID:       idTmp,
-		Name:     name,
-		Password: pass,
+		ID:           id,
+		Name:         name,
+		Password:     pass,
+		Role:         role,
+		Disabled:     disabled,
+		FailedLogins: failed,
+		LockedUntil:  locked.Time,
+		Email:        email,
 	}
 
 	return user, nil
 }
 
-func FindUserByName(db *sql.DB, name string) (User, error) {
-	err := db.Ping()
+func UpdateUserRole(db *sql.DB, userID int64, role string) error {
+	return UpdateUserRoleContext(context.Background(), db, userID, role)
+}
+
+func UpdateUserRoleContext(ctx context.Context, db *sql.DB, userID int64, role string) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "UPDATE %v SET Role = ? WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+	_, err := dbExec(ctx, db, q, role, userID)
 	if err != nil {
-		return User{}, err
+		return err
 	}
 
-	m := "SELECT ID,Name,Password FROM %v WHERE Name = ?"
-	q := fmt.Sprintf(m, UserTable)
+	return nil
+}
 
-	var id int64
-	var nameTmp string
-	var pass string
+func PromoteAdmins(db *sql.DB, names []string) error {
+	return PromoteAdminsContext(context.Background(), db, names)
+}
+
+// PromoteAdminsContext gives the users with one of the names the admin role.
+// Unknown names are ignored.
+func PromoteAdminsContext(ctx context.Context, db *sql.DB, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	args := []interface{}{RoleAdmin}
+	for _, n := range names {
+		args = append(args, n)
+	}
 
-	err = db.QueryRow(q, name).Scan(&id, &nameTmp, &pass)
+	m := "UPDATE %v SET Role = ? WHERE Name IN (%v)"
+	q := fmt.Sprintf(m, quote(UserTable), placeholders(len(names)))
+	_, err := dbExec(ctx, db, q, args...)
+
+	return err
+}
+
+func UpdateUserDisabled(db *sql.DB, userID int64, disabled bool) error {
+	return UpdateUserDisabledContext(context.Background(), db, userID, disabled)
+}
+
+func UpdateUserDisabledContext(ctx context.Context, db *sql.DB, userID int64, disabled bool) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "UPDATE %v SET Disabled = ? WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+	_, err := dbExec(ctx, db, q, disabled, userID)
 	if err != nil {
-		return User{}, err
+		return err
 	}
 
-	user := User{
-		ID:       id,
-		Name:     nameTmp,
-		Password: pass,
+	return nil
+}
+
+func UpdateUserPassword(db *sql.DB, userID int64, pass string) error {
+	return UpdateUserPasswordContext(context.Background(), db, userID, pass)
+}
+
+func UpdateUserPasswordContext(ctx context.Context, db *sql.DB, userID int64, pass string) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "UPDATE %v SET Password = ? WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+	_, err := dbExec(ctx, db, q, NewSha512Password(pass), userID)
+	if err != nil {
+		return err
 	}
 
-	return user, nil
+	return nil
+}
+
+func UpdateUserName(db *sql.DB, userID int64, name string) error {
+	return UpdateUserNameContext(context.Background(), db, userID, name)
+}
+
+func UpdateUserNameContext(ctx context.Context, db *sql.DB, userID int64, name string) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "UPDATE %v SET Name = ? WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+	_, err := dbExec(ctx, db, q, name, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RemoveUser deletes the user with its series list and progress. Series
+// of the list which are no longer used by anybody are deleted as well and
+// returned so the caller can clean up their images.
+func RemoveUser(db *sql.DB, userID int64) (SeriesList, error) {
+	return RemoveUserContext(context.Background(), db, userID)
+}
+
+func RemoveUserContext(ctx context.Context, db *sql.DB, userID int64) (SeriesList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	sList, err := ReadSeriesListContext(ctx, db, userID)
+	if err != nil {
+		return SeriesList{}, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return SeriesList{}, err
+	}
+
+	stmts := []string{
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(LastWatchedTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(SeriesListTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(CalendarFeedTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(APITokenTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(ScrobbleInboxTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(SeriesExternalIDTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE Webhook_ID IN (SELECT ID FROM %v WHERE User_ID = ?)",
+			quote(WebhookDeliveryTable), quote(WebhookTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(WebhookTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(RecoveryCodeTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(TOTPTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(SessionTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(UserIdentityTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(PasswordResetTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(NotificationPreferenceTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(PushSubscriptionTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(SyncChangeTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(WatchedEpisodeTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(EmailVerificationTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE ID = ?", quote(UserTable)),
+	}
+	for _, q := range stmts {
+		_, err = dbExec(ctx, tx, q, userID)
+		if err != nil {
+			tx.Rollback()
+			return SeriesList{}, err
+		}
+	}
+
+	removed := SeriesList{}
+	for _, series := range sList {
+		ok, err := removeSeriesIfUnused(ctx, tx, series.ID)
+		if err != nil {
+			tx.Rollback()
+			return SeriesList{}, err
+		}
+
+		if ok {
+			removed = append(removed, series)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return SeriesList{}, err
+	}
+
+	return removed, nil
+}
+
+// removeSeriesIfUnused deletes the series unless a user still has it on
+// the list, has watched it or mapped an external id to it.
+func removeSeriesIfUnused(ctx context.Context, tx *sql.Tx, seriesID int64) (bool, error) {
+	stmts := []string{
+		fmt.Sprintf("SELECT COUNT(*) FROM %v WHERE Series_ID = ?", quote(SeriesListTable)),
+		fmt.Sprintf("SELECT COUNT(*) FROM %v WHERE Series_ID = ?", quote(LastWatchedTable)),
+		fmt.Sprintf("SELECT COUNT(*) FROM %v WHERE Episode_ID IN (SELECT ID FROM %v WHERE Series_ID = ?)",
+			quote(WatchedEpisodeTable), quote(EpisodesTable)),
+		fmt.Sprintf("SELECT COUNT(*) FROM %v WHERE Series_ID = ?", quote(SeriesExternalIDTable)),
+	}
+	for _, q := range stmts {
+		var count int
+		err := dbQueryRow(ctx, tx, q, seriesID).Scan(&count)
+		if err != nil {
+			return false, err
+		}
+
+		if count > 0 {
+			return false, nil
+		}
+	}
+
+	err := removeSeriesRows(ctx, tx, seriesID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// removeSeriesRows deletes the series and records its removal from the
+// lists and last watched episodes of the users for the sync.
+func removeSeriesRows(ctx context.Context, tx *sql.Tx, seriesID int64) error {
+	q := fmt.Sprintf("SELECT User_ID FROM %v WHERE Series_ID = ?", quote(SeriesListTable))
+	listUsers, err := readUserIDs(ctx, tx, q, seriesID)
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf("SELECT User_ID FROM %v WHERE Series_ID = ?", quote(LastWatchedTable))
+	watchedUsers, err := readUserIDs(ctx, tx, q, seriesID)
+	if err != nil {
+		return err
+	}
+
+	stmts := []string{
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID = ?", quote(SeriesListTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID = ?", quote(LastWatchedTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE Episode_ID IN (SELECT ID FROM %v WHERE Series_ID = ?)",
+			quote(WatchedEpisodeTable), quote(EpisodesTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID = ?", quote(EpisodesTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID = ?", quote(EpisodesResourceTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID = ?", quote(SeriesExternalIDTable)),
+		fmt.Sprintf("DELETE FROM %v WHERE ID = ?", quote(SeriesTable)),
+	}
+	for _, q := range stmts {
+		_, err := dbExec(ctx, tx, q, seriesID)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for _, userID := range listUsers {
+		c := SyncChange{Kind: SyncSeries, SeriesID: seriesID, Deleted: true, Updated: now}
+		_, err = recordSyncChange(ctx, tx, userID, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, userID := range watchedUsers {
+		c := SyncChange{Kind: SyncWatched, SeriesID: seriesID, Deleted: true, Updated: now}
+		_, err = recordSyncChange(ctx, tx, userID, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func NewUserStore(db *sql.DB) kauth.UserStore {
+func readUserIDs(ctx context.Context, db querier, q string, args ...interface{}) ([]int64, error) {
+	rows, err := dbQuery(ctx, db, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// PurgeSeries deletes the series and everything which references it.
+func PurgeSeries(db *sql.DB, seriesID int64) error {
+	return PurgeSeriesContext(context.Background(), db, seriesID)
+}
+
+func PurgeSeriesContext(ctx context.Context, db *sql.DB, seriesID int64) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = removeSeriesRows(ctx, tx, seriesID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MergeSeries moves every reference of the series src to the series dst and
+// deletes src afterwards. If a user has both series the entries of dst are
+// kept.
+func MergeSeries(db *sql.DB, src, dst int64) error {
+	return MergeSeriesContext(context.Background(), db, src, dst)
+}
+
+func MergeSeriesContext(ctx context.Context, db *sql.DB, src, dst int64) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	list := `
+	INSERT INTO %[1]v (User_ID, Series_ID)
+	SELECT User_ID, ? FROM %[1]v
+	WHERE Series_ID = ?
+	AND User_ID NOT IN (SELECT User_ID FROM %[1]v WHERE Series_ID = ?)
+	`
+	last := `
+	INSERT INTO %[1]v (User_ID, Series_ID, Session, Episode)
+	SELECT User_ID, ?, Session, Episode FROM %[1]v
+	WHERE Series_ID = ?
+	AND User_ID NOT IN (SELECT User_ID FROM %[1]v WHERE Series_ID = ?)
+	`
+	stmts := []struct {
+		Query string
+		Args  []interface{}
+	}{
+		{fmt.Sprintf(list, quote(SeriesListTable)), []interface{}{dst, src, dst}},
+		{fmt.Sprintf(last, quote(LastWatchedTable)), []interface{}{dst, src, dst}},
+		{fmt.Sprintf("UPDATE %v SET Series_ID = ? WHERE Series_ID = ?", quote(EpisodesTable)),
+			[]interface{}{dst, src}},
+		{fmt.Sprintf("UPDATE %v SET Series_ID = ? WHERE Series_ID = ?", quote(EpisodesResourceTable)),
+			[]interface{}{dst, src}},
+		{fmt.Sprintf("UPDATE %v SET Series_ID = ? WHERE Series_ID = ?", quote(SeriesExternalIDTable)),
+			[]interface{}{dst, src}},
+	}
+	for _, stmt := range stmts {
+		_, err = dbExec(ctx, tx, stmt.Query, stmt.Args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = recordMergedSeries(ctx, tx, src, dst)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = removeSeriesRows(ctx, tx, src)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// recordMergedSeries records dst for the sync of the users of src, the
+// removal of src is recorded by removeSeriesRows.
+func recordMergedSeries(ctx context.Context, tx *sql.Tx, src, dst int64) error {
+	q := fmt.Sprintf("SELECT User_ID FROM %v WHERE Series_ID = ?", quote(SeriesListTable))
+	listUsers, err := readUserIDs(ctx, tx, q, src)
+	if err != nil {
+		return err
+	}
+
+	m := `
+	SELECT User_ID, Session, Episode FROM %[1]v
+	WHERE Series_ID = ?
+	AND User_ID IN (SELECT User_ID FROM %[1]v WHERE Series_ID = ?)
+	`
+	q = fmt.Sprintf(m, quote(LastWatchedTable))
+	rows, err := dbQuery(ctx, tx, q, dst, src)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	watchedUsers := []int64{}
+	changes := SyncChangeList{}
+	for rows.Next() {
+		var userID int64
+		c := SyncChange{Kind: SyncWatched, SeriesID: dst, Updated: now}
+		err := rows.Scan(&userID, &c.Session, &c.Episode)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		watchedUsers = append(watchedUsers, userID)
+		changes = append(changes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userID := range listUsers {
+		c := SyncChange{Kind: SyncSeries, SeriesID: dst, Updated: now}
+		_, err = recordSyncChange(ctx, tx, userID, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, c := range changes {
+		_, err = recordSyncChange(ctx, tx, watchedUsers[i], c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewUserStore returns a store with the login policy of specs.
+func NewUserStore(db *sql.DB, specs Specs) kauth.UserStore {
+	return NewUserStoreWithPolicy(db, NewLoginPolicy(specs))
+}
+
+// NewUserStoreWithPolicy returns a store which locks accounts and limits
+// the login attempts per account by the policy.
+func NewUserStoreWithPolicy(db *sql.DB, policy LoginPolicy) kauth.UserStore {
 	return &userStore{
-		db: db,
+		db:     db,
+		policy: policy,
 	}
 }
 
 func (s *userStore) FindUser(name string) (kauth.User, error) {
+	if ok, _ := s.policy.Accounts.Allow(name, time.Now()); !ok {
+		return nil, ErrRateLimited
+	}
+
 	user, err := FindUserByName(s.db, name)
 	if err != nil {
 		return nil, err
 	}
 
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+
+	if user.LockedUntil.After(time.Now()) {
+		return nil, ErrAccountLocked
+	}
+
 	s.user = user
 
 	kuser := kauthUser{
 		id:       strconv.FormatInt(user.ID, 10),
 		password: user.Password,
+		db:       s.db,
+		user:     user,
+		policy:   s.policy,
 	}
 
 	return kuser, nil
 }
 
+// ValidPassword records failed logins and delays the response of every
+// failed login a bit longer. A successful login resets the counter.
+// kauth.Login can't ask for the second factor, so users with TOTP have to
+// use the login handler of sj.
 func (u kauthUser) ValidPassword(pass string) bool {
+	if !u.passwordMatches(pass) {
+		u.failedLogin()
+		return false
+	}
+
+	t, err := ReadTOTP(u.db, u.user.ID)
+	if err != sql.ErrNoRows && (err != nil || t.Enabled) {
+		return false
+	}
+
+	u.succeededLogin()
+	return true
+}
+
+func (u kauthUser) passwordMatches(pass string) bool {
 	return u.password == NewSha512Password(pass)
 }
 
+func (u kauthUser) succeededLogin() {
+	if u.user.FailedLogins > 0 || !u.user.LockedUntil.IsZero() {
+		ResetFailedLogins(u.db, u.user.ID)
+	}
+}
+
+func (u kauthUser) failedLogin() {
+	p := u.policy
+	RecordFailedLogin(u.db, u.user.ID, p.MaxFailures, time.Now().UTC().Add(p.Lockout))
+	time.Sleep(p.delay(u.user.FailedLogins + 1))
+}
+
 func (u kauthUser) ID() string {
 	return u.id
 }
@@ -303,33 +938,83 @@ func (u kauthUser) Password() string {
 }
 
 func AppendSeriesList(db *sql.DB, userID, seriesID int64) error {
-	err := db.Ping()
-	if err != nil {
+	return AppendSeriesListContext(context.Background(), db, userID, seriesID)
+}
+
+func AppendSeriesListContext(ctx context.Context, db querier, userID, seriesID int64) error {
+	return appendSeriesList(ctx, db, userID, seriesID, time.Now())
+}
+
+// appendSeriesList adds the series and records the change for the sync,
+// updated is the time the user made the change.
+func appendSeriesList(ctx context.Context, db querier, userID, seriesID int64, updated time.Time) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	return inTx(ctx, db, func(tx querier) error {
+		q := fmt.Sprintf("INSERT INTO %v VALUES(?, ?)", quote(SeriesListTable))
+		_, err := dbExec(ctx, tx, q, userID, seriesID)
+		if err != nil {
+			return err
+		}
+
+		c := SyncChange{Kind: SyncSeries, SeriesID: seriesID, Updated: updated}
+		_, err = recordSyncChange(ctx, tx, userID, c)
 		return err
-	}
-	q := fmt.Sprintf("INSERT INTO %v VALUES(?, ?)", SeriesListTable)
-	_, err = db.Exec(q, userID, seriesID)
+	})
+}
+
+func ExistsSeriesList(db *sql.DB, userID, seriesID int64) (bool, error) {
+	return ExistsSeriesListContext(context.Background(), db, userID, seriesID)
+}
+
+func ExistsSeriesListContext(ctx context.Context, db querier, userID, seriesID int64) (bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "SELECT COUNT(*) FROM %v WHERE User_ID = ? AND Series_ID = ?"
+	q := fmt.Sprintf(s, quote(SeriesListTable))
+	var count int
+	err := dbQueryRow(ctx, db, q, userID, seriesID).Scan(&count)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	return nil
+	return count > 0, nil
 }
 
 func RemoveSeriesList(db *sql.DB, userID, seriesID int64) (int64, error) {
-	err := db.Ping()
-	if err != nil {
-		return 0, err
-	}
+	return RemoveSeriesListContext(context.Background(), db, userID, seriesID)
+}
 
-	s := "DELETE FROM %v WHERE User_ID = ? AND Series_ID = ?"
-	q := fmt.Sprintf(s, SeriesListTable)
-	rsrc, err := db.Exec(q, userID, seriesID)
-	if err != nil {
-		return 0, err
-	}
+func RemoveSeriesListContext(ctx context.Context, db querier, userID, seriesID int64) (int64, error) {
+	return removeSeriesList(ctx, db, userID, seriesID, time.Now())
+}
 
-	c, err := rsrc.RowsAffected()
+// removeSeriesList removes the series and records the change for the sync
+// if the series was in the list.
+func removeSeriesList(ctx context.Context, db querier, userID, seriesID int64, updated time.Time) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	var c int64
+	err := inTx(ctx, db, func(tx querier) error {
+		s := "DELETE FROM %v WHERE User_ID = ? AND Series_ID = ?"
+		q := fmt.Sprintf(s, quote(SeriesListTable))
+		rsrc, err := dbExec(ctx, tx, q, userID, seriesID)
+		if err != nil {
+			return err
+		}
+
+		c, err = rsrc.RowsAffected()
+		if err != nil || c == 0 {
+			return err
+		}
+
+		change := SyncChange{Kind: SyncSeries, SeriesID: seriesID, Deleted: true, Updated: updated}
+		_, err = recordSyncChange(ctx, tx, userID, change)
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -338,72 +1023,152 @@ func RemoveSeriesList(db *sql.DB, userID, seriesID int64) (int64, error) {
 }
 
 func ReadSeriesList(db *sql.DB, userID int64) (SeriesList, error) {
+	return ReadSeriesListContext(context.Background(), db, userID)
+}
+
+func ReadSeriesListContext(ctx context.Context, db *sql.DB, userID int64) (SeriesList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
 	m := `
-	SELECT series.ID as ID, series.Title as Title, series.Image as Image
+	SELECT series.ID as ID, series.Title as Title, series.Image as Image,
+	series.Description as Description
 	FROM %v as series, %v as list 
 	WHERE list.User_ID = ? 
 	AND series.ID=list.Series_ID
 	`
-	q := fmt.Sprintf(m, SeriesTable, SeriesListTable)
+	q := fmt.Sprintf(m, quote(SeriesTable), quote(SeriesListTable))
 
-	rows, err := db.Query(q, userID)
+	rows, err := dbQuery(ctx, db, q, userID)
 	if err != nil {
 		return SeriesList{}, err
 	}
 	defer rows.Close()
 
+	return scanSeriesList(rows)
+}
+
+func scanSeriesList(rows *sql.Rows) (SeriesList, error) {
 	sList := SeriesList{}
 	for rows.Next() {
 		var id int64
 		var title string
 		var image string
-		err := rows.Scan(&id, &title, &image)
+		var desc string
+		err := rows.Scan(&id, &title, &image, &desc)
 		if err != nil {
 			return SeriesList{}, err
 		}
 
 		series := Series{
-			ID:    id,
-			Title: title,
-			Image: image,
+			ID:          id,
+			Title:       title,
+			Image:       image,
+			Description: desc,
 		}
 		sList = append(sList, series)
 	}
 
+	if err := rows.Err(); err != nil {
+		return SeriesList{}, err
+	}
+
 	return sList, nil
 }
 
 func UpdateLastWatched(db *sql.DB, lastWatched LastWatched) error {
+	return UpdateLastWatchedContext(context.Background(), db, lastWatched)
+}
 
-	err := db.Ping()
-	if err != nil {
+func UpdateLastWatchedContext(ctx context.Context, db querier, lastWatched LastWatched) error {
+	return updateLastWatched(ctx, db, lastWatched, time.Now())
+}
+
+// updateLastWatched stores the last watched episode and records the change
+// for the sync, updated is the time the user watched it.
+func updateLastWatched(ctx context.Context, db querier, lastWatched LastWatched, updated time.Time) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	return inTx(ctx, db, func(tx querier) error {
+		q := dialect.Upsert(quote(LastWatchedTable),
+			[]string{"User_ID", "Series_ID"},
+			[]string{"Session", "Episode"},
+		)
+		_, err := dbExec(ctx, tx, q, lastWatched.UserID, lastWatched.SeriesID,
+			lastWatched.Session, lastWatched.Episode)
+		if err != nil {
+			return err
+		}
+
+		c := SyncChange{
+			Kind:     SyncWatched,
+			SeriesID: lastWatched.SeriesID,
+			Session:  lastWatched.Session,
+			Episode:  lastWatched.Episode,
+			Updated:  updated,
+		}
+		_, err = recordSyncChange(ctx, tx, lastWatched.UserID, c)
 		return err
-	}
+	})
+}
 
-	s := "REPLACE INTO %v VALUES (?, ?, ?, ?)"
-	q := fmt.Sprintf(s, LastWatchedTable)
-	_, err = db.Exec(q, lastWatched.UserID, lastWatched.SeriesID,
-		lastWatched.Session, lastWatched.Episode)
-	if err != nil {
+func RemoveLastWatched(db *sql.DB, userID, seriesID int64) (int64, error) {
+	return RemoveLastWatchedContext(context.Background(), db, userID, seriesID)
+}
+
+// RemoveLastWatchedContext removes the last watched episode of the series
+// and records the removal for the sync.
+func RemoveLastWatchedContext(ctx context.Context, db querier, userID, seriesID int64) (int64, error) {
+	return removeLastWatched(ctx, db, userID, seriesID, time.Now())
+}
+
+// removeLastWatched removes the last watched episode and records the
+// removal for the sync, updated is the time the user removed it.
+func removeLastWatched(ctx context.Context, db querier, userID, seriesID int64, updated time.Time) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	var c int64
+	err := inTx(ctx, db, func(tx querier) error {
+		s := "DELETE FROM %v WHERE User_ID = ? AND Series_ID = ?"
+		q := fmt.Sprintf(s, quote(LastWatchedTable))
+		rsrc, err := dbExec(ctx, tx, q, userID, seriesID)
+		if err != nil {
+			return err
+		}
+
+		c, err = rsrc.RowsAffected()
+		if err != nil || c == 0 {
+			return err
+		}
+
+		change := SyncChange{Kind: SyncWatched, SeriesID: seriesID, Deleted: true, Updated: updated}
+		_, err = recordSyncChange(ctx, tx, userID, change)
 		return err
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	return c, nil
 }
 
 func ReadLastWatchedList(db *sql.DB, userID int64) (LastWatchedList, error) {
-	err := db.Ping()
-	if err != nil {
-		return LastWatchedList{}, err
-	}
+	return ReadLastWatchedListContext(context.Background(), db, userID)
+}
+
+func ReadLastWatchedListContext(ctx context.Context, db *sql.DB, userID int64) (LastWatchedList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
 
 	s := `
 	SELECT Series_ID, Session, Episode
 	FROM %v
 	WHERE User_ID = ? 
 	`
-	q := fmt.Sprintf(s, LastWatchedTable)
-	rows, err := db.Query(q, userID)
+	q := fmt.Sprintf(s, quote(LastWatchedTable))
+	rows, err := dbQuery(ctx, db, q, userID)
 	if err != nil {
 		return LastWatchedList{}, err
 	}
@@ -433,15 +1198,38 @@ func ReadLastWatchedList(db *sql.DB, userID int64) (LastWatchedList, error) {
 	return wList, nil
 }
 
-func CountSeriesWithImage(db *sql.DB, image string) (int, error) {
-	if err := db.Ping(); err != nil {
-		return 0, err
+func ReadLastWatched(db *sql.DB, userID, seriesID int64) (LastWatched, error) {
+	return ReadLastWatchedContext(context.Background(), db, userID, seriesID)
+}
+
+func ReadLastWatchedContext(ctx context.Context, db querier, userID, seriesID int64) (LastWatched, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "SELECT Session, Episode FROM %v WHERE User_ID = ? AND Series_ID = ?"
+	q := fmt.Sprintf(s, quote(LastWatchedTable))
+
+	w := LastWatched{UserID: userID, SeriesID: seriesID}
+	err := dbQueryRow(ctx, db, q, userID, seriesID).Scan(&w.Session, &w.Episode)
+	if err != nil {
+		return LastWatched{}, err
 	}
 
+	return w, nil
+}
+
+func CountSeriesWithImage(db *sql.DB, image string) (int, error) {
+	return CountSeriesWithImageContext(context.Background(), db, image)
+}
+
+func CountSeriesWithImageContext(ctx context.Context, db *sql.DB, image string) (int, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
 	s := "SELECT COUNT(ID) as Images FROM %v WHERE Image = ?"
-	q := fmt.Sprintf(s, SeriesTable)
+	q := fmt.Sprintf(s, quote(SeriesTable))
 	var amount int
-	err := db.QueryRow(q, image).Scan(&amount)
+	err := dbQueryRow(ctx, db, q, image).Scan(&amount)
 	if err != nil {
 		return 0, err
 	}
@@ -449,3 +1237,90 @@ func CountSeriesWithImage(db *sql.DB, image string) (int, error) {
 	return amount, nil
 
 }
+
+func NewInviteCode(db *sql.DB, createdBy int64) (InviteCode, error) {
+	return NewInviteCodeContext(context.Background(), db, createdBy)
+}
+
+func NewInviteCodeContext(ctx context.Context, db *sql.DB, createdBy int64) (InviteCode, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	code, err := newSecretToken()
+	if err != nil {
+		return InviteCode{}, err
+	}
+
+	invite := InviteCode{
+		Code:      code,
+		CreatedBy: createdBy,
+		Created:   time.Now().UTC().Truncate(time.Second),
+	}
+
+	s := "INSERT INTO %v (Code, Created_By, Created) VALUES (?, ?, ?)"
+	q := fmt.Sprintf(s, quote(InviteCodeTable))
+	_, err = dbExec(ctx, db, q, invite.Code, invite.CreatedBy, invite.Created)
+	if err != nil {
+		return InviteCode{}, err
+	}
+
+	return invite, nil
+}
+
+func ReadInviteCode(db *sql.DB, code string) (InviteCode, error) {
+	return ReadInviteCodeContext(context.Background(), db, code)
+}
+
+func ReadInviteCodeContext(ctx context.Context, db *sql.DB, code string) (InviteCode, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "SELECT Created_By, Used_By, Created FROM %v WHERE Code = ?"
+	q := fmt.Sprintf(s, quote(InviteCodeTable))
+
+	var createdBy int64
+	var usedBy sql.NullInt64
+	var created time.Time
+	err := dbQueryRow(ctx, db, q, code).Scan(&createdBy, &usedBy, &created)
+	if err != nil {
+		return InviteCode{}, err
+	}
+
+	invite := InviteCode{
+		Code:      code,
+		CreatedBy: createdBy,
+		UsedBy:    usedBy.Int64,
+		Created:   created,
+	}
+
+	return invite, nil
+}
+
+// UseInviteCode marks the code as used by the user. It fails with
+// ErrInvalidInviteCode if the code does not exist or was already used.
+func UseInviteCode(db *sql.DB, code string, userID int64) error {
+	return UseInviteCodeContext(context.Background(), db, code, userID)
+}
+
+func UseInviteCodeContext(ctx context.Context, db *sql.DB, code string, userID int64) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "UPDATE %v SET Used_By = ? WHERE Code = ? AND Used_By IS NULL"
+	q := fmt.Sprintf(s, quote(InviteCodeTable))
+	rsrc, err := dbExec(ctx, db, q, userID, code)
+	if err != nil {
+		return err
+	}
+
+	c, err := rsrc.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if c != 1 {
+		return ErrInvalidInviteCode
+	}
+
+	return nil
+}
@@ -0,0 +1,587 @@
+package sj
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// The integration tests run the data functions against real databases.
+// They are skipped unless SJ_TEST_MYSQL_DSN or SJ_TEST_POSTGRES_DSN point
+// to a throwaway database, every table of sj is dropped and recreated.
+var integrationDialects = []struct {
+	Dialect Dialect
+	Env     string
+	Schema  string
+}{
+	{MySQL, "SJ_TEST_MYSQL_DSN", "sql/new.sql"},
+	{Postgres, "SJ_TEST_POSTGRES_DSN", "sql/postgres.sql"},
+}
+
+// integrationTables lists the tables in the order they can be dropped.
+var integrationTables = []string{
+	EmailVerificationTable,
+	WatchedEpisodeTable,
+	SyncChangeTable,
+	PushSubscriptionTable,
+	NotificationPreferenceTable,
+	PasswordResetTable,
+	UserIdentityTable,
+	SessionTable,
+	RecoveryCodeTable,
+	TOTPTable,
+	WebhookDeliveryTable,
+	WebhookTable,
+	ScrobbleInboxTable,
+	SeriesExternalIDTable,
+	APITokenTable,
+	CalendarFeedTable,
+	InviteCodeTable,
+	LastWatchedTable,
+	SeriesListTable,
+	UserTable,
+	EpisodesTable,
+	EpisodesResourceTable,
+	SeriesTable,
+}
+
+func integrationDB(t *testing.T, d Dialect, env, schema string) *sql.DB {
+	dsn := os.Getenv(env)
+	if dsn == "" {
+		t.Skipf("%v not set", env)
+	}
+
+	SetDialect(d)
+	t.Cleanup(func() { SetDialect(MySQL) })
+
+	db, err := sql.Open(d.DriverName(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, table := range integrationTables {
+		q := fmt.Sprintf("DROP TABLE IF EXISTS %v", d.Quote(table))
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stmt := range strings.Split(string(b), ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" || strings.HasPrefix(stmt, "CREATE DATABASE") {
+			continue
+		}
+
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%v: %v", stmt, err)
+		}
+	}
+
+	return db
+}
+
+// integrationCases run the cases of db_test.go against every database, each
+// case gets a freshly created schema.
+var integrationCases = []struct {
+	Name string
+	Run  func(*testing.T, *sql.DB)
+}{
+	{"Users", integrationUsers},
+	{"Series", integrationSeries},
+	{"SeriesList", integrationSeriesList},
+	{"Episodes", integrationEpisodes},
+	{"Watched", integrationWatched},
+	{"SyncChanges", integrationSyncChanges},
+	{"Tokens", integrationTokens},
+	{"ExternalIDs", integrationExternalIDs},
+	{"Invites", integrationInvites},
+	{"MergeAndRemoveUser", integrationMergeAndRemoveUser},
+}
+
+func Test_Integration(t *testing.T) {
+	for _, tc := range integrationDialects {
+		t.Run(tc.Dialect.Name(), func(t *testing.T) {
+			for _, c := range integrationCases {
+				t.Run(c.Name, func(t *testing.T) {
+					db := integrationDB(t, tc.Dialect, tc.Env, tc.Schema)
+					c.Run(t, db)
+				})
+			}
+		})
+	}
+}
+
+func newIntegrationUser(t *testing.T, db *sql.DB, name string) int64 {
+	userID, err := NewUser(db, User{Name: name, Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return userID
+}
+
+func newIntegrationSeries(t *testing.T, db *sql.DB, s Series) int64 {
+	id, err := NewSeries(db, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func integrationUsers(t *testing.T, db *sql.DB) {
+	userID := newIntegrationUser(t, db, "alice")
+	newIntegrationUser(t, db, "bob")
+
+	user, err := FindUserByName(db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != userID || user.Role != RoleUser || user.Disabled {
+		t.Fatalf("Unexpected user %v", user)
+	}
+
+	err = UpdateUserPassword(db, userID, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UpdateUserDisabled(db, userID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PromoteAdmins(db, []string{"alice", "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err = ReadUser(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Disabled || user.Role != RoleAdmin || user.Password != NewSha512Password("new") {
+		t.Fatalf("Unexpected user %v", user)
+	}
+
+	bob, err := FindUserByName(db, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.Role != RoleUser {
+		t.Fatalf("Unexpected user %v", bob)
+	}
+}
+
+func integrationSeries(t *testing.T, db *sql.DB) {
+	id := newIntegrationSeries(t, db, series)
+
+	s, err := ReadSeries(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := series
+	expect.ID = id
+	if err := EqualSeries(expect, s); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = FindSeriesByTitle(db, series.Title)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != id {
+		t.Fatalf("Expect %v was %v", id, s.ID)
+	}
+
+	count, err := CountSeriesWithImage(db, series.Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("Expect 1 was %v", count)
+	}
+
+	results, err := SearchSeries(db, "robot", DefaultSearchLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Series.ID != id {
+		t.Fatalf("Unexpected search results %v", results)
+	}
+
+	r := resource
+	r.SeriesID = id
+	rID, err := NewEpisodeResource(db, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ID = rID
+	stored, err := ReadEpisodeResource(db, rID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EqualEpisodeResource(r, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	err = RemoveSeries(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadSeries(db, id)
+	if err != sql.ErrNoRows {
+		t.Fatalf("Expect %v was %v", sql.ErrNoRows, err)
+	}
+}
+
+func integrationSeriesList(t *testing.T, db *sql.DB) {
+	userID := newIntegrationUser(t, db, "alice")
+	id := newIntegrationSeries(t, db, series)
+
+	err := AppendSeriesList(db, userID, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := ExistsSeriesList(db, userID, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("Expect series in list")
+	}
+
+	for _, e := range []int{1, 2} {
+		err = UpdateLastWatched(db, LastWatched{
+			UserID:   userID,
+			SeriesID: id,
+			Session:  1,
+			Episode:  e,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wList, err := ReadLastWatchedList(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wList) != 1 || wList[0].Episode != 2 {
+		t.Fatalf("Unexpected last watched list %v", wList)
+	}
+
+	n, err := RemoveSeriesList(db, userID, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expect 1 was %v", n)
+	}
+
+	sList, err := ReadSeriesList(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sList) != 0 {
+		t.Fatalf("Unexpected series list %v", sList)
+	}
+}
+
+func integrationEpisodes(t *testing.T, db *sql.DB) {
+	userID := newIntegrationUser(t, db, "alice")
+	id := newIntegrationSeries(t, db, series)
+
+	err := AppendSeriesList(db, userID, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	airDate := time.Date(2016, 3, 3, 0, 0, 0, 0, time.UTC)
+	_, err = NewEpisode(db, Episode{SeriesID: id, Session: 1, Episode: 3, AirDate: airDate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewEpisode(db, Episode{SeriesID: id, Session: 1, Episode: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uList, err := ReadUpcomingEpisodes(db, userID, airDate, airDate.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uList) != 1 || uList[0].Episode.Episode != 3 {
+		t.Fatalf("Unexpected upcoming episodes %v", uList)
+	}
+}
+
+func integrationWatched(t *testing.T, db *sql.DB) {
+	userID := newIntegrationUser(t, db, "alice")
+	id := newIntegrationSeries(t, db, series)
+
+	err := AppendSeriesList(db, userID, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	episodes := []int64{}
+	for _, e := range []int{1, 2} {
+		eID, err := NewEpisode(db, Episode{SeriesID: id, Session: 1, Episode: e})
+		if err != nil {
+			t.Fatal(err)
+		}
+		episodes = append(episodes, eID)
+	}
+
+	result, err := SetEpisodeWatched(db, userID, episodes[0], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LastWatched == nil || result.LastWatched.Episode != 1 {
+		t.Fatalf("Unexpected result %v", result)
+	}
+
+	pList, err := ReadSeriesProgress(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pList) != 1 || pList[0].Watched != 1 || pList[0].Percent != 50 {
+		t.Fatalf("Unexpected progress %v", pList)
+	}
+}
+
+func integrationSyncChanges(t *testing.T, db *sql.DB) {
+	userID := newIntegrationUser(t, db, "alice")
+	id := newIntegrationSeries(t, db, series)
+
+	err := AppendSeriesList(db, userID, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []int{1, 2} {
+		err = UpdateLastWatched(db, LastWatched{UserID: userID, SeriesID: id, Session: 1, Episode: e})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cursor, err := ReadSyncCursor(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != 3 {
+		t.Fatal("Expect cursor 3 was", cursor)
+	}
+
+	cList, err := ReadSyncChanges(db, userID, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cList) != 1 || cList[0].Version != 3 || cList[0].Episode != 2 {
+		t.Fatalf("Unexpected changes %v", cList)
+	}
+
+	err = PurgeSeries(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cList, err = ReadSyncChanges(db, userID, cursor, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cList) != 2 || !cList[0].Deleted || !cList[1].Deleted {
+		t.Fatalf("Expect the purge to be synced was %v", cList)
+	}
+}
+
+func integrationTokens(t *testing.T, db *sql.DB) {
+	userID := newIntegrationUser(t, db, "alice")
+
+	token, err := NewCalendarToken(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = NewCalendarToken(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := FindCalendarTokenUser(db, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != userID {
+		t.Fatalf("Expect %v was %v", userID, id)
+	}
+
+	err = UpdateUserDisabled(db, userID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, raw, err := NewAPIToken(db, userID, "kodi", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = FindAPIToken(db, raw)
+	if err != sql.ErrNoRows {
+		t.Fatalf("Expect token of disabled user to be rejected was %v", err)
+	}
+	err = UpdateUserDisabled(db, userID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiToken, err := FindAPIToken(db, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiToken.UserID != userID || !apiToken.ReadOnly {
+		t.Fatalf("Unexpected API token %v", apiToken)
+	}
+}
+
+func integrationExternalIDs(t *testing.T, db *sql.DB) {
+	userID := newIntegrationUser(t, db, "alice")
+	src := newIntegrationSeries(t, db, series)
+	dst := newIntegrationSeries(t, db, Series{Title: "Mr Robot"})
+
+	ids := ExternalIDs{SourceKodi: "12"}
+	for _, id := range []int64{dst, src} {
+		err := SaveSeriesExternalIDs(db, userID, id, ids, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, err := FindSeriesByExternalID(db, userID, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != src {
+		t.Fatalf("Expect %v was %v", src, found)
+	}
+
+	// Kodi ids are local to the installation of alice
+	bobID := newIntegrationUser(t, db, "bob")
+	_, err = FindSeriesByExternalID(db, bobID, ids)
+	if err != sql.ErrNoRows {
+		t.Fatalf("Expect %v was %v", sql.ErrNoRows, err)
+	}
+
+	// Plex GUIDs are shared, but bob's own mapping wins
+	guid := ExternalIDs{SourcePlex: "plex://show/5d9c"}
+	err = SaveSeriesExternalIDs(db, userID, src, guid, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An existing shared mapping is never pointed to another series
+	err = SaveSeriesExternalIDs(db, bobID, dst, guid, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SaveSeriesExternalIDs(db, bobID, dst, guid, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, expect := range map[int64]int64{userID: src, bobID: dst} {
+		found, err := FindSeriesByExternalID(db, id, guid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != expect {
+			t.Fatalf("Expect %v was %v", expect, found)
+		}
+	}
+
+	inboxID, err := NewScrobbleInboxEntry(db, ScrobbleInboxEntry{
+		UserID:      userID,
+		Source:      SourceKodi,
+		Title:       "Unknown",
+		Session:     1,
+		Episode:     1,
+		ExternalIDs: ExternalIDs{SourceKodi: "13"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox, err := ReadScrobbleInbox(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inbox) != 1 || inbox[0].ID != inboxID || inbox[0].ExternalIDs[SourceKodi] != "13" {
+		t.Fatalf("Unexpected inbox %v", inbox)
+	}
+}
+
+func integrationInvites(t *testing.T, db *sql.DB) {
+	userID := newIntegrationUser(t, db, "alice")
+
+	invite, err := NewInviteCode(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UseInviteCode(db, invite.Code, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UseInviteCode(db, invite.Code, userID)
+	if err != ErrInvalidInviteCode {
+		t.Fatalf("Expect %v was %v", ErrInvalidInviteCode, err)
+	}
+}
+
+func integrationMergeAndRemoveUser(t *testing.T, db *sql.DB) {
+	userID := newIntegrationUser(t, db, "alice")
+	src := newIntegrationSeries(t, db, series)
+	dst := newIntegrationSeries(t, db, Series{Title: "Mr Robot"})
+
+	err := AppendSeriesList(db, userID, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eID, err := NewEpisode(db, Episode{SeriesID: src, Session: 1, Episode: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SetEpisodeWatched(db, userID, eID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = MergeSeries(db, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sList, err := ReadSeriesList(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sList) != 1 || sList[0].ID != dst {
+		t.Fatalf("Unexpected series list %v", sList)
+	}
+
+	removed, err := RemoveUser(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].ID != dst {
+		t.Fatalf("Unexpected removed series %v", removed)
+	}
+
+	_, err = ReadSeries(db, dst)
+	if err != sql.ErrNoRows {
+		t.Fatalf("Expect %v was %v", sql.ErrNoRows, err)
+	}
+}
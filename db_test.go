@@ -1,19 +1,23 @@
 package sj
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"strconv"
 	"testing"
+	"time"
 
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
 
 var (
 	series = Series{
-		ID:    1,
-		Title: "Mr. Robot",
-		Image: "http://photo/img.png",
+		ID:          1,
+		Title:       "Mr. Robot",
+		Image:       "http://photo/img.png",
+		Description: "A hacker joins fsociety.",
 	}
 
 	resource = EpisodeResource{
@@ -27,7 +31,8 @@ var (
 func EqualSeries(s1, s2 Series) error {
 	if s1.ID != s2.ID ||
 		s1.Title != s2.Title ||
-		s1.Image != s2.Image {
+		s1.Image != s2.Image ||
+		s1.Description != s2.Description {
 		m := fmt.Sprintf("Expect %v was %v", s1, s2)
 		return errors.New(m)
 	}
@@ -110,12 +115,14 @@ func Test_NewSeries_OK(t *testing.T) {
 
 	query := fmt.Sprintf("INSERT INTO %v", SeriesTable)
 	mock.ExpectExec(query).
-		WithArgs(series.Title, series.Image).
+		WithArgs(series.Title, series.Image, series.Description, FoldText(series.Title),
+			FoldText(series.Description), sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(series.ID, 1))
 
 	s := Series{
-		Title: series.Title,
-		Image: series.Image,
+		Title:       series.Title,
+		Image:       series.Image,
+		Description: series.Description,
 	}
 
 	id, err := NewSeries(db, s)
@@ -160,9 +167,9 @@ func Test_ReadSeries_OK(t *testing.T) {
 	}
 	defer db.Close()
 
-	query := fmt.Sprintf("SELECT Title, Image FROM %v", SeriesTable)
-	rows := sqlmock.NewRows([]string{"Title", "Image"}).
-		AddRow(series.Title, series.Image)
+	query := fmt.Sprintf("SELECT Title, Image, Description FROM %v", SeriesTable)
+	rows := sqlmock.NewRows([]string{"Title", "Image", "Description"}).
+		AddRow(series.Title, series.Image, series.Description)
 	mock.ExpectQuery(query).WillReturnRows(rows)
 
 	s, err := ReadSeries(db, series.ID)
@@ -187,9 +194,9 @@ func Test_FindSeries_OK(t *testing.T) {
 	}
 	defer db.Close()
 
-	query := fmt.Sprintf("SELECT ID, Title, Image FROM %v", SeriesTable)
-	rows := sqlmock.NewRows([]string{"ID", "Title", "Image"}).
-		AddRow(series.ID, series.Title, series.Image)
+	query := fmt.Sprintf("SELECT ID, Title, Image, Description FROM %v", SeriesTable)
+	rows := sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"}).
+		AddRow(series.ID, series.Title, series.Image, series.Description)
 	mock.ExpectQuery(query).WillReturnRows(rows)
 
 	s, err := FindSeriesByTitle(db, series.Title)
@@ -277,7 +284,7 @@ func Test_NewUser_OK(t *testing.T) {
 
 	query := fmt.Sprintf("INSERT INTO %v", UserTable)
 	mock.ExpectExec(query).
-		WithArgs(user.Name, NewSha512Password(user.Password)).
+		WithArgs(user.Name, NewSha512Password(user.Password), "").
 		WillReturnResult(sqlmock.NewResult(user.ID, 1))
 
 	id, err := NewUser(db, user)
@@ -304,10 +311,10 @@ func Test_ReadUser_OK(t *testing.T) {
 		Password: "Fuckoff",
 	}
 
-	m := "SELECT ID,Name,Password FROM %v"
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v"
 	q := fmt.Sprintf(m, UserTable)
-	rows := sqlmock.NewRows([]string{"ID", "Name", "Password"}).
-		AddRow(user.ID, user.Name, user.Password)
+	rows := sqlmock.NewRows([]string{"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email"}).
+		AddRow(user.ID, user.Name, user.Password, RoleUser, false, 0, nil, "")
 	mock.ExpectQuery(q).WillReturnRows(rows)
 
 	result, err := ReadUser(db, user.ID)
@@ -339,10 +346,10 @@ func Test_FindUserByName_OK(t *testing.T) {
 		Password: "Fuckoff",
 	}
 
-	m := "SELECT ID,Name,Password FROM %v"
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v"
 	q := fmt.Sprintf(m, UserTable)
-	rows := sqlmock.NewRows([]string{"ID", "Name", "Password"}).
-		AddRow(user.ID, user.Name, user.Password)
+	rows := sqlmock.NewRows([]string{"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email"}).
+		AddRow(user.ID, user.Name, user.Password, RoleUser, false, 0, nil, "")
 	mock.ExpectQuery(q).WillReturnRows(rows)
 
 	result, err := FindUserByName(db, user.Name)
@@ -373,13 +380,13 @@ func Test_UserStoreFindUserAndValidatedPassword_OK(t *testing.T) {
 		Password: "Fuckoff",
 	}
 
-	m := "SELECT ID,Name,Password FROM %v"
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v"
 	q := fmt.Sprintf(m, UserTable)
-	rows := sqlmock.NewRows([]string{"ID", "Name", "Password"}).
-		AddRow(user.ID, user.Name, NewSha512Password(user.Password))
+	rows := sqlmock.NewRows([]string{"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email"}).
+		AddRow(user.ID, user.Name, NewSha512Password(user.Password), RoleUser, false, 0, nil, "")
 	mock.ExpectQuery(q).WillReturnRows(rows)
 
-	userStore := NewUserStore(db)
+	userStore := NewUserStore(db, Specs{})
 
 	result, err := userStore.FindUser(user.Name)
 	if err != nil {
@@ -391,6 +398,9 @@ func Test_UserStoreFindUserAndValidatedPassword_OK(t *testing.T) {
 		t.Fatal("Expect", user, "was", result)
 	}
 
+	q = fmt.Sprintf("SELECT Secret, Enabled, Last_Counter, Created FROM %v", TOTPTable)
+	mock.ExpectQuery(q).WithArgs(user.ID).WillReturnError(sql.ErrNoRows)
+
 	if !result.ValidPassword(user.Password) {
 		t.Fatal("Expect", user.Password, "to be correct")
 	}
@@ -408,10 +418,13 @@ func Test_AppendSeriesList_OK(t *testing.T) {
 	userID := int64(2)
 	seriesID := int64(1)
 
+	mock.ExpectBegin()
 	q := fmt.Sprintf("INSERT INTO %v", SeriesListTable)
 	mock.ExpectExec(q).
 		WithArgs(userID, seriesID).
 		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncSeries, seriesID)
+	mock.ExpectCommit()
 
 	err = AppendSeriesList(db, userID, seriesID)
 	if err != nil {
@@ -431,9 +444,12 @@ func Test_RemoveSeriesList_OK(t *testing.T) {
 	userID := int64(2)
 	seriesID := int64(1)
 
+	mock.ExpectBegin()
 	q := fmt.Sprintf("DELETE FROM %v", SeriesListTable)
 	mock.ExpectExec(q).
 		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncSeries, seriesID)
+	mock.ExpectCommit()
 
 	c, err := RemoveSeriesList(db, userID, seriesID)
 	if err != nil {
@@ -457,15 +473,15 @@ func Test_ReadSeriesList_OK(t *testing.T) {
 
 	userID := int64(1)
 	expect := SeriesList{
-		{0, "Mr. Robot", "robot.png"},
-		{1, "Narcos", "narcos.png"},
+		{0, "Mr. Robot", "robot.png", "A hacker joins fsociety."},
+		{1, "Narcos", "narcos.png", ""},
 	}
-	m := `SELECT series.ID as ID, series.Title as Title, series.Image as Image FROM %v as series, %v as list`
+	m := `SELECT series.ID as ID, series.Title as Title, series.Image as Image, series.Description as Description FROM %v as series, %v as list`
 	q := fmt.Sprintf(m, SeriesTable, SeriesListTable)
-	rows := sqlmock.NewRows([]string{"ID", "Title", "Image"})
+	rows := sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"})
 
 	for _, s := range expect {
-		rows.AddRow(s.ID, s.Title, s.Image)
+		rows.AddRow(s.ID, s.Title, s.Image, s.Description)
 	}
 
 	mock.ExpectQuery(q).WillReturnRows(rows)
@@ -494,9 +510,12 @@ func Test_UpdateLastWatched_OK(t *testing.T) {
 	lastEpisode := 4
 	s := "REPLACE INTO %v"
 	q := fmt.Sprintf(s, LastWatchedTable)
+	mock.ExpectBegin()
 	mock.ExpectExec(q).
 		WithArgs(userID, seriesID, lastSession, lastEpisode).
 		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncWatched, seriesID)
+	mock.ExpectCommit()
 
 	lastWatched := LastWatched{
 		UserID:   userID,
@@ -581,3 +600,270 @@ func Test_CountSeriesWithImage_OK(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func Test_UpdateUserPassword_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(3)
+	q := fmt.Sprintf("UPDATE %v SET Password", UserTable)
+	mock.ExpectExec(q).
+		WithArgs(NewSha512Password("new"), userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = UpdateUserPassword(db, userID, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_PromoteAdmins_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("UPDATE %v SET Role = \\? WHERE Name IN \\(\\?, \\?\\)", UserTable)
+	mock.ExpectExec(q).
+		WithArgs(RoleAdmin, "boss", "root").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = PromoteAdmins(db, []string{"boss", "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing to promote, no query
+	err = PromoteAdmins(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_RemoveUser_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(1)
+
+	m := `SELECT series.ID as ID, series.Title as Title, series.Image as Image, series.Description as Description FROM %v as series, %v as list`
+	q := fmt.Sprintf(m, SeriesTable, SeriesListTable)
+	rows := sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"}).
+		AddRow(1, "Mr. Robot", "robot.png", "").
+		AddRow(2, "Narcos", "narcos.png", "").
+		AddRow(3, "Dark", "dark.png", "")
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	mock.ExpectBegin()
+	for _, table := range []string{
+		LastWatchedTable, SeriesListTable, CalendarFeedTable, APITokenTable,
+		ScrobbleInboxTable, SeriesExternalIDTable,
+	} {
+		q = fmt.Sprintf("DELETE FROM %v WHERE User_ID", table)
+		mock.ExpectExec(q).
+			WithArgs(userID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	q = fmt.Sprintf("DELETE FROM %v WHERE Webhook_ID IN", WebhookDeliveryTable)
+	mock.ExpectExec(q).
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for _, table := range []string{WebhookTable, RecoveryCodeTable, TOTPTable, SessionTable, UserIdentityTable, PasswordResetTable, NotificationPreferenceTable, PushSubscriptionTable, SyncChangeTable, WatchedEpisodeTable, EmailVerificationTable} {
+		q = fmt.Sprintf("DELETE FROM %v WHERE User_ID", table)
+		mock.ExpectExec(q).
+			WithArgs(userID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	q = fmt.Sprintf("DELETE FROM %v WHERE ID", UserTable)
+	mock.ExpectExec(q).
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	counts := []string{
+		fmt.Sprintf("SELECT COUNT\\(\\*\\) FROM %v WHERE Series_ID", SeriesListTable),
+		fmt.Sprintf("SELECT COUNT\\(\\*\\) FROM %v WHERE Series_ID", LastWatchedTable),
+		fmt.Sprintf("SELECT COUNT\\(\\*\\) FROM %v WHERE Episode_ID IN", WatchedEpisodeTable),
+		fmt.Sprintf("SELECT COUNT\\(\\*\\) FROM %v WHERE Series_ID", SeriesExternalIDTable),
+	}
+
+	// Mr. Robot is still on another list
+	rows = sqlmock.NewRows([]string{"COUNT"}).AddRow(1)
+	mock.ExpectQuery(counts[0]).WithArgs(1).WillReturnRows(rows)
+
+	for _, q := range counts {
+		rows = sqlmock.NewRows([]string{"COUNT"}).AddRow(0)
+		mock.ExpectQuery(q).WithArgs(2).WillReturnRows(rows)
+	}
+	for _, table := range []string{SeriesListTable, LastWatchedTable} {
+		q = fmt.Sprintf("SELECT User_ID FROM %v WHERE Series_ID", table)
+		mock.ExpectQuery(q).WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"User_ID"}))
+	}
+	for _, q := range []string{
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID", SeriesListTable),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID", LastWatchedTable),
+		fmt.Sprintf("DELETE FROM %v WHERE Episode_ID IN \\(SELECT ID FROM %v WHERE Series_ID", WatchedEpisodeTable, EpisodesTable),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID", EpisodesTable),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID", EpisodesResourceTable),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID", SeriesExternalIDTable),
+	} {
+		mock.ExpectExec(q).
+			WithArgs(2).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	q = fmt.Sprintf("DELETE FROM %v WHERE ID", SeriesTable)
+	mock.ExpectExec(q).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Dark was dropped from another list but is still watched
+	for i, q := range counts[:2] {
+		rows = sqlmock.NewRows([]string{"COUNT"}).AddRow(i)
+		mock.ExpectQuery(q).WithArgs(3).WillReturnRows(rows)
+	}
+	mock.ExpectCommit()
+
+	removed, err := RemoveUser(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 1 || removed[0].ID != 2 {
+		t.Fatal("Expect Narcos to be removed was", removed)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_MergeSeries_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	src := int64(2)
+	dst := int64(1)
+
+	mock.ExpectBegin()
+	for _, table := range []string{SeriesListTable, LastWatchedTable} {
+		q := fmt.Sprintf("INSERT INTO %v", table)
+		mock.ExpectExec(q).
+			WithArgs(dst, src, dst).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	for _, table := range []string{
+		EpisodesTable, EpisodesResourceTable, SeriesExternalIDTable,
+	} {
+		q := fmt.Sprintf("UPDATE %v SET Series_ID", table)
+		mock.ExpectExec(q).
+			WithArgs(dst, src).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	// User 7 had src, the sync gets dst and the removal of src
+	userID := int64(7)
+	q := fmt.Sprintf("SELECT User_ID FROM %v WHERE Series_ID", SeriesListTable)
+	mock.ExpectQuery(q).WithArgs(src).
+		WillReturnRows(sqlmock.NewRows([]string{"User_ID"}).AddRow(userID))
+	q = fmt.Sprintf("SELECT User_ID, Session, Episode FROM %v", LastWatchedTable)
+	mock.ExpectQuery(q).WithArgs(dst, src).
+		WillReturnRows(sqlmock.NewRows([]string{"User_ID", "Session", "Episode"}).AddRow(userID, 1, 2))
+	expectSyncChange(mock, userID, 1, SyncSeries, dst)
+	expectSyncChange(mock, userID, 2, SyncWatched, dst)
+
+	for _, table := range []string{SeriesListTable, LastWatchedTable} {
+		q = fmt.Sprintf("SELECT User_ID FROM %v WHERE Series_ID", table)
+		mock.ExpectQuery(q).WithArgs(src).
+			WillReturnRows(sqlmock.NewRows([]string{"User_ID"}).AddRow(userID))
+	}
+	for _, q := range []string{
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID", SeriesListTable),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID", LastWatchedTable),
+		fmt.Sprintf("DELETE FROM %v WHERE Episode_ID IN \\(SELECT ID FROM %v WHERE Series_ID", WatchedEpisodeTable, EpisodesTable),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID", EpisodesTable),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID", EpisodesResourceTable),
+		fmt.Sprintf("DELETE FROM %v WHERE Series_ID", SeriesExternalIDTable),
+	} {
+		mock.ExpectExec(q).
+			WithArgs(src).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	q = fmt.Sprintf("DELETE FROM %v WHERE ID", SeriesTable)
+	mock.ExpectExec(q).
+		WithArgs(src).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 3, SyncSeries, src)
+	expectSyncChange(mock, userID, 4, SyncWatched, src)
+	mock.ExpectCommit()
+
+	err = MergeSeries(db, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_UserStoreFindUser_Disabled(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v"
+	q := fmt.Sprintf(m, UserTable)
+	rows := sqlmock.NewRows([]string{"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email"}).
+		AddRow(1, "spammer", NewSha512Password("123"), RoleUser, true, 0, nil, "")
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	_, err = NewUserStore(db, Specs{}).FindUser("spammer")
+	if err != ErrUserDisabled {
+		t.Fatal("Expect", ErrUserDisabled, "was", err)
+	}
+}
+
+func Test_ReadSeriesContext_QueryTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT Title, Image, Description FROM %v", SeriesTable)
+	rows := sqlmock.NewRows([]string{"Title", "Image", "Description"}).
+		AddRow(series.Title, series.Image, series.Description)
+	mock.ExpectQuery(query).
+		WillDelayFor(time.Second).
+		WillReturnRows(rows)
+
+	ctx := WithQueryTimeout(context.Background(), 10*time.Millisecond)
+	start := time.Now()
+	_, err = ReadSeriesContext(ctx, db, series.ID)
+	if err == nil {
+		t.Fatal("Expect error")
+	}
+
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatal("Expect query to be canceled after 10ms was", d)
+	}
+}
@@ -0,0 +1,230 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	DialectMySQL    = "mysql"
+	DialectPostgres = "postgres"
+)
+
+type (
+	// Dialect hides the differences of the SQL databases sj runs on. The
+	// data functions write their queries with ? placeholders which are
+	// rebound by the dialect before they are sent to the database.
+	Dialect interface {
+		Name() string
+		DriverName() string
+		DSN(specs Specs) string
+		Rebind(q string) string
+		Quote(name string) string
+		Upsert(table string, keys, cols []string) string
+		InsertIgnore(table string, cols []string) string
+		InsertID(ctx context.Context, db querier, q string, args ...interface{}) (int64, error)
+	}
+
+	// querier is implemented by *sql.DB and *sql.Tx, data functions which
+	// take it can run in a transaction.
+	querier interface {
+		ExecContext(ctx context.Context, q string, args ...interface{}) (sql.Result, error)
+		QueryContext(ctx context.Context, q string, args ...interface{}) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, q string, args ...interface{}) *sql.Row
+	}
+
+	mysqlDialect struct{}
+
+	postgresDialect struct{}
+)
+
+var (
+	MySQL    Dialect = mysqlDialect{}
+	Postgres Dialect = postgresDialect{}
+
+	dialect = MySQL
+)
+
+func DialectByName(name string) (Dialect, error) {
+	switch name {
+	case "", DialectMySQL:
+		return MySQL, nil
+	case DialectPostgres:
+		return Postgres, nil
+	}
+
+	m := fmt.Sprintf("Unknown database dialect %v", name)
+	return nil, errors.New(m)
+}
+
+// SetDialect sets the dialect used by all data functions. It has to be
+// called before the first query, NewApp does this for the configured
+// dialect.
+func SetDialect(d Dialect) {
+	dialect = d
+}
+
+func CurrentDialect() Dialect {
+	return dialect
+}
+
+func quote(name string) string {
+	return dialect.Quote(name)
+}
+
+func dbExec(ctx context.Context, db querier, q string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(ctx, dialect.Rebind(q), args...)
+}
+
+func dbQuery(ctx context.Context, db querier, q string, args ...interface{}) (*sql.Rows, error) {
+	return db.QueryContext(ctx, dialect.Rebind(q), args...)
+}
+
+func dbQueryRow(ctx context.Context, db querier, q string, args ...interface{}) *sql.Row {
+	return db.QueryRowContext(ctx, dialect.Rebind(q), args...)
+}
+
+func dbInsertID(ctx context.Context, db querier, q string, args ...interface{}) (int64, error) {
+	return dialect.InsertID(ctx, db, dialect.Rebind(q), args...)
+}
+
+func (mysqlDialect) Name() string {
+	return DialectMySQL
+}
+
+func (mysqlDialect) DriverName() string {
+	return "mysql"
+}
+
+func (mysqlDialect) DSN(specs Specs) string {
+	return fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true",
+		specs.DBUser,
+		specs.DBPass,
+		specs.DBHost,
+		specs.DBPort,
+		specs.DBName,
+	)
+}
+
+func (mysqlDialect) Rebind(q string) string {
+	return q
+}
+
+func (mysqlDialect) Quote(name string) string {
+	return name
+}
+
+func (mysqlDialect) Upsert(table string, keys, cols []string) string {
+	all := append(append([]string{}, keys...), cols...)
+	return fmt.Sprintf("REPLACE INTO %v (%v) VALUES (%v)",
+		table,
+		strings.Join(all, ", "),
+		placeholders(len(all)),
+	)
+}
+
+// InsertIgnore inserts the row unless it violates a unique key.
+func (mysqlDialect) InsertIgnore(table string, cols []string) string {
+	return fmt.Sprintf("INSERT IGNORE INTO %v (%v) VALUES (%v)",
+		table,
+		strings.Join(cols, ", "),
+		placeholders(len(cols)),
+	)
+}
+
+func (mysqlDialect) InsertID(ctx context.Context, db querier, q string, args ...interface{}) (int64, error) {
+	res, err := db.ExecContext(ctx, q, args...)
+	if err != nil {
+		return -1, err
+	}
+
+	return res.LastInsertId()
+}
+
+func (postgresDialect) Name() string {
+	return DialectPostgres
+}
+
+func (postgresDialect) DriverName() string {
+	return "postgres"
+}
+
+func (postgresDialect) DSN(specs Specs) string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(specs.DBUser, specs.DBPass),
+		Host:     fmt.Sprintf("%v:%v", specs.DBHost, specs.DBPort),
+		Path:     specs.DBName,
+		RawQuery: "sslmode=" + url.QueryEscape(specs.DBSSLMode),
+	}
+
+	return u.String()
+}
+
+// Rebind replaces the ? placeholders with $1, $2, ... Question marks inside
+// of string literals are left alone.
+func (postgresDialect) Rebind(q string) string {
+	buf := strings.Builder{}
+	n := 0
+	literal := false
+	for _, r := range q {
+		switch {
+		case r == '\'':
+			literal = !literal
+		case r == '?' && !literal:
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		buf.WriteRune(r)
+	}
+
+	return buf.String()
+}
+
+func (postgresDialect) Quote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func (postgresDialect) Upsert(table string, keys, cols []string) string {
+	all := append(append([]string{}, keys...), cols...)
+	set := []string{}
+	for _, c := range cols {
+		set = append(set, fmt.Sprintf("%v = EXCLUDED.%v", c, c))
+	}
+
+	return fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v) ON CONFLICT (%v) DO UPDATE SET %v",
+		table,
+		strings.Join(all, ", "),
+		placeholders(len(all)),
+		strings.Join(keys, ", "),
+		strings.Join(set, ", "),
+	)
+}
+
+func (postgresDialect) InsertIgnore(table string, cols []string) string {
+	return fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v) ON CONFLICT DO NOTHING",
+		table,
+		strings.Join(cols, ", "),
+		placeholders(len(cols)),
+	)
+}
+
+func (postgresDialect) InsertID(ctx context.Context, db querier, q string, args ...interface{}) (int64, error) {
+	var id int64
+	err := db.QueryRowContext(ctx, q+" RETURNING ID", args...).Scan(&id)
+	if err != nil {
+		return -1, err
+	}
+
+	return id, nil
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
@@ -0,0 +1,152 @@
+package sj
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func usePostgres(t *testing.T) {
+	SetDialect(Postgres)
+	t.Cleanup(func() { SetDialect(MySQL) })
+}
+
+func Test_PostgresRebind(t *testing.T) {
+	q := Postgres.Rebind("SELECT '?' FROM t WHERE a = ? AND b = ?")
+	expect := "SELECT '?' FROM t WHERE a = $1 AND b = $2"
+	if q != expect {
+		t.Fatalf("Expect %v was %v", expect, q)
+	}
+}
+
+func Test_Upsert(t *testing.T) {
+	keys := []string{"User_ID", "Series_ID"}
+	cols := []string{"Session", "Episode"}
+
+	q := MySQL.Upsert("LastWatched", keys, cols)
+	expect := "REPLACE INTO LastWatched (User_ID, Series_ID, Session, Episode) VALUES (?, ?, ?, ?)"
+	if q != expect {
+		t.Fatalf("Expect %v was %v", expect, q)
+	}
+
+	q = Postgres.Upsert(`"LastWatched"`, keys, cols)
+	expect = `INSERT INTO "LastWatched" (User_ID, Series_ID, Session, Episode) VALUES (?, ?, ?, ?) ON CONFLICT (User_ID, Series_ID) DO UPDATE SET Session = EXCLUDED.Session, Episode = EXCLUDED.Episode`
+	if q != expect {
+		t.Fatalf("Expect %v was %v", expect, q)
+	}
+}
+
+func Test_InsertIgnore(t *testing.T) {
+	cols := []string{"User_ID", "Provider", "External_ID", "Series_ID"}
+
+	q := MySQL.InsertIgnore("SeriesExternalID", cols)
+	expect := "INSERT IGNORE INTO SeriesExternalID (User_ID, Provider, External_ID, Series_ID) VALUES (?, ?, ?, ?)"
+	if q != expect {
+		t.Fatalf("Expect %v was %v", expect, q)
+	}
+
+	q = Postgres.InsertIgnore(`"SeriesExternalID"`, cols)
+	expect = `INSERT INTO "SeriesExternalID" (User_ID, Provider, External_ID, Series_ID) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`
+	if q != expect {
+		t.Fatalf("Expect %v was %v", expect, q)
+	}
+}
+
+func Test_NewSeries_Postgres(t *testing.T) {
+	usePostgres(t)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := `INSERT INTO "Series" \(Title,Image,Description,Search_Title,Search_Description,Updated\) VALUES\(\$1, \$2, \$3, \$4, \$5, \$6\) RETURNING ID`
+	rows := sqlmock.NewRows([]string{"ID"}).AddRow(series.ID)
+	mock.ExpectQuery(q).
+		WithArgs(series.Title, series.Image, series.Description, FoldText(series.Title), FoldText(series.Description),
+			sqlmock.AnyArg()).
+		WillReturnRows(rows)
+
+	id, err := NewSeries(db, series)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != series.ID {
+		t.Fatalf("Expect %v was %v", series.ID, id)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_UpdateLastWatched_Postgres(t *testing.T) {
+	usePostgres(t)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf(`INSERT INTO "%v" .* ON CONFLICT \(User_ID, Series_ID\)`, LastWatchedTable)
+	mock.ExpectBegin()
+	mock.ExpectExec(q).
+		WithArgs(1, 2, 3, 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	q = regexp.QuoteMeta(`UPDATE "User" SET Sync_Version = Sync_Version + 1, Sync_Updated = $1 WHERE ID = $2`)
+	mock.ExpectExec(q).WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	q = regexp.QuoteMeta(`SELECT Sync_Version FROM "User" WHERE ID = $1`)
+	mock.ExpectQuery(q).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"Sync_Version"}).AddRow(5))
+	q = regexp.QuoteMeta(`INSERT INTO "SyncChange"`)
+	mock.ExpectExec(q).
+		WithArgs(1, 5, SyncWatched, 2, false, 3, 4, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	q = regexp.QuoteMeta(`DELETE FROM "SyncChange" WHERE User_ID = $1 AND Kind = $2 AND Series_ID = $3 AND Version < $4`)
+	mock.ExpectExec(q).WithArgs(1, SyncWatched, 2, 5).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	err = UpdateLastWatched(db, LastWatched{
+		UserID:   1,
+		SeriesID: 2,
+		Session:  3,
+		Episode:  4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ReadUser_Postgres(t *testing.T) {
+	usePostgres(t)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := regexp.QuoteMeta(`FROM "User" WHERE ID = $1`)
+	rows := sqlmock.NewRows([]string{"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email"}).
+		AddRow(1, "alice", "pass", RoleUser, false, 0, nil, "")
+	mock.ExpectQuery(q).WithArgs(1).WillReturnRows(rows)
+
+	_, err = ReadUser(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
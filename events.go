@@ -0,0 +1,56 @@
+package sj
+
+import (
+	"context"
+	"time"
+)
+
+// EventEpisodeWatched carries the new LastWatched of a series, which may
+// also be lower after an episode was marked as not watched.
+// EventLastWatchedRemoved carries the LastWatched of a series without any
+// watched episode anymore.
+const (
+	EventSeriesAdded        = "series.added"
+	EventSeriesRemoved      = "series.removed"
+	EventEpisodeWatched     = "episode.watched"
+	EventLastWatchedRemoved = "lastwatched.removed"
+)
+
+type (
+	Event struct {
+		Type    string
+		UserID  int64
+		Created time.Time
+		Data    interface{}
+	}
+
+	SeriesListEvent struct {
+		SeriesID int64
+	}
+
+	// EventSink receives the events of the handlers, e.g. to deliver them
+	// as webhooks.
+	EventSink interface {
+		Emit(ctx context.Context, e Event) error
+	}
+)
+
+func NewEvent(eventType string, userID int64, data interface{}) Event {
+	return Event{
+		Type:    eventType,
+		UserID:  userID,
+		Created: time.Now().UTC(),
+		Data:    data,
+	}
+}
+
+// emit passes the event to every sink of the app. The change which caused
+// the event is already done, so a failing sink is logged but doesn't fail
+// the request.
+func emit(ctx context.Context, app AppCtx, e Event) {
+	for _, sink := range app.Events {
+		if err := sink.Emit(ctx, e); err != nil {
+			logEventError(ctx, app, e, err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	StatusWatching = "watching"
+	StatusPlanned  = "planned"
+)
+
+var exportCSVHeader = []string{
+	"Title", "Image", "Description", "Status", "Session", "Episode",
+}
+
+type (
+	ExportEntry struct {
+		Title       string
+		Image       string
+		Description string
+		Status      string
+		Session     int
+		Episode     int
+	}
+
+	ExportList []ExportEntry
+
+	ImportReport struct {
+		CreatedSeries int
+		AppendedList  int
+		UpdatedLast   int
+	}
+)
+
+func ReadExportList(db *sql.DB, userID int64) (ExportList, error) {
+	return ReadExportListContext(context.Background(), db, userID)
+}
+
+func ReadExportListContext(ctx context.Context, db *sql.DB, userID int64) (ExportList, error) {
+	sList, err := ReadSeriesListContext(ctx, db, userID)
+	if err != nil {
+		return ExportList{}, err
+	}
+
+	wList, err := ReadLastWatchedListContext(ctx, db, userID)
+	if err != nil {
+		return ExportList{}, err
+	}
+
+	watched := map[int64]LastWatched{}
+	for _, w := range wList {
+		watched[w.SeriesID] = w
+	}
+
+	eList := ExportList{}
+	for _, s := range sList {
+		e := ExportEntry{
+			Title:       s.Title,
+			Image:       s.Image,
+			Description: s.Description,
+			Status:      StatusPlanned,
+		}
+
+		if w, ok := watched[s.ID]; ok {
+			e.Status = StatusWatching
+			e.Session = w.Session
+			e.Episode = w.Episode
+		}
+
+		eList = append(eList, e)
+	}
+
+	return eList, nil
+}
+
+// ImportExportList adds every entry to the users series list. Series are
+// matched by title and only created if missing, so importing the same list
+// twice does not change anything. The import is done in one transaction,
+// a failing entry leaves the list unchanged.
+func ImportExportList(db *sql.DB, userID int64, eList ExportList) (ImportReport, error) {
+	return ImportExportListContext(context.Background(), db, userID, eList)
+}
+
+func ImportExportListContext(ctx context.Context, db *sql.DB, userID int64, eList ExportList) (ImportReport, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	report, err := importExportList(ctx, tx, userID, eList)
+	if err != nil {
+		tx.Rollback()
+		return ImportReport{}, err
+	}
+
+	return report, tx.Commit()
+}
+
+func importExportList(ctx context.Context, tx *sql.Tx, userID int64, eList ExportList) (ImportReport, error) {
+	report := ImportReport{}
+
+	for _, e := range eList {
+		if e.Title == "" {
+			return report, NewMissingFieldError("Title")
+		}
+
+		s, err := FindSeriesByTitleContext(ctx, tx, e.Title)
+		if err == sql.ErrNoRows {
+			s = Series{
+				Title:       e.Title,
+				Image:       importImage(e.Image),
+				Description: e.Description,
+			}
+			s.ID, err = NewSeriesContext(ctx, tx, s)
+			if err != nil {
+				return report, err
+			}
+			report.CreatedSeries++
+		} else if err != nil {
+			return report, err
+		}
+
+		exists, err := ExistsSeriesListContext(ctx, tx, userID, s.ID)
+		if err != nil {
+			return report, err
+		}
+
+		if !exists {
+			err = AppendSeriesListContext(ctx, tx, userID, s.ID)
+			if err != nil {
+				return report, err
+			}
+			report.AppendedList++
+		}
+
+		if e.Session == 0 && e.Episode == 0 {
+			continue
+		}
+
+		err = UpdateLastWatchedContext(ctx, tx, LastWatched{
+			UserID:   userID,
+			SeriesID: s.ID,
+			Session:  e.Session,
+			Episode:  e.Episode,
+		})
+		if err != nil {
+			return report, err
+		}
+		report.UpdatedLast++
+	}
+
+	return report, nil
+}
+
+// importImage keeps only image names created by SaveImage. Other names are
+// dropped, they could point outside of the image directory.
+func importImage(name string) string {
+	if !imageNameRegexp.MatchString(name) {
+		return ""
+	}
+
+	return name
+}
+
+func WriteExportCSV(w io.Writer, eList ExportList) error {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write(exportCSVHeader)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range eList {
+		err := cw.Write([]string{
+			e.Title,
+			e.Image,
+			e.Description,
+			e.Status,
+			strconv.Itoa(e.Session),
+			strconv.Itoa(e.Episode),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func ReadExportCSV(r io.Reader) (ExportList, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return ExportList{}, err
+	}
+
+	if len(records) == 0 {
+		return ExportList{}, errors.New("Missing CSV header")
+	}
+
+	cols := map[string]int{}
+	for i, name := range records[0] {
+		cols[strings.TrimSpace(name)] = i
+	}
+
+	if _, ok := cols["Title"]; !ok {
+		return ExportList{}, NewMissingFieldError("Title")
+	}
+
+	eList := ExportList{}
+	for n, rec := range records[1:] {
+		field := func(name string) string {
+			i, ok := cols[name]
+			if !ok || i >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[i])
+		}
+
+		e := ExportEntry{
+			Title:       field("Title"),
+			Image:       field("Image"),
+			Description: field("Description"),
+			Status:      field("Status"),
+		}
+
+		for name, v := range map[string]*int{
+			"Session": &e.Session,
+			"Episode": &e.Episode,
+		} {
+			tmp := field(name)
+			if tmp == "" {
+				continue
+			}
+
+			*v, err = strconv.Atoi(tmp)
+			if err != nil {
+				m := fmt.Sprintf("Wrong value in %v in line %v", name, n+2)
+				return ExportList{}, errors.New(m)
+			}
+		}
+
+		eList = append(eList, e)
+	}
+
+	return eList, nil
+}
@@ -0,0 +1,191 @@
+package sj
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var exportList = ExportList{
+	{"Mr. Robot", "robot.png", "A hacker joins fsociety.", StatusWatching, 2, 4},
+	{"Narcos", "narcos.png", "", StatusPlanned, 0, 0},
+}
+
+func Test_ExportCSV_RoundTrip(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	err := WriteExportCSV(buf, exportList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ReadExportCSV(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(exportList, result) {
+		t.Fatal("Expect", exportList, "was", result)
+	}
+}
+
+func Test_ReadExportCSV_WrongNumber(t *testing.T) {
+	data := "Title,Session,Episode\nDark,one,2\n"
+	_, err := ReadExportCSV(bytes.NewBufferString(data))
+	if err == nil {
+		t.Fatal("Expect error")
+	}
+}
+
+func Test_ReadExportList_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(1)
+
+	m := `SELECT series.ID as ID, series.Title as Title, series.Image as Image, series.Description as Description FROM %v as series, %v as list`
+	q := fmt.Sprintf(m, SeriesTable, SeriesListTable)
+	rows := sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"}).
+		AddRow(1, "Mr. Robot", "robot.png", "A hacker joins fsociety.").
+		AddRow(2, "Narcos", "narcos.png", "")
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT Series_ID, Session, Episode FROM %v", LastWatchedTable)
+	rows = sqlmock.NewRows([]string{"Series_ID", "Session", "Episode"}).
+		AddRow(1, 2, 4)
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	result, err := ReadExportList(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(exportList, result) {
+		t.Fatal("Expect", exportList, "was", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ImportExportList_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(1)
+
+	mock.ExpectBegin()
+
+	// Mr. Robot already exists and is on the list
+	q := fmt.Sprintf("SELECT ID, Title, Image, Description FROM %v", SeriesTable)
+	rows := sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"}).
+		AddRow(1, "Mr. Robot", "robot.png", "")
+	mock.ExpectQuery(q).WithArgs("Mr. Robot").WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT COUNT\\(\\*\\) FROM %v", SeriesListTable)
+	rows = sqlmock.NewRows([]string{"COUNT"}).AddRow(1)
+	mock.ExpectQuery(q).WithArgs(userID, 1).WillReturnRows(rows)
+
+	q = fmt.Sprintf("REPLACE INTO %v", LastWatchedTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, 1, 2, 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncWatched, 1)
+
+	// Narcos is unknown, its image name is not a SaveImage name
+	q = fmt.Sprintf("SELECT ID, Title, Image, Description FROM %v", SeriesTable)
+	mock.ExpectQuery(q).WithArgs("Narcos").WillReturnError(sql.ErrNoRows)
+
+	q = fmt.Sprintf("INSERT INTO %v", SeriesTable)
+	mock.ExpectExec(q).
+		WithArgs("Narcos", "", "", "narcos", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+
+	q = fmt.Sprintf("SELECT COUNT\\(\\*\\) FROM %v", SeriesListTable)
+	rows = sqlmock.NewRows([]string{"COUNT"}).AddRow(0)
+	mock.ExpectQuery(q).WithArgs(userID, 2).WillReturnRows(rows)
+
+	q = fmt.Sprintf("INSERT INTO %v", SeriesListTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 2, SyncSeries, 2)
+
+	mock.ExpectCommit()
+
+	report, err := ImportExportList(db, userID, exportList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := ImportReport{
+		CreatedSeries: 1,
+		AppendedList:  1,
+		UpdatedLast:   1,
+	}
+	if expect != report {
+		t.Fatal("Expect", expect, "was", report)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ImportExportList_Rollback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(1)
+
+	mock.ExpectBegin()
+
+	q := fmt.Sprintf("SELECT ID, Title, Image, Description FROM %v", SeriesTable)
+	rows := sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"}).
+		AddRow(1, "Mr. Robot", "robot.png", "")
+	mock.ExpectQuery(q).WithArgs("Mr. Robot").WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT COUNT\\(\\*\\) FROM %v", SeriesListTable)
+	mock.ExpectQuery(q).WithArgs(userID, 1).WillReturnError(errors.New("fail"))
+
+	mock.ExpectRollback()
+
+	_, err = ImportExportList(db, userID, exportList)
+	if err == nil {
+		t.Fatal("Expect error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ImportImage(t *testing.T) {
+	name := strings.Repeat("a", 40) + ".png"
+	cases := map[string]string{
+		name:               name,
+		"narcos.png":       "",
+		"../../etc/passwd": "",
+		"":                 "",
+	}
+	for in, expect := range cases {
+		if out := importImage(in); out != expect {
+			t.Fatal("Expect", expect, "was", out)
+		}
+	}
+}
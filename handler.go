@@ -1,11 +1,11 @@
 package sj
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
-	"path"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
@@ -19,8 +19,9 @@ type (
 	}
 
 	FailResponse struct {
-		Status string
-		Err    string
+		Status    string
+		Err       string
+		RequestID string `json:",omitempty"`
 	}
 
 	AppHandler func(AppCtx, *gin.Context) error
@@ -48,15 +49,19 @@ func NewAppHandler(app AppCtx, fn AppHandler) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		err := fn(app, c)
 		if err != nil {
+			logHandlerError(app, c, err)
+
 			resp := NewFailResponse(err)
+			resp.RequestID = requestID(c)
 			c.JSON(http.StatusOK, resp)
 		}
 	}
 }
 
 func NewSeriesHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
 
-	session, err := kauth.ReadSession(c)
+	userID, err := readSessionUserID(c)
 	if err != nil {
 		return err
 	}
@@ -71,31 +76,23 @@ func NewSeriesHandler(app AppCtx, c *gin.Context) error {
 	if err != nil {
 		return err
 	}
-	imgPath := path.Join(imgDir, name)
-
 	s.Image = name
 
-	seriesID, err := NewSeries(app.DB, s)
-	if err != nil {
-		removeImage(imgPath)
-		return err
-	}
-
-	userID, err := strconv.Atoi(session.UserID())
+	seriesID, err := NewSeriesContext(ctx, app.DB, s)
 	if err != nil {
-		// todo(tochti):remove series
-		removeImage(imgPath)
+		removeImage(imgDir, name)
 		return err
 	}
 
-	err = AppendSeriesList(app.DB, int64(userID), seriesID)
+	err = AppendSeriesListContext(ctx, app.DB, userID, seriesID)
 	if err != nil {
 		// todo(tochti):remove series
-		removeImage(imgPath)
+		removeImage(imgDir, name)
 		return err
 	}
 
 	s.ID = seriesID
+	emit(ctx, app, NewEvent(EventSeriesAdded, userID, SeriesListEvent{seriesID}))
 
 	resp := NewSuccessResponse(s)
 	c.JSON(http.StatusOK, resp)
@@ -104,6 +101,7 @@ func NewSeriesHandler(app AppCtx, c *gin.Context) error {
 }
 
 func ReadSeriesHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
 
 	tmp := c.Params.ByName("id")
 
@@ -112,7 +110,23 @@ func ReadSeriesHandler(app AppCtx, c *gin.Context) error {
 		return err
 	}
 
-	s, err := ReadSeries(app.DB, int64(id))
+	// Series only change when they are created, the time is their version
+	updated, err := ReadSeriesUpdatedContext(ctx, app.DB, int64(id))
+	if err != nil {
+		return err
+	}
+
+	var version int64
+	if !updated.IsZero() {
+		version = updated.Unix()
+	}
+
+	etag := versionETag("series", int64(id), version)
+	if respondNotModified(c, etag, updated) {
+		return nil
+	}
+
+	s, err := ReadSeriesContext(ctx, app.DB, int64(id))
 	if err != nil {
 		return err
 	}
@@ -124,6 +138,8 @@ func ReadSeriesHandler(app AppCtx, c *gin.Context) error {
 }
 
 func RemoveSeriesHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
 	idParam := c.Params.ByName("id")
 	tmp, err := strconv.Atoi(idParam)
 	if err != nil {
@@ -131,22 +147,17 @@ func RemoveSeriesHandler(app AppCtx, c *gin.Context) error {
 	}
 	seriesID := int64(tmp)
 
-	session, err := kauth.ReadSession(c)
+	userID, err := readSessionUserID(c)
 	if err != nil {
 		return err
 	}
-	tmp, err = strconv.Atoi(session.UserID())
-	if err != nil {
-		return err
-	}
-	userID := int64(tmp)
 
-	series, err := ReadSeries(app.DB, seriesID)
+	series, err := ReadSeriesContext(ctx, app.DB, seriesID)
 	if err != nil {
 		return err
 	}
 
-	affected, err := RemoveSeriesList(app.DB, userID, seriesID)
+	affected, err := RemoveSeriesListContext(ctx, app.DB, userID, seriesID)
 	if err != nil {
 		return err
 	}
@@ -154,10 +165,11 @@ func RemoveSeriesHandler(app AppCtx, c *gin.Context) error {
 	if affected < 1 {
 		return errors.New("Cannot found Series")
 	}
+	emit(ctx, app, NewEvent(EventSeriesRemoved, userID, SeriesListEvent{seriesID}))
 
-	err = RemoveSeries(app.DB, seriesID)
+	err = RemoveSeriesContext(ctx, app.DB, seriesID)
 	if err != nil {
-		err2 := AppendSeriesList(app.DB, userID, seriesID)
+		err2 := AppendSeriesListContext(ctx, app.DB, userID, seriesID)
 		if err2 != nil {
 			return err2
 		}
@@ -165,13 +177,13 @@ func RemoveSeriesHandler(app AppCtx, c *gin.Context) error {
 		return err
 	}
 
-	count, err := CountSeriesWithImage(app.DB, series.Image)
+	count, err := CountSeriesWithImageContext(ctx, app.DB, series.Image)
 	if err != nil {
 		return err
 	}
 
 	if count == 0 {
-		removeImage(path.Join(app.Specs.ImageDir, series.Image))
+		removeImage(app.Specs.ImageDir, series.Image)
 	}
 
 	resp := NewSuccessResponse(series)
@@ -182,12 +194,47 @@ func RemoveSeriesHandler(app AppCtx, c *gin.Context) error {
 }
 
 func NewUserHandler(app AppCtx, c *gin.Context) error {
-	user, err := ParseNewUserRequest(c)
+	ctx := requestContext(app, c)
+
+	data, err := ParseRegistrationRequest(c)
+	if err != nil {
+		return err
+	}
+	user := data.User
+
+	mode := registrationMode(app.Specs)
+	if mode == RegistrationClosed {
+		return ErrRegistrationClosed
+	}
+
+	if mode == RegistrationInvite {
+		invite, err := ReadInviteCodeContext(ctx, app.DB, data.InviteCode)
+		if err == sql.ErrNoRows || (err == nil && invite.UsedBy != 0) {
+			return ErrInvalidInviteCode
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ValidateUserName(user.Name)
 	if err != nil {
 		return err
 	}
 
-	_, err = FindUserByName(app.DB, user.Name)
+	err = ValidatePassword(app.Specs, user.Password)
+	if err != nil {
+		return err
+	}
+
+	if user.Email != "" {
+		err = ValidateEmail(user.Email)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = FindUserByNameContext(ctx, app.DB, user.Name)
 	if err == nil || err != sql.ErrNoRows {
 		if err != nil {
 			return err
@@ -197,16 +244,39 @@ func NewUserHandler(app AppCtx, c *gin.Context) error {
 		return errors.New(m)
 	}
 
-	id, err := NewUser(app.DB, user)
+	// The email is only set once it is verified
+	email := user.Email
+	user.Email = ""
+
+	id, err := NewUserContext(ctx, app.DB, user)
 	if err != nil {
 		return err
 	}
 
+	if mode == RegistrationInvite {
+		err = UseInviteCodeContext(ctx, app.DB, data.InviteCode, id)
+		if err != nil {
+			RemoveUserContext(ctx, app.DB, id)
+			return err
+		}
+	}
+
 	u := User{
 		ID:   id,
 		Name: user.Name,
 	}
 
+	if email != "" {
+		err = sendEmailVerification(ctx, app, u, email)
+		if err != nil {
+			logger(app).ErrorContext(ctx, "email verification mail failed",
+				"request_id", requestID(c),
+				"user_id", id,
+				"error", err.Error(),
+			)
+		}
+	}
+
 	resp := NewSuccessResponse(u)
 	c.JSON(http.StatusOK, resp)
 
@@ -215,11 +285,9 @@ func NewUserHandler(app AppCtx, c *gin.Context) error {
 }
 
 func AppendSeriesListHandler(app AppCtx, c *gin.Context) error {
-	session, err := kauth.ReadSession(c)
-	if err != nil {
-		return err
-	}
-	userID, err := strconv.Atoi(session.UserID())
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
 	if err != nil {
 		return err
 	}
@@ -229,10 +297,11 @@ func AppendSeriesListHandler(app AppCtx, c *gin.Context) error {
 		return err
 	}
 
-	err = AppendSeriesList(app.DB, int64(userID), data.SeriesID)
+	err = AppendSeriesListContext(ctx, app.DB, userID, data.SeriesID)
 	if err != nil {
 		return err
 	}
+	emit(ctx, app, NewEvent(EventSeriesAdded, userID, SeriesListEvent{data.SeriesID}))
 
 	resp := NewSuccessResponse("")
 	c.JSON(http.StatusOK, resp)
@@ -241,17 +310,23 @@ func AppendSeriesListHandler(app AppCtx, c *gin.Context) error {
 }
 
 func ReadSeriesListHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
 
-	session, err := kauth.ReadSession(c)
+	id, err := readSessionUserID(c)
 	if err != nil {
 		return err
 	}
-	id, err := strconv.Atoi(session.UserID())
+
+	version, updated, err := ReadSyncStateContext(ctx, app.DB, id)
 	if err != nil {
 		return err
 	}
 
-	sList, err := ReadSeriesList(app.DB, int64(id))
+	if respondNotModified(c, versionETag("list", id, version), updated) {
+		return nil
+	}
+
+	sList, err := ReadSeriesListContext(ctx, app.DB, id)
 	if err != nil {
 		return err
 	}
@@ -263,11 +338,9 @@ func ReadSeriesListHandler(app AppCtx, c *gin.Context) error {
 }
 
 func UpdateLastWatchedHandler(app AppCtx, c *gin.Context) error {
-	session, err := kauth.ReadSession(c)
-	if err != nil {
-		return err
-	}
-	userID, err := strconv.Atoi(session.UserID())
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
 	if err != nil {
 		return err
 	}
@@ -277,12 +350,13 @@ func UpdateLastWatchedHandler(app AppCtx, c *gin.Context) error {
 		return err
 	}
 
-	lastWatched.UserID = int64(userID)
+	lastWatched.UserID = userID
 
-	err = UpdateLastWatched(app.DB, lastWatched)
+	err = UpdateLastWatchedContext(ctx, app.DB, lastWatched)
 	if err != nil {
 		return err
 	}
+	emit(ctx, app, NewEvent(EventEpisodeWatched, userID, lastWatched))
 
 	resp := NewSuccessResponse(lastWatched)
 	c.JSON(http.StatusOK, resp)
@@ -291,16 +365,23 @@ func UpdateLastWatchedHandler(app AppCtx, c *gin.Context) error {
 }
 
 func LastWatchedListHandler(app AppCtx, c *gin.Context) error {
-	session, err := kauth.ReadSession(c)
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
 	if err != nil {
 		return err
 	}
-	userID, err := strconv.Atoi(session.UserID())
+
+	version, updated, err := ReadSyncStateContext(ctx, app.DB, userID)
 	if err != nil {
 		return err
 	}
 
-	watchedList, err := ReadLastWatchedList(app.DB, int64(userID))
+	if respondNotModified(c, versionETag("watched", userID, version), updated) {
+		return nil
+	}
+
+	watchedList, err := ReadLastWatchedListContext(ctx, app.DB, userID)
 	if err != nil {
 		return err
 	}
@@ -310,3 +391,330 @@ func LastWatchedListHandler(app AppCtx, c *gin.Context) error {
 
 	return nil
 }
+
+func SearchSeriesHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	params := c.Request.URL.Query()
+
+	query := params.Get("q")
+	if query == "" {
+		return NewMissingFieldError("q")
+	}
+
+	limit := DefaultSearchLimit
+	if tmp := params.Get("limit"); tmp != "" {
+		l, err := strconv.Atoi(tmp)
+		if err != nil {
+			return err
+		}
+		limit = l
+	}
+
+	var results SearchResultList
+	var err error
+	if params.Get("scope") == "list" {
+		var userID int64
+		userID, err = readSessionUserID(c)
+		if err != nil {
+			return err
+		}
+
+		results, err = SearchSeriesListContext(ctx, app.DB, userID, query, limit)
+	} else {
+		results, err = SearchSeriesContext(ctx, app.DB, query, limit)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(results)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// readSessionUserID returns the user of the API token or the kauth session
+// which authenticated the request.
+func readSessionUserID(c *gin.Context) (int64, error) {
+	if token, ok := readAPIToken(c); ok {
+		return token.UserID, nil
+	}
+
+	session, err := kauth.ReadSession(c)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(session.UserID(), 10, 64)
+}
+
+func ExportHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	eList, err := ReadExportListContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	format := c.Request.URL.Query().Get("format")
+	switch format {
+	case "", "json":
+		c.Header("Content-Disposition", "attachment; filename=sj.json")
+		resp := NewSuccessResponse(eList)
+		c.JSON(http.StatusOK, resp)
+	case "csv":
+		c.Header("Content-Disposition", "attachment; filename=sj.csv")
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		return WriteExportCSV(c.Writer, eList)
+	default:
+		m := fmt.Sprintf("Unknown export format %v", format)
+		return errors.New(m)
+	}
+
+	return nil
+}
+
+func ImportHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	eList, err := ParseImportRequest(c)
+	if err != nil {
+		return err
+	}
+
+	report, err := ImportExportListContext(ctx, app.DB, userID, eList)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(report)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func ImportFileHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	file, _, err := c.Request.FormFile("file")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	eList, err := ParseImportFile(c.Request.FormValue("format"), file)
+	if err != nil {
+		return err
+	}
+
+	preview, resolved, err := PreviewImportContext(ctx, app.DB, userID, eList)
+	if err != nil {
+		return err
+	}
+
+	dryRun, _ := strconv.ParseBool(c.Request.FormValue("dryrun"))
+	if dryRun {
+		resp := NewSuccessResponse(preview)
+		c.JSON(http.StatusOK, resp)
+		return nil
+	}
+
+	report, err := ImportExportListContext(ctx, app.DB, userID, resolved)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(struct {
+		Preview ImportPreview
+		Report  ImportReport
+	}{preview, report})
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func ChangePasswordHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseAccountRequest(c, []string{"NewPassword"})
+	if err != nil {
+		return err
+	}
+
+	err = checkPassword(ctx, app, userID, data.Password)
+	if err != nil {
+		return err
+	}
+
+	err = ValidatePassword(app.Specs, data.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	err = UpdateUserPasswordContext(ctx, app.DB, userID, data.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	// Other devices have to log in with the new password.
+	err = RemoveUserSessionsContext(ctx, app.DB, userID, currentSessionToken(c))
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func RenameUserHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseAccountRequest(c, []string{"Name"})
+	if err != nil {
+		return err
+	}
+
+	err = checkPassword(ctx, app, userID, data.Password)
+	if err != nil {
+		return err
+	}
+
+	err = ValidateUserName(data.Name)
+	if err != nil {
+		return err
+	}
+
+	other, err := FindUserByNameContext(ctx, app.DB, data.Name)
+	if err == nil && other.ID != userID {
+		m := fmt.Sprintf("User %v already exists", data.Name)
+		return errors.New(m)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	err = UpdateUserNameContext(ctx, app.DB, userID, data.Name)
+	if err != nil {
+		return err
+	}
+
+	u := User{
+		ID:   userID,
+		Name: data.Name,
+	}
+
+	resp := NewSuccessResponse(u)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func RemoveUserHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseAccountRequest(c, []string{})
+	if err != nil {
+		return err
+	}
+
+	err = checkPassword(ctx, app, userID, data.Password)
+	if err != nil {
+		return err
+	}
+
+	removed, err := RemoveUserContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	err = removeUnusedImages(ctx, app, removed)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func checkPassword(ctx context.Context, app AppCtx, userID int64, pass string) error {
+	user, err := ReadUserContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	if user.Password != NewSha512Password(pass) {
+		return errors.New("Wrong password")
+	}
+
+	return nil
+}
+
+func removeUnusedImages(ctx context.Context, app AppCtx, sList SeriesList) error {
+	for _, s := range sList {
+		count, err := CountSeriesWithImageContext(ctx, app.DB, s.Image)
+		if err != nil {
+			return err
+		}
+
+		if count == 0 {
+			removeImage(app.Specs.ImageDir, s.Image)
+		}
+	}
+
+	return nil
+}
+
+func NewInviteCodeHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	invite, err := NewInviteCodeContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(invite)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
@@ -2,6 +2,7 @@ package sj
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -68,19 +69,44 @@ func EqualResponse(expect interface{}, result *bytes.Buffer) error {
 	return nil
 }
 
+// eventRecorder keeps the emitted events.
+type eventRecorder struct {
+	events []Event
+}
+
+func (r *eventRecorder) Emit(ctx context.Context, e Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+// newSignedInServer registers the routes behind a session of the user and
+// returns the server together with the session token.
+func newSignedInServer(t *testing.T, app AppCtx, userID int64, routes func(*gin.RouterGroup, AppCtx, func(gin.HandlerFunc) gin.HandlerFunc)) (*gin.Engine, string) {
+	sessionStore := smem.NewStore()
+	session, err := sessionStore.NewSession(strconv.FormatInt(userID, 10), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := gin.New()
+	routes(srv.Group("/"), app, kauth.SignedIn(&sessionStore))
+
+	return srv, session.Token()
+}
+
 func Test_POST_User_OK(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	m := "SELECT ID,Name,Password FROM %v"
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v"
 	q := fmt.Sprintf(m, UserTable)
 	mock.ExpectQuery(q).WillReturnError(sql.ErrNoRows)
 
 	q = fmt.Sprintf("INSERT INTO %v", UserTable)
 	mock.ExpectExec(q).
-		WithArgs("devilXX", NewSha512Password("123")).
+		WithArgs("devilXX", NewSha512Password("123"), "").
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	app := AppCtx{
@@ -128,10 +154,13 @@ func Test_PATCH_SeriesList_OK(t *testing.T) {
 	userID := int64(1)
 	seriesID := int64(2)
 
+	mock.ExpectBegin()
 	q := fmt.Sprintf("INSERT INTO %v", SeriesListTable)
 	mock.ExpectExec(q).
 		WithArgs(userID, seriesID).
 		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncSeries, seriesID)
+	mock.ExpectCommit()
 
 	app := AppCtx{
 		DB: db,
@@ -185,17 +214,18 @@ func Test_ReadSeriesListHandler_OK(t *testing.T) {
 
 	userID := int64(1)
 	expect := SeriesList{
-		{0, "Mr. Robot", "robot.png"},
-		{1, "Narcos", "narcos.png"},
+		{0, "Mr. Robot", "robot.png", "A hacker joins fsociety."},
+		{1, "Narcos", "narcos.png", ""},
 	}
 
-	m := `SELECT series.ID as ID, series.Title as Title, series.Image as Image FROM %v as series, %v as list`
+	m := `SELECT series.ID as ID, series.Title as Title, series.Image as Image, series.Description as Description FROM %v as series, %v as list`
 	q := fmt.Sprintf(m, SeriesTable, SeriesListTable)
-	rows := sqlmock.NewRows([]string{"ID", "Title", "Image"})
+	rows := sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"})
 
 	for _, s := range expect {
-		rows.AddRow(s.ID, s.Title, s.Image)
+		rows.AddRow(s.ID, s.Title, s.Image, s.Description)
 	}
+	expectSyncState(mock, userID, 2, time.Now())
 	mock.ExpectQuery(q).WillReturnRows(rows)
 
 	app := AppCtx{
@@ -262,10 +292,13 @@ func Test_POST_UpdateLastWatched_OK(t *testing.T) {
 	lastSession := 3
 	lastEpisode := 4
 
+	mock.ExpectBegin()
 	q := fmt.Sprintf("REPLACE INTO %v", LastWatchedTable)
 	mock.ExpectExec(q).
 		WithArgs(userID, seriesID, lastSession, lastEpisode).
 		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncWatched, seriesID)
+	mock.ExpectCommit()
 
 	sessionStore := smem.NewStore()
 	expires := time.Now().Add(1 * time.Hour)
@@ -339,6 +372,7 @@ func Test_GET_LastWatchedList_OK(t *testing.T) {
 		rows.AddRow(s.SeriesID, s.Session, s.Episode)
 	}
 
+	expectSyncState(mock, userID, 2, time.Now())
 	mock.ExpectQuery(q).WillReturnRows(rows)
 	sessionStore := smem.NewStore()
 	expires := time.Now().Add(1 * time.Hour)
@@ -374,3 +408,239 @@ func Test_GET_LastWatchedList_OK(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func Test_POST_ChangePassword_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := int64(1)
+
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v"
+	q := fmt.Sprintf(m, UserTable)
+	rows := sqlmock.NewRows([]string{"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email"}).
+		AddRow(userID, "devilXX", NewSha512Password("123"), RoleUser, false, 0, nil, "")
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	q = fmt.Sprintf("UPDATE %v SET Password", UserTable)
+	mock.ExpectExec(q).
+		WithArgs(NewSha512Password("456"), userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	q = fmt.Sprintf("DELETE FROM %v WHERE User_ID = \\? AND Token_Hash <>", SessionTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	sessionStore := smem.NewStore()
+	expires := time.Now().Add(1 * time.Hour)
+	tmp := strconv.FormatInt(userID, 10)
+	session, err := sessionStore.NewSession(tmp, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	signedIn := kauth.SignedIn(&sessionStore)
+	h := NewAppHandler(app, ChangePasswordHandler)
+	srv.POST("/", signedIn(h))
+
+	body := `
+	{
+		"Data": {
+			"Password": "123",
+			"NewPassword": "456"
+		}
+	}
+	`
+
+	req := TestRequest{
+		Body:    body,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("POST", "/", session.Token())
+
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code)
+	}
+
+	expect := NewSuccessResponse("")
+	err = EqualResponse(expect, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_ChangePassword_WrongPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := int64(1)
+
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v"
+	q := fmt.Sprintf(m, UserTable)
+	rows := sqlmock.NewRows([]string{"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email"}).
+		AddRow(userID, "devilXX", NewSha512Password("123"), RoleUser, false, 0, nil, "")
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	sessionStore := smem.NewStore()
+	expires := time.Now().Add(1 * time.Hour)
+	tmp := strconv.FormatInt(userID, 10)
+	session, err := sessionStore.NewSession(tmp, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{
+		DB: db,
+	}
+	srv := gin.New()
+	signedIn := kauth.SignedIn(&sessionStore)
+	h := NewAppHandler(app, ChangePasswordHandler)
+	srv.POST("/", signedIn(h))
+
+	body := `
+	{
+		"Data": {
+			"Password": "wrong",
+			"NewPassword": "456"
+		}
+	}
+	`
+
+	req := TestRequest{
+		Body:    body,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("POST", "/", session.Token())
+
+	expect := NewFailResponse(errors.New("Wrong password"))
+	err = EqualResponse(expect, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_User_RegistrationClosed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{
+		Specs: Specs{
+			Registration: RegistrationClosed,
+		},
+		DB: db,
+	}
+	srv := gin.New()
+	srv.POST("/", NewAppHandler(app, NewUserHandler))
+
+	body := `
+	{
+		"Data": {
+			"Name": "devilXX",
+			"Password": "123"
+		}
+	}
+	`
+
+	req := TestRequest{
+		Body:    body,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.Send("POST", "/")
+
+	expect := NewFailResponse(ErrRegistrationClosed)
+	err = EqualResponse(expect, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_User_InviteCode_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := "abc"
+
+	q := fmt.Sprintf("SELECT Created_By, Used_By, Created FROM %v", InviteCodeTable)
+	rows := sqlmock.NewRows([]string{"Created_By", "Used_By", "Created"}).
+		AddRow(1, nil, time.Now())
+	mock.ExpectQuery(q).WithArgs(code).WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v", UserTable)
+	mock.ExpectQuery(q).WillReturnError(sql.ErrNoRows)
+
+	q = fmt.Sprintf("INSERT INTO %v", UserTable)
+	mock.ExpectExec(q).
+		WithArgs("devilXX", NewSha512Password("123"), "").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+
+	q = fmt.Sprintf("UPDATE %v SET Used_By", InviteCodeTable)
+	mock.ExpectExec(q).
+		WithArgs(2, code).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	app := AppCtx{
+		Specs: Specs{
+			Registration: RegistrationInvite,
+		},
+		DB: db,
+	}
+	srv := gin.New()
+	srv.POST("/", NewAppHandler(app, NewUserHandler))
+
+	body := `
+	{
+		"Data": {
+			"Name": "devilXX",
+			"Password": "123",
+			"InviteCode": "abc"
+		}
+	}
+	`
+
+	req := TestRequest{
+		Body:    body,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.Send("POST", "/")
+
+	expect := NewSuccessResponse(User{
+		ID:   2,
+		Name: "devilXX",
+	})
+	err = EqualResponse(expect, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
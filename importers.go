@@ -0,0 +1,295 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatTrakt  = "trakt"
+	FormatMAL    = "mal"
+	FormatTVTime = "tvtime"
+)
+
+type (
+	ImportMatch struct {
+		Title    string
+		SeriesID int64
+		Session  int
+		Episode  int
+	}
+
+	ImportConflict struct {
+		Title           string
+		SeriesID        int64
+		CurrentSession  int
+		CurrentEpisode  int
+		ImportedSession int
+		ImportedEpisode int
+	}
+
+	ImportPreview struct {
+		Matches   []ImportMatch
+		Conflicts []ImportConflict
+		Unmatched []string
+	}
+
+	traktShow struct {
+		Show struct {
+			Title string `json:"title"`
+		} `json:"show"`
+		Seasons []struct {
+			Number   int `json:"number"`
+			Episodes []struct {
+				Number int `json:"number"`
+			} `json:"episodes"`
+		} `json:"seasons"`
+	}
+
+	malExport struct {
+		Anime []struct {
+			Title   string `xml:"series_title"`
+			Watched int    `xml:"my_watched_episodes"`
+		} `xml:"anime"`
+	}
+)
+
+func ParseImportFile(format string, r io.Reader) (ExportList, error) {
+	switch format {
+	case FormatTrakt:
+		return ParseTraktExport(r)
+	case FormatMAL:
+		return ParseMALExport(r)
+	case FormatTVTime:
+		return ParseTVTimeExport(r)
+	}
+
+	m := fmt.Sprintf("Unknown import format %v", format)
+	return ExportList{}, errors.New(m)
+}
+
+// ParseTraktExport reads the watched shows (or watchlist) JSON export of
+// Trakt. The progress is the highest watched episode of every show.
+func ParseTraktExport(r io.Reader) (ExportList, error) {
+	shows := []traktShow{}
+	err := json.NewDecoder(r).Decode(&shows)
+	if err != nil {
+		return ExportList{}, err
+	}
+
+	p := newProgressList()
+	for _, s := range shows {
+		p.Add(s.Show.Title, 0, 0)
+		for _, season := range s.Seasons {
+			for _, e := range season.Episodes {
+				p.Add(s.Show.Title, season.Number, e.Number)
+			}
+		}
+	}
+
+	return p.List(), nil
+}
+
+// ParseMALExport reads the MyAnimeList XML export. MAL has no seasons so
+// every watched anime is on session 1.
+func ParseMALExport(r io.Reader) (ExportList, error) {
+	export := malExport{}
+	err := xml.NewDecoder(r).Decode(&export)
+	if err != nil {
+		return ExportList{}, err
+	}
+
+	p := newProgressList()
+	for _, a := range export.Anime {
+		if a.Watched > 0 {
+			p.Add(a.Title, 1, a.Watched)
+		} else {
+			p.Add(a.Title, 0, 0)
+		}
+	}
+
+	return p.List(), nil
+}
+
+// ParseTVTimeExport reads the seen_episode.csv (or followed_tv_show.csv)
+// file of a TV Time data export.
+func ParseTVTimeExport(r io.Reader) (ExportList, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return ExportList{}, err
+	}
+
+	if len(records) == 0 {
+		return ExportList{}, errors.New("Missing CSV header")
+	}
+
+	cols := map[string]int{}
+	for i, name := range records[0] {
+		cols[strings.TrimSpace(name)] = i
+	}
+
+	titleCol, ok := cols["tv_show_name"]
+	if !ok {
+		return ExportList{}, NewMissingFieldError("tv_show_name")
+	}
+	sessionCol, hasSession := cols["episode_season_number"]
+	episodeCol, hasEpisode := cols["episode_number"]
+
+	p := newProgressList()
+	for n, rec := range records[1:] {
+		if titleCol >= len(rec) {
+			continue
+		}
+		title := rec[titleCol]
+
+		if !hasSession || !hasEpisode ||
+			sessionCol >= len(rec) || episodeCol >= len(rec) {
+			p.Add(title, 0, 0)
+			continue
+		}
+
+		session, err := strconv.Atoi(strings.TrimSpace(rec[sessionCol]))
+		if err != nil {
+			m := fmt.Sprintf("Wrong value in episode_season_number in line %v", n+2)
+			return ExportList{}, errors.New(m)
+		}
+
+		episode, err := strconv.Atoi(strings.TrimSpace(rec[episodeCol]))
+		if err != nil {
+			m := fmt.Sprintf("Wrong value in episode_number in line %v", n+2)
+			return ExportList{}, errors.New(m)
+		}
+
+		p.Add(title, session, episode)
+	}
+
+	return p.List(), nil
+}
+
+// PreviewImport matches the entries against the catalog and the users
+// progress. It returns the report and the list which should be imported:
+// matched titles are replaced by the catalog title and conflicting entries
+// keep the progress the user already has.
+func PreviewImport(db *sql.DB, userID int64, eList ExportList) (ImportPreview, ExportList, error) {
+	return PreviewImportContext(context.Background(), db, userID, eList)
+}
+
+func PreviewImportContext(ctx context.Context, db *sql.DB, userID int64, eList ExportList) (ImportPreview, ExportList, error) {
+	preview := ImportPreview{
+		Matches:   []ImportMatch{},
+		Conflicts: []ImportConflict{},
+		Unmatched: []string{},
+	}
+
+	wList, err := ReadLastWatchedListContext(ctx, db, userID)
+	if err != nil {
+		return preview, ExportList{}, err
+	}
+
+	watched := map[int64]LastWatched{}
+	for _, w := range wList {
+		watched[w.SeriesID] = w
+	}
+
+	resolved := ExportList{}
+	for _, e := range eList {
+		s, err := FindSeriesBySearchTitleContext(ctx, db, e.Title)
+		if err == sql.ErrNoRows {
+			preview.Unmatched = append(preview.Unmatched, e.Title)
+			resolved = append(resolved, e)
+			continue
+		}
+		if err != nil {
+			return preview, ExportList{}, err
+		}
+
+		e.Title = s.Title
+
+		w, ok := watched[s.ID]
+		if ok && isBehind(e.Session, e.Episode, w.Session, w.Episode) {
+			preview.Conflicts = append(preview.Conflicts, ImportConflict{
+				Title:           s.Title,
+				SeriesID:        s.ID,
+				CurrentSession:  w.Session,
+				CurrentEpisode:  w.Episode,
+				ImportedSession: e.Session,
+				ImportedEpisode: e.Episode,
+			})
+			e.Session = 0
+			e.Episode = 0
+		} else {
+			preview.Matches = append(preview.Matches, ImportMatch{
+				Title:    s.Title,
+				SeriesID: s.ID,
+				Session:  e.Session,
+				Episode:  e.Episode,
+			})
+		}
+
+		resolved = append(resolved, e)
+	}
+
+	return preview, resolved, nil
+}
+
+func isBehind(session, episode, curSession, curEpisode int) bool {
+	if session != curSession {
+		return session < curSession
+	}
+
+	return episode < curEpisode
+}
+
+type progressList struct {
+	index map[string]int
+	list  ExportList
+}
+
+func newProgressList() *progressList {
+	return &progressList{
+		index: map[string]int{},
+		list:  ExportList{},
+	}
+}
+
+// Add records the episode for the title if it is further than the
+// progress seen so far.
+func (p *progressList) Add(title string, session, episode int) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return
+	}
+
+	i, ok := p.index[title]
+	if !ok {
+		p.index[title] = len(p.list)
+		p.list = append(p.list, ExportEntry{
+			Title:  title,
+			Status: StatusPlanned,
+		})
+		i = len(p.list) - 1
+	}
+
+	e := &p.list[i]
+	if session == 0 && episode == 0 {
+		return
+	}
+
+	if e.Status == StatusPlanned || isBehind(e.Session, e.Episode, session, episode) {
+		e.Session = session
+		e.Episode = episode
+		e.Status = StatusWatching
+	}
+}
+
+func (p *progressList) List() ExportList {
+	return p.list
+}
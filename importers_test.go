@@ -0,0 +1,161 @@
+package sj
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func Test_ParseTraktExport_OK(t *testing.T) {
+	data := `[
+		{
+			"show": {"title": "Breaking Bad", "ids": {"tvdb": 81189}},
+			"seasons": [
+				{"number": 1, "episodes": [{"number": 1}, {"number": 7}]},
+				{"number": 2, "episodes": [{"number": 3}]}
+			]
+		},
+		{"show": {"title": "Dark"}, "seasons": []}
+	]`
+
+	result, err := ParseImportFile(FormatTrakt, bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := ExportList{
+		{Title: "Breaking Bad", Status: StatusWatching, Session: 2, Episode: 3},
+		{Title: "Dark", Status: StatusPlanned},
+	}
+	if !reflect.DeepEqual(expect, result) {
+		t.Fatal("Expect", expect, "was", result)
+	}
+}
+
+func Test_ParseMALExport_OK(t *testing.T) {
+	data := `<?xml version="1.0" encoding="UTF-8" ?>
+	<myanimelist>
+		<anime>
+			<series_title><![CDATA[Cowboy Bebop]]></series_title>
+			<my_watched_episodes>26</my_watched_episodes>
+			<my_status>Completed</my_status>
+		</anime>
+		<anime>
+			<series_title><![CDATA[Monster]]></series_title>
+			<my_watched_episodes>0</my_watched_episodes>
+			<my_status>Plan to Watch</my_status>
+		</anime>
+	</myanimelist>`
+
+	result, err := ParseImportFile(FormatMAL, bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := ExportList{
+		{Title: "Cowboy Bebop", Status: StatusWatching, Session: 1, Episode: 26},
+		{Title: "Monster", Status: StatusPlanned},
+	}
+	if !reflect.DeepEqual(expect, result) {
+		t.Fatal("Expect", expect, "was", result)
+	}
+}
+
+func Test_ParseTVTimeExport_OK(t *testing.T) {
+	data := "tv_show_name,episode_season_number,episode_number,updated_at\n" +
+		"Dark,1,4,2018-01-01\n" +
+		"Dark,2,1,2018-02-01\n" +
+		"Dark,1,10,2018-01-05\n" +
+		"Narcos,1,2,2018-03-01\n"
+
+	result, err := ParseImportFile(FormatTVTime, bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := ExportList{
+		{Title: "Dark", Status: StatusWatching, Session: 2, Episode: 1},
+		{Title: "Narcos", Status: StatusWatching, Session: 1, Episode: 2},
+	}
+	if !reflect.DeepEqual(expect, result) {
+		t.Fatal("Expect", expect, "was", result)
+	}
+}
+
+func Test_ParseImportFile_UnknownFormat(t *testing.T) {
+	_, err := ParseImportFile("netflix", bytes.NewBufferString(""))
+	if err == nil {
+		t.Fatal("Expect error")
+	}
+}
+
+func Test_PreviewImport_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(1)
+
+	q := fmt.Sprintf("SELECT Series_ID, Session, Episode FROM %v", LastWatchedTable)
+	rows := sqlmock.NewRows([]string{"Series_ID", "Session", "Episode"}).
+		AddRow(5, 3, 1)
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT ID, Title, Image, Description FROM %v WHERE Search_Title = \\?", SeriesTable)
+	for _, s := range []Series{catalog[0], catalog[4]} {
+		rows = sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"}).
+			AddRow(s.ID, s.Title, s.Image, s.Description)
+		mock.ExpectQuery(q).WithArgs(FoldText(s.Title)).WillReturnRows(rows)
+	}
+	mock.ExpectQuery(q).WithArgs("babylon berlin").WillReturnError(sql.ErrNoRows)
+
+	eList := ExportList{
+		{Title: "Mr Robot", Status: StatusWatching, Session: 1, Episode: 2},
+		{Title: "DARK", Status: StatusWatching, Session: 2, Episode: 8},
+		{Title: "Babylon Berlin", Status: StatusPlanned},
+	}
+
+	preview, resolved, err := PreviewImport(db, userID, eList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := ImportPreview{
+		Matches: []ImportMatch{
+			{Title: "Mr. Robot", SeriesID: 1, Session: 1, Episode: 2},
+		},
+		Conflicts: []ImportConflict{
+			{
+				Title:           "Dark",
+				SeriesID:        5,
+				CurrentSession:  3,
+				CurrentEpisode:  1,
+				ImportedSession: 2,
+				ImportedEpisode: 8,
+			},
+		},
+		Unmatched: []string{"Babylon Berlin"},
+	}
+	if !reflect.DeepEqual(expect, preview) {
+		t.Fatal("Expect", expect, "was", preview)
+	}
+
+	expectList := ExportList{
+		{Title: "Mr. Robot", Status: StatusWatching, Session: 1, Episode: 2},
+		{Title: "Dark", Status: StatusWatching},
+		{Title: "Babylon Berlin", Status: StatusPlanned},
+	}
+	if !reflect.DeepEqual(expectList, resolved) {
+		t.Fatal("Expect", expectList, "was", resolved)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,149 @@
+package sj
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+
+	requestIDKey = "sj.requestid"
+
+	maxRequestIDLength = 64
+)
+
+// NewLogger returns a JSON logger which writes the records of level and
+// above to w. level is one of debug, info, warn or error.
+func NewLogger(w io.Writer, level string) (*slog.Logger, error) {
+	l := slog.LevelInfo
+	if level != "" {
+		err := l.UnmarshalText([]byte(level))
+		if err != nil {
+			m := fmt.Sprintf("Wrong log level %v", level)
+			return nil, errors.New(m)
+		}
+	}
+
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})
+	return slog.New(h), nil
+}
+
+// logger returns the logger of the app, apps without one log to the
+// default logger.
+func logger(app AppCtx) *slog.Logger {
+	if app.Logger == nil {
+		return slog.Default()
+	}
+
+	return app.Logger
+}
+
+// RequestLogger is a gin middleware which assigns every request an ID and
+// logs the request when it is done. An ID sent by a proxy in X-Request-ID
+// is reused, so the logs can be joined.
+func RequestLogger(app AppCtx) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.Request.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(RequestIDHeader, id)
+
+		c.Next()
+
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", loggedPath(c)),
+			slog.Int("status", c.Writer.Status()),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if userID, err := readSessionUserID(c); err == nil {
+			attrs = append(attrs, slog.Int64("user_id", userID))
+		}
+
+		logger(app).LogAttrs(c.Request.Context(), slog.LevelInfo, "request", attrs...)
+	}
+}
+
+// secretParams are the route parameters which carry credentials, like the
+// API token of the scrobble webhook.
+var secretParams = map[string]bool{
+	"token": true,
+}
+
+// loggedPath returns the path of the request with the values of the secret
+// parameters redacted.
+func loggedPath(c *gin.Context) string {
+	p := c.Request.URL.Path
+	for _, param := range c.Params {
+		if secretParams[param.Key] && param.Value != "" {
+			p = strings.Replace(p, param.Value, "REDACTED", 1)
+		}
+	}
+
+	return p
+}
+
+// logHandlerError logs an error which a handler returned to the client.
+func logHandlerError(app AppCtx, c *gin.Context, err error) {
+	attrs := []slog.Attr{
+		slog.String("request_id", requestID(c)),
+		slog.String("method", c.Request.Method),
+		slog.String("route", c.FullPath()),
+		slog.String("error", err.Error()),
+	}
+	if userID, err := readSessionUserID(c); err == nil {
+		attrs = append(attrs, slog.Int64("user_id", userID))
+	}
+
+	logger(app).LogAttrs(c.Request.Context(), slog.LevelError, "handler failed", attrs...)
+}
+
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// validRequestID only accepts short IDs of printable ASCII, so clients
+// can't inject anything into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	return strings.IndexFunc(id, func(r rune) bool {
+		return r <= ' ' || r > '~'
+	}) < 0
+}
+
+// logEventError is used by emit, the sinks fail after the change is done.
+func logEventError(ctx context.Context, app AppCtx, e Event, err error) {
+	logger(app).LogAttrs(ctx, slog.LevelError, "event sink failed",
+		slog.String("event", e.Type),
+		slog.Int64("user_id", e.UserID),
+		slog.String("error", err.Error()),
+	)
+}
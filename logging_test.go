@@ -0,0 +1,147 @@
+package sj
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_RequestLogger_HandlerError(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log, err := NewLogger(buf, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{Logger: log}
+	failing := func(app AppCtx, c *gin.Context) error {
+		return errors.New("Broken")
+	}
+
+	srv := gin.New()
+	srv.Use(RequestLogger(app))
+	srv.GET("/series/:id", NewAppHandler(app, failing))
+
+	req := TestRequest{
+		Handler: srv,
+	}
+	resp := req.Send("GET", "/series/1")
+
+	id := resp.Header().Get(RequestIDHeader)
+	if len(id) != 32 {
+		t.Fatal("Expect request id was", id)
+	}
+
+	expect := FailResponse{
+		Status:    "fail",
+		Err:       "Broken",
+		RequestID: id,
+	}
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Expect 2 log records was", lines)
+	}
+
+	record := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	if record["level"] != "ERROR" || record["request_id"] != id ||
+		record["route"] != "/series/:id" || record["error"] != "Broken" {
+		t.Fatal("Wrong error record", record)
+	}
+
+	record = map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	if record["msg"] != "request" || record["request_id"] != id || record["status"] != 200.0 {
+		t.Fatal("Wrong request record", record)
+	}
+}
+
+func Test_RequestLogger_RedactsToken(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log, err := NewLogger(buf, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{Logger: log}
+	ok := func(app AppCtx, c *gin.Context) error {
+		return nil
+	}
+
+	srv := gin.New()
+	srv.Use(RequestLogger(app))
+	srv.POST("/scrobble/:token", NewAppHandler(app, ok))
+
+	req := TestRequest{
+		Handler: srv,
+	}
+	req.Send("POST", "/scrobble/sj_secret")
+
+	if strings.Contains(buf.String(), "sj_secret") {
+		t.Fatal("Expect token to be redacted was", buf.String())
+	}
+
+	record := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	if record["path"] != "/scrobble/REDACTED" || record["route"] != "/scrobble/:token" {
+		t.Fatal("Wrong request record", record)
+	}
+}
+
+func Test_RequestLogger_RequestID(t *testing.T) {
+	log, err := NewLogger(&bytes.Buffer{}, "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := gin.New()
+	srv.Use(RequestLogger(AppCtx{Logger: log}))
+	srv.GET("/", func(c *gin.Context) {})
+
+	tests := []struct {
+		RequestID string
+		Reused    bool
+	}{
+		{"proxy-1234", true},
+		{"bad id\n", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, tc := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set(RequestIDHeader, tc.RequestID)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+
+		id := w.Header().Get(RequestIDHeader)
+		if (id == tc.RequestID) != tc.Reused || id == "" {
+			t.Fatal("Wrong request id", id, "for", tc.RequestID)
+		}
+	}
+}
+
+func Test_NewLogger_WrongLevel(t *testing.T) {
+	_, err := NewLogger(&bytes.Buffer{}, "loud")
+	if err == nil {
+		t.Fatal("Expect error")
+	}
+}
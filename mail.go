@@ -0,0 +1,138 @@
+package sj
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+var ErrMailHeader = errors.New("Line break in mail header")
+
+type (
+	Mail struct {
+		To      string
+		Subject string
+		Body    string
+	}
+
+	// Mailer sends the mails of the app, e.g. password resets.
+	Mailer interface {
+		Send(ctx context.Context, m Mail) error
+	}
+
+	// SMTPMailer sends the mails with the SMTP server at Addr. Username
+	// enables PLAIN auth, which net/smtp only allows with TLS or on
+	// localhost.
+	SMTPMailer struct {
+		Addr     string
+		Username string
+		Password string
+		From     string
+	}
+
+	// LogMailer only logs the mails, for setups without a mail server.
+	LogMailer struct {
+		Logger *slog.Logger
+	}
+)
+
+// NewMailer returns a SMTPMailer if SMTPAddr is set, a LogMailer otherwise.
+func NewMailer(specs Specs, logger *slog.Logger) Mailer {
+	if specs.SMTPAddr == "" {
+		return LogMailer{Logger: logger}
+	}
+
+	return SMTPMailer{
+		Addr:     specs.SMTPAddr,
+		Username: specs.SMTPUser,
+		Password: specs.SMTPPass,
+		From:     specs.MailFrom,
+	}
+}
+
+// ValidateEmail accepts a plain address without a display name.
+func ValidateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("Wrong value in Email")
+	}
+
+	return nil
+}
+
+func (s SMTPMailer) Send(ctx context.Context, m Mail) error {
+	msg, err := s.message(m, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	// net/smtp has no context, the send is abandoned when ctx is done.
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, msg)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s SMTPMailer) message(m Mail, now time.Time) ([]byte, error) {
+	for _, v := range []string{s.From, m.To, m.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, ErrMailHeader
+		}
+	}
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "From: %v\r\n", s.From)
+	fmt.Fprintf(&buf, "To: %v\r\n", m.To)
+	fmt.Fprintf(&buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %v\r\n", now.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+
+	return buf.Bytes(), nil
+}
+
+func (l LogMailer) Send(ctx context.Context, m Mail) error {
+	logger := l.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	// The body contains the links with the reset and verification tokens,
+	// so it is only logged for debugging.
+	logger.InfoContext(ctx, "mail",
+		slog.String("to", m.To),
+		slog.String("subject", m.Subject),
+	)
+	logger.DebugContext(ctx, "mail body",
+		slog.String("to", m.To),
+		slog.String("body", m.Body),
+	)
+
+	return nil
+}
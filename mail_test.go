@@ -0,0 +1,164 @@
+package sj
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+type (
+	// fakeSMTPServer accepts one mail and stores its data.
+	fakeSMTPServer struct {
+		ln   net.Listener
+		rcpt []string
+		data chan string
+	}
+
+	mailRecorder struct {
+		mails []Mail
+	}
+)
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSMTPServer{ln: ln, data: make(chan string, 1)}
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeSMTPServer) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(l string) {
+		conn.Write([]byte(l + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP fake")
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(l))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.rcpt = append(s.rcpt, strings.TrimSpace(l[8:]))
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			data := strings.Builder{}
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.data <- data.String()
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (m *mailRecorder) Send(ctx context.Context, mail Mail) error {
+	m.mails = append(m.mails, mail)
+	return nil
+}
+
+func Test_SMTPMailer_Send(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	defer srv.ln.Close()
+
+	mailer := SMTPMailer{
+		Addr: srv.ln.Addr().String(),
+		From: "sj@localhost",
+	}
+
+	m := Mail{
+		To:      "jane@example.com",
+		Subject: "Reset your sj password",
+		Body:    "Hello\nJane",
+	}
+	err := mailer.Send(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := <-srv.data
+	expect := []string{
+		"From: sj@localhost\r\n",
+		"To: jane@example.com\r\n",
+		"Subject: Reset your sj password\r\n",
+		"\r\n\r\nHello\r\nJane",
+	}
+	for _, e := range expect {
+		if !strings.Contains(data, e) {
+			t.Fatalf("Expect %q in %q", e, data)
+		}
+	}
+
+	if len(srv.rcpt) != 1 || srv.rcpt[0] != "<jane@example.com>" {
+		t.Fatal("Wrong recipients", srv.rcpt)
+	}
+}
+
+func Test_SMTPMailer_HeaderInjection(t *testing.T) {
+	mailer := SMTPMailer{From: "sj@localhost"}
+
+	m := Mail{
+		To:      "jane@example.com\r\nBcc: all@example.com",
+		Subject: "Hi",
+	}
+	err := mailer.Send(context.Background(), m)
+	if err != ErrMailHeader {
+		t.Fatal("Expect", ErrMailHeader, "was", err)
+	}
+}
+
+func Test_LogMailer_Send(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(buf, nil))
+	mailer := LogMailer{Logger: logger}
+
+	m := Mail{
+		To:      "jane@example.com",
+		Subject: "Reset your sj password",
+		Body:    "https://sj.example.com/#/password-reset?token=secret",
+	}
+	err := mailer.Send(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "jane@example.com") {
+		t.Fatal("Expect recipient in", buf.String())
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatal("Expect no token in", buf.String())
+	}
+}
@@ -0,0 +1,157 @@
+package sj
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	imageSaved  = "saved"
+	imageExists = "exists"
+	imageError  = "error"
+)
+
+type (
+	HealthCheckList map[string]string
+)
+
+var (
+	// metricsRegistry holds the metrics of the package. The collectors of an
+	// app, e.g. its DB pool, are added per MetricsRoutes call, so tests can
+	// create several apps.
+	metricsRegistry = prometheus.NewRegistry()
+
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "sj",
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of the HTTP requests by route and status.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"method", "route", "status"},
+	)
+
+	imageDownloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sj",
+			Name:      "image_downloads_total",
+			Help:      "Image downloads of SaveImage by result.",
+		},
+		[]string{"result"},
+	)
+
+	imageDownloadBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "sj",
+			Name:      "image_download_bytes_total",
+			Help:      "Bytes downloaded by SaveImage.",
+		},
+	)
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		httpRequestDuration,
+		imageDownloads,
+		imageDownloadBytes,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Metrics is a gin middleware which observes the latency of every request.
+// Requests without a matching route are counted as route "unmatched", so
+// scanners can't blow up the label set.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequestDuration.
+			WithLabelValues(c.Request.Method, route, status).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// MetricsRoutes registers /metrics, /healthz and /readyz. The endpoints are
+// not authenticated, the access to /metrics should be restricted by the
+// proxy.
+func MetricsRoutes(r *gin.RouterGroup, app AppCtx) {
+	dbRegistry := prometheus.NewRegistry()
+	dbRegistry.MustRegister(collectors.NewDBStatsCollector(app.DB, "sj"))
+
+	gatherers := prometheus.Gatherers{metricsRegistry, dbRegistry}
+	metrics := promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+
+	r.GET("/metrics", gin.WrapH(metrics))
+	r.GET("/healthz", HealthHandler)
+	r.GET("/readyz", NewAppHandler(app, ReadyHandler))
+}
+
+// HealthHandler only tells that the process is able to serve requests.
+func HealthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, NewSuccessResponse("ok"))
+}
+
+// ReadyHandler checks the dependencies of the app and responds with 503 if
+// one of them fails.
+func ReadyHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	checks := HealthCheckList{}
+	failed := []string{}
+
+	check := func(name string, err error) {
+		if err != nil {
+			checks[name] = err.Error()
+			failed = append(failed, fmt.Sprintf("%v: %v", name, err))
+			return
+		}
+		checks[name] = "ok"
+	}
+
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	check("db", app.DB.PingContext(ctx))
+	check("imagedir", checkWritableDir(app.Specs.ImageDir))
+
+	if len(failed) > 0 {
+		m := "Not ready, " + strings.Join(failed, ", ")
+		c.JSON(http.StatusServiceUnavailable, NewFailResponse(errors.New(m)))
+		return nil
+	}
+
+	c.JSON(http.StatusOK, NewSuccessResponse(checks))
+
+	return nil
+}
+
+func checkWritableDir(dir string) error {
+	if dir == "" {
+		return errors.New("Missing image dir")
+	}
+
+	f, err := ioutil.TempFile(dir, ".sj-ready")
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,121 @@
+package sj
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_GET_Metrics_OK(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := gin.New()
+	srv.Use(Metrics())
+	MetricsRoutes(srv.Group("/"), AppCtx{DB: db})
+
+	req := TestRequest{
+		Handler: srv,
+	}
+	req.Send("GET", "/healthz")
+	resp := req.Send("GET", "/metrics")
+
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code)
+	}
+
+	body := resp.Body.String()
+	expect := []string{
+		`sj_http_request_duration_seconds_count{method="GET",route="/healthz",status="200"}`,
+		"sj_image_download_bytes_total",
+		`go_sql_max_open_connections{db_name="sj"}`,
+	}
+	for _, e := range expect {
+		if !strings.Contains(body, e) {
+			t.Fatal("Expect", e, "in", body)
+		}
+	}
+}
+
+func Test_GET_Readyz_OK(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	imgDir, err := ioutil.TempDir("", "sj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(imgDir)
+
+	app := AppCtx{
+		DB:    db,
+		Specs: Specs{ImageDir: imgDir},
+	}
+	srv := gin.New()
+	MetricsRoutes(srv.Group("/"), app)
+
+	req := TestRequest{
+		Handler: srv,
+	}
+	resp := req.Send("GET", "/readyz")
+
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code)
+	}
+
+	expect := NewSuccessResponse(HealthCheckList{
+		"db":       "ok",
+		"imagedir": "ok",
+	})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(imgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatal("Expect empty image dir was", files)
+	}
+}
+
+func Test_GET_Readyz_Fail(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	app := AppCtx{
+		DB:    db,
+		Specs: Specs{ImageDir: "/does/not/exist"},
+	}
+	srv := gin.New()
+	MetricsRoutes(srv.Group("/"), app)
+
+	req := TestRequest{
+		Handler: srv,
+	}
+	resp := req.Send("GET", "/readyz")
+
+	if 503 != resp.Code {
+		t.Fatal("Expect 503 was", resp.Code)
+	}
+
+	body := resp.Body.String()
+	if !strings.Contains(body, "db: ") || !strings.Contains(body, "imagedir: ") {
+		t.Fatal("Expect failed checks in", body)
+	}
+}
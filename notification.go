@@ -0,0 +1,679 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	NotifyOff     = "off"
+	NotifyDigest  = "digest"
+	NotifyEpisode = "episode"
+
+	// Push services keep undelivered notifications for a day.
+	pushTTL = 24 * 60 * 60
+)
+
+var ErrPushNotConfigured = errors.New("Web push is not configured")
+
+type (
+	// NotificationPreference tells how the user is notified about new
+	// episodes. Episodes which aired until NotifiedUntil are done.
+	NotificationPreference struct {
+		UserID           int64
+		Mode             string
+		Email            bool
+		Push             bool
+		UnsubscribeToken string `json:"-"`
+		NotifiedUntil    time.Time
+	}
+
+	PushSubscription struct {
+		ID       int64
+		UserID   int64
+		Endpoint string
+		P256dh   string `json:"-"`
+		Auth     string `json:"-"`
+		Created  time.Time
+	}
+
+	PushSubscriptionList []PushSubscription
+
+	Notification struct {
+		User           User
+		Episodes       UpcomingEpisodeList
+		URL            string
+		UnsubscribeURL string
+	}
+
+	// Notifier is a channel which delivers the notifications.
+	Notifier interface {
+		Notify(ctx context.Context, n Notification) error
+	}
+
+	EmailNotifier struct {
+		Mailer Mailer
+	}
+
+	// WebPushNotifier sends the notifications to the push subscriptions of
+	// the user, signed with the VAPID keys (RFC 8292).
+	WebPushNotifier struct {
+		DB         *sql.DB
+		PublicKey  string
+		PrivateKey string
+		Subscriber string
+		Client     *http.Client
+	}
+
+	// NotificationScheduler notifies the users once a day about the
+	// episodes of their list which aired since the last run.
+	NotificationScheduler struct {
+		DB        *sql.DB
+		Email     Notifier
+		Push      Notifier
+		Interval  time.Duration
+		PublicURL string
+		Logger    *slog.Logger
+	}
+
+	pushPayload struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+		URL   string `json:"url"`
+	}
+)
+
+// NotificationRoutes registers the preferences, the push subscriptions
+// and the unsubscribe link, which works without a session.
+func NotificationRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	r.GET("/notifications/preferences", signedIn(NewAppHandler(app, ReadNotificationPreferenceHandler)))
+	r.POST("/notifications/preferences", signedIn(NewAppHandler(app, SaveNotificationPreferenceHandler)))
+	r.GET("/notifications/push/key", NewAppHandler(app, VAPIDKeyHandler))
+	r.POST("/notifications/push", signedIn(NewAppHandler(app, NewPushSubscriptionHandler)))
+	r.DELETE("/notifications/push/:id", signedIn(NewAppHandler(app, RemovePushSubscriptionHandler)))
+	r.POST("/notifications/unsubscribe/:token", NewAppHandler(app, UnsubscribeHandler))
+}
+
+func NewNotificationScheduler(app AppCtx) *NotificationScheduler {
+	s := &NotificationScheduler{
+		DB:        app.DB,
+		Email:     EmailNotifier{Mailer: app.Mailer},
+		Interval:  app.Specs.NotificationInterval,
+		PublicURL: app.Specs.PublicURL,
+		Logger:    logger(app),
+	}
+
+	if app.Specs.VAPIDPrivateKey != "" {
+		s.Push = WebPushNotifier{
+			DB:         app.DB,
+			PublicKey:  app.Specs.VAPIDPublicKey,
+			PrivateKey: app.Specs.VAPIDPrivateKey,
+			Subscriber: app.Specs.VAPIDSubject,
+			Client:     NewPublicClient(app.Specs.WebhookTimeout),
+		}
+	}
+
+	return s
+}
+
+func (s *NotificationScheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := s.RunDue(ctx, time.Now().UTC())
+		if err != nil {
+			s.Logger.Error("notification scheduler failed", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue notifies every user who wasn't notified today and returns the
+// number of sent notifications. Failing channels are logged, the day is
+// done anyway so nobody gets the same notification twice.
+func (s *NotificationScheduler) RunDue(ctx context.Context, now time.Time) (int, error) {
+	today := day(now)
+
+	pList, err := ReadDueNotificationPreferencesContext(ctx, s.DB, today)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, p := range pList {
+		// A failing user is retried on the next run, the others still
+		// get their notifications
+		user, err := ReadUserContext(ctx, s.DB, p.UserID)
+		if err != nil {
+			s.Logger.Error("reading user failed",
+				"user_id", p.UserID,
+				"error", err.Error(),
+			)
+			continue
+		}
+
+		from := p.NotifiedUntil.AddDate(0, 0, 1)
+		uList, err := ReadUpcomingEpisodesContext(ctx, s.DB, p.UserID, from, today.AddDate(0, 0, 1))
+		if err != nil {
+			s.Logger.Error("reading upcoming episodes failed",
+				"user_id", p.UserID,
+				"error", err.Error(),
+			)
+			continue
+		}
+
+		for _, n := range s.notifications(p, user, uList) {
+			for _, notifier := range s.channels(p, user) {
+				err := notifier.Notify(ctx, n)
+				if err != nil {
+					s.Logger.Warn("notification failed",
+						"user_id", p.UserID,
+						"error", err.Error(),
+					)
+					continue
+				}
+				sent++
+			}
+		}
+
+		err = UpdateNotifiedUntilContext(ctx, s.DB, p.UserID, today)
+		if err != nil {
+			s.Logger.Error("updating notified until failed",
+				"user_id", p.UserID,
+				"error", err.Error(),
+			)
+		}
+	}
+
+	return sent, nil
+}
+
+// notifications returns one notification per episode or a single digest.
+func (s *NotificationScheduler) notifications(p NotificationPreference, user User, uList UpcomingEpisodeList) []Notification {
+	if len(uList) == 0 {
+		return nil
+	}
+
+	base := strings.TrimSuffix(s.PublicURL, "/")
+	n := Notification{
+		User:           user,
+		URL:            base + "/",
+		UnsubscribeURL: base + "/#/unsubscribe?token=" + p.UnsubscribeToken,
+	}
+
+	if p.Mode == NotifyDigest {
+		n.Episodes = uList
+		return []Notification{n}
+	}
+
+	nList := []Notification{}
+	for _, u := range uList {
+		n.Episodes = UpcomingEpisodeList{u}
+		nList = append(nList, n)
+	}
+
+	return nList
+}
+
+func (s *NotificationScheduler) channels(p NotificationPreference, user User) []Notifier {
+	channels := []Notifier{}
+	if p.Email && user.Email != "" && s.Email != nil {
+		channels = append(channels, s.Email)
+	}
+	if p.Push && s.Push != nil {
+		channels = append(channels, s.Push)
+	}
+
+	return channels
+}
+
+func (n Notification) Title() string {
+	if len(n.Episodes) == 1 {
+		u := n.Episodes[0]
+		return fmt.Sprintf("New episode of %v", u.SeriesTitle)
+	}
+
+	return fmt.Sprintf("%v new episodes", len(n.Episodes))
+}
+
+func (n Notification) Lines() []string {
+	lines := []string{}
+	for _, u := range n.Episodes {
+		e := u.Episode
+		l := fmt.Sprintf("%v S%02dE%02d", u.SeriesTitle, e.Session, e.Episode)
+		if e.Title != "" {
+			l = fmt.Sprintf("%v - %v", l, e.Title)
+		}
+		lines = append(lines, l)
+	}
+
+	return lines
+}
+
+func (e EmailNotifier) Notify(ctx context.Context, n Notification) error {
+	body := fmt.Sprintf("Hello %v,\n\n%v\n\n%v\n\nUnsubscribe: %v\n",
+		n.User.Name, strings.Join(n.Lines(), "\n"), n.URL, n.UnsubscribeURL)
+
+	m := Mail{
+		To:      n.User.Email,
+		Subject: n.Title(),
+		Body:    body,
+	}
+
+	return e.Mailer.Send(ctx, m)
+}
+
+// Notify sends the notification to every subscription of the user.
+// Subscriptions which the push service doesn't know anymore are removed.
+func (w WebPushNotifier) Notify(ctx context.Context, n Notification) error {
+	sList, err := ReadPushSubscriptionListContext(ctx, w.DB, n.User.ID)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(pushPayload{
+		Title: n.Title(),
+		Body:  strings.Join(n.Lines(), "\n"),
+		URL:   n.URL,
+	})
+	if err != nil {
+		return err
+	}
+
+	opts := &webpush.Options{
+		HTTPClient:      w.Client,
+		Subscriber:      w.Subscriber,
+		VAPIDPublicKey:  w.PublicKey,
+		VAPIDPrivateKey: w.PrivateKey,
+		TTL:             pushTTL,
+	}
+
+	var lastErr error
+	for _, s := range sList {
+		sub := &webpush.Subscription{
+			Endpoint: s.Endpoint,
+			Keys:     webpush.Keys{P256dh: s.P256dh, Auth: s.Auth},
+		}
+
+		resp, err := webpush.SendNotificationWithContext(ctx, payload, sub, opts)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			_, err := RemovePushSubscriptionContext(ctx, w.DB, s.UserID, s.ID)
+			if err != nil {
+				lastErr = err
+			}
+		case resp.StatusCode >= 300:
+			lastErr = fmt.Errorf("Unexpected status %v", resp.Status)
+		}
+	}
+
+	return lastErr
+}
+
+func day(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func ReadNotificationPreference(db *sql.DB, userID int64) (NotificationPreference, error) {
+	return ReadNotificationPreferenceContext(context.Background(), db, userID)
+}
+
+func ReadNotificationPreferenceContext(ctx context.Context, db *sql.DB, userID int64) (NotificationPreference, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `SELECT User_ID, Mode, Email, Push, Unsubscribe_Token, Notified_Until
+	FROM %v WHERE User_ID = ?`
+	q := fmt.Sprintf(m, quote(NotificationPreferenceTable))
+
+	return scanNotificationPreference(dbQueryRow(ctx, db, q, userID))
+}
+
+// ReadDueNotificationPreferences returns the preferences of the users who
+// want notifications and weren't notified about today.
+func ReadDueNotificationPreferences(db *sql.DB, today time.Time) ([]NotificationPreference, error) {
+	return ReadDueNotificationPreferencesContext(context.Background(), db, today)
+}
+
+func ReadDueNotificationPreferencesContext(ctx context.Context, db *sql.DB, today time.Time) ([]NotificationPreference, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `SELECT User_ID, Mode, Email, Push, Unsubscribe_Token, Notified_Until
+	FROM %v WHERE Mode <> ? AND Notified_Until < ?
+	ORDER BY User_ID`
+	q := fmt.Sprintf(m, quote(NotificationPreferenceTable))
+	rows, err := dbQuery(ctx, db, q, NotifyOff, today)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pList := []NotificationPreference{}
+	for rows.Next() {
+		p, err := scanNotificationPreference(rows)
+		if err != nil {
+			return nil, err
+		}
+		pList = append(pList, p)
+	}
+
+	return pList, rows.Err()
+}
+
+func scanNotificationPreference(row scanner) (NotificationPreference, error) {
+	p := NotificationPreference{}
+	err := row.Scan(&p.UserID, &p.Mode, &p.Email, &p.Push, &p.UnsubscribeToken,
+		&p.NotifiedUntil)
+	if err != nil {
+		return NotificationPreference{}, err
+	}
+
+	return p, nil
+}
+
+func SaveNotificationPreference(db *sql.DB, p NotificationPreference) error {
+	return SaveNotificationPreferenceContext(context.Background(), db, p)
+}
+
+func SaveNotificationPreferenceContext(ctx context.Context, db *sql.DB, p NotificationPreference) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	q := dialect.Upsert(quote(NotificationPreferenceTable),
+		[]string{"User_ID"},
+		[]string{"Mode", "Email", "Push", "Unsubscribe_Token", "Notified_Until"},
+	)
+	_, err := dbExec(ctx, db, q, p.UserID, p.Mode, p.Email, p.Push,
+		p.UnsubscribeToken, p.NotifiedUntil)
+
+	return err
+}
+
+func UpdateNotifiedUntil(db *sql.DB, userID int64, until time.Time) error {
+	return UpdateNotifiedUntilContext(context.Background(), db, userID, until)
+}
+
+func UpdateNotifiedUntilContext(ctx context.Context, db *sql.DB, userID int64, until time.Time) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "UPDATE %v SET Notified_Until = ? WHERE User_ID = ?"
+	q := fmt.Sprintf(m, quote(NotificationPreferenceTable))
+	_, err := dbExec(ctx, db, q, until, userID)
+
+	return err
+}
+
+// Unsubscribe turns the notifications of the token off and returns false
+// if the token is unknown.
+func Unsubscribe(db *sql.DB, token string) (bool, error) {
+	return UnsubscribeContext(context.Background(), db, token)
+}
+
+func UnsubscribeContext(ctx context.Context, db *sql.DB, token string) (bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "UPDATE %v SET Mode = ? WHERE Unsubscribe_Token = ?"
+	q := fmt.Sprintf(m, quote(NotificationPreferenceTable))
+	rsrc, err := dbExec(ctx, db, q, NotifyOff, token)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := rsrc.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func NewPushSubscription(db *sql.DB, s PushSubscription) (int64, error) {
+	return NewPushSubscriptionContext(context.Background(), db, s)
+}
+
+func NewPushSubscriptionContext(ctx context.Context, db *sql.DB, s PushSubscription) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "INSERT INTO %v (User_ID,Endpoint,P256dh,Auth,Created) VALUES(?, ?, ?, ?, ?)"
+	q := fmt.Sprintf(m, quote(PushSubscriptionTable))
+	created := time.Now().UTC().Truncate(time.Second)
+
+	return dbInsertID(ctx, db, q, s.UserID, s.Endpoint, s.P256dh, s.Auth, created)
+}
+
+func ReadPushSubscriptionList(db *sql.DB, userID int64) (PushSubscriptionList, error) {
+	return ReadPushSubscriptionListContext(context.Background(), db, userID)
+}
+
+func ReadPushSubscriptionListContext(ctx context.Context, db *sql.DB, userID int64) (PushSubscriptionList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT ID, Endpoint, P256dh, Auth, Created FROM %v WHERE User_ID = ? ORDER BY ID"
+	q := fmt.Sprintf(m, quote(PushSubscriptionTable))
+	rows, err := dbQuery(ctx, db, q, userID)
+	if err != nil {
+		return PushSubscriptionList{}, err
+	}
+	defer rows.Close()
+
+	sList := PushSubscriptionList{}
+	for rows.Next() {
+		s := PushSubscription{UserID: userID}
+		err := rows.Scan(&s.ID, &s.Endpoint, &s.P256dh, &s.Auth, &s.Created)
+		if err != nil {
+			return PushSubscriptionList{}, err
+		}
+		sList = append(sList, s)
+	}
+
+	return sList, rows.Err()
+}
+
+func RemovePushSubscription(db *sql.DB, userID, id int64) (int64, error) {
+	return RemovePushSubscriptionContext(context.Background(), db, userID, id)
+}
+
+func RemovePushSubscriptionContext(ctx context.Context, db *sql.DB, userID, id int64) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "DELETE FROM %v WHERE ID = ? AND User_ID = ?"
+	q := fmt.Sprintf(s, quote(PushSubscriptionTable))
+	rsrc, err := dbExec(ctx, db, q, id, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return rsrc.RowsAffected()
+}
+
+// ReadNotificationPreferenceHandler responds with mode off for users who
+// never saved their preference.
+func ReadNotificationPreferenceHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	p, err := ReadNotificationPreferenceContext(ctx, app.DB, userID)
+	if err == sql.ErrNoRows {
+		p = NotificationPreference{UserID: userID, Mode: NotifyOff}
+	} else if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(p)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// SaveNotificationPreferenceHandler keeps the unsubscribe token and the
+// notified days, new preferences start with today so the user doesn't get
+// the whole past.
+func SaveNotificationPreferenceHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseNotificationPreferenceRequest(c)
+	if err != nil {
+		return err
+	}
+
+	p, err := ReadNotificationPreferenceContext(ctx, app.DB, userID)
+	if err == sql.ErrNoRows {
+		p = NotificationPreference{
+			UserID:        userID,
+			NotifiedUntil: day(time.Now()),
+		}
+		p.UnsubscribeToken, err = newSecretToken()
+	}
+	if err != nil {
+		return err
+	}
+
+	p.Mode = data.Mode
+	p.Email = data.Email
+	p.Push = data.Push
+
+	err = SaveNotificationPreferenceContext(ctx, app.DB, p)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(p)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// VAPIDKeyHandler responds with the public key which browsers need to
+// subscribe.
+func VAPIDKeyHandler(app AppCtx, c *gin.Context) error {
+	if app.Specs.VAPIDPublicKey == "" {
+		return ErrPushNotConfigured
+	}
+
+	resp := NewSuccessResponse(app.Specs.VAPIDPublicKey)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func NewPushSubscriptionHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	s, err := ParsePushSubscriptionRequest(c)
+	if err != nil {
+		return err
+	}
+	s.UserID = userID
+
+	// The push service is chosen by the browser, like webhooks it may
+	// not point into the network of the server
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return err
+	}
+	err = validatePublicURL(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	s.ID, err = NewPushSubscriptionContext(ctx, app.DB, s)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(s)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func RemovePushSubscriptionHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	affected, err := RemovePushSubscriptionContext(ctx, app.DB, userID, id)
+	if err != nil {
+		return err
+	}
+
+	if affected < 1 {
+		return errors.New("Cannot found push subscription")
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func UnsubscribeHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	ok, err := UnsubscribeContext(ctx, app.DB, c.Params.ByName("token"))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return nil
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
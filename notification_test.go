@@ -0,0 +1,344 @@
+package sj
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+	"github.com/tochti/smem"
+)
+
+var notificationPreferenceColumns = []string{
+	"User_ID", "Mode", "Email", "Push", "Unsubscribe_Token", "Notified_Until",
+}
+
+func Test_NotificationScheduler_RunDue_Digest(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Date(2016, 3, 3, 7, 30, 0, 0, time.UTC)
+	today := time.Date(2016, 3, 3, 0, 0, 0, 0, time.UTC)
+	notified := time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	q := fmt.Sprintf("FROM %v WHERE Mode <> \\? AND Notified_Until < \\?", NotificationPreferenceTable)
+	rows := sqlmock.NewRows(notificationPreferenceColumns).
+		AddRow(14, NotifyDigest, true, false, "unsub-token", notified)
+	mock.ExpectQuery(q).WithArgs(NotifyOff, today).WillReturnRows(rows)
+
+	q = fmt.Sprintf("FROM %v WHERE ID", UserTable)
+	rows = sqlmock.NewRows(userColumns).
+		AddRow(14, "jane", "hash", RoleUser, false, 0, nil, "jane@example.com")
+	mock.ExpectQuery(q).WithArgs(14).WillReturnRows(rows)
+
+	q = fmt.Sprintf("FROM %v as e", EpisodesTable)
+	rows = sqlmock.NewRows(upcomingColumns).
+		AddRow(7, 1, "eps2.0", 2, 1, notified.AddDate(0, 0, 1), "Mr. Robot").
+		AddRow(9, 2, "", 1, 5, today, "Westworld")
+	mock.ExpectQuery(q).
+		WithArgs(14, notified.AddDate(0, 0, 1), today.AddDate(0, 0, 1)).
+		WillReturnRows(rows)
+
+	q = fmt.Sprintf("UPDATE %v SET Notified_Until", NotificationPreferenceTable)
+	mock.ExpectExec(q).WithArgs(today, 14).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mailer := &mailRecorder{}
+	s := NotificationScheduler{
+		DB:        db,
+		Email:     EmailNotifier{Mailer: mailer},
+		PublicURL: "https://sj.example.com/",
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	sent, err := s.RunDue(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != 1 || len(mailer.mails) != 1 {
+		t.Fatal("Expect one digest was", sent, mailer.mails)
+	}
+
+	m := mailer.mails[0]
+	if m.To != "jane@example.com" || m.Subject != "2 new episodes" {
+		t.Fatal("Unexpected mail", m)
+	}
+
+	for _, s := range []string{
+		"Mr. Robot S02E01 - eps2.0\nWestworld S01E05\n",
+		"https://sj.example.com/#/unsubscribe?token=unsub-token",
+	} {
+		if !strings.Contains(m.Body, s) {
+			t.Fatalf("Expect %q in %v", s, m.Body)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_WebPushNotifier_Notify(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	received := make(chan *http.Request, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	private, public, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	p256dh := base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	authKey := base64.RawURLEncoding.EncodeToString(auth)
+
+	q := fmt.Sprintf("FROM %v WHERE User_ID", PushSubscriptionTable)
+	rows := sqlmock.NewRows([]string{"ID", "Endpoint", "P256dh", "Auth", "Created"}).
+		AddRow(1, srv.URL+"/ok", p256dh, authKey, time.Now()).
+		AddRow(2, srv.URL+"/gone", p256dh, authKey, time.Now())
+	mock.ExpectQuery(q).WithArgs(14).WillReturnRows(rows)
+
+	q = fmt.Sprintf("DELETE FROM %v WHERE ID", PushSubscriptionTable)
+	mock.ExpectExec(q).WithArgs(2, 14).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	n := WebPushNotifier{
+		DB:         db,
+		PublicKey:  public,
+		PrivateKey: private,
+		Subscriber: "mailto:admin@example.com",
+		Client:     srv.Client(),
+	}
+	err = n.Notify(context.Background(), Notification{
+		User: User{ID: 14},
+		Episodes: UpcomingEpisodeList{
+			{SeriesTitle: "Mr. Robot", Episode: Episode{Session: 2, Episode: 1}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		r := <-received
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "vapid ") {
+			t.Fatal("Expect VAPID authorization was", r.Header.Get("Authorization"))
+		}
+		if r.Header.Get("Content-Encoding") != "aes128gcm" {
+			t.Fatal("Expect encrypted payload was", r.Header.Get("Content-Encoding"))
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_NotificationPreferences_New(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+
+	q := fmt.Sprintf("FROM %v WHERE User_ID", NotificationPreferenceTable)
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnError(sql.ErrNoRows)
+
+	q = fmt.Sprintf("INTO %v", NotificationPreferenceTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, NotifyEpisode, true, false, sqlmock.AnyArg(), day(time.Now())).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	sessionStore := smem.NewStore()
+	session, err := sessionStore.NewSession(strconv.FormatInt(userID, 10), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{DB: db}
+	srv := gin.New()
+	NotificationRoutes(srv.Group("/"), app, kauth.SignedIn(&sessionStore))
+
+	req := TestRequest{
+		Body:    `{"Data": {"Mode": "episode", "Email": true, "Push": false}}`,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("POST", "/notifications/preferences", session.Token())
+
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `"Mode":"episode"`) {
+		t.Fatal("Unexpected response", resp.Code, resp.Body.String())
+	}
+
+	if strings.Contains(resp.Body.String(), "Unsubscribe") {
+		t.Fatal("Expect unsubscribe token to be hidden", resp.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_Unsubscribe(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("UPDATE %v SET Mode", NotificationPreferenceTable)
+	mock.ExpectExec(q).WithArgs(NotifyOff, "unsub-token").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q).WithArgs(NotifyOff, "unknown").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	app := AppCtx{DB: db}
+	srv := gin.New()
+	NotificationRoutes(srv.Group("/"), app, kauth.SignedIn(nil))
+
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+	}
+	resp := req.Send("POST", "/notifications/unsubscribe/unsub-token")
+	if err := EqualResponse(NewSuccessResponse(""), resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = req.Send("POST", "/notifications/unsubscribe/unknown")
+	if resp.Code != http.StatusNotFound {
+		t.Fatal("Expect 404 was", resp.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_NotificationScheduler_RunDue_SkipsFailingUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Date(2016, 3, 3, 7, 30, 0, 0, time.UTC)
+	today := time.Date(2016, 3, 3, 0, 0, 0, 0, time.UTC)
+	notified := time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	q := fmt.Sprintf("FROM %v WHERE Mode <> \\? AND Notified_Until < \\?", NotificationPreferenceTable)
+	rows := sqlmock.NewRows(notificationPreferenceColumns).
+		AddRow(13, NotifyDigest, true, false, "other-token", notified).
+		AddRow(14, NotifyDigest, true, false, "unsub-token", notified)
+	mock.ExpectQuery(q).WithArgs(NotifyOff, today).WillReturnRows(rows)
+
+	q = fmt.Sprintf("FROM %v WHERE ID", UserTable)
+	mock.ExpectQuery(q).WithArgs(13).WillReturnError(sql.ErrNoRows)
+
+	rows = sqlmock.NewRows(userColumns).
+		AddRow(14, "jane", "hash", RoleUser, false, 0, nil, "jane@example.com")
+	mock.ExpectQuery(q).WithArgs(14).WillReturnRows(rows)
+
+	q = fmt.Sprintf("FROM %v as e", EpisodesTable)
+	rows = sqlmock.NewRows(upcomingColumns).
+		AddRow(9, 2, "", 1, 5, today, "Westworld")
+	mock.ExpectQuery(q).
+		WithArgs(14, notified.AddDate(0, 0, 1), today.AddDate(0, 0, 1)).
+		WillReturnRows(rows)
+
+	q = fmt.Sprintf("UPDATE %v SET Notified_Until", NotificationPreferenceTable)
+	mock.ExpectExec(q).WithArgs(today, 14).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mailer := &mailRecorder{}
+	s := NotificationScheduler{
+		DB:        db,
+		Email:     EmailNotifier{Mailer: mailer},
+		PublicURL: "https://sj.example.com/",
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	sent, err := s.RunDue(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != 1 || len(mailer.mails) != 1 || mailer.mails[0].To != "jane@example.com" {
+		t.Fatal("Expect one mail to jane was", sent, mailer.mails)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_PushSubscription_PrivateAddress(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+
+	sessionStore := smem.NewStore()
+	session, err := sessionStore.NewSession(strconv.FormatInt(userID, 10), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{DB: db}
+	srv := gin.New()
+	NotificationRoutes(srv.Group("/"), app, kauth.SignedIn(&sessionStore))
+
+	req := TestRequest{
+		Body:    `{"Data": {"endpoint": "https://127.0.0.1/push", "keys": {"p256dh": "key", "auth": "auth"}}}`,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("POST", "/notifications/push", session.Token())
+
+	if err := EqualResponse(NewFailResponse(ErrPrivateAddress), resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
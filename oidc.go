@@ -0,0 +1,347 @@
+package sj
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookie    = "sj_oidc_state"
+	oidcNonceCookie    = "sj_oidc_nonce"
+	oidcVerifierCookie = "sj_oidc_verifier"
+
+	// The login at the provider has to be done within this time.
+	oidcCookieMaxAge = 10 * 60
+)
+
+var (
+	ErrOIDCState        = errors.New("Invalid OIDC state")
+	ErrOIDCNonce        = errors.New("Invalid OIDC nonce")
+	ErrOIDCNoAccount    = errors.New("No account is linked to this login")
+	ErrOIDCNameTaken    = errors.New("Name of the OIDC account is already taken")
+	ErrOIDCNotAvailable = errors.New("OIDC is not configured")
+
+	oidcNameRe = regexp.MustCompile(`[^a-zA-Z0-9._@-]+`)
+)
+
+type (
+	// OIDC is the login at an OpenID Connect provider with the
+	// authorization code flow and PKCE. Local password logins keep
+	// working next to it.
+	OIDC struct {
+		Provider *oidc.Provider
+		Verifier *oidc.IDTokenVerifier
+		Config   oauth2.Config
+		Issuer   string
+
+		AutoProvision bool
+		LinkByEmail   bool
+		Registration  string
+		PostLoginURL  string
+	}
+
+	OIDCClaims struct {
+		Subject           string `json:"sub"`
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+		Nonce             string `json:"nonce"`
+	}
+)
+
+// NewOIDC discovers the provider of OIDCIssuer. It returns
+// ErrOIDCNotAvailable if no issuer is configured.
+func NewOIDC(ctx context.Context, specs Specs) (*OIDC, error) {
+	if specs.OIDCIssuer == "" {
+		return nil, ErrOIDCNotAvailable
+	}
+
+	provider, err := oidc.NewProvider(ctx, specs.OIDCIssuer)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := specs.OIDCScopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+
+	o := &OIDC{
+		Provider: provider,
+		Verifier: provider.Verifier(&oidc.Config{ClientID: specs.OIDCClientID}),
+		Config: oauth2.Config{
+			ClientID:     specs.OIDCClientID,
+			ClientSecret: specs.OIDCClientSecret,
+			RedirectURL:  specs.OIDCRedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+		Issuer:        specs.OIDCIssuer,
+		AutoProvision: specs.OIDCAutoProvision,
+		LinkByEmail:   specs.OIDCLinkByEmail,
+		Registration:  registrationMode(specs),
+		PostLoginURL:  specs.OIDCPostLoginURL,
+	}
+
+	return o, nil
+}
+
+// OIDCRoutes registers the login and the callback of the provider.
+func OIDCRoutes(r *gin.RouterGroup, app AppCtx, o *OIDC, sessionStore kauth.SessionStore) {
+	r.GET("/oidc/login", o.LoginHandler)
+	r.GET("/oidc/callback", NewAppHandler(app, o.NewCallbackHandler(sessionStore)))
+}
+
+// LoginHandler redirects to the provider. state, nonce and the PKCE
+// verifier are kept in short-lived cookies until the callback.
+func (o *OIDC) LoginHandler(c *gin.Context) {
+	state, err := newSecretToken()
+	if err != nil {
+		c.JSON(http.StatusOK, NewFailResponse(err))
+		return
+	}
+	nonce, err := newSecretToken()
+	if err != nil {
+		c.JSON(http.StatusOK, NewFailResponse(err))
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	setOIDCCookie(c, oidcStateCookie, state, oidcCookieMaxAge)
+	setOIDCCookie(c, oidcNonceCookie, nonce, oidcCookieMaxAge)
+	setOIDCCookie(c, oidcVerifierCookie, verifier, oidcCookieMaxAge)
+
+	u := o.Config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	c.Redirect(http.StatusFound, u)
+}
+
+// NewCallbackHandler returns the handler which exchanges the code of the
+// provider, finds or provisions the user and creates the session.
+func (o *OIDC) NewCallbackHandler(sessionStore kauth.SessionStore) AppHandler {
+	return func(app AppCtx, c *gin.Context) error {
+		ctx := requestContext(app, c)
+
+		state, _ := c.Cookie(oidcStateCookie)
+		nonce, _ := c.Cookie(oidcNonceCookie)
+		verifier, _ := c.Cookie(oidcVerifierCookie)
+		for _, name := range []string{oidcStateCookie, oidcNonceCookie, oidcVerifierCookie} {
+			setOIDCCookie(c, name, "", -1)
+		}
+
+		if !equalSecret(state, c.Query("state")) {
+			return ErrOIDCState
+		}
+
+		if e := c.Query("error"); e != "" {
+			m := fmt.Sprintf("OIDC login failed, %v", e)
+			return errors.New(m)
+		}
+
+		token, err := o.Config.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(verifier))
+		if err != nil {
+			return err
+		}
+
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			return errors.New("Missing id_token")
+		}
+
+		idToken, err := o.Verifier.Verify(ctx, rawIDToken)
+		if err != nil {
+			return err
+		}
+
+		claims := OIDCClaims{}
+		err = idToken.Claims(&claims)
+		if err != nil {
+			return err
+		}
+
+		if !equalSecret(nonce, claims.Nonce) {
+			return ErrOIDCNonce
+		}
+
+		user, err := o.findOrProvisionUser(ctx, app.DB, claims)
+		if err != nil {
+			return err
+		}
+
+		if user.Disabled {
+			return ErrUserDisabled
+		}
+
+		expires := time.Now().Add(app.Specs.SessionTTL)
+		session, err := newSession(sessionStore, fmt.Sprint(user.ID), expires, c)
+		if err != nil {
+			return err
+		}
+
+		maxAge := int(app.Specs.SessionTTL.Seconds())
+		secure := c.Request.TLS != nil
+		c.SetCookie(xsrfCookie, session.Token(), maxAge, "/", "", secure, false)
+
+		target := o.PostLoginURL
+		if target == "" {
+			target = "/"
+		}
+		c.Redirect(http.StatusFound, target)
+
+		return nil
+	}
+}
+
+// findOrProvisionUser returns the user linked to the subject. Unknown
+// subjects are linked to the only enabled user with the verified email if
+// LinkByEmail is set, or get a new user if AutoProvision is set and the
+// registration is open.
+func (o *OIDC) findOrProvisionUser(ctx context.Context, db *sql.DB, claims OIDCClaims) (User, error) {
+	userID, err := FindOIDCIdentityUserContext(ctx, db, o.Issuer, claims.Subject)
+	if err == nil {
+		return ReadUserContext(ctx, db, userID)
+	}
+	if err != sql.ErrNoRows {
+		return User{}, err
+	}
+
+	if o.LinkByEmail && claims.Email != "" && claims.EmailVerified {
+		// Stored emails are verified, see ChangeEmailHandler
+		users, err := FindUsersByEmailContext(ctx, db, claims.Email)
+		if err != nil {
+			return User{}, err
+		}
+
+		enabled := UserList{}
+		for _, u := range users {
+			if !u.Disabled {
+				enabled = append(enabled, u)
+			}
+		}
+
+		if len(enabled) == 1 {
+			user := enabled[0]
+			err = NewOIDCIdentityContext(ctx, db, user.ID, o.Issuer, claims.Subject, claims.Email)
+			return user, err
+		}
+	}
+
+	if !o.AutoProvision {
+		return User{}, ErrOIDCNoAccount
+	}
+
+	if o.Registration != RegistrationOpen {
+		return User{}, ErrRegistrationClosed
+	}
+
+	name := oidcUserName(claims)
+	_, err = FindUserByNameContext(ctx, db, name)
+	if err == nil {
+		return User{}, ErrOIDCNameTaken
+	}
+	if err != sql.ErrNoRows {
+		return User{}, err
+	}
+
+	// The password is random, the user can only log in at the provider
+	// until an admin sets one.
+	pass, err := newSecretToken()
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{Name: name, Password: pass, Role: RoleUser}
+	if claims.EmailVerified {
+		user.Email = claims.Email
+	}
+	user.ID, err = NewUserContext(ctx, db, user)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = NewOIDCIdentityContext(ctx, db, user.ID, o.Issuer, claims.Subject, claims.Email)
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func oidcUserName(claims OIDCClaims) string {
+	name := claims.PreferredUsername
+	if name == "" {
+		name = claims.Email
+	}
+	if name == "" {
+		name = claims.Subject
+	}
+
+	return oidcNameRe.ReplaceAllString(strings.TrimSpace(name), "_")
+}
+
+func FindOIDCIdentityUser(db *sql.DB, issuer, subject string) (int64, error) {
+	return FindOIDCIdentityUserContext(context.Background(), db, issuer, subject)
+}
+
+func FindOIDCIdentityUserContext(ctx context.Context, db *sql.DB, issuer, subject string) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT User_ID FROM %v WHERE Issuer = ? AND Subject = ?"
+	q := fmt.Sprintf(m, quote(UserIdentityTable))
+
+	var userID int64
+	err := dbQueryRow(ctx, db, q, issuer, subject).Scan(&userID)
+	if err != nil {
+		return -1, err
+	}
+
+	return userID, nil
+}
+
+func NewOIDCIdentity(db *sql.DB, userID int64, issuer, subject, email string) error {
+	return NewOIDCIdentityContext(context.Background(), db, userID, issuer, subject, email)
+}
+
+func NewOIDCIdentityContext(ctx context.Context, db *sql.DB, userID int64, issuer, subject, email string) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "INSERT INTO %v (Issuer,Subject,User_ID,Email,Created) VALUES(?, ?, ?, ?, ?)"
+	q := fmt.Sprintf(m, quote(UserIdentityTable))
+	created := time.Now().UTC().Truncate(time.Second)
+	_, err := dbExec(ctx, db, q, issuer, subject, userID, email, created)
+
+	return err
+}
+
+func equalSecret(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func setOIDCCookie(c *gin.Context, name, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   c.Request.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
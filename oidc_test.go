@@ -0,0 +1,294 @@
+package sj
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/smem"
+)
+
+// fakeOIDCProvider is a minimal OpenID Connect provider which issues an
+// id_token for the code "good-code".
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	nonce    string
+	subject  string
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakeOIDCProvider{key: key, clientID: "sj", subject: "user-1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/keys", p.keys)
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+
+	return p
+}
+
+func (p *fakeOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/auth",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *fakeOIDCProvider) keys(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *fakeOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("code") != "good-code" || r.Form.Get("code_verifier") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	idToken := p.sign(map[string]interface{}{
+		"iss":                p.URL,
+		"sub":                p.subject,
+		"aud":                p.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"nonce":              p.nonce,
+		"email":              "jane@example.com",
+		"email_verified":     true,
+		"preferred_username": "jane",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func (p *fakeOIDCProvider) sign(claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	head := enc(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	body := enc(claims)
+	sum := sha256.Sum256([]byte(head + "." + body))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+
+	return head + "." + body + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func Test_OIDC_LoginProvisionsUser(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	specs := Specs{
+		SessionTTL:        time.Hour,
+		OIDCIssuer:        provider.URL,
+		OIDCClientID:      provider.clientID,
+		OIDCRedirectURL:   "http://sj/oidc/callback",
+		OIDCAutoProvision: true,
+	}
+	o, err := NewOIDC(context.Background(), specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionStore := smem.NewStore()
+	srv := gin.New()
+	OIDCRoutes(srv.Group("/"), AppCtx{DB: db, Specs: specs}, o, &sessionStore)
+
+	resp := httptest.NewRecorder()
+	srv.ServeHTTP(resp, httptest.NewRequest("GET", "/oidc/login", nil))
+	if 302 != resp.Code {
+		t.Fatal("Expect 302 was", resp.Code)
+	}
+
+	loc, err := url.Parse(resp.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(loc.String(), provider.URL+"/auth") ||
+		loc.Query().Get("code_challenge_method") != "S256" {
+		t.Fatal("Wrong redirect", loc)
+	}
+	provider.nonce = loc.Query().Get("nonce")
+
+	q := fmt.Sprintf("SELECT User_ID FROM %v WHERE Issuer", UserIdentityTable)
+	mock.ExpectQuery(q).WithArgs(provider.URL, "user-1").WillReturnError(sql.ErrNoRows)
+
+	q = fmt.Sprintf("SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v", UserTable)
+	mock.ExpectQuery(q).WithArgs("jane").WillReturnError(sql.ErrNoRows)
+
+	q = fmt.Sprintf("INSERT INTO %v", UserTable)
+	mock.ExpectExec(q).
+		WithArgs("jane", sqlmock.AnyArg(), "jane@example.com").
+		WillReturnResult(sqlmock.NewResult(7, 1))
+
+	q = fmt.Sprintf("INSERT INTO %v", UserIdentityTable)
+	mock.ExpectExec(q).
+		WithArgs(provider.URL, "user-1", 7, "jane@example.com", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	callback := "/oidc/callback?code=good-code&state=" + loc.Query().Get("state")
+	req := httptest.NewRequest("GET", callback, nil)
+	for _, cookie := range resp.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	resp = httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+
+	if 302 != resp.Code || resp.Header().Get("Location") != "/" {
+		t.Fatal("Expect redirect to / was", resp.Code, resp.Body.String())
+	}
+
+	var token string
+	for _, cookie := range resp.Result().Cookies() {
+		if cookie.Name == xsrfCookie {
+			token = cookie.Value
+		}
+	}
+
+	session, ok := sessionStore.ReadSession(token)
+	if !ok || session.UserID() != "7" {
+		t.Fatal("Expect session of user 7 was", session)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_OIDC_WrongState(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	specs := Specs{
+		OIDCIssuer:   provider.URL,
+		OIDCClientID: provider.clientID,
+	}
+	o, err := NewOIDC(context.Background(), specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionStore := smem.NewStore()
+	srv := gin.New()
+	OIDCRoutes(srv.Group("/"), AppCtx{Specs: specs}, o, &sessionStore)
+
+	req := httptest.NewRequest("GET", "/oidc/callback?code=good-code&state=forged", nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: "expected"})
+	resp := httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+
+	if err := EqualResponse(NewFailResponse(ErrOIDCState), resp.Body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_OIDC_LinkByVerifiedEmail(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	o := &OIDC{Issuer: "https://idp", LinkByEmail: true, Registration: RegistrationOpen}
+	claims := OIDCClaims{Subject: "user-1", Email: "jane@example.com", EmailVerified: true}
+
+	q := fmt.Sprintf("SELECT User_ID FROM %v WHERE Issuer", UserIdentityTable)
+	mock.ExpectQuery(q).WithArgs("https://idp", "user-1").WillReturnError(sql.ErrNoRows)
+
+	q = fmt.Sprintf("SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v WHERE Email", UserTable)
+	rows := sqlmock.NewRows(userColumns).
+		AddRow(14, "jane", "hash", RoleUser, false, 0, nil, "jane@example.com").
+		AddRow(15, "spammer", "hash", RoleUser, true, 0, nil, "jane@example.com")
+	mock.ExpectQuery(q).WithArgs("jane@example.com").WillReturnRows(rows)
+
+	q = fmt.Sprintf("INSERT INTO %v", UserIdentityTable)
+	mock.ExpectExec(q).
+		WithArgs("https://idp", "user-1", 14, "jane@example.com", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	user, err := o.findOrProvisionUser(context.Background(), db, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.ID != 14 {
+		t.Fatal("Expect user 14 was", user)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_OIDC_ProvisionRegistrationClosed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	o := &OIDC{Issuer: "https://idp", AutoProvision: true, Registration: RegistrationInvite}
+	claims := OIDCClaims{Subject: "user-1", PreferredUsername: "jane"}
+
+	q := fmt.Sprintf("SELECT User_ID FROM %v WHERE Issuer", UserIdentityTable)
+	mock.ExpectQuery(q).WithArgs("https://idp", "user-1").WillReturnError(sql.ErrNoRows)
+
+	_, err = o.findOrProvisionUser(context.Background(), db, claims)
+	if err != ErrRegistrationClosed {
+		t.Fatal("Expect", ErrRegistrationClosed, "was", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,421 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrInvalidResetToken  = errors.New("Invalid or expired reset token")
+	ErrInvalidVerifyToken = errors.New("Invalid or expired verification token")
+)
+
+const passwordResetMail = `Hello %v,
+
+somebody asked to reset the password of your sj account. Open the link
+to choose a new password, it is valid until %v:
+
+%v
+
+If it wasn't you, just ignore this mail.
+`
+
+const emailVerificationMail = `Hello %v,
+
+please confirm that this is the email of your sj account. Open the link,
+it is valid until %v:
+
+%v
+
+If it wasn't you, just ignore this mail.
+`
+
+// PasswordResetRoutes registers the endpoints to reset a forgotten
+// password and to verify an email. All are rate limited per IP like the
+// login.
+func PasswordResetRoutes(r *gin.RouterGroup, app AppCtx) {
+	limit := LoginRateLimit(app)
+	r.POST("/password-reset/request", limit, NewAppHandler(app, RequestPasswordResetHandler))
+	r.POST("/password-reset", limit, NewAppHandler(app, ResetForgottenPasswordHandler))
+	r.POST("/email-verification", limit, NewAppHandler(app, VerifyEmailHandler))
+}
+
+func FindUsersByEmail(db *sql.DB, email string) (UserList, error) {
+	return FindUsersByEmailContext(context.Background(), db, email)
+}
+
+func FindUsersByEmailContext(ctx context.Context, db *sql.DB, email string) (UserList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v WHERE Email = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+	rows, err := dbQuery(ctx, db, q, email)
+	if err != nil {
+		return UserList{}, err
+	}
+	defer rows.Close()
+
+	uList := UserList{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return UserList{}, err
+		}
+		uList = append(uList, user)
+	}
+
+	return uList, rows.Err()
+}
+
+func UpdateUserEmail(db *sql.DB, userID int64, email string) error {
+	return UpdateUserEmailContext(context.Background(), db, userID, email)
+}
+
+func UpdateUserEmailContext(ctx context.Context, db querier, userID int64, email string) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "UPDATE %v SET Email = ? WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+	_, err := dbExec(ctx, db, q, email, userID)
+
+	return err
+}
+
+// NewPasswordReset returns a single-use token to reset the password of
+// the user. Only its hash is stored.
+func NewPasswordReset(db *sql.DB, userID int64, expires time.Time) (string, error) {
+	return NewPasswordResetContext(context.Background(), db, userID, expires)
+}
+
+func NewPasswordResetContext(ctx context.Context, db *sql.DB, userID int64, expires time.Time) (string, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	token, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	m := "INSERT INTO %v (Token_Hash,User_ID,Expires,Created) VALUES(?, ?, ?, ?)"
+	q := fmt.Sprintf(m, quote(PasswordResetTable))
+	created := time.Now().UTC().Truncate(time.Second)
+	_, err = dbExec(ctx, db, q, HashAPIToken(token), userID,
+		expires.UTC().Truncate(time.Second), created)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// UsePasswordReset sets the new password of the user of the token. The
+// token and all other tokens of the user are removed, the account is
+// unlocked and all sessions of the user are revoked.
+func UsePasswordReset(db *sql.DB, token, pass string, now time.Time) (int64, error) {
+	return UsePasswordResetContext(context.Background(), db, token, pass, now)
+}
+
+func UsePasswordResetContext(ctx context.Context, db *sql.DB, token, pass string, now time.Time) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	m := "SELECT User_ID FROM %v WHERE Token_Hash = ? AND Expires > ?"
+	q := fmt.Sprintf(m, quote(PasswordResetTable))
+
+	var userID int64
+	err = dbQueryRow(ctx, tx, q, HashAPIToken(token), now).Scan(&userID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return -1, ErrInvalidResetToken
+	}
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	// The delete decides which of two concurrent resets wins.
+	m = "DELETE FROM %v WHERE Token_Hash = ?"
+	q = fmt.Sprintf(m, quote(PasswordResetTable))
+	rsrc, err := dbExec(ctx, tx, q, HashAPIToken(token))
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	if affected, err := rsrc.RowsAffected(); err != nil || affected != 1 {
+		tx.Rollback()
+		return -1, ErrInvalidResetToken
+	}
+
+	m = "UPDATE %v SET Password = ?, Failed_Logins = 0, Locked_Until = NULL WHERE ID = ?"
+	q = fmt.Sprintf(m, quote(UserTable))
+	_, err = dbExec(ctx, tx, q, NewSha512Password(pass), userID)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	for _, table := range []string{PasswordResetTable, SessionTable} {
+		q := fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(table))
+		_, err = dbExec(ctx, tx, q, userID)
+		if err != nil {
+			tx.Rollback()
+			return -1, err
+		}
+	}
+
+	return userID, tx.Commit()
+}
+
+// NewEmailVerification returns a single-use token which sets the email of
+// the user once it is used. Only its hash is stored.
+func NewEmailVerification(db *sql.DB, userID int64, email string, expires time.Time) (string, error) {
+	return NewEmailVerificationContext(context.Background(), db, userID, email, expires)
+}
+
+func NewEmailVerificationContext(ctx context.Context, db *sql.DB, userID int64, email string, expires time.Time) (string, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	token, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	m := "INSERT INTO %v (Token_Hash,User_ID,Email,Expires,Created) VALUES(?, ?, ?, ?, ?)"
+	q := fmt.Sprintf(m, quote(EmailVerificationTable))
+	created := time.Now().UTC().Truncate(time.Second)
+	_, err = dbExec(ctx, db, q, HashAPIToken(token), userID, email,
+		expires.UTC().Truncate(time.Second), created)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// UseEmailVerification sets the email of the token as email of its user.
+// All pending verifications of the user are removed.
+func UseEmailVerification(db *sql.DB, token string, now time.Time) (int64, error) {
+	return UseEmailVerificationContext(context.Background(), db, token, now)
+}
+
+func UseEmailVerificationContext(ctx context.Context, db *sql.DB, token string, now time.Time) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	m := "SELECT User_ID, Email FROM %v WHERE Token_Hash = ? AND Expires > ?"
+	q := fmt.Sprintf(m, quote(EmailVerificationTable))
+
+	var userID int64
+	var email string
+	err = dbQueryRow(ctx, tx, q, HashAPIToken(token), now).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return -1, ErrInvalidVerifyToken
+	}
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	m = "DELETE FROM %v WHERE User_ID = ?"
+	q = fmt.Sprintf(m, quote(EmailVerificationTable))
+	_, err = dbExec(ctx, tx, q, userID)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	err = UpdateUserEmailContext(ctx, tx, userID, email)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// RequestPasswordResetHandler mails a reset link to every enabled user with
+// the email. It always succeeds, so it can't be used to find accounts.
+func RequestPasswordResetHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	email, err := ParsePasswordResetRequest(c)
+	if err != nil {
+		return err
+	}
+
+	uList, err := FindUsersByEmailContext(ctx, app.DB, email)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(app.Specs.PasswordResetTTL)
+	for _, user := range uList {
+		if user.Disabled {
+			continue
+		}
+
+		token, err := NewPasswordResetContext(ctx, app.DB, user.ID, expires)
+		if err != nil {
+			return err
+		}
+
+		link := strings.TrimSuffix(app.Specs.PublicURL, "/") + "/#/password-reset?token=" + token
+		m := Mail{
+			To:      user.Email,
+			Subject: "Reset your sj password",
+			Body:    fmt.Sprintf(passwordResetMail, user.Name, expires.UTC().Format(time.RFC1123), link),
+		}
+
+		// A broken mailer must not tell which emails exist.
+		if err := sendMail(ctx, app, m); err != nil {
+			logger(app).ErrorContext(ctx, "password reset mail failed",
+				"request_id", requestID(c),
+				"user_id", user.ID,
+				"error", err.Error(),
+			)
+		}
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func ResetForgottenPasswordHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	token, pass, err := ParsePasswordResetData(c)
+	if err != nil {
+		return err
+	}
+
+	err = ValidatePassword(app.Specs, pass)
+	if err != nil {
+		return err
+	}
+
+	_, err = UsePasswordResetContext(ctx, app.DB, token, pass, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// ChangeEmailHandler mails a verification link to the new email, it is
+// set once the link was opened. An empty email removes the email at once.
+func ChangeEmailHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseAccountRequest(c, []string{"Email"})
+	if err != nil {
+		return err
+	}
+
+	err = checkPassword(ctx, app, userID, data.Password)
+	if err != nil {
+		return err
+	}
+
+	if data.Email == "" {
+		err = UpdateUserEmailContext(ctx, app.DB, userID, "")
+	} else {
+		err = ValidateEmail(data.Email)
+		if err != nil {
+			return err
+		}
+
+		var user User
+		user, err = ReadUserContext(ctx, app.DB, userID)
+		if err != nil {
+			return err
+		}
+
+		err = sendEmailVerification(ctx, app, user, data.Email)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func VerifyEmailHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	token, err := ParseEmailVerificationRequest(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = UseEmailVerificationContext(ctx, app.DB, token, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// sendEmailVerification mails the link which sets email as email of the
+// user.
+func sendEmailVerification(ctx context.Context, app AppCtx, user User, email string) error {
+	expires := time.Now().Add(app.Specs.EmailVerifyTTL)
+	token, err := NewEmailVerificationContext(ctx, app.DB, user.ID, email, expires)
+	if err != nil {
+		return err
+	}
+
+	link := strings.TrimSuffix(app.Specs.PublicURL, "/") + "/#/verify-email?token=" + token
+	m := Mail{
+		To:      email,
+		Subject: "Confirm your sj email",
+		Body:    fmt.Sprintf(emailVerificationMail, user.Name, expires.UTC().Format(time.RFC1123), link),
+	}
+
+	return sendMail(ctx, app, m)
+}
+
+func sendMail(ctx context.Context, app AppCtx, m Mail) error {
+	mailer := app.Mailer
+	if mailer == nil {
+		mailer = LogMailer{Logger: logger(app)}
+	}
+
+	return mailer.Send(ctx, m)
+}
@@ -0,0 +1,217 @@
+package sj
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_POST_PasswordResetRequest_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v WHERE Email", UserTable)
+	rows := sqlmock.NewRows(userColumns).
+		AddRow(14, "jane", "hash", RoleUser, false, 0, nil, "jane@example.com").
+		AddRow(15, "spammer", "hash", RoleUser, true, 0, nil, "jane@example.com")
+	mock.ExpectQuery(q).WithArgs("jane@example.com").WillReturnRows(rows)
+
+	q = fmt.Sprintf("INSERT INTO %v", PasswordResetTable)
+	mock.ExpectExec(q).
+		WithArgs(sqlmock.AnyArg(), 14, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mailer := &mailRecorder{}
+	app := AppCtx{
+		DB:     db,
+		Mailer: mailer,
+		Specs: Specs{
+			PublicURL:        "https://sj.example.com/",
+			PasswordResetTTL: time.Hour,
+		},
+	}
+	srv := gin.New()
+	PasswordResetRoutes(srv.Group("/"), app)
+
+	req := TestRequest{
+		Body:    `{"Data": {"Email": "jane@example.com"}}`,
+		Handler: srv,
+	}
+	resp := req.Send("POST", "/password-reset/request")
+
+	if err := EqualResponse(NewSuccessResponse(""), resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mailer.mails) != 1 || mailer.mails[0].To != "jane@example.com" {
+		t.Fatal("Expect one mail to jane was", mailer.mails)
+	}
+
+	link := "https://sj.example.com/#/password-reset?token="
+	if !strings.Contains(mailer.mails[0].Body, link) {
+		t.Fatal("Expect reset link in", mailer.mails[0].Body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_PasswordReset_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	token := "secret-token"
+	userID := int64(14)
+
+	mock.ExpectBegin()
+	q := fmt.Sprintf("SELECT User_ID FROM %v WHERE Token_Hash", PasswordResetTable)
+	rows := sqlmock.NewRows([]string{"User_ID"}).AddRow(userID)
+	mock.ExpectQuery(q).
+		WithArgs(HashAPIToken(token), sqlmock.AnyArg()).
+		WillReturnRows(rows)
+
+	q = fmt.Sprintf("DELETE FROM %v WHERE Token_Hash", PasswordResetTable)
+	mock.ExpectExec(q).
+		WithArgs(HashAPIToken(token)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	q = fmt.Sprintf("UPDATE %v SET Password = \\?, Failed_Logins = 0", UserTable)
+	mock.ExpectExec(q).
+		WithArgs(NewSha512Password("n3w-Password"), userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	for _, table := range []string{PasswordResetTable, SessionTable} {
+		q = fmt.Sprintf("DELETE FROM %v WHERE User_ID", table)
+		mock.ExpectExec(q).
+			WithArgs(userID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	srv := gin.New()
+	PasswordResetRoutes(srv.Group("/"), AppCtx{DB: db})
+
+	req := TestRequest{
+		Body:    fmt.Sprintf(`{"Data": {"Token": "%v", "NewPassword": "n3w-Password"}}`, token),
+		Handler: srv,
+	}
+	resp := req.Send("POST", "/password-reset")
+
+	if err := EqualResponse(NewSuccessResponse(""), resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_PasswordReset_Expired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	q := fmt.Sprintf("SELECT User_ID FROM %v WHERE Token_Hash", PasswordResetTable)
+	mock.ExpectQuery(q).WillReturnRows(sqlmock.NewRows([]string{"User_ID"}))
+	mock.ExpectRollback()
+
+	srv := gin.New()
+	PasswordResetRoutes(srv.Group("/"), AppCtx{DB: db})
+
+	req := TestRequest{
+		Body:    `{"Data": {"Token": "old", "NewPassword": "n3w-Password"}}`,
+		Handler: srv,
+	}
+	resp := req.Send("POST", "/password-reset")
+
+	if err := EqualResponse(NewFailResponse(ErrInvalidResetToken), resp.Body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_EmailVerification_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	token := "secret-token"
+	userID := int64(14)
+
+	mock.ExpectBegin()
+	q := fmt.Sprintf("SELECT User_ID, Email FROM %v WHERE Token_Hash", EmailVerificationTable)
+	rows := sqlmock.NewRows([]string{"User_ID", "Email"}).AddRow(userID, "jane@example.com")
+	mock.ExpectQuery(q).
+		WithArgs(HashAPIToken(token), sqlmock.AnyArg()).
+		WillReturnRows(rows)
+
+	q = fmt.Sprintf("DELETE FROM %v WHERE User_ID", EmailVerificationTable)
+	mock.ExpectExec(q).
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	q = fmt.Sprintf("UPDATE %v SET Email = \\?", UserTable)
+	mock.ExpectExec(q).
+		WithArgs("jane@example.com", userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	srv := gin.New()
+	PasswordResetRoutes(srv.Group("/"), AppCtx{DB: db})
+
+	req := TestRequest{
+		Body:    fmt.Sprintf(`{"Data": {"Token": "%v"}}`, token),
+		Handler: srv,
+	}
+	resp := req.Send("POST", "/email-verification")
+
+	if err := EqualResponse(NewSuccessResponse(""), resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_EmailVerification_Expired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	q := fmt.Sprintf("SELECT User_ID, Email FROM %v WHERE Token_Hash", EmailVerificationTable)
+	mock.ExpectQuery(q).WillReturnRows(sqlmock.NewRows([]string{"User_ID", "Email"}))
+	mock.ExpectRollback()
+
+	srv := gin.New()
+	PasswordResetRoutes(srv.Group("/"), AppCtx{DB: db})
+
+	req := TestRequest{
+		Body:    `{"Data": {"Token": "old"}}`,
+		Handler: srv,
+	}
+	resp := req.Send("POST", "/email-verification")
+
+	if err := EqualResponse(NewFailResponse(ErrInvalidVerifyToken), resp.Body); err != nil {
+		t.Fatal(err)
+	}
+}
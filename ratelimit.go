@@ -0,0 +1,241 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MaxLoginDelay = 8 * time.Second
+
+	// Buckets which weren't used for this long are full again and can be
+	// dropped.
+	rateLimitSweep = 10 * time.Minute
+)
+
+var (
+	ErrRateLimited   = errors.New("Too many requests")
+	ErrAccountLocked = errors.New("Account is temporarily locked")
+)
+
+type (
+	// RateLimiter is a token bucket per key. A nil RateLimiter allows
+	// everything.
+	RateLimiter struct {
+		mu        sync.Mutex
+		rate      float64
+		burst     float64
+		buckets   map[string]*rateBucket
+		lastSweep time.Time
+	}
+
+	rateBucket struct {
+		tokens float64
+		last   time.Time
+	}
+
+	// LoginPolicy configures the brute-force protection of the logins.
+	// After MaxFailures failed logins in a row the account is locked for
+	// Lockout, every failed login is delayed by Delay doubled per failure.
+	LoginPolicy struct {
+		MaxFailures int
+		Lockout     time.Duration
+		Delay       time.Duration
+		Accounts    *RateLimiter
+	}
+)
+
+// NewRateLimiter allows n requests per key and period, a burst of n
+// requests included. It returns nil if n is 0, that disables the limit.
+func NewRateLimiter(n int, per time.Duration) *RateLimiter {
+	if n <= 0 || per <= 0 {
+		return nil
+	}
+
+	return &RateLimiter{
+		rate:    float64(n) / per.Seconds(),
+		burst:   float64(n),
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+// Allow takes a token of the key. If there is none it returns false and
+// when the next one is available.
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweep {
+		return
+	}
+	l.lastSweep = now
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// RateLimit is a gin middleware which responds with 429 if the key of the
+// request has no tokens left.
+func RateLimit(l *RateLimiter, key func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, wait := l.Allow(key(c), time.Now())
+		if ok {
+			c.Next()
+			return
+		}
+
+		secs := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(secs))
+
+		resp := NewFailResponse(ErrRateLimited)
+		resp.RequestID = requestID(c)
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, resp)
+	}
+}
+
+func ClientIP(c *gin.Context) string {
+	return c.ClientIP()
+}
+
+// LoginRateLimit limits the login requests per IP by LoginRate.
+func LoginRateLimit(app AppCtx) gin.HandlerFunc {
+	return RateLimit(NewRateLimiter(app.Specs.LoginRate, time.Minute), ClientIP)
+}
+
+// SignupRateLimit limits the new accounts per IP by SignupRate.
+func SignupRateLimit(app AppCtx) gin.HandlerFunc {
+	return RateLimit(NewRateLimiter(app.Specs.SignupRate, time.Hour), ClientIP)
+}
+
+func NewLoginPolicy(specs Specs) LoginPolicy {
+	return LoginPolicy{
+		MaxFailures: specs.LoginMaxFailures,
+		Lockout:     specs.LoginLockout,
+		Delay:       specs.LoginDelay,
+		Accounts:    NewRateLimiter(specs.LoginAccountRate, time.Minute),
+	}
+}
+
+// delay returns how long the response of the nth failed login in a row is
+// delayed.
+func (p LoginPolicy) delay(failures int) time.Duration {
+	if p.Delay <= 0 || failures < 1 {
+		return 0
+	}
+
+	d := p.Delay
+	for i := 1; i < failures && d < MaxLoginDelay; i++ {
+		d *= 2
+	}
+
+	if d > MaxLoginDelay {
+		return MaxLoginDelay
+	}
+
+	return d
+}
+
+// RecordFailedLogin counts a failed login of the user and locks the account
+// until lockedUntil once maxFailures is reached. The counter is only reset
+// by a successful login, so every further failure locks the account again.
+func RecordFailedLogin(db *sql.DB, userID int64, maxFailures int, lockedUntil time.Time) error {
+	return RecordFailedLoginContext(context.Background(), db, userID, maxFailures, lockedUntil)
+}
+
+func RecordFailedLoginContext(ctx context.Context, db *sql.DB, userID int64, maxFailures int, lockedUntil time.Time) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	if maxFailures <= 0 {
+		m := "UPDATE %v SET Failed_Logins = Failed_Logins + 1 WHERE ID = ?"
+		q := fmt.Sprintf(m, quote(UserTable))
+		_, err := dbExec(ctx, db, q, userID)
+		return err
+	}
+
+	// Locked_Until is set first, MySQL would see the incremented
+	// Failed_Logins otherwise.
+	m := `
+	UPDATE %v SET
+	Locked_Until = CASE WHEN Failed_Logins + 1 >= ? THEN ? ELSE Locked_Until END,
+	Failed_Logins = Failed_Logins + 1
+	WHERE ID = ?
+	`
+	q := fmt.Sprintf(m, quote(UserTable))
+	_, err := dbExec(ctx, db, q, maxFailures, lockedUntil, userID)
+
+	return err
+}
+
+func ResetFailedLogins(db *sql.DB, userID int64) error {
+	return ResetFailedLoginsContext(context.Background(), db, userID)
+}
+
+func ResetFailedLoginsContext(ctx context.Context, db *sql.DB, userID int64) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "UPDATE %v SET Failed_Logins = 0, Locked_Until = NULL WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+	_, err := dbExec(ctx, db, q, userID)
+
+	return err
+}
+
+// UnlockUserHandler lifts the lockout of an account before it expires.
+func UnlockUserHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	err = ResetFailedLoginsContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package sj
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/smem"
+)
+
+var userColumns = []string{
+	"ID", "Name", "Password", "Role", "Disabled", "Failed_Logins", "Locked_Until", "Email",
+}
+
+func Test_RateLimiter_Allow(t *testing.T) {
+	l := NewRateLimiter(2, time.Minute)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("1.2.3.4", now); !ok {
+			t.Fatal("Expect request", i, "to be allowed")
+		}
+	}
+
+	ok, wait := l.Allow("1.2.3.4", now)
+	if ok || wait != 30*time.Second {
+		t.Fatal("Expect to wait 30s was", ok, wait)
+	}
+
+	if ok, _ := l.Allow("5.6.7.8", now); !ok {
+		t.Fatal("Expect other key to be allowed")
+	}
+
+	if ok, _ := l.Allow("1.2.3.4", now.Add(30*time.Second)); !ok {
+		t.Fatal("Expect refilled token")
+	}
+
+	if ok, _ := (*RateLimiter)(nil).Allow("1.2.3.4", now); !ok {
+		t.Fatal("Expect nil limiter to allow everything")
+	}
+}
+
+func Test_RateLimit_TooManyRequests(t *testing.T) {
+	srv := gin.New()
+	limit := RateLimit(NewRateLimiter(1, time.Hour), ClientIP)
+	srv.POST("/signup", limit, func(c *gin.Context) {
+		c.JSON(200, NewSuccessResponse(""))
+	})
+
+	req := TestRequest{
+		Handler: srv,
+	}
+	resp := req.Send("POST", "/signup")
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code)
+	}
+
+	resp = req.Send("POST", "/signup")
+	if 429 != resp.Code {
+		t.Fatal("Expect 429 was", resp.Code)
+	}
+
+	if resp.Header().Get("Retry-After") != "3600" {
+		t.Fatal("Wrong Retry-After", resp.Header().Get("Retry-After"))
+	}
+
+	if err := EqualResponse(NewFailResponse(ErrRateLimited), resp.Body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_AccountRoutes_SignupRateLimit(t *testing.T) {
+	sessionStore := smem.NewStore()
+	app := AppCtx{Specs: Specs{SignupRate: 1}}
+
+	srv := gin.New()
+	AccountRoutes(srv.Group("/"), app, &sessionStore)
+
+	req := TestRequest{
+		Body:    `{"Data": {}}`,
+		Handler: srv,
+	}
+	resp := req.Send("POST", "/signup")
+	if 429 == resp.Code {
+		t.Fatal("Expect first signup to pass")
+	}
+
+	resp = req.Send("POST", "/signup")
+	if 429 != resp.Code {
+		t.Fatal("Expect 429 was", resp.Code)
+	}
+}
+
+func Test_NewUserStore_Specs(t *testing.T) {
+	specs := Specs{
+		LoginAccountRate: 1,
+		LoginMaxFailures: 3,
+		LoginLockout:     time.Minute,
+		LoginDelay:       time.Second,
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v", UserTable)
+	mock.ExpectQuery(q).WillReturnError(sql.ErrNoRows)
+
+	store := NewUserStore(db, specs).(*userStore)
+	p := store.policy
+	if p.MaxFailures != 3 || p.Lockout != time.Minute || p.Delay != time.Second || p.Accounts == nil {
+		t.Fatal("Unexpected policy", p)
+	}
+
+	// The second login of the account within a minute is limited
+	store.FindUser("peacemaker")
+	if _, err := store.FindUser("peacemaker"); err != ErrRateLimited {
+		t.Fatal("Expect", ErrRateLimited, "was", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_UserStore_FailedLoginLocks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v", UserTable)
+	rows := sqlmock.NewRows(userColumns).
+		AddRow(14, "peacemaker", NewSha512Password("secret"), RoleUser, false, 4, nil, "")
+	mock.ExpectQuery(q).WithArgs("peacemaker").WillReturnRows(rows)
+
+	q = fmt.Sprintf("UPDATE %v SET Locked_Until = CASE", UserTable)
+	mock.ExpectExec(q).
+		WithArgs(5, sqlmock.AnyArg(), 14).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	policy := LoginPolicy{
+		MaxFailures: 5,
+		Lockout:     time.Minute,
+	}
+	user, err := NewUserStoreWithPolicy(db, policy).FindUser("peacemaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.ValidPassword("guess") {
+		t.Fatal("Expect invalid password")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_UserStore_Locked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v", UserTable)
+	rows := sqlmock.NewRows(userColumns).
+		AddRow(14, "peacemaker", NewSha512Password("secret"), RoleUser, false, 5, time.Now().Add(time.Minute), "")
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	_, err = NewUserStore(db, Specs{}).FindUser("peacemaker")
+	if err != ErrAccountLocked {
+		t.Fatal("Expect", ErrAccountLocked, "was", err)
+	}
+}
+
+func Test_UserStore_ValidPasswordResets(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v", UserTable)
+	rows := sqlmock.NewRows(userColumns).
+		AddRow(14, "peacemaker", NewSha512Password("secret"), RoleUser, false, 2, time.Now().Add(-time.Minute), "")
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT Secret, Enabled, Last_Counter, Created FROM %v", TOTPTable)
+	mock.ExpectQuery(q).WithArgs(14).WillReturnError(sql.ErrNoRows)
+
+	q = fmt.Sprintf("UPDATE %v SET Failed_Logins = 0, Locked_Until = NULL", UserTable)
+	mock.ExpectExec(q).WithArgs(14).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	user, err := NewUserStore(db, Specs{}).FindUser("peacemaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !user.ValidPassword("secret") {
+		t.Fatal("Expect valid password")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_LoginPolicy_Delay(t *testing.T) {
+	p := LoginPolicy{Delay: time.Second}
+
+	tests := map[int]time.Duration{
+		0:  0,
+		1:  time.Second,
+		3:  4 * time.Second,
+		10: MaxLoginDelay,
+	}
+	for failures, expect := range tests {
+		if d := p.delay(failures); d != expect {
+			t.Fatal("Expect", expect, "for", failures, "was", d)
+		}
+	}
+}
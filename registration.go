@@ -0,0 +1,104 @@
+package sj
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+)
+
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+var (
+	ErrRegistrationClosed = errors.New("Registration is closed")
+	ErrInvalidInviteCode  = errors.New("Invalid invite code")
+
+	userNameRegexp = regexp.MustCompile(`^[\p{L}\p{N}_.-]{3,32}$`)
+)
+
+// AccountRoutes registers the signup and the login. Signups are limited per
+// IP by SignupRate, logins per IP by LoginRate and per account by the login
+// policy of the specs.
+func AccountRoutes(r *gin.RouterGroup, app AppCtx, sessionStore kauth.SessionStore) {
+	userStore := NewUserStore(app.DB, app.Specs)
+	r.POST("/signup", SignupRateLimit(app), NewAppHandler(app, NewUserHandler))
+	r.POST("/login", LoginRateLimit(app), NewAppHandler(app, NewLoginHandler(sessionStore, userStore)))
+}
+
+func ValidateUserName(name string) error {
+	if !userNameRegexp.MatchString(name) {
+		m := "Name has to be 3 to 32 letters, digits or one of _ . -"
+		return errors.New(m)
+	}
+
+	return nil
+}
+
+// ValidatePassword checks the password against the policy in specs. The
+// character classes are lower case, upper case, digits and everything else.
+func ValidatePassword(specs Specs, pass string) error {
+	if pass == "" {
+		return errors.New("Password is empty")
+	}
+
+	if len([]rune(pass)) < specs.PasswordMinLength {
+		m := fmt.Sprintf("Password needs at least %v characters",
+			specs.PasswordMinLength)
+		return errors.New(m)
+	}
+
+	classes := map[string]bool{}
+	for _, r := range pass {
+		switch {
+		case unicode.IsLower(r):
+			classes["lower"] = true
+		case unicode.IsUpper(r):
+			classes["upper"] = true
+		case unicode.IsDigit(r):
+			classes["digit"] = true
+		default:
+			classes["other"] = true
+		}
+	}
+
+	if len(classes) < specs.PasswordMinClasses {
+		m := fmt.Sprintf("Password needs at least %v of lower case, upper case, digits and symbols",
+			specs.PasswordMinClasses)
+		return errors.New(m)
+	}
+
+	return nil
+}
+
+// ValidateRegistrationMode returns an error if Registration is not one of
+// open, invite or closed.
+func ValidateRegistrationMode(specs Specs) error {
+	switch specs.Registration {
+	case "", RegistrationOpen, RegistrationInvite, RegistrationClosed:
+		return nil
+	}
+
+	m := fmt.Sprintf("Unknown registration mode %v", specs.Registration)
+	return errors.New(m)
+}
+
+// registrationMode returns the registration mode of specs. An unknown mode
+// closes the registration.
+func registrationMode(specs Specs) string {
+	if specs.Registration == "" {
+		return RegistrationOpen
+	}
+
+	if ValidateRegistrationMode(specs) != nil {
+		return RegistrationClosed
+	}
+
+	return specs.Registration
+}
@@ -0,0 +1,73 @@
+package sj
+
+import "testing"
+
+func Test_ValidatePassword(t *testing.T) {
+	specs := Specs{
+		PasswordMinLength:  8,
+		PasswordMinClasses: 3,
+	}
+
+	cases := map[string]bool{
+		"":            false,
+		"Ab1!":        false,
+		"abcdefgh":    false,
+		"abcdefgH":    false,
+		"abcdefH1":    true,
+		"Süßes Gift1": true,
+	}
+
+	for pass, valid := range cases {
+		err := ValidatePassword(specs, pass)
+		if valid && err != nil {
+			t.Fatal("Expect", pass, "to be valid", err)
+		}
+
+		if !valid && err == nil {
+			t.Fatal("Expect", pass, "to be invalid")
+		}
+	}
+}
+
+func Test_ValidateUserName(t *testing.T) {
+	cases := map[string]bool{
+		"devilXX":      true,
+		"jürgen.m":     true,
+		"ab":           false,
+		"robert'); --": false,
+		"a b c":        false,
+	}
+
+	for name, valid := range cases {
+		err := ValidateUserName(name)
+		if valid && err != nil {
+			t.Fatal("Expect", name, "to be valid", err)
+		}
+
+		if !valid && err == nil {
+			t.Fatal("Expect", name, "to be invalid")
+		}
+	}
+}
+
+func Test_RegistrationMode(t *testing.T) {
+	cases := map[string]string{
+		"":       RegistrationOpen,
+		"open":   RegistrationOpen,
+		"invite": RegistrationInvite,
+		"closed": RegistrationClosed,
+		"Closed": RegistrationClosed,
+		"invtie": RegistrationClosed,
+	}
+
+	for in, expect := range cases {
+		specs := Specs{Registration: in}
+		if mode := registrationMode(specs); mode != expect {
+			t.Fatal("Expect", expect, "was", mode)
+		}
+	}
+
+	if err := ValidateRegistrationMode(Specs{Registration: "invtie"}); err == nil {
+		t.Fatal("Expect error")
+	}
+}
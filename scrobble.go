@@ -0,0 +1,707 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SourcePlex     = "plex"
+	SourceJellyfin = "jellyfin"
+	SourceKodi     = "kodi"
+
+	maxScrobbleBody = 1 << 20
+)
+
+type (
+	// ExternalIDs maps a provider to the id of a series there. The media
+	// servers send their own ids, so series are recognized again after the
+	// title was matched once. Most ids are local to one installation and
+	// are only mapped for the user who sent them, see sharedExternalID.
+	ExternalIDs map[string]string
+
+	ScrobbleEvent struct {
+		Source      string
+		Title       string
+		Session     int
+		Episode     int
+		ExternalIDs ExternalIDs
+	}
+
+	ScrobbleResult struct {
+		Matched  bool
+		SeriesID int64
+		Session  int
+		Episode  int
+		Updated  bool
+		InboxID  int64
+	}
+
+	ScrobbleInboxEntry struct {
+		ID          int64
+		UserID      int64
+		Source      string
+		Title       string
+		Session     int
+		Episode     int
+		ExternalIDs ExternalIDs
+		Created     time.Time
+	}
+
+	ScrobbleInbox []ScrobbleInboxEntry
+
+	plexWebhook struct {
+		Event    string `json:"event"`
+		Metadata struct {
+			Type             string `json:"type"`
+			GrandparentTitle string `json:"grandparentTitle"`
+			GrandparentGUID  string `json:"grandparentGuid"`
+			ParentIndex      int    `json:"parentIndex"`
+			Index            int    `json:"index"`
+		} `json:"Metadata"`
+	}
+
+	jellyfinWebhook struct {
+		NotificationType   string
+		ItemType           string
+		SeriesName         string
+		SeriesID           string `json:"SeriesId"`
+		SeasonNumber       int
+		EpisodeNumber      int
+		PlayedToCompletion bool
+	}
+
+	kodiNotification struct {
+		Method string `json:"method"`
+		Params struct {
+			Data struct {
+				End  bool `json:"end"`
+				Item struct {
+					Type      string `json:"type"`
+					ShowTitle string `json:"showtitle"`
+					Season    int    `json:"season"`
+					Episode   int    `json:"episode"`
+					TVShowID  int64  `json:"tvshowid"`
+				} `json:"item"`
+			} `json:"data"`
+		} `json:"params"`
+	}
+)
+
+// ScrobbleRoutes registers the webhook and the inbox of unmatched events.
+// The webhook is authenticated by an API token in the URL because media
+// servers can't send custom headers.
+func ScrobbleRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	r.POST("/scrobble/:token", NewAppHandler(app, ScrobbleHandler))
+	r.GET("/scrobble-inbox", signedIn(NewAppHandler(app, ScrobbleInboxHandler)))
+	r.POST("/scrobble-inbox/:id", signedIn(NewAppHandler(app, ResolveScrobbleHandler)))
+	r.DELETE("/scrobble-inbox/:id", signedIn(NewAppHandler(app, DismissScrobbleHandler)))
+}
+
+// ParseScrobbleRequest detects the media server by the payload. The bool is
+// false for events which are not a finished episode.
+func ParseScrobbleRequest(r *http.Request) (ScrobbleEvent, bool, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		err := r.ParseMultipartForm(maxScrobbleBody)
+		if err != nil {
+			return ScrobbleEvent{}, false, err
+		}
+
+		return ParsePlexWebhook([]byte(r.FormValue("payload")))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxScrobbleBody))
+	if err != nil {
+		return ScrobbleEvent{}, false, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	err = json.Unmarshal(body, &fields)
+	if err != nil {
+		return ScrobbleEvent{}, false, err
+	}
+
+	switch {
+	case fields["NotificationType"] != nil:
+		return ParseJellyfinWebhook(body)
+	case fields["method"] != nil:
+		return ParseKodiNotification(body)
+	case fields["event"] != nil:
+		return ParsePlexWebhook(body)
+	}
+
+	return ScrobbleEvent{}, false, errors.New("Unknown scrobble payload")
+}
+
+func ParsePlexWebhook(payload []byte) (ScrobbleEvent, bool, error) {
+	hook := plexWebhook{}
+	err := json.Unmarshal(payload, &hook)
+	if err != nil {
+		return ScrobbleEvent{}, false, err
+	}
+
+	m := hook.Metadata
+	if hook.Event != "media.scrobble" || m.Type != "episode" {
+		return ScrobbleEvent{}, false, nil
+	}
+
+	e := ScrobbleEvent{
+		Source:      SourcePlex,
+		Title:       m.GrandparentTitle,
+		Session:     m.ParentIndex,
+		Episode:     m.Index,
+		ExternalIDs: ExternalIDs{},
+	}
+	if m.GrandparentGUID != "" {
+		e.ExternalIDs[SourcePlex] = m.GrandparentGUID
+	}
+
+	return e, true, nil
+}
+
+func ParseJellyfinWebhook(payload []byte) (ScrobbleEvent, bool, error) {
+	hook := jellyfinWebhook{}
+	err := json.Unmarshal(payload, &hook)
+	if err != nil {
+		return ScrobbleEvent{}, false, err
+	}
+
+	if hook.NotificationType != "PlaybackStop" || !hook.PlayedToCompletion ||
+		hook.ItemType != "Episode" {
+		return ScrobbleEvent{}, false, nil
+	}
+
+	e := ScrobbleEvent{
+		Source:      SourceJellyfin,
+		Title:       hook.SeriesName,
+		Session:     hook.SeasonNumber,
+		Episode:     hook.EpisodeNumber,
+		ExternalIDs: ExternalIDs{},
+	}
+	if hook.SeriesID != "" {
+		e.ExternalIDs[SourceJellyfin] = hook.SeriesID
+	}
+
+	return e, true, nil
+}
+
+// ParseKodiNotification reads the Player.OnStop notification of the Kodi
+// JSON-RPC API.
+func ParseKodiNotification(payload []byte) (ScrobbleEvent, bool, error) {
+	n := kodiNotification{}
+	err := json.Unmarshal(payload, &n)
+	if err != nil {
+		return ScrobbleEvent{}, false, err
+	}
+
+	data := n.Params.Data
+	if n.Method != "Player.OnStop" || !data.End || data.Item.Type != "episode" {
+		return ScrobbleEvent{}, false, nil
+	}
+
+	e := ScrobbleEvent{
+		Source:      SourceKodi,
+		Title:       data.Item.ShowTitle,
+		Session:     data.Item.Season,
+		Episode:     data.Item.Episode,
+		ExternalIDs: ExternalIDs{},
+	}
+	if data.Item.TVShowID > 0 {
+		e.ExternalIDs[SourceKodi] = strconv.FormatInt(data.Item.TVShowID, 10)
+	}
+
+	return e, true, nil
+}
+
+// Scrobble matches the event to a series, first by its external ids then by
+// its title, and moves the users progress forward. Unmatched events are put
+// into the users inbox.
+func Scrobble(db *sql.DB, userID int64, e ScrobbleEvent) (ScrobbleResult, error) {
+	return ScrobbleContext(context.Background(), db, userID, e)
+}
+
+func ScrobbleContext(ctx context.Context, db *sql.DB, userID int64, e ScrobbleEvent) (ScrobbleResult, error) {
+	seriesID, err := FindSeriesByExternalIDContext(ctx, db, userID, e.ExternalIDs)
+	if err == sql.ErrNoRows {
+		seriesID, err = matchSeriesTitle(ctx, db, e.Title)
+		if err == nil {
+			// The title comes from the client, so the ids are only mapped
+			// for the user
+			err = SaveSeriesExternalIDsContext(ctx, db, userID, seriesID, e.ExternalIDs, false)
+		}
+	}
+
+	if err == sql.ErrNoRows {
+		id, err := NewScrobbleInboxEntryContext(ctx, db, ScrobbleInboxEntry{
+			UserID:      userID,
+			Source:      e.Source,
+			Title:       e.Title,
+			Session:     e.Session,
+			Episode:     e.Episode,
+			ExternalIDs: e.ExternalIDs,
+		})
+		if err != nil {
+			return ScrobbleResult{}, err
+		}
+
+		return ScrobbleResult{InboxID: id}, nil
+	}
+	if err != nil {
+		return ScrobbleResult{}, err
+	}
+
+	updated, err := applyScrobble(ctx, db, userID, seriesID, e.Session, e.Episode)
+	if err != nil {
+		return ScrobbleResult{}, err
+	}
+
+	return ScrobbleResult{
+		Matched:  true,
+		SeriesID: seriesID,
+		Session:  e.Session,
+		Episode:  e.Episode,
+		Updated:  updated,
+	}, nil
+}
+
+// ResolveScrobbleInboxEntry assigns the event to the series. The external
+// ids of the event are saved for the user, so the next events match
+// automatically.
+func ResolveScrobbleInboxEntry(db *sql.DB, userID, id, seriesID int64) (ScrobbleResult, error) {
+	return ResolveScrobbleInboxEntryContext(context.Background(), db, userID, id, seriesID)
+}
+
+func ResolveScrobbleInboxEntryContext(ctx context.Context, db *sql.DB, userID, id, seriesID int64) (ScrobbleResult, error) {
+	entry, err := ReadScrobbleInboxEntryContext(ctx, db, userID, id)
+	if err != nil {
+		return ScrobbleResult{}, err
+	}
+
+	_, err = ReadSeriesContext(ctx, db, seriesID)
+	if err != nil {
+		return ScrobbleResult{}, err
+	}
+
+	// The user chose the series, so even global ids are only mapped for them
+	err = SaveSeriesExternalIDsContext(ctx, db, userID, seriesID, entry.ExternalIDs, false)
+	if err != nil {
+		return ScrobbleResult{}, err
+	}
+
+	updated, err := applyScrobble(ctx, db, userID, seriesID, entry.Session, entry.Episode)
+	if err != nil {
+		return ScrobbleResult{}, err
+	}
+
+	_, err = RemoveScrobbleInboxEntryContext(ctx, db, userID, id)
+	if err != nil {
+		return ScrobbleResult{}, err
+	}
+
+	return ScrobbleResult{
+		Matched:  true,
+		SeriesID: seriesID,
+		Session:  entry.Session,
+		Episode:  entry.Episode,
+		Updated:  updated,
+	}, nil
+}
+
+func matchSeriesTitle(ctx context.Context, db *sql.DB, title string) (int64, error) {
+	s, err := FindSeriesBySearchTitleContext(ctx, db, title)
+	if err != nil {
+		return -1, err
+	}
+
+	return s.ID, nil
+}
+
+// applyScrobble adds the series to the users list and updates the last
+// watched episode unless the user is already further.
+func applyScrobble(ctx context.Context, db *sql.DB, userID, seriesID int64, session, episode int) (bool, error) {
+	exists, err := ExistsSeriesListContext(ctx, db, userID, seriesID)
+	if err != nil {
+		return false, err
+	}
+
+	if !exists {
+		err = AppendSeriesListContext(ctx, db, userID, seriesID)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	wList, err := ReadLastWatchedListContext(ctx, db, userID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, w := range wList {
+		if w.SeriesID == seriesID && !isBehind(w.Session, w.Episode, session, episode) {
+			return false, nil
+		}
+	}
+
+	err = UpdateLastWatchedContext(ctx, db, LastWatched{
+		UserID:   userID,
+		SeriesID: seriesID,
+		Session:  session,
+		Episode:  episode,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// FindSeriesByExternalID returns the series of the first known id or
+// sql.ErrNoRows. A mapping of the user wins over a shared one.
+func FindSeriesByExternalID(db *sql.DB, userID int64, ids ExternalIDs) (int64, error) {
+	return FindSeriesByExternalIDContext(context.Background(), db, userID, ids)
+}
+
+func FindSeriesByExternalIDContext(ctx context.Context, db *sql.DB, userID int64, ids ExternalIDs) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `SELECT Series_ID FROM %v WHERE Provider = ? AND External_ID = ?
+	AND User_ID IN (?, ?) ORDER BY User_ID DESC LIMIT 1`
+	q := fmt.Sprintf(m, quote(SeriesExternalIDTable))
+
+	for _, provider := range ids.providers() {
+		id := ids[provider]
+		owner := userID
+		if sharedExternalID(provider, id) {
+			owner = 0
+		}
+
+		var seriesID int64
+		err := dbQueryRow(ctx, db, q, provider, id, userID, owner).Scan(&seriesID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return -1, err
+		}
+
+		return seriesID, nil
+	}
+
+	return -1, sql.ErrNoRows
+}
+
+// SaveSeriesExternalIDs maps the ids to the series for the user. If share
+// is true global ids are mapped for all users, unless they are mapped
+// already. A shared mapping is never changed.
+func SaveSeriesExternalIDs(db *sql.DB, userID, seriesID int64, ids ExternalIDs, share bool) error {
+	return SaveSeriesExternalIDsContext(context.Background(), db, userID, seriesID, ids, share)
+}
+
+func SaveSeriesExternalIDsContext(ctx context.Context, db *sql.DB, userID, seriesID int64, ids ExternalIDs, share bool) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	upsert := dialect.Upsert(quote(SeriesExternalIDTable),
+		[]string{"User_ID", "Provider", "External_ID"},
+		[]string{"Series_ID"},
+	)
+	insert := dialect.InsertIgnore(quote(SeriesExternalIDTable),
+		[]string{"User_ID", "Provider", "External_ID", "Series_ID"},
+	)
+	for _, provider := range ids.providers() {
+		id := ids[provider]
+		q, owner := upsert, userID
+		if share && sharedExternalID(provider, id) {
+			q, owner = insert, 0
+		}
+
+		_, err := dbExec(ctx, db, q, owner, provider, id, seriesID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sharedExternalID reports whether the id names the same series on every
+// installation. Kodi and Jellyfin ids and local Plex agents are numbered
+// per server, only Plex GUIDs of the online metadata agents are global.
+func sharedExternalID(provider, id string) bool {
+	if provider != SourcePlex {
+		return false
+	}
+
+	for _, prefix := range []string{"plex://", "com.plexapp.agents.thetvdb://", "com.plexapp.agents.imdb://", "com.plexapp.agents.themoviedb://"} {
+		if strings.HasPrefix(id, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func NewScrobbleInboxEntry(db *sql.DB, entry ScrobbleInboxEntry) (int64, error) {
+	return NewScrobbleInboxEntryContext(context.Background(), db, entry)
+}
+
+func NewScrobbleInboxEntryContext(ctx context.Context, db *sql.DB, entry ScrobbleInboxEntry) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	ids, err := json.Marshal(entry.ExternalIDs)
+	if err != nil {
+		return -1, err
+	}
+
+	if entry.Created.IsZero() {
+		entry.Created = time.Now().UTC().Truncate(time.Second)
+	}
+
+	m := `INSERT INTO %v (User_ID,Source,Title,Session,Episode,External_IDs,Created)
+	VALUES(?, ?, ?, ?, ?, ?, ?)`
+	q := fmt.Sprintf(m, quote(ScrobbleInboxTable))
+
+	return dbInsertID(ctx, db, q, entry.UserID, entry.Source, entry.Title,
+		entry.Session, entry.Episode, string(ids), entry.Created)
+}
+
+func ReadScrobbleInbox(db *sql.DB, userID int64) (ScrobbleInbox, error) {
+	return ReadScrobbleInboxContext(context.Background(), db, userID)
+}
+
+func ReadScrobbleInboxContext(ctx context.Context, db *sql.DB, userID int64) (ScrobbleInbox, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `
+	SELECT ID, User_ID, Source, Title, Session, Episode, External_IDs, Created
+	FROM %v WHERE User_ID = ? ORDER BY ID
+	`
+	q := fmt.Sprintf(m, quote(ScrobbleInboxTable))
+	rows, err := dbQuery(ctx, db, q, userID)
+	if err != nil {
+		return ScrobbleInbox{}, err
+	}
+	defer rows.Close()
+
+	inbox := ScrobbleInbox{}
+	for rows.Next() {
+		entry, err := scanScrobbleInboxEntry(rows)
+		if err != nil {
+			return ScrobbleInbox{}, err
+		}
+
+		inbox = append(inbox, entry)
+	}
+
+	return inbox, rows.Err()
+}
+
+func ReadScrobbleInboxEntry(db *sql.DB, userID, id int64) (ScrobbleInboxEntry, error) {
+	return ReadScrobbleInboxEntryContext(context.Background(), db, userID, id)
+}
+
+func ReadScrobbleInboxEntryContext(ctx context.Context, db *sql.DB, userID, id int64) (ScrobbleInboxEntry, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `
+	SELECT ID, User_ID, Source, Title, Session, Episode, External_IDs, Created
+	FROM %v WHERE ID = ? AND User_ID = ?
+	`
+	q := fmt.Sprintf(m, quote(ScrobbleInboxTable))
+
+	return scanScrobbleInboxEntry(dbQueryRow(ctx, db, q, id, userID))
+}
+
+func RemoveScrobbleInboxEntry(db *sql.DB, userID, id int64) (int64, error) {
+	return RemoveScrobbleInboxEntryContext(context.Background(), db, userID, id)
+}
+
+func RemoveScrobbleInboxEntryContext(ctx context.Context, db *sql.DB, userID, id int64) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "DELETE FROM %v WHERE ID = ? AND User_ID = ?"
+	q := fmt.Sprintf(s, quote(ScrobbleInboxTable))
+	rsrc, err := dbExec(ctx, db, q, id, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return rsrc.RowsAffected()
+}
+
+func scanScrobbleInboxEntry(row scanner) (ScrobbleInboxEntry, error) {
+	entry := ScrobbleInboxEntry{}
+	var ids string
+	err := row.Scan(&entry.ID, &entry.UserID, &entry.Source, &entry.Title,
+		&entry.Session, &entry.Episode, &ids, &entry.Created)
+	if err != nil {
+		return ScrobbleInboxEntry{}, err
+	}
+
+	entry.ExternalIDs = ExternalIDs{}
+	if ids != "" {
+		err = json.Unmarshal([]byte(ids), &entry.ExternalIDs)
+		if err != nil {
+			return ScrobbleInboxEntry{}, err
+		}
+	}
+
+	return entry, nil
+}
+
+func (ids ExternalIDs) providers() []string {
+	p := []string{}
+	for provider, id := range ids {
+		if id != "" {
+			p = append(p, provider)
+		}
+	}
+	sort.Strings(p)
+
+	return p
+}
+
+func ScrobbleHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	token, err := FindAPITokenContext(ctx, app.DB, c.Params.ByName("token"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, NewFailResponse(ErrInvalidAPIToken))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if token.ReadOnly {
+		c.JSON(http.StatusForbidden, NewFailResponse(ErrReadOnlyAPIToken))
+		return nil
+	}
+
+	e, ok, err := ParseScrobbleRequest(c.Request)
+	if err != nil {
+		return err
+	}
+
+	result := ScrobbleResult{}
+	if ok {
+		result, err = ScrobbleContext(ctx, app.DB, token.UserID, e)
+		if err != nil {
+			return err
+		}
+		emitScrobble(ctx, app, token.UserID, result)
+	}
+
+	resp := NewSuccessResponse(result)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func emitScrobble(ctx context.Context, app AppCtx, userID int64, result ScrobbleResult) {
+	if !result.Updated {
+		return
+	}
+
+	emit(ctx, app, NewEvent(EventEpisodeWatched, userID, LastWatched{
+		UserID:   userID,
+		SeriesID: result.SeriesID,
+		Session:  result.Session,
+		Episode:  result.Episode,
+	}))
+}
+
+func ScrobbleInboxHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	inbox, err := ReadScrobbleInboxContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(inbox)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func ResolveScrobbleHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseAppendSeriesListRequest(c)
+	if err != nil {
+		return err
+	}
+
+	result, err := ResolveScrobbleInboxEntryContext(ctx, app.DB, userID, id, data.SeriesID)
+	if err != nil {
+		return err
+	}
+	emitScrobble(ctx, app, userID, result)
+
+	resp := NewSuccessResponse(result)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func DismissScrobbleHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	affected, err := RemoveScrobbleInboxEntryContext(ctx, app.DB, userID, id)
+	if err != nil {
+		return err
+	}
+
+	if affected < 1 {
+		return errors.New("Cannot found inbox entry")
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
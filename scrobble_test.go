@@ -0,0 +1,347 @@
+package sj
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	plexPayload = `{
+		"event": "media.scrobble",
+		"Metadata": {
+			"type": "episode",
+			"grandparentTitle": "Mr. Robot",
+			"grandparentGuid": "plex://show/5d9c",
+			"parentIndex": 2,
+			"index": 3
+		}
+	}`
+
+	jellyfinPayload = `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Episode",
+		"SeriesName": "Mr. Robot",
+		"SeriesId": "a1b2",
+		"SeasonNumber": 2,
+		"EpisodeNumber": 3,
+		"PlayedToCompletion": true
+	}`
+
+	kodiPayload = `{
+		"jsonrpc": "2.0",
+		"method": "Player.OnStop",
+		"params": {
+			"data": {
+				"end": true,
+				"item": {"type": "episode", "showtitle": "Mr. Robot", "season": 2, "episode": 3, "tvshowid": 12}
+			}
+		}
+	}`
+)
+
+// noSignIn is used for routes which authenticate themselves.
+func noSignIn(h gin.HandlerFunc) gin.HandlerFunc {
+	return h
+}
+
+func Test_ParseScrobbleRequest(t *testing.T) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	w.WriteField("payload", plexPayload)
+	w.Close()
+	plexReq := httptest.NewRequest("POST", "/", body)
+	plexReq.Header.Set("Content-Type", w.FormDataContentType())
+
+	tests := []struct {
+		Req    *http.Request
+		Expect ScrobbleEvent
+	}{
+		{
+			plexReq,
+			ScrobbleEvent{SourcePlex, "Mr. Robot", 2, 3, ExternalIDs{SourcePlex: "plex://show/5d9c"}},
+		},
+		{
+			httptest.NewRequest("POST", "/", strings.NewReader(jellyfinPayload)),
+			ScrobbleEvent{SourceJellyfin, "Mr. Robot", 2, 3, ExternalIDs{SourceJellyfin: "a1b2"}},
+		},
+		{
+			httptest.NewRequest("POST", "/", strings.NewReader(kodiPayload)),
+			ScrobbleEvent{SourceKodi, "Mr. Robot", 2, 3, ExternalIDs{SourceKodi: "12"}},
+		},
+	}
+
+	for _, tc := range tests {
+		e, ok, err := ParseScrobbleRequest(tc.Req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !ok {
+			t.Fatal("Expect scrobble event for", tc.Expect.Source)
+		}
+
+		if fmt.Sprint(e) != fmt.Sprint(tc.Expect) {
+			t.Fatalf("Expect %v was %v", tc.Expect, e)
+		}
+	}
+}
+
+func Test_ParseScrobbleRequest_Ignored(t *testing.T) {
+	payload := strings.Replace(jellyfinPayload, `"PlayedToCompletion": true`,
+		`"PlayedToCompletion": false`, 1)
+	req := httptest.NewRequest("POST", "/", strings.NewReader(payload))
+
+	_, ok, err := ParseScrobbleRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok {
+		t.Fatal("Expect unfinished playback to be ignored")
+	}
+}
+
+func Test_POST_Scrobble_ExternalID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := "sj_secret"
+	userID := int64(3)
+	expectAPIToken(mock, raw, userID, false)
+
+	q := fmt.Sprintf("SELECT Series_ID FROM %v WHERE Provider", SeriesExternalIDTable)
+	rows := sqlmock.NewRows([]string{"Series_ID"}).AddRow(series.ID)
+	mock.ExpectQuery(q).WithArgs(SourceJellyfin, "a1b2", userID, userID).WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT COUNT\\(\\*\\) FROM %v", SeriesListTable)
+	rows = sqlmock.NewRows([]string{"COUNT"}).AddRow(1)
+	mock.ExpectQuery(q).WithArgs(userID, series.ID).WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT Series_ID, Session, Episode FROM %v", LastWatchedTable)
+	rows = sqlmock.NewRows([]string{"Series_ID", "Session", "Episode"}).
+		AddRow(series.ID, 2, 1)
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	mock.ExpectBegin()
+	q = fmt.Sprintf("REPLACE INTO %v", LastWatchedTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, series.ID, 2, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncWatched, series.ID)
+	mock.ExpectCommit()
+
+	srv := gin.New()
+	ScrobbleRoutes(srv.Group("/"), AppCtx{DB: db}, noSignIn)
+
+	req := TestRequest{
+		Body:    jellyfinPayload,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.Send("POST", "/scrobble/"+raw)
+
+	expect := NewSuccessResponse(ScrobbleResult{
+		Matched:  true,
+		SeriesID: series.ID,
+		Session:  2,
+		Episode:  3,
+		Updated:  true,
+	})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_Scrobble_Unmatched(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := "sj_secret"
+	userID := int64(3)
+	expectAPIToken(mock, raw, userID, false)
+
+	q := fmt.Sprintf("SELECT Series_ID FROM %v WHERE Provider", SeriesExternalIDTable)
+	mock.ExpectQuery(q).
+		WithArgs(SourceKodi, "12", userID, userID).
+		WillReturnRows(sqlmock.NewRows([]string{"Series_ID"}))
+
+	q = fmt.Sprintf("SELECT ID, Title, Image, Description FROM %v WHERE Search_Title = \\?", SeriesTable)
+	mock.ExpectQuery(q).WithArgs("mr robot").WillReturnError(sql.ErrNoRows)
+
+	q = fmt.Sprintf("INSERT INTO %v", ScrobbleInboxTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, SourceKodi, "Mr. Robot", 2, 3, `{"kodi":"12"}`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(5, 1))
+
+	srv := gin.New()
+	ScrobbleRoutes(srv.Group("/"), AppCtx{DB: db}, noSignIn)
+
+	req := TestRequest{
+		Body:    kodiPayload,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.Send("POST", "/scrobble/"+raw)
+
+	expect := NewSuccessResponse(ScrobbleResult{InboxID: 5})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Scrobble_TitleMatchUserMapping(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(3)
+	guid := "plex://show/5d9c"
+
+	q := fmt.Sprintf("SELECT Series_ID FROM %v WHERE Provider", SeriesExternalIDTable)
+	mock.ExpectQuery(q).
+		WithArgs(SourcePlex, guid, userID, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"Series_ID"}))
+
+	q = fmt.Sprintf("SELECT ID, Title, Image, Description FROM %v WHERE Search_Title = \\?", SeriesTable)
+	rows := sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"}).
+		AddRow(series.ID, series.Title, series.Image, series.Description)
+	mock.ExpectQuery(q).WithArgs("mr robot").WillReturnRows(rows)
+
+	// The title is sent by the client, the shared GUID stays untouched
+	q = fmt.Sprintf("REPLACE INTO %v", SeriesExternalIDTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, SourcePlex, guid, series.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	q = fmt.Sprintf("SELECT COUNT\\(\\*\\) FROM %v", SeriesListTable)
+	rows = sqlmock.NewRows([]string{"COUNT"}).AddRow(1)
+	mock.ExpectQuery(q).WithArgs(userID, series.ID).WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT Series_ID, Session, Episode FROM %v", LastWatchedTable)
+	rows = sqlmock.NewRows([]string{"Series_ID", "Session", "Episode"})
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	mock.ExpectBegin()
+	q = fmt.Sprintf("REPLACE INTO %v", LastWatchedTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, series.ID, 2, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncWatched, series.ID)
+	mock.ExpectCommit()
+
+	e := ScrobbleEvent{SourcePlex, "Mr. Robot", 2, 3, ExternalIDs{SourcePlex: guid}}
+	result, err := Scrobble(db, userID, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Matched || result.SeriesID != series.ID {
+		t.Fatal("Unexpected result", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_SharedExternalID(t *testing.T) {
+	cases := []struct {
+		Provider string
+		ID       string
+		Shared   bool
+	}{
+		{SourcePlex, "plex://show/5d9c", true},
+		{SourcePlex, "com.plexapp.agents.thetvdb://289590?lang=en", true},
+		{SourcePlex, "local://123", false},
+		{SourceJellyfin, "a1b2", false},
+		{SourceKodi, "12", false},
+	}
+
+	for _, c := range cases {
+		if shared := sharedExternalID(c.Provider, c.ID); shared != c.Shared {
+			t.Fatal("Expect", c.Shared, "for", c.ID, "was", shared)
+		}
+	}
+}
+
+func Test_ResolveScrobbleInboxEntry_UserMapping(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(3)
+	created := time.Date(2016, 3, 3, 0, 0, 0, 0, time.UTC)
+
+	q := fmt.Sprintf("SELECT ID, User_ID, Source, Title, Session, Episode, External_IDs, Created FROM %v", ScrobbleInboxTable)
+	rows := sqlmock.NewRows([]string{"ID", "User_ID", "Source", "Title", "Session", "Episode", "External_IDs", "Created"}).
+		AddRow(5, userID, SourcePlex, "Mr. Robot", 2, 3, `{"plex":"plex://show/5d9c"}`, created)
+	mock.ExpectQuery(q).WithArgs(5, userID).WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT Title, Image, Description FROM %v", SeriesTable)
+	rows = sqlmock.NewRows([]string{"Title", "Image", "Description"}).
+		AddRow(series.Title, series.Image, series.Description)
+	mock.ExpectQuery(q).WithArgs(series.ID).WillReturnRows(rows)
+
+	// A global id chosen by hand is only mapped for the user
+	q = fmt.Sprintf("REPLACE INTO %v", SeriesExternalIDTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, SourcePlex, "plex://show/5d9c", series.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	q = fmt.Sprintf("SELECT COUNT\\(\\*\\) FROM %v", SeriesListTable)
+	rows = sqlmock.NewRows([]string{"COUNT"}).AddRow(1)
+	mock.ExpectQuery(q).WithArgs(userID, series.ID).WillReturnRows(rows)
+
+	q = fmt.Sprintf("SELECT Series_ID, Session, Episode FROM %v", LastWatchedTable)
+	rows = sqlmock.NewRows([]string{"Series_ID", "Session", "Episode"})
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	mock.ExpectBegin()
+	q = fmt.Sprintf("REPLACE INTO %v", LastWatchedTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, series.ID, 2, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncWatched, series.ID)
+	mock.ExpectCommit()
+
+	q = fmt.Sprintf("DELETE FROM %v", ScrobbleInboxTable)
+	mock.ExpectExec(q).
+		WithArgs(5, userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	_, err = ResolveScrobbleInboxEntry(db, userID, 5, series.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,382 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+
+	scoreExact       = 1.0
+	scorePrefix      = 0.9
+	scoreWordPrefix  = 0.8
+	scoreContains    = 0.7
+	scoreFuzzy       = 0.5
+	scoreDescription = 0.4
+	scoreDescFuzzy   = 0.3
+)
+
+type (
+	SearchResult struct {
+		Series Series
+		Score  float64
+	}
+
+	SearchResultList []SearchResult
+)
+
+var foldMap = map[rune]string{
+	'ä': "a", 'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'å': "a",
+	'æ': "ae", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ñ': "n",
+	'ö': "o", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ø': "o",
+	'œ': "oe", 'ß': "ss",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u",
+	'ý': "y", 'ÿ': "y",
+}
+
+func SearchSeries(db *sql.DB, query string, limit int) (SearchResultList, error) {
+	return SearchSeriesContext(context.Background(), db, query, limit)
+}
+
+// SearchSeriesContext ranks the series whose folded title or description
+// shares a part with a query word.
+func SearchSeriesContext(ctx context.Context, db *sql.DB, query string, limit int) (SearchResultList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	q := FoldText(query)
+	if q == "" {
+		return SearchResultList{}, nil
+	}
+
+	where := []string{}
+	args := []interface{}{}
+	for _, p := range searchPatterns(q) {
+		where = append(where, "Search_Title LIKE ?", "Search_Description LIKE ?")
+		args = append(args, p, p)
+	}
+
+	m := "SELECT ID, Title, Image, Description FROM %v WHERE %v"
+	sqlQuery := fmt.Sprintf(m, quote(SeriesTable), strings.Join(where, " OR "))
+	rows, err := dbQuery(ctx, db, sqlQuery, args...)
+	if err != nil {
+		return SearchResultList{}, err
+	}
+	defer rows.Close()
+
+	sList, err := scanSeriesList(rows)
+	if err != nil {
+		return SearchResultList{}, err
+	}
+
+	return RankSeries(sList, query, searchLimit(limit)), nil
+}
+
+// FindSeriesBySearchTitle returns the series whose folded title equals the
+// folded title, the exact match of RankSeries, or sql.ErrNoRows.
+func FindSeriesBySearchTitle(db *sql.DB, title string) (Series, error) {
+	return FindSeriesBySearchTitleContext(context.Background(), db, title)
+}
+
+func FindSeriesBySearchTitleContext(ctx context.Context, db querier, title string) (Series, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	folded := FoldText(title)
+	if folded == "" {
+		return Series{}, sql.ErrNoRows
+	}
+
+	s := Series{}
+	m := "SELECT ID, Title, Image, Description FROM %v WHERE Search_Title = ? ORDER BY ID LIMIT 1"
+	q := fmt.Sprintf(m, quote(SeriesTable))
+	err := dbQueryRow(ctx, db, q, folded).Scan(&s.ID, &s.Title, &s.Image, &s.Description)
+	if err != nil {
+		return Series{}, err
+	}
+
+	return s, nil
+}
+
+// searchPatterns returns LIKE patterns for the start and the end of every
+// query word, so titles with a typo in one half of a word are still found.
+func searchPatterns(q string) []string {
+	seen := map[string]bool{}
+	patterns := []string{}
+	add := func(part string) {
+		p := "%" + part + "%"
+		if !seen[p] {
+			seen[p] = true
+			patterns = append(patterns, p)
+		}
+	}
+
+	for _, w := range strings.Fields(q) {
+		r := []rune(w)
+		if len(r) <= 3 {
+			add(w)
+			continue
+		}
+		add(string(r[:3]))
+		add(string(r[len(r)-3:]))
+	}
+
+	return patterns
+}
+
+func searchLimit(limit int) int {
+	switch {
+	case limit < 1:
+		return DefaultSearchLimit
+	case limit > MaxSearchLimit:
+		return MaxSearchLimit
+	}
+
+	return limit
+}
+
+// UpdateSearchTitles fills Search_Title and Search_Description of the
+// series stored before the columns existed. NewApp runs it at startup.
+func UpdateSearchTitles(db *sql.DB) (int, error) {
+	return UpdateSearchTitlesContext(context.Background(), db)
+}
+
+func UpdateSearchTitlesContext(ctx context.Context, db *sql.DB) (int, error) {
+	m := `SELECT ID, Title, Image, Description FROM %v
+	WHERE Search_Title = '' OR (Search_Description = '' AND Description <> '')`
+	q := fmt.Sprintf(m, quote(SeriesTable))
+	rows, err := dbQuery(ctx, db, q)
+	if err != nil {
+		return 0, err
+	}
+	sList, err := scanSeriesList(rows)
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, s := range sList {
+		title := FoldText(s.Title)
+		desc := FoldText(s.Description)
+		if title == "" && desc == "" {
+			continue
+		}
+
+		m := "UPDATE %v SET Search_Title = ?, Search_Description = ? WHERE ID = ?"
+		q := fmt.Sprintf(m, quote(SeriesTable))
+		_, err := dbExec(ctx, db, q, title, desc, s.ID)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+func SearchSeriesList(db *sql.DB, userID int64, query string, limit int) (SearchResultList, error) {
+	return SearchSeriesListContext(context.Background(), db, userID, query, limit)
+}
+
+func SearchSeriesListContext(ctx context.Context, db *sql.DB, userID int64, query string, limit int) (SearchResultList, error) {
+	sList, err := ReadSeriesListContext(ctx, db, userID)
+	if err != nil {
+		return SearchResultList{}, err
+	}
+
+	return RankSeries(sList, query, searchLimit(limit)), nil
+}
+
+// RankSeries scores every series against the query and returns the matches
+// ordered by descending score. A limit < 1 returns all matches.
+func RankSeries(sList SeriesList, query string, limit int) SearchResultList {
+	q := FoldText(query)
+	results := SearchResultList{}
+	if q == "" {
+		return results
+	}
+
+	for _, s := range sList {
+		score := scoreSeries(s, q)
+		if score > 0 {
+			results = append(results, SearchResult{
+				Series: s,
+				Score:  score,
+			})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return FoldText(results[i].Series.Title) < FoldText(results[j].Series.Title)
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results
+}
+
+// FoldText lower-cases the text, removes accents and collapses everything
+// that is not a letter or a digit into single spaces.
+func FoldText(text string) string {
+	buf := make([]rune, 0, len(text))
+	space := true
+	for _, r := range strings.ToLower(text) {
+		if f, ok := foldMap[r]; ok {
+			buf = append(buf, []rune(f)...)
+			space = false
+			continue
+		}
+
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			buf = append(buf, r)
+			space = false
+			continue
+		}
+
+		if !space {
+			buf = append(buf, ' ')
+			space = true
+		}
+	}
+
+	return strings.TrimSpace(string(buf))
+}
+
+func scoreSeries(s Series, q string) float64 {
+	title := FoldText(s.Title)
+	desc := FoldText(s.Description)
+
+	switch {
+	case title == q:
+		return scoreExact
+	case strings.HasPrefix(title, q):
+		return scorePrefix
+	case hasWordPrefix(title, q):
+		return scoreWordPrefix
+	case strings.Contains(title, q):
+		return scoreContains
+	}
+
+	if sim := fuzzyMatch(title, q); sim > 0 {
+		return scoreFuzzy * sim
+	}
+
+	if desc == "" {
+		return 0
+	}
+
+	if strings.Contains(desc, q) {
+		return scoreDescription
+	}
+
+	if sim := fuzzyMatch(desc, q); sim > 0 {
+		return scoreDescFuzzy * sim
+	}
+
+	return 0
+}
+
+func hasWordPrefix(text, q string) bool {
+	for _, w := range strings.Fields(text) {
+		if strings.HasPrefix(w, q) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fuzzyMatch returns the mean similarity of every query word to its closest
+// word in text, or 0 if one of the query words has no close match.
+func fuzzyMatch(text, q string) float64 {
+	words := strings.Fields(text)
+	qWords := strings.Fields(q)
+	if len(words) == 0 || len(qWords) == 0 {
+		return 0
+	}
+
+	sum := 0.0
+	for _, qw := range qWords {
+		best := 0.0
+		for _, w := range words {
+			if strings.HasPrefix(w, qw) {
+				best = 1
+				break
+			}
+
+			d := levenshtein(qw, w)
+			if d > maxEditDistance(qw) {
+				continue
+			}
+
+			l := len([]rune(w))
+			if ql := len([]rune(qw)); ql > l {
+				l = ql
+			}
+
+			sim := 1 - float64(d)/float64(l)
+			if sim > best {
+				best = sim
+			}
+		}
+
+		if best == 0 {
+			return 0
+		}
+		sum += best
+	}
+
+	return sum / float64(len(qWords))
+}
+
+func maxEditDistance(w string) int {
+	switch l := len([]rune(w)); {
+	case l < 3:
+		return 0
+	case l < 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func levenshtein(a, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
@@ -0,0 +1,201 @@
+package sj
+
+import (
+	"fmt"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var catalog = SeriesList{
+	{1, "Mr. Robot", "robot.png", "A hacker joins fsociety."},
+	{2, "Narcos", "narcos.png", "The rise of Pablo Escobar."},
+	{3, "Die Brücke", "bruecke.png", "Eine Leiche auf der Öresundbrücke."},
+	{4, "Robot Chicken", "chicken.png", ""},
+	{5, "Dark", "dark.png", "Zeitreisen in Winden."},
+}
+
+func ResultIDs(results SearchResultList) []int64 {
+	ids := []int64{}
+	for _, r := range results {
+		ids = append(ids, r.Series.ID)
+	}
+
+	return ids
+}
+
+func EqualIDs(expect, result []int64) error {
+	if fmt.Sprint(expect) != fmt.Sprint(result) {
+		return fmt.Errorf("Expect %v was %v", expect, result)
+	}
+
+	return nil
+}
+
+func Test_FoldText_OK(t *testing.T) {
+	cases := map[string]string{
+		"Die Brücke":       "die brucke",
+		"  Mr. Robot!  ":   "mr robot",
+		"Straße der Öfen":  "strasse der ofen",
+		"Café-Crème, Noël": "cafe creme noel",
+	}
+
+	for in, expect := range cases {
+		if r := FoldText(in); r != expect {
+			t.Fatal("Expect", expect, "was", r)
+		}
+	}
+}
+
+func Test_RankSeries_OK(t *testing.T) {
+	cases := []struct {
+		Query  string
+		Expect []int64
+	}{
+		{"robot", []int64{4, 1}},
+		{"mr. robot", []int64{1}},
+		{"brucke", []int64{3}},
+		{"BRÜCKE", []int64{3}},
+		{"narcso", []int64{2}},
+		{"escobar", []int64{2}},
+		{"zeitreise", []int64{5}},
+		{"xyz", []int64{}},
+		{"", []int64{}},
+	}
+
+	for _, c := range cases {
+		results := RankSeries(catalog, c.Query, 0)
+		if err := EqualIDs(c.Expect, ResultIDs(results)); err != nil {
+			t.Fatal(c.Query, err)
+		}
+	}
+}
+
+func Test_RankSeries_Limit(t *testing.T) {
+	results := RankSeries(catalog, "r", 1)
+	if len(results) != 1 {
+		t.Fatal("Expect 1 was", len(results))
+	}
+}
+
+func Test_SearchLimit(t *testing.T) {
+	cases := map[int]int{
+		-1:                 DefaultSearchLimit,
+		0:                  DefaultSearchLimit,
+		5:                  5,
+		MaxSearchLimit + 1: MaxSearchLimit,
+	}
+	for limit, expect := range cases {
+		if l := searchLimit(limit); l != expect {
+			t.Fatal("Expect", expect, "was", l)
+		}
+	}
+}
+
+func Test_SearchPatterns(t *testing.T) {
+	patterns := searchPatterns("the walking dead")
+	expect := []string{"%the%", "%wal%", "%ing%", "%dea%", "%ead%"}
+	if len(patterns) != len(expect) {
+		t.Fatal("Expect", expect, "was", patterns)
+	}
+	for i := range expect {
+		if patterns[i] != expect[i] {
+			t.Fatal("Expect", expect, "was", patterns)
+		}
+	}
+}
+
+func Test_SearchSeries_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("SELECT ID, Title, Image, Description FROM %v", SeriesTable)
+	rows := sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"})
+	for _, s := range catalog {
+		rows.AddRow(s.ID, s.Title, s.Image, s.Description)
+	}
+	q += " WHERE Search_Title LIKE \\? OR Search_Description LIKE \\? OR Search_Title LIKE \\? OR Search_Description LIKE \\?"
+	mock.ExpectQuery(q).WithArgs("%dar%", "%dar%", "%ark%", "%ark%").WillReturnRows(rows)
+
+	results, err := SearchSeries(db, "dark", DefaultSearchLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EqualIDs([]int64{5}, ResultIDs(results)); err != nil {
+		t.Fatal(err)
+	}
+
+	if results[0].Score != scoreExact {
+		t.Fatal("Expect", scoreExact, "was", results[0].Score)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_SearchSeries_Description(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The folded description of Die Brücke contains oresundbrucke
+	q := fmt.Sprintf("SELECT ID, Title, Image, Description FROM %v", SeriesTable)
+	rows := sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"}).
+		AddRow(catalog[2].ID, catalog[2].Title, catalog[2].Image, catalog[2].Description)
+	mock.ExpectQuery(q).WithArgs("%ore%", "%ore%", "%und%", "%und%").WillReturnRows(rows)
+
+	results, err := SearchSeries(db, "Oresund", DefaultSearchLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EqualIDs([]int64{3}, ResultIDs(results)); err != nil {
+		t.Fatal(err)
+	}
+
+	if results[0].Score != scoreDescription {
+		t.Fatal("Expect", scoreDescription, "was", results[0].Score)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_UpdateSearchTitles_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("SELECT ID, Title, Image, Description FROM %v\\s+WHERE Search_Title = ''", SeriesTable)
+	rows := sqlmock.NewRows([]string{"ID", "Title", "Image", "Description"}).
+		AddRow(catalog[2].ID, catalog[2].Title, catalog[2].Image, catalog[2].Description)
+	mock.ExpectQuery(q).WillReturnRows(rows)
+
+	q = fmt.Sprintf("UPDATE %v SET Search_Title = \\?, Search_Description = \\?", SeriesTable)
+	mock.ExpectExec(q).
+		WithArgs("die brucke", "eine leiche auf der oresundbrucke", catalog[2].ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	n, err := UpdateSearchTitles(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Fatal("Expect 1 was", n)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,422 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+)
+
+const (
+	// Last_Seen is only written once per interval, not on every request.
+	sessionTouchInterval = time.Minute
+
+	maxUserAgentLength = 250
+)
+
+type (
+	// SessionRegistry wraps a kauth session store and records every
+	// session in the database. Sessions which are missing in the registry
+	// are revoked, so they can be removed without knowing their token.
+	SessionRegistry struct {
+		Store kauth.SessionStore
+		DB    *sql.DB
+	}
+
+	SessionClient struct {
+		UserAgent string
+		IP        string
+	}
+
+	SessionInfo struct {
+		ID        int64
+		UserAgent string
+		IP        string
+		Created   time.Time
+		LastSeen  time.Time
+		Expires   time.Time
+		Current   bool
+	}
+
+	SessionInfoList []SessionInfo
+
+	// ClientSessionStore is implemented by stores which record the client
+	// of a new session.
+	ClientSessionStore interface {
+		NewClientSession(id string, expires time.Time, client SessionClient) (kauth.Session, error)
+	}
+)
+
+// SessionRoutes registers the endpoints to list and revoke the sessions of
+// the signed in user.
+func SessionRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	r.GET("/sessions", signedIn(NewAppHandler(app, ListSessionsHandler)))
+	r.DELETE("/sessions", signedIn(NewAppHandler(app, RemoveAllSessionsHandler)))
+	r.DELETE("/sessions/:id", signedIn(NewAppHandler(app, RemoveSessionHandler)))
+}
+
+func NewSessionRegistry(store kauth.SessionStore, db *sql.DB) *SessionRegistry {
+	return &SessionRegistry{
+		Store: store,
+		DB:    db,
+	}
+}
+
+func (r *SessionRegistry) NewSession(id string, expires time.Time) (kauth.Session, error) {
+	return r.NewClientSession(id, expires, SessionClient{})
+}
+
+func (r *SessionRegistry) NewClientSession(id string, expires time.Time, client SessionClient) (kauth.Session, error) {
+	session, err := r.Store.NewSession(id, expires)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := parseUserID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = NewSessionInfo(r.DB, userID, session.Token(), client, expires)
+	if err != nil {
+		r.Store.RemoveSession(session.Token())
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// ReadSession returns the session only if it is still registered. Errors
+// of the database count as revoked, the request has to be repeated.
+func (r *SessionRegistry) ReadSession(token string) (kauth.Session, bool) {
+	session, ok := r.Store.ReadSession(token)
+	if !ok {
+		return nil, false
+	}
+
+	info, err := FindSessionInfo(r.DB, token)
+	if err == sql.ErrNoRows {
+		r.Store.RemoveSession(token)
+		return nil, false
+	}
+	if err != nil {
+		return nil, false
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(info.LastSeen) > sessionTouchInterval {
+		TouchSessionInfo(r.DB, info.ID, now)
+	}
+
+	return session, true
+}
+
+func (r *SessionRegistry) RemoveSession(token string) error {
+	err := r.Store.RemoveSession(token)
+	if err != nil {
+		return err
+	}
+
+	return RemoveSessionInfoByToken(r.DB, token)
+}
+
+func (r *SessionRegistry) RemoveExpiredSessions() (int, error) {
+	n, err := r.Store.RemoveExpiredSessions()
+	if err != nil {
+		return n, err
+	}
+
+	return n, RemoveExpiredSessionInfos(r.DB, time.Now().UTC())
+}
+
+func NewSessionInfo(db *sql.DB, userID int64, token string, client SessionClient, expires time.Time) error {
+	return NewSessionInfoContext(context.Background(), db, userID, token, client, expires)
+}
+
+func NewSessionInfoContext(ctx context.Context, db *sql.DB, userID int64, token string, client SessionClient, expires time.Time) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	ua := client.UserAgent
+	if len(ua) > maxUserAgentLength {
+		ua = ua[:maxUserAgentLength]
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	m := `INSERT INTO %v (User_ID,Token_Hash,User_Agent,IP,Created,Last_Seen,Expires)
+	VALUES(?, ?, ?, ?, ?, ?, ?)`
+	q := fmt.Sprintf(m, quote(SessionTable))
+	_, err := dbExec(ctx, db, q, userID, HashAPIToken(token), ua, client.IP,
+		now, now, expires.UTC().Truncate(time.Second))
+
+	return err
+}
+
+func FindSessionInfo(db *sql.DB, token string) (SessionInfo, error) {
+	return FindSessionInfoContext(context.Background(), db, token)
+}
+
+func FindSessionInfoContext(ctx context.Context, db *sql.DB, token string) (SessionInfo, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT ID, User_Agent, IP, Created, Last_Seen, Expires FROM %v WHERE Token_Hash = ?"
+	q := fmt.Sprintf(m, quote(SessionTable))
+
+	return scanSessionInfo(dbQueryRow(ctx, db, q, HashAPIToken(token)))
+}
+
+func TouchSessionInfo(db *sql.DB, id int64, now time.Time) error {
+	return TouchSessionInfoContext(context.Background(), db, id, now)
+}
+
+func TouchSessionInfoContext(ctx context.Context, db *sql.DB, id int64, now time.Time) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "UPDATE %v SET Last_Seen = ? WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(SessionTable))
+	_, err := dbExec(ctx, db, q, now.Truncate(time.Second), id)
+
+	return err
+}
+
+// ReadSessionInfoList returns the sessions of the user, current is the
+// token of the session which asks.
+func ReadSessionInfoList(db *sql.DB, userID int64, current string) (SessionInfoList, error) {
+	return ReadSessionInfoListContext(context.Background(), db, userID, current)
+}
+
+func ReadSessionInfoListContext(ctx context.Context, db *sql.DB, userID int64, current string) (SessionInfoList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `
+	SELECT ID, User_Agent, IP, Created, Last_Seen, Expires, Token_Hash
+	FROM %v
+	WHERE User_ID = ? AND Expires > ?
+	ORDER BY Last_Seen DESC
+	`
+	q := fmt.Sprintf(m, quote(SessionTable))
+	rows, err := dbQuery(ctx, db, q, userID, time.Now().UTC())
+	if err != nil {
+		return SessionInfoList{}, err
+	}
+	defer rows.Close()
+
+	currentHash := ""
+	if current != "" {
+		currentHash = HashAPIToken(current)
+	}
+
+	sList := SessionInfoList{}
+	for rows.Next() {
+		s := SessionInfo{}
+		var hash string
+		err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.Created, &s.LastSeen,
+			&s.Expires, &hash)
+		if err != nil {
+			return SessionInfoList{}, err
+		}
+
+		s.Current = hash == currentHash
+		sList = append(sList, s)
+	}
+
+	return sList, rows.Err()
+}
+
+func RemoveSessionInfo(db *sql.DB, userID, id int64) (int64, error) {
+	return RemoveSessionInfoContext(context.Background(), db, userID, id)
+}
+
+func RemoveSessionInfoContext(ctx context.Context, db *sql.DB, userID, id int64) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "DELETE FROM %v WHERE ID = ? AND User_ID = ?"
+	q := fmt.Sprintf(s, quote(SessionTable))
+	rsrc, err := dbExec(ctx, db, q, id, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return rsrc.RowsAffected()
+}
+
+func RemoveSessionInfoByToken(db *sql.DB, token string) error {
+	return RemoveSessionInfoByTokenContext(context.Background(), db, token)
+}
+
+func RemoveSessionInfoByTokenContext(ctx context.Context, db *sql.DB, token string) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "DELETE FROM %v WHERE Token_Hash = ?"
+	q := fmt.Sprintf(s, quote(SessionTable))
+	_, err := dbExec(ctx, db, q, HashAPIToken(token))
+
+	return err
+}
+
+// RemoveUserSessions revokes all sessions of the user but the one of keep,
+// an empty keep revokes all.
+func RemoveUserSessions(db *sql.DB, userID int64, keep string) error {
+	return RemoveUserSessionsContext(context.Background(), db, userID, keep)
+}
+
+func RemoveUserSessionsContext(ctx context.Context, db *sql.DB, userID int64, keep string) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	if keep == "" {
+		s := "DELETE FROM %v WHERE User_ID = ?"
+		q := fmt.Sprintf(s, quote(SessionTable))
+		_, err := dbExec(ctx, db, q, userID)
+		return err
+	}
+
+	s := "DELETE FROM %v WHERE User_ID = ? AND Token_Hash <> ?"
+	q := fmt.Sprintf(s, quote(SessionTable))
+	_, err := dbExec(ctx, db, q, userID, HashAPIToken(keep))
+
+	return err
+}
+
+func RemoveExpiredSessionInfos(db *sql.DB, now time.Time) error {
+	return RemoveExpiredSessionInfosContext(context.Background(), db, now)
+}
+
+func RemoveExpiredSessionInfosContext(ctx context.Context, db *sql.DB, now time.Time) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "DELETE FROM %v WHERE Expires <= ?"
+	q := fmt.Sprintf(s, quote(SessionTable))
+	_, err := dbExec(ctx, db, q, now)
+
+	return err
+}
+
+func scanSessionInfo(row scanner) (SessionInfo, error) {
+	s := SessionInfo{}
+	err := row.Scan(&s.ID, &s.UserAgent, &s.IP, &s.Created, &s.LastSeen, &s.Expires)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+
+	return s, nil
+}
+
+func ListSessionsHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	sList, err := ReadSessionInfoListContext(ctx, app.DB, userID, currentSessionToken(c))
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(sList)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func RemoveSessionHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	affected, err := RemoveSessionInfoContext(ctx, app.DB, userID, id)
+	if err != nil {
+		return err
+	}
+
+	if affected < 1 {
+		return errors.New("Cannot found session")
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// RemoveAllSessionsHandler logs the user out everywhere, the session of the
+// request included.
+func RemoveAllSessionsHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	err = RemoveUserSessionsContext(ctx, app.DB, userID, "")
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// currentSessionToken returns the token of the kauth session of the
+// request, requests with an API token have none.
+func currentSessionToken(c *gin.Context) string {
+	if _, ok := readAPIToken(c); ok {
+		return ""
+	}
+
+	session, err := kauth.ReadSession(c)
+	if err != nil {
+		return ""
+	}
+
+	return session.Token()
+}
+
+// newSession records the client of the request if the store supports it.
+func newSession(store kauth.SessionStore, id string, expires time.Time, c *gin.Context) (kauth.Session, error) {
+	cs, ok := store.(ClientSessionStore)
+	if !ok {
+		return store.NewSession(id, expires)
+	}
+
+	client := SessionClient{
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+	}
+
+	return cs.NewClientSession(id, expires, client)
+}
+
+func parseUserID(id string) (int64, error) {
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, errors.New("Wrong value in user id")
+	}
+
+	return userID, nil
+}
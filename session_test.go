@@ -0,0 +1,118 @@
+package sj
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/smem"
+)
+
+var sessionInfoColumns = []string{
+	"ID", "User_Agent", "IP", "Created", "Last_Seen", "Expires",
+}
+
+func Test_SessionRegistry_Revoke(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := smem.NewStore()
+	registry := NewSessionRegistry(&store, db)
+	expires := time.Now().Add(time.Hour)
+
+	q := fmt.Sprintf("INSERT INTO %v", SessionTable)
+	mock.ExpectExec(q).
+		WithArgs(14, sqlmock.AnyArg(), "curl", "127.0.0.1", sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	client := SessionClient{UserAgent: "curl", IP: "127.0.0.1"}
+	session, err := registry.NewClientSession("14", expires, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q = fmt.Sprintf("SELECT ID, User_Agent, IP, Created, Last_Seen, Expires FROM %v", SessionTable)
+	rows := sqlmock.NewRows(sessionInfoColumns).
+		AddRow(1, "curl", "127.0.0.1", time.Now(), time.Now().Add(-time.Hour), expires)
+	mock.ExpectQuery(q).
+		WithArgs(HashAPIToken(session.Token())).
+		WillReturnRows(rows)
+
+	q = fmt.Sprintf("UPDATE %v SET Last_Seen", SessionTable)
+	mock.ExpectExec(q).
+		WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if _, ok := registry.ReadSession(session.Token()); !ok {
+		t.Fatal("Expect registered session")
+	}
+
+	// The session was revoked by another device
+	q = fmt.Sprintf("SELECT ID, User_Agent, IP, Created, Last_Seen, Expires FROM %v", SessionTable)
+	mock.ExpectQuery(q).WillReturnError(sql.ErrNoRows)
+
+	if _, ok := registry.ReadSession(session.Token()); ok {
+		t.Fatal("Expect revoked session")
+	}
+
+	if _, ok := store.ReadSession(session.Token()); ok {
+		t.Fatal("Expect session to be removed from the store")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_GET_Sessions_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+	sessionStore := smem.NewStore()
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	session, err := sessionStore.NewSession("14", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := time.Now().UTC().Truncate(time.Second)
+	q := fmt.Sprintf("SELECT ID, User_Agent, IP, Created, Last_Seen, Expires, Token_Hash FROM %v", SessionTable)
+	rows := sqlmock.NewRows(append(sessionInfoColumns, "Token_Hash")).
+		AddRow(1, "curl", "127.0.0.1", seen, seen, expires, HashAPIToken(session.Token())).
+		AddRow(2, "firefox", "10.0.0.1", seen, seen, expires, HashAPIToken("other"))
+	mock.ExpectQuery(q).WithArgs(userID, sqlmock.AnyArg()).WillReturnRows(rows)
+
+	srv := gin.New()
+	SessionRoutes(srv.Group("/"), AppCtx{DB: db}, SignedIn(AppCtx{DB: db}, &sessionStore))
+
+	req := TestRequest{
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("GET", "/sessions", session.Token())
+
+	expect := NewSuccessResponse(SessionInfoList{
+		{ID: 1, UserAgent: "curl", IP: "127.0.0.1", Created: seen, LastSeen: seen, Expires: expires, Current: true},
+		{ID: 2, UserAgent: "firefox", IP: "10.0.0.1", Created: seen, LastSeen: seen, Expires: expires},
+	})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,5 @@
+-- NewApp fills the search columns of the existing series
+ALTER TABLE Series
+	ADD Description varchar(2000) NOT NULL DEFAULT '',
+	ADD Search_Title varchar(250) NOT NULL DEFAULT '',
+	ADD Search_Description varchar(4000) NOT NULL DEFAULT '';
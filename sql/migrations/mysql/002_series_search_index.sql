@@ -0,0 +1 @@
+ALTER TABLE Series ADD INDEX Search_Title (Search_Title);
@@ -0,0 +1,3 @@
+ALTER TABLE User
+	ADD Role varchar(16) NOT NULL DEFAULT 'user',
+	ADD Disabled boolean NOT NULL DEFAULT false;
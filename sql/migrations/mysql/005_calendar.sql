@@ -0,0 +1,5 @@
+ALTER TABLE Episodes ADD AirDate date NULL;
+CREATE TABLE CalendarFeed (
+	User_ID int PRIMARY KEY,
+	Token_Hash char(64) NOT NULL UNIQUE
+);
@@ -0,0 +1,8 @@
+CREATE TABLE APIToken (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	Name varchar(250) NOT NULL,
+	Token_Hash varchar(64) NOT NULL UNIQUE,
+	Read_Only boolean NOT NULL DEFAULT false,
+	Created datetime NOT NULL
+);
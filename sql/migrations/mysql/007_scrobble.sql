@@ -0,0 +1,17 @@
+CREATE TABLE SeriesExternalID (
+	User_ID int NOT NULL DEFAULT 0,
+	Provider varchar(32) NOT NULL,
+	External_ID varchar(250) NOT NULL,
+	Series_ID int NOT NULL,
+	PRIMARY KEY (User_ID, Provider, External_ID)
+);
+CREATE TABLE ScrobbleInbox (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	Source varchar(32) NOT NULL,
+	Title varchar(250) NOT NULL,
+	Session int NOT NULL,
+	Episode int NOT NULL,
+	External_IDs varchar(1000) NOT NULL DEFAULT '',
+	Created datetime NOT NULL
+);
@@ -0,0 +1,21 @@
+CREATE TABLE Webhook (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	URL varchar(2000) NOT NULL,
+	Secret varchar(64) NOT NULL,
+	Events varchar(250) NOT NULL DEFAULT '',
+	Created datetime NOT NULL
+);
+CREATE TABLE WebhookDelivery (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	Webhook_ID int NOT NULL,
+	Event varchar(32) NOT NULL,
+	Payload text NOT NULL,
+	Status varchar(16) NOT NULL,
+	Attempts int NOT NULL DEFAULT 0,
+	Next_Attempt datetime NOT NULL,
+	Response_Code int NOT NULL DEFAULT 0,
+	Last_Error varchar(500) NOT NULL DEFAULT '',
+	Created datetime NOT NULL,
+	INDEX Due (Status, Next_Attempt)
+);
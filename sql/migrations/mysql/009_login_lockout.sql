@@ -0,0 +1,3 @@
+ALTER TABLE User
+	ADD Failed_Logins int NOT NULL DEFAULT 0,
+	ADD Locked_Until datetime NULL;
@@ -0,0 +1,12 @@
+CREATE TABLE TOTP (
+	User_ID int PRIMARY KEY,
+	Secret varchar(64) NOT NULL,
+	Enabled boolean NOT NULL DEFAULT false,
+	Last_Counter bigint NOT NULL DEFAULT 0,
+	Created datetime NOT NULL
+);
+CREATE TABLE RecoveryCode (
+	User_ID int NOT NULL,
+	Code_Hash char(64) NOT NULL,
+	PRIMARY KEY (User_ID, Code_Hash)
+);
@@ -0,0 +1,10 @@
+CREATE TABLE UserSession (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	Token_Hash char(64) NOT NULL UNIQUE,
+	User_Agent varchar(250) NOT NULL DEFAULT '',
+	IP varchar(45) NOT NULL DEFAULT '',
+	Created datetime NOT NULL,
+	Last_Seen datetime NOT NULL,
+	Expires datetime NOT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE UserIdentity (
+	Issuer varchar(500) NOT NULL,
+	Subject varchar(255) NOT NULL,
+	User_ID int NOT NULL,
+	Email varchar(500) NOT NULL DEFAULT '',
+	Created datetime NOT NULL,
+	PRIMARY KEY (Issuer(200), Subject)
+);
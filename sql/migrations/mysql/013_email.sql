@@ -0,0 +1,14 @@
+ALTER TABLE User ADD Email varchar(500) NOT NULL DEFAULT '';
+CREATE TABLE PasswordReset (
+	Token_Hash char(64) PRIMARY KEY,
+	User_ID int NOT NULL,
+	Expires datetime NOT NULL,
+	Created datetime NOT NULL
+);
+CREATE TABLE EmailVerification (
+	Token_Hash char(64) PRIMARY KEY,
+	User_ID int NOT NULL,
+	Email varchar(500) NOT NULL,
+	Expires datetime NOT NULL,
+	Created datetime NOT NULL
+);
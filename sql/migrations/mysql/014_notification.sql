@@ -0,0 +1,17 @@
+CREATE TABLE NotificationPreference (
+	User_ID int PRIMARY KEY,
+	Mode varchar(16) NOT NULL DEFAULT 'off',
+	Email boolean NOT NULL DEFAULT false,
+	Push boolean NOT NULL DEFAULT false,
+	Unsubscribe_Token varchar(64) NOT NULL UNIQUE,
+	Notified_Until date NOT NULL
+);
+CREATE TABLE PushSubscription (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	Endpoint varchar(1000) NOT NULL,
+	P256dh varchar(250) NOT NULL,
+	Auth varchar(64) NOT NULL,
+	Created datetime NOT NULL,
+	UNIQUE KEY Endpoint (Endpoint(250))
+);
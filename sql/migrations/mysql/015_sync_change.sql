@@ -0,0 +1,14 @@
+ALTER TABLE User ADD Sync_Version bigint NOT NULL DEFAULT 0;
+CREATE TABLE SyncChange (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	Version bigint NOT NULL,
+	Kind varchar(16) NOT NULL,
+	Series_ID int NOT NULL,
+	Deleted boolean NOT NULL DEFAULT false,
+	Session int NOT NULL DEFAULT 0,
+	Episode int NOT NULL DEFAULT 0,
+	Updated datetime NOT NULL,
+	INDEX Item (User_ID, Kind, Series_ID),
+	INDEX Version (User_ID, Version)
+);
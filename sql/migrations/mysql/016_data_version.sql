@@ -0,0 +1,5 @@
+ALTER TABLE SyncChange ADD Created datetime NULL;
+UPDATE SyncChange SET Created = Updated;
+ALTER TABLE SyncChange MODIFY Created datetime NOT NULL;
+ALTER TABLE Series ADD Updated datetime NULL;
+ALTER TABLE User ADD Sync_Updated datetime NULL;
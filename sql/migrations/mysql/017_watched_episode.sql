@@ -0,0 +1,6 @@
+CREATE TABLE WatchedEpisode (
+	User_ID int NOT NULL,
+	Episode_ID int NOT NULL,
+	Watched datetime NOT NULL,
+	PRIMARY KEY (User_ID, Episode_ID)
+);
@@ -0,0 +1,7 @@
+-- Databases from an older postgres.sql can have some changes already, so
+-- the Postgres scripts only add what is missing
+-- NewApp fills the search columns of the existing series
+ALTER TABLE "Series"
+	ADD COLUMN IF NOT EXISTS Description varchar(2000) NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS Search_Title varchar(250) NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS Search_Description varchar(4000) NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS Series_Search_Title ON "Series" (Search_Title);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS "InviteCode" (
+	Code varchar(64) PRIMARY KEY,
+	Created_By int NOT NULL,
+	Used_By int NULL,
+	Created timestamp NOT NULL
+);
@@ -0,0 +1,3 @@
+ALTER TABLE "User"
+	ADD COLUMN IF NOT EXISTS Role varchar(16) NOT NULL DEFAULT 'user',
+	ADD COLUMN IF NOT EXISTS Disabled boolean NOT NULL DEFAULT false;
@@ -0,0 +1,5 @@
+ALTER TABLE "Episodes" ADD COLUMN IF NOT EXISTS AirDate date NULL;
+CREATE TABLE IF NOT EXISTS "CalendarFeed" (
+	User_ID int PRIMARY KEY,
+	Token_Hash char(64) NOT NULL UNIQUE
+);
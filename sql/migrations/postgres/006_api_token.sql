@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS "APIToken" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	Name varchar(250) NOT NULL,
+	Token_Hash varchar(64) NOT NULL UNIQUE,
+	Read_Only boolean NOT NULL DEFAULT false,
+	Created timestamp NOT NULL
+);
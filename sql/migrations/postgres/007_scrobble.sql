@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS "SeriesExternalID" (
+	User_ID int NOT NULL DEFAULT 0,
+	Provider varchar(32) NOT NULL,
+	External_ID varchar(250) NOT NULL,
+	Series_ID int NOT NULL,
+	PRIMARY KEY (User_ID, Provider, External_ID)
+);
+CREATE TABLE IF NOT EXISTS "ScrobbleInbox" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	Source varchar(32) NOT NULL,
+	Title varchar(250) NOT NULL,
+	Session int NOT NULL,
+	Episode int NOT NULL,
+	External_IDs varchar(1000) NOT NULL DEFAULT '',
+	Created timestamp NOT NULL
+);
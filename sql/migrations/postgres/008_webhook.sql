@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS "Webhook" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	URL varchar(2000) NOT NULL,
+	Secret varchar(64) NOT NULL,
+	Events varchar(250) NOT NULL DEFAULT '',
+	Created timestamp NOT NULL
+);
+CREATE TABLE IF NOT EXISTS "WebhookDelivery" (
+	ID serial PRIMARY KEY,
+	Webhook_ID int NOT NULL,
+	Event varchar(32) NOT NULL,
+	Payload text NOT NULL,
+	Status varchar(16) NOT NULL,
+	Attempts int NOT NULL DEFAULT 0,
+	Next_Attempt timestamp NOT NULL,
+	Response_Code int NOT NULL DEFAULT 0,
+	Last_Error varchar(500) NOT NULL DEFAULT '',
+	Created timestamp NOT NULL
+);
+CREATE INDEX IF NOT EXISTS WebhookDelivery_Due ON "WebhookDelivery" (Status, Next_Attempt);
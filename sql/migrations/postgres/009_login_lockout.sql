@@ -0,0 +1,3 @@
+ALTER TABLE "User"
+	ADD COLUMN IF NOT EXISTS Failed_Logins int NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS Locked_Until timestamp NULL;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS "TOTP" (
+	User_ID int PRIMARY KEY,
+	Secret varchar(64) NOT NULL,
+	Enabled boolean NOT NULL DEFAULT false,
+	Last_Counter bigint NOT NULL DEFAULT 0,
+	Created timestamp NOT NULL
+);
+CREATE TABLE IF NOT EXISTS "RecoveryCode" (
+	User_ID int NOT NULL,
+	Code_Hash char(64) NOT NULL,
+	PRIMARY KEY (User_ID, Code_Hash)
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS "UserSession" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	Token_Hash char(64) NOT NULL UNIQUE,
+	User_Agent varchar(250) NOT NULL DEFAULT '',
+	IP varchar(45) NOT NULL DEFAULT '',
+	Created timestamp NOT NULL,
+	Last_Seen timestamp NOT NULL,
+	Expires timestamp NOT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS "UserIdentity" (
+	Issuer varchar(500) NOT NULL,
+	Subject varchar(255) NOT NULL,
+	User_ID int NOT NULL,
+	Email varchar(500) NOT NULL DEFAULT '',
+	Created timestamp NOT NULL,
+	PRIMARY KEY (Issuer, Subject)
+);
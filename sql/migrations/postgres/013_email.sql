@@ -0,0 +1,14 @@
+ALTER TABLE "User" ADD COLUMN IF NOT EXISTS Email varchar(500) NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS "PasswordReset" (
+	Token_Hash char(64) PRIMARY KEY,
+	User_ID int NOT NULL,
+	Expires timestamp NOT NULL,
+	Created timestamp NOT NULL
+);
+CREATE TABLE IF NOT EXISTS "EmailVerification" (
+	Token_Hash char(64) PRIMARY KEY,
+	User_ID int NOT NULL,
+	Email varchar(500) NOT NULL,
+	Expires timestamp NOT NULL,
+	Created timestamp NOT NULL
+);
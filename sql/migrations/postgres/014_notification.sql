@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS "NotificationPreference" (
+	User_ID int PRIMARY KEY,
+	Mode varchar(16) NOT NULL DEFAULT 'off',
+	Email boolean NOT NULL DEFAULT false,
+	Push boolean NOT NULL DEFAULT false,
+	Unsubscribe_Token varchar(64) NOT NULL UNIQUE,
+	Notified_Until date NOT NULL
+);
+CREATE TABLE IF NOT EXISTS "PushSubscription" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	Endpoint varchar(1000) NOT NULL UNIQUE,
+	P256dh varchar(250) NOT NULL,
+	Auth varchar(64) NOT NULL,
+	Created timestamp NOT NULL
+);
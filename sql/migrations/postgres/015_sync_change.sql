@@ -0,0 +1,14 @@
+ALTER TABLE "User" ADD COLUMN IF NOT EXISTS Sync_Version bigint NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS "SyncChange" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	Version bigint NOT NULL,
+	Kind varchar(16) NOT NULL,
+	Series_ID int NOT NULL,
+	Deleted boolean NOT NULL DEFAULT false,
+	Session int NOT NULL DEFAULT 0,
+	Episode int NOT NULL DEFAULT 0,
+	Updated timestamp NOT NULL
+);
+CREATE INDEX IF NOT EXISTS SyncChange_Item ON "SyncChange" (User_ID, Kind, Series_ID);
+CREATE INDEX IF NOT EXISTS SyncChange_Version ON "SyncChange" (User_ID, Version);
@@ -0,0 +1,5 @@
+ALTER TABLE "SyncChange" ADD COLUMN IF NOT EXISTS Created timestamp NULL;
+UPDATE "SyncChange" SET Created = Updated WHERE Created IS NULL;
+ALTER TABLE "SyncChange" ALTER COLUMN Created SET NOT NULL;
+ALTER TABLE "Series" ADD COLUMN IF NOT EXISTS Updated timestamp NULL;
+ALTER TABLE "User" ADD COLUMN IF NOT EXISTS Sync_Updated timestamp NULL;
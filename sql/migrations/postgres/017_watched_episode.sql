@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS "WatchedEpisode" (
+	User_ID int NOT NULL,
+	Episode_ID int NOT NULL,
+	Watched timestamp NOT NULL,
+	PRIMARY KEY (User_ID, Episode_ID)
+);
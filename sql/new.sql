@@ -2,7 +2,12 @@ CREATE DATABASE IF NOT EXISTS sj;
 CREATE TABLE Series (
 	ID int AUTO_INCREMENT PRIMARY KEY,
 	Title varchar(250),
-	Image varchar(500)
+	Image varchar(500),
+	Description varchar(2000) NOT NULL DEFAULT '',
+	Search_Title varchar(250) NOT NULL DEFAULT '',
+	Search_Description varchar(4000) NOT NULL DEFAULT '',
+	Updated datetime NULL,
+	INDEX Search_Title (Search_Title)
 );
 CREATE TABLE EpisodesResource (
 	ID int AUTO_INCREMENT PRIMARY KEY,
@@ -17,12 +22,20 @@ CREATE TABLE Episodes (
 	Title varchar(500),
 	Session int,
 	Episode int,
+	AirDate date NULL,
 	FOREIGN KEY(Series_ID) REFERENCES Series(ID)
 );
 CREATE TABLE User(
 	ID int AUTO_INCREMENT PRIMARY KEY,
 	Name varchar(500),
-	Password varchar(136)
+	Password varchar(136),
+	Role varchar(16) NOT NULL DEFAULT 'user',
+	Disabled boolean NOT NULL DEFAULT false,
+	Email varchar(500) NOT NULL DEFAULT '',
+	Failed_Logins int NOT NULL DEFAULT 0,
+	Locked_Until datetime NULL,
+	Sync_Version bigint NOT NULL DEFAULT 0,
+	Sync_Updated datetime NULL
 );
 CREATE TABLE SeriesList (
 	User_ID int NOT NULL,
@@ -35,4 +48,140 @@ CREATE TABLE LastWatched (
 	Session int,
 	Episode int,
 	PRIMARY KEY (User_ID, Series_ID)
+);
+CREATE TABLE InviteCode (
+	Code varchar(64) PRIMARY KEY,
+	Created_By int NOT NULL,
+	Used_By int NULL,
+	Created datetime NOT NULL
+);
+CREATE TABLE CalendarFeed (
+	User_ID int PRIMARY KEY,
+	Token_Hash char(64) NOT NULL UNIQUE
+);
+CREATE TABLE APIToken (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	Name varchar(250) NOT NULL,
+	Token_Hash varchar(64) NOT NULL UNIQUE,
+	Read_Only boolean NOT NULL DEFAULT false,
+	Created datetime NOT NULL
+);
+CREATE TABLE SeriesExternalID (
+	User_ID int NOT NULL DEFAULT 0,
+	Provider varchar(32) NOT NULL,
+	External_ID varchar(250) NOT NULL,
+	Series_ID int NOT NULL,
+	PRIMARY KEY (User_ID, Provider, External_ID)
+);
+CREATE TABLE ScrobbleInbox (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	Source varchar(32) NOT NULL,
+	Title varchar(250) NOT NULL,
+	Session int NOT NULL,
+	Episode int NOT NULL,
+	External_IDs varchar(1000) NOT NULL DEFAULT '',
+	Created datetime NOT NULL
+);
+CREATE TABLE Webhook (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	URL varchar(2000) NOT NULL,
+	Secret varchar(64) NOT NULL,
+	Events varchar(250) NOT NULL DEFAULT '',
+	Created datetime NOT NULL
+);
+CREATE TABLE WebhookDelivery (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	Webhook_ID int NOT NULL,
+	Event varchar(32) NOT NULL,
+	Payload text NOT NULL,
+	Status varchar(16) NOT NULL,
+	Attempts int NOT NULL DEFAULT 0,
+	Next_Attempt datetime NOT NULL,
+	Response_Code int NOT NULL DEFAULT 0,
+	Last_Error varchar(500) NOT NULL DEFAULT '',
+	Created datetime NOT NULL,
+	INDEX Due (Status, Next_Attempt)
+);
+CREATE TABLE TOTP (
+	User_ID int PRIMARY KEY,
+	Secret varchar(64) NOT NULL,
+	Enabled boolean NOT NULL DEFAULT false,
+	Last_Counter bigint NOT NULL DEFAULT 0,
+	Created datetime NOT NULL
+);
+CREATE TABLE RecoveryCode (
+	User_ID int NOT NULL,
+	Code_Hash char(64) NOT NULL,
+	PRIMARY KEY (User_ID, Code_Hash)
+);
+CREATE TABLE UserSession (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	Token_Hash char(64) NOT NULL UNIQUE,
+	User_Agent varchar(250) NOT NULL DEFAULT '',
+	IP varchar(45) NOT NULL DEFAULT '',
+	Created datetime NOT NULL,
+	Last_Seen datetime NOT NULL,
+	Expires datetime NOT NULL
+);
+CREATE TABLE UserIdentity (
+	Issuer varchar(500) NOT NULL,
+	Subject varchar(255) NOT NULL,
+	User_ID int NOT NULL,
+	Email varchar(500) NOT NULL DEFAULT '',
+	Created datetime NOT NULL,
+	PRIMARY KEY (Issuer(200), Subject)
+);
+CREATE TABLE PasswordReset (
+	Token_Hash char(64) PRIMARY KEY,
+	User_ID int NOT NULL,
+	Expires datetime NOT NULL,
+	Created datetime NOT NULL
+);
+CREATE TABLE NotificationPreference (
+	User_ID int PRIMARY KEY,
+	Mode varchar(16) NOT NULL DEFAULT 'off',
+	Email boolean NOT NULL DEFAULT false,
+	Push boolean NOT NULL DEFAULT false,
+	Unsubscribe_Token varchar(64) NOT NULL UNIQUE,
+	Notified_Until date NOT NULL
+);
+CREATE TABLE PushSubscription (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	Endpoint varchar(1000) NOT NULL,
+	P256dh varchar(250) NOT NULL,
+	Auth varchar(64) NOT NULL,
+	Created datetime NOT NULL,
+	UNIQUE KEY Endpoint (Endpoint(250))
+);
+CREATE TABLE SyncChange (
+	ID int AUTO_INCREMENT PRIMARY KEY,
+	User_ID int NOT NULL,
+	Version bigint NOT NULL,
+	Kind varchar(16) NOT NULL,
+	Series_ID int NOT NULL,
+	Deleted boolean NOT NULL DEFAULT false,
+	Session int NOT NULL DEFAULT 0,
+	Episode int NOT NULL DEFAULT 0,
+	Updated datetime NOT NULL,
+	Created datetime NOT NULL,
+	INDEX Item (User_ID, Kind, Series_ID),
+	INDEX Version (User_ID, Version)
+);
+CREATE TABLE WatchedEpisode (
+	User_ID int NOT NULL,
+	Episode_ID int NOT NULL,
+	Watched datetime NOT NULL,
+	PRIMARY KEY (User_ID, Episode_ID)
+);
+CREATE TABLE EmailVerification (
+	Token_Hash char(64) PRIMARY KEY,
+	User_ID int NOT NULL,
+	Email varchar(500) NOT NULL,
+	Expires datetime NOT NULL,
+	Created datetime NOT NULL
 )
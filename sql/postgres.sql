@@ -0,0 +1,183 @@
+CREATE TABLE "Series" (
+	ID serial PRIMARY KEY,
+	Title varchar(250),
+	Image varchar(500),
+	Description varchar(2000) NOT NULL DEFAULT '',
+	Search_Title varchar(250) NOT NULL DEFAULT '',
+	Search_Description varchar(4000) NOT NULL DEFAULT '',
+	Updated timestamp NULL
+);
+CREATE TABLE "EpisodesResource" (
+	ID serial PRIMARY KEY,
+	Series_ID int REFERENCES "Series"(ID),
+	Name varchar(250),
+	URL varchar(500)
+);
+CREATE TABLE "Episodes" (
+	ID serial PRIMARY KEY,
+	Series_ID int REFERENCES "Series"(ID),
+	Title varchar(500),
+	Session int,
+	Episode int,
+	AirDate date NULL
+);
+CREATE TABLE "User" (
+	ID serial PRIMARY KEY,
+	Name varchar(500),
+	Password varchar(136),
+	Role varchar(16) NOT NULL DEFAULT 'user',
+	Disabled boolean NOT NULL DEFAULT false,
+	Email varchar(500) NOT NULL DEFAULT '',
+	Failed_Logins int NOT NULL DEFAULT 0,
+	Locked_Until timestamp NULL,
+	Sync_Version bigint NOT NULL DEFAULT 0,
+	Sync_Updated timestamp NULL
+);
+CREATE TABLE "SeriesList" (
+	User_ID int NOT NULL,
+	Series_ID int NOT NULL,
+	PRIMARY KEY (User_ID, Series_ID)
+);
+CREATE TABLE "LastWatched" (
+	User_ID int NOT NULL,
+	Series_ID int NOT NULL,
+	Session int,
+	Episode int,
+	PRIMARY KEY (User_ID, Series_ID)
+);
+CREATE TABLE "InviteCode" (
+	Code varchar(64) PRIMARY KEY,
+	Created_By int NOT NULL,
+	Used_By int NULL,
+	Created timestamp NOT NULL
+);
+CREATE TABLE "CalendarFeed" (
+	User_ID int PRIMARY KEY,
+	Token_Hash char(64) NOT NULL UNIQUE
+);
+CREATE TABLE "APIToken" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	Name varchar(250) NOT NULL,
+	Token_Hash varchar(64) NOT NULL UNIQUE,
+	Read_Only boolean NOT NULL DEFAULT false,
+	Created timestamp NOT NULL
+);
+CREATE TABLE "SeriesExternalID" (
+	User_ID int NOT NULL DEFAULT 0,
+	Provider varchar(32) NOT NULL,
+	External_ID varchar(250) NOT NULL,
+	Series_ID int NOT NULL,
+	PRIMARY KEY (User_ID, Provider, External_ID)
+);
+CREATE TABLE "ScrobbleInbox" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	Source varchar(32) NOT NULL,
+	Title varchar(250) NOT NULL,
+	Session int NOT NULL,
+	Episode int NOT NULL,
+	External_IDs varchar(1000) NOT NULL DEFAULT '',
+	Created timestamp NOT NULL
+);
+CREATE TABLE "Webhook" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	URL varchar(2000) NOT NULL,
+	Secret varchar(64) NOT NULL,
+	Events varchar(250) NOT NULL DEFAULT '',
+	Created timestamp NOT NULL
+);
+CREATE TABLE "WebhookDelivery" (
+	ID serial PRIMARY KEY,
+	Webhook_ID int NOT NULL,
+	Event varchar(32) NOT NULL,
+	Payload text NOT NULL,
+	Status varchar(16) NOT NULL,
+	Attempts int NOT NULL DEFAULT 0,
+	Next_Attempt timestamp NOT NULL,
+	Response_Code int NOT NULL DEFAULT 0,
+	Last_Error varchar(500) NOT NULL DEFAULT '',
+	Created timestamp NOT NULL
+);
+CREATE TABLE "TOTP" (
+	User_ID int PRIMARY KEY,
+	Secret varchar(64) NOT NULL,
+	Enabled boolean NOT NULL DEFAULT false,
+	Last_Counter bigint NOT NULL DEFAULT 0,
+	Created timestamp NOT NULL
+);
+CREATE TABLE "RecoveryCode" (
+	User_ID int NOT NULL,
+	Code_Hash char(64) NOT NULL,
+	PRIMARY KEY (User_ID, Code_Hash)
+);
+CREATE TABLE "UserSession" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	Token_Hash char(64) NOT NULL UNIQUE,
+	User_Agent varchar(250) NOT NULL DEFAULT '',
+	IP varchar(45) NOT NULL DEFAULT '',
+	Created timestamp NOT NULL,
+	Last_Seen timestamp NOT NULL,
+	Expires timestamp NOT NULL
+);
+CREATE TABLE "UserIdentity" (
+	Issuer varchar(500) NOT NULL,
+	Subject varchar(255) NOT NULL,
+	User_ID int NOT NULL,
+	Email varchar(500) NOT NULL DEFAULT '',
+	Created timestamp NOT NULL,
+	PRIMARY KEY (Issuer, Subject)
+);
+CREATE TABLE "PasswordReset" (
+	Token_Hash char(64) PRIMARY KEY,
+	User_ID int NOT NULL,
+	Expires timestamp NOT NULL,
+	Created timestamp NOT NULL
+);
+CREATE TABLE "NotificationPreference" (
+	User_ID int PRIMARY KEY,
+	Mode varchar(16) NOT NULL DEFAULT 'off',
+	Email boolean NOT NULL DEFAULT false,
+	Push boolean NOT NULL DEFAULT false,
+	Unsubscribe_Token varchar(64) NOT NULL UNIQUE,
+	Notified_Until date NOT NULL
+);
+CREATE TABLE "PushSubscription" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	Endpoint varchar(1000) NOT NULL UNIQUE,
+	P256dh varchar(250) NOT NULL,
+	Auth varchar(64) NOT NULL,
+	Created timestamp NOT NULL
+);
+CREATE TABLE "SyncChange" (
+	ID serial PRIMARY KEY,
+	User_ID int NOT NULL,
+	Version bigint NOT NULL,
+	Kind varchar(16) NOT NULL,
+	Series_ID int NOT NULL,
+	Deleted boolean NOT NULL DEFAULT false,
+	Session int NOT NULL DEFAULT 0,
+	Episode int NOT NULL DEFAULT 0,
+	Updated timestamp NOT NULL,
+	Created timestamp NOT NULL
+);
+CREATE TABLE "WatchedEpisode" (
+	User_ID int NOT NULL,
+	Episode_ID int NOT NULL,
+	Watched timestamp NOT NULL,
+	PRIMARY KEY (User_ID, Episode_ID)
+);
+CREATE TABLE "EmailVerification" (
+	Token_Hash char(64) PRIMARY KEY,
+	User_ID int NOT NULL,
+	Email varchar(500) NOT NULL,
+	Expires timestamp NOT NULL,
+	Created timestamp NOT NULL
+);
+CREATE INDEX Series_Search_Title ON "Series" (Search_Title);
+CREATE INDEX SyncChange_Item ON "SyncChange" (User_ID, Kind, Series_ID);
+CREATE INDEX SyncChange_Version ON "SyncChange" (User_ID, Version);
+CREATE INDEX WebhookDelivery_Due ON "WebhookDelivery" (Status, Next_Attempt)
@@ -0,0 +1,162 @@
+package sj
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrStreamNotAvailable = errors.New("Event stream is not available")
+
+// streamBuffer is the number of events a subscriber may lag behind before
+// it gets disconnected.
+const streamBuffer = 16
+
+type (
+	// EventBroker passes the events of a user to the open streams of the
+	// user. EventHub does it in-process, a broker on top of e.g. Redis is
+	// needed when the app runs more than one instance.
+	EventBroker interface {
+		EventSink
+		Subscribe(userID int64) (<-chan Event, func())
+	}
+
+	EventHub struct {
+		mu   sync.Mutex
+		subs map[int64]map[chan Event]struct{}
+	}
+
+	streamEvent struct {
+		Type    string
+		Created time.Time
+		Data    interface{}
+	}
+)
+
+// StreamRoutes registers the event stream of the user. The stream is sent
+// as server-sent events with a comment line every Specs.StreamHeartbeat,
+// so proxies keep the connection open.
+func StreamRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	r.GET("/events", signedIn(NewAppHandler(app, EventStreamHandler)))
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subs: map[int64]map[chan Event]struct{}{},
+	}
+}
+
+// Subscribe returns the events of the user and a function to cancel the
+// subscription. The channel is closed when the subscription is canceled
+// or the subscriber is too slow.
+func (h *EventHub) Subscribe(userID int64) (<-chan Event, func()) {
+	ch := make(chan Event, streamBuffer)
+
+	h.mu.Lock()
+	if h.subs[userID] == nil {
+		h.subs[userID] = map[chan Event]struct{}{}
+	}
+	h.subs[userID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(userID, ch)
+	}
+}
+
+// Emit never blocks the handler, a subscriber with a full buffer is
+// dropped instead and has to reconnect and reload its data.
+func (h *EventHub) Emit(ctx context.Context, e Event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[e.UserID] {
+		select {
+		case ch <- e:
+		default:
+			h.remove(e.UserID, ch)
+		}
+	}
+
+	return nil
+}
+
+func (h *EventHub) remove(userID int64, ch chan Event) {
+	if _, ok := h.subs[userID][ch]; !ok {
+		return
+	}
+
+	delete(h.subs[userID], ch)
+	if len(h.subs[userID]) == 0 {
+		delete(h.subs, userID)
+	}
+	close(ch)
+}
+
+func EventStreamHandler(app AppCtx, c *gin.Context) error {
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	if app.Broker == nil {
+		return ErrStreamNotAvailable
+	}
+
+	events, cancel := app.Broker.Subscribe(userID)
+	defer cancel()
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(app.Specs.StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	ctx := c.Request.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(c.Writer, ": ping\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			err = writeStreamEvent(c.Writer, e)
+		}
+		if err != nil {
+			// The client is gone, there is nobody to respond to.
+			return nil
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeStreamEvent(w gin.ResponseWriter, e Event) error {
+	data, err := json.Marshal(streamEvent{
+		Type:    e.Type,
+		Created: e.Created,
+		Data:    e.Data,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %v\ndata: %s\n\n", e.Type, data)
+
+	return err
+}
@@ -0,0 +1,123 @@
+package sj
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+	"github.com/tochti/smem"
+)
+
+func Test_EventHub_Emit(t *testing.T) {
+	hub := NewEventHub()
+	ctx := context.Background()
+
+	jane, cancelJane := hub.Subscribe(1)
+	john, cancelJohn := hub.Subscribe(2)
+	defer cancelJohn()
+
+	e := NewEvent(EventSeriesAdded, 1, SeriesListEvent{SeriesID: 3})
+	if err := hub.Emit(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-jane; got.Type != EventSeriesAdded || got.UserID != 1 {
+		t.Fatal("Unexpected event", got)
+	}
+
+	select {
+	case got := <-john:
+		t.Fatal("Expect no event for other user was", got)
+	default:
+	}
+
+	cancelJane()
+	if _, ok := <-jane; ok {
+		t.Fatal("Expect closed channel")
+	}
+	cancelJane()
+
+	// john doesn't read, so he is dropped once his buffer is full.
+	e = NewEvent(EventSeriesAdded, 2, SeriesListEvent{SeriesID: 3})
+	for i := 0; i <= streamBuffer; i++ {
+		hub.Emit(ctx, e)
+	}
+
+	n := 0
+	for range john {
+		n++
+	}
+	if n != streamBuffer {
+		t.Fatal("Expect", streamBuffer, "events was", n)
+	}
+}
+
+func Test_GET_Events_Stream(t *testing.T) {
+	userID := int64(14)
+
+	sessionStore := smem.NewStore()
+	session, err := sessionStore.NewSession(strconv.FormatInt(userID, 10), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewEventHub()
+	app := AppCtx{
+		Events: []EventSink{hub},
+		Broker: hub,
+		Specs:  Specs{StreamHeartbeat: time.Hour},
+	}
+	r := gin.New()
+	StreamRoutes(r.Group("/"), app, kauth.SignedIn(&sessionStore))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-XSRF-TOKEN", session.Token())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatal("Expect event stream was", ct)
+	}
+
+	emit(ctx, app, NewEvent(EventEpisodeWatched, userID+1, LastWatched{}))
+	emit(ctx, app, NewEvent(EventEpisodeWatched, userID, LastWatched{
+		UserID:   userID,
+		SeriesID: 3,
+		Session:  2,
+		Episode:  1,
+	}))
+
+	scanner := bufio.NewScanner(resp.Body)
+	lines := []string{}
+	for scanner.Scan() && scanner.Text() != "" {
+		lines = append(lines, scanner.Text())
+	}
+
+	if len(lines) != 2 || lines[0] != "event: episode.watched" {
+		t.Fatal("Unexpected event", lines)
+	}
+
+	data := `"Data":{"UserID":14,"SeriesID":3,"Session":2,"Episode":1}`
+	if !strings.HasPrefix(lines[1], "data: {") || !strings.Contains(lines[1], data) {
+		t.Fatal("Unexpected data", lines[1])
+	}
+}
@@ -0,0 +1,498 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SyncSeries  = "series"
+	SyncWatched = "watched"
+
+	ResolveLastWriter  = "last-writer-wins"
+	ResolveMaxProgress = "max-progress"
+
+	syncPageSize = 500
+)
+
+type (
+	// SyncChange is the latest change of a series in the list or of the
+	// last watched episode of a series. Version is the cursor of the
+	// change, it counts the changes of the user in the order they were
+	// committed. Updated is the time the change was made, possibly
+	// offline.
+	SyncChange struct {
+		Version  int64
+		Kind     string
+		SeriesID int64
+		Deleted  bool
+		Session  int
+		Episode  int
+		Updated  time.Time
+	}
+
+	SyncChangeList []SyncChange
+
+	SyncPull struct {
+		Changes SyncChangeList
+		Cursor  int64
+		More    bool
+	}
+
+	SyncRejected struct {
+		Change  SyncChange
+		Reason  string
+		Current *SyncChange
+	}
+
+	SyncPushResult struct {
+		Applied  SyncChangeList
+		Rejected []SyncRejected
+		Cursor   int64
+	}
+)
+
+// SyncRoutes registers the delta sync. Clients start with cursor 0 which
+// returns the whole state, afterwards they pull the changes since the
+// returned cursor and push the changes they made offline.
+func SyncRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	r.GET("/sync/changes", signedIn(NewAppHandler(app, PullChangesHandler)))
+	r.POST("/sync/changes", signedIn(NewAppHandler(app, PushChangesHandler)))
+}
+
+func NewSyncChange(db *sql.DB, userID int64, c SyncChange) (int64, error) {
+	return NewSyncChangeContext(context.Background(), db, userID, c)
+}
+
+func NewSyncChangeContext(ctx context.Context, db querier, userID int64, c SyncChange) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	var version int64
+	err := inTx(ctx, db, func(tx querier) error {
+		var err error
+		version, err = recordSyncChange(ctx, tx, userID, c)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	return version, nil
+}
+
+// recordSyncChange stores the change with the next version of the user and
+// removes the older changes of the same item, only the latest state of an
+// item is synced. It has to run in the transaction of the write. The row of
+// the user stays locked until the commit, so the versions of a user are
+// committed in order and a pull never skips a change.
+func recordSyncChange(ctx context.Context, tx querier, userID int64, c SyncChange) (int64, error) {
+	created := time.Now().UTC().Truncate(time.Second)
+	m := "UPDATE %v SET Sync_Version = Sync_Version + 1, Sync_Updated = ? WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+	_, err := dbExec(ctx, tx, q, created, userID)
+	if err != nil {
+		return -1, err
+	}
+
+	m = "SELECT Sync_Version FROM %v WHERE ID = ?"
+	q = fmt.Sprintf(m, quote(UserTable))
+	var version int64
+	err = dbQueryRow(ctx, tx, q, userID).Scan(&version)
+	if err != nil {
+		return -1, err
+	}
+
+	m = `INSERT INTO %v (User_ID,Version,Kind,Series_ID,Deleted,Session,Episode,Updated,Created)
+	VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	q = fmt.Sprintf(m, quote(SyncChangeTable))
+	_, err = dbExec(ctx, tx, q, userID, version, c.Kind, c.SeriesID, c.Deleted,
+		c.Session, c.Episode, c.Updated.UTC().Truncate(time.Second), created)
+	if err != nil {
+		return -1, err
+	}
+
+	m = "DELETE FROM %v WHERE User_ID = ? AND Kind = ? AND Series_ID = ? AND Version < ?"
+	q = fmt.Sprintf(m, quote(SyncChangeTable))
+	_, err = dbExec(ctx, tx, q, userID, c.Kind, c.SeriesID, version)
+	if err != nil {
+		return -1, err
+	}
+
+	return version, nil
+}
+
+func ReadSyncChanges(db *sql.DB, userID, since int64, limit int) (SyncChangeList, error) {
+	return ReadSyncChangesContext(context.Background(), db, userID, since, limit)
+}
+
+func ReadSyncChangesContext(ctx context.Context, db *sql.DB, userID, since int64, limit int) (SyncChangeList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `SELECT Version, Kind, Series_ID, Deleted, Session, Episode, Updated
+	FROM %v WHERE User_ID = ? AND Version > ?
+	ORDER BY Version LIMIT ?`
+	q := fmt.Sprintf(m, quote(SyncChangeTable))
+	rows, err := dbQuery(ctx, db, q, userID, since, limit)
+	if err != nil {
+		return SyncChangeList{}, err
+	}
+	defer rows.Close()
+
+	cList := SyncChangeList{}
+	for rows.Next() {
+		c, err := scanSyncChange(rows)
+		if err != nil {
+			return SyncChangeList{}, err
+		}
+		cList = append(cList, c)
+	}
+
+	return cList, rows.Err()
+}
+
+func ReadLatestSyncChange(db *sql.DB, userID int64, kind string, seriesID int64) (SyncChange, error) {
+	return ReadLatestSyncChangeContext(context.Background(), db, userID, kind, seriesID)
+}
+
+func ReadLatestSyncChangeContext(ctx context.Context, db *sql.DB, userID int64, kind string, seriesID int64) (SyncChange, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `SELECT Version, Kind, Series_ID, Deleted, Session, Episode, Updated
+	FROM %v WHERE User_ID = ? AND Kind = ? AND Series_ID = ?
+	ORDER BY Version DESC LIMIT 1`
+	q := fmt.Sprintf(m, quote(SyncChangeTable))
+
+	return scanSyncChange(dbQueryRow(ctx, db, q, userID, kind, seriesID))
+}
+
+func scanSyncChange(row scanner) (SyncChange, error) {
+	c := SyncChange{}
+	err := row.Scan(&c.Version, &c.Kind, &c.SeriesID, &c.Deleted, &c.Session,
+		&c.Episode, &c.Updated)
+	if err != nil {
+		return SyncChange{}, err
+	}
+
+	return c, nil
+}
+
+// ReadSyncCursor returns the version of the latest change of the user.
+func ReadSyncCursor(db *sql.DB, userID int64) (int64, error) {
+	return ReadSyncCursorContext(context.Background(), db, userID)
+}
+
+func ReadSyncCursorContext(ctx context.Context, db *sql.DB, userID int64) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT Sync_Version FROM %v WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+
+	var cursor int64
+	err := dbQueryRow(ctx, db, q, userID).Scan(&cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	return cursor, nil
+}
+
+func ReadSyncState(db *sql.DB, userID int64) (int64, time.Time, error) {
+	return ReadSyncStateContext(context.Background(), db, userID)
+}
+
+// ReadSyncStateContext returns the version of the data of the user and when
+// it was changed last. Every change of the list or the watched episodes of
+// the user changes both.
+func ReadSyncStateContext(ctx context.Context, db *sql.DB, userID int64) (int64, time.Time, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT Sync_Version, Sync_Updated FROM %v WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(UserTable))
+
+	var version int64
+	var updated sql.NullTime
+	err := dbQueryRow(ctx, db, q, userID).Scan(&version, &updated)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return version, updated.Time, nil
+}
+
+// readSyncSnapshot returns the whole list and last watched episodes as
+// changes. The cursor is read first, so changes made meanwhile are pulled
+// again next time instead of getting lost.
+func readSyncSnapshot(ctx context.Context, db *sql.DB, userID int64) (SyncPull, error) {
+	cursor, err := ReadSyncCursorContext(ctx, db, userID)
+	if err != nil {
+		return SyncPull{}, err
+	}
+
+	sList, err := ReadSeriesListContext(ctx, db, userID)
+	if err != nil {
+		return SyncPull{}, err
+	}
+
+	wList, err := ReadLastWatchedListContext(ctx, db, userID)
+	if err != nil {
+		return SyncPull{}, err
+	}
+
+	cList := SyncChangeList{}
+	for _, s := range sList {
+		cList = append(cList, SyncChange{Kind: SyncSeries, SeriesID: s.ID})
+	}
+	for _, w := range wList {
+		cList = append(cList, SyncChange{
+			Kind:     SyncWatched,
+			SeriesID: w.SeriesID,
+			Session:  w.Session,
+			Episode:  w.Episode,
+		})
+	}
+
+	return SyncPull{Changes: cList, Cursor: cursor}, nil
+}
+
+func PullChangesHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil || since < 0 {
+		return errors.New("Wrong value in since")
+	}
+
+	var pull SyncPull
+	if since == 0 {
+		pull, err = readSyncSnapshot(ctx, app.DB, userID)
+		if err != nil {
+			return err
+		}
+	} else {
+		cList, err := ReadSyncChangesContext(ctx, app.DB, userID, since, syncPageSize+1)
+		if err != nil {
+			return err
+		}
+
+		pull = SyncPull{Cursor: since}
+		if len(cList) > syncPageSize {
+			cList = cList[:syncPageSize]
+			pull.More = true
+		}
+		if len(cList) > 0 {
+			pull.Cursor = cList[len(cList)-1].Version
+		}
+		pull.Changes = cList
+	}
+
+	resp := NewSuccessResponse(pull)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// PushChangesHandler applies the changes of a client in their order. A
+// change which loses against the state of the server is rejected together
+// with the current state, so the client can take it over.
+func PushChangesHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ParseSyncPushRequest(c)
+	if err != nil {
+		return err
+	}
+
+	result := SyncPushResult{
+		Applied:  SyncChangeList{},
+		Rejected: []SyncRejected{},
+	}
+	now := time.Now().UTC()
+	for _, change := range data.Changes {
+		// Clocks of offline clients can't win against the future.
+		if change.Updated.IsZero() || change.Updated.After(now) {
+			change.Updated = now
+		}
+
+		rejected, err := applySyncChange(ctx, app, userID, change, data.Resolve)
+		if err != nil {
+			return err
+		}
+
+		if rejected != nil {
+			result.Rejected = append(result.Rejected, *rejected)
+			continue
+		}
+		result.Applied = append(result.Applied, change)
+	}
+
+	result.Cursor, err = ReadSyncCursorContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(result)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func applySyncChange(ctx context.Context, app AppCtx, userID int64, change SyncChange, resolve string) (*SyncRejected, error) {
+	latest, err := ReadLatestSyncChangeContext(ctx, app.DB, userID, change.Kind, change.SeriesID)
+	hasLatest := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	reject := func(reason string, current *SyncChange) (*SyncRejected, error) {
+		return &SyncRejected{Change: change, Reason: reason, Current: current}, nil
+	}
+
+	switch change.Kind {
+	case SyncSeries:
+		if hasLatest && latest.Updated.After(change.Updated) {
+			return reject("Changed later on the server", &latest)
+		}
+
+		err := applySeriesChange(ctx, app, userID, change)
+		if err == sql.ErrNoRows {
+			return reject("Unknown series", nil)
+		}
+
+		return nil, err
+
+	case SyncWatched:
+		w, err := ReadLastWatchedContext(ctx, app.DB, userID, change.SeriesID)
+		hasWatched := err == nil
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+
+		current := SyncChange{
+			Kind:     SyncWatched,
+			SeriesID: w.SeriesID,
+			Session:  w.Session,
+			Episode:  w.Episode,
+		}
+		if hasLatest {
+			current.Version = latest.Version
+			current.Updated = latest.Updated
+		}
+
+		// A removal never has more progress, it only wins with
+		// last-writer-wins.
+		if change.Deleted {
+			switch {
+			case !hasWatched:
+				return nil, nil
+			case resolve != ResolveLastWriter:
+				return reject("Less progress than on the server", &current)
+			case hasLatest && latest.Updated.After(change.Updated):
+				return reject("Changed later on the server", &current)
+			}
+
+			_, err = removeLastWatched(ctx, app.DB, userID, change.SeriesID, change.Updated)
+			if err != nil {
+				return nil, err
+			}
+
+			e := NewEvent(EventLastWatchedRemoved, userID, LastWatched{UserID: userID, SeriesID: change.SeriesID})
+			e.Created = change.Updated
+			emit(ctx, app, e)
+
+			return nil, nil
+		}
+
+		if resolve == ResolveLastWriter {
+			if hasLatest && latest.Updated.After(change.Updated) {
+				return reject("Changed later on the server", &current)
+			}
+		} else if hasWatched && !aheadOf(change, w) {
+			if change.Session == w.Session && change.Episode == w.Episode {
+				return nil, nil
+			}
+			return reject("Less progress than on the server", &current)
+		}
+
+		lastWatched := LastWatched{
+			UserID:   userID,
+			SeriesID: change.SeriesID,
+			Session:  change.Session,
+			Episode:  change.Episode,
+		}
+		err = updateLastWatched(ctx, app.DB, lastWatched, change.Updated)
+		if err != nil {
+			return nil, err
+		}
+
+		e := NewEvent(EventEpisodeWatched, userID, lastWatched)
+		e.Created = change.Updated
+		emit(ctx, app, e)
+
+		return nil, nil
+	}
+
+	return reject("Unknown kind", nil)
+}
+
+// applySeriesChange adds or removes the series, the change is recorded with
+// the time of the client so it keeps its place for last-writer-wins.
+func applySeriesChange(ctx context.Context, app AppCtx, userID int64, change SyncChange) error {
+	exists, err := ExistsSeriesListContext(ctx, app.DB, userID, change.SeriesID)
+	if err != nil {
+		return err
+	}
+
+	var e Event
+	switch {
+	case change.Deleted && exists:
+		_, err = removeSeriesList(ctx, app.DB, userID, change.SeriesID, change.Updated)
+		e = NewEvent(EventSeriesRemoved, userID, SeriesListEvent{change.SeriesID})
+	case !change.Deleted && !exists:
+		_, err = ReadSeriesContext(ctx, app.DB, change.SeriesID)
+		if err != nil {
+			return err
+		}
+		err = appendSeriesList(ctx, app.DB, userID, change.SeriesID, change.Updated)
+		e = NewEvent(EventSeriesAdded, userID, SeriesListEvent{change.SeriesID})
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	e.Created = change.Updated
+	emit(ctx, app, e)
+
+	return nil
+}
+
+func aheadOf(change SyncChange, w LastWatched) bool {
+	if change.Session != w.Session {
+		return change.Session > w.Session
+	}
+
+	return change.Episode > w.Episode
+}
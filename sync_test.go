@@ -0,0 +1,262 @@
+package sj
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var syncChangeColumns = []string{
+	"Version", "Kind", "Series_ID", "Deleted", "Session", "Episode", "Updated",
+}
+
+// expectSyncChange expects the change of the item to be recorded with the
+// next version of the user.
+func expectSyncChange(mock sqlmock.Sqlmock, userID, version int64, kind string, seriesID int64) {
+	q := fmt.Sprintf("UPDATE %v SET Sync_Version = Sync_Version \\+ 1, Sync_Updated = \\? WHERE ID = \\?", UserTable)
+	mock.ExpectExec(q).WithArgs(sqlmock.AnyArg(), userID).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	q = fmt.Sprintf("SELECT Sync_Version FROM %v WHERE ID = \\?", UserTable)
+	rows := sqlmock.NewRows([]string{"Sync_Version"}).AddRow(version)
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	q = fmt.Sprintf("INSERT INTO %v", SyncChangeTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, version, kind, seriesID, sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	q = fmt.Sprintf("DELETE FROM %v WHERE User_ID = \\? AND Kind = \\? AND Series_ID = \\? AND Version < \\?", SyncChangeTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, kind, seriesID, version).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectSyncState expects the version of the data of the user to be read.
+func expectSyncState(mock sqlmock.Sqlmock, userID, version int64, updated time.Time) {
+	q := fmt.Sprintf("SELECT Sync_Version, Sync_Updated FROM %v WHERE ID = \\?", UserTable)
+	rows := sqlmock.NewRows([]string{"Sync_Version", "Sync_Updated"}).AddRow(version, updated)
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+}
+
+func Test_NewSyncChange_Version(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	updated := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	q := fmt.Sprintf("UPDATE %v SET Sync_Version = Sync_Version \\+ 1, Sync_Updated = \\? WHERE ID = \\?", UserTable)
+	mock.ExpectExec(q).WithArgs(sqlmock.AnyArg(), 14).WillReturnResult(sqlmock.NewResult(0, 1))
+	q = fmt.Sprintf("SELECT Sync_Version FROM %v WHERE ID = \\?", UserTable)
+	rows := sqlmock.NewRows([]string{"Sync_Version"}).AddRow(9)
+	mock.ExpectQuery(q).WithArgs(14).WillReturnRows(rows)
+	q = fmt.Sprintf("INSERT INTO %v", SyncChangeTable)
+	mock.ExpectExec(q).
+		WithArgs(14, 9, SyncSeries, 3, true, 0, 0, updated, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(31, 1))
+	q = fmt.Sprintf("DELETE FROM %v WHERE User_ID = \\? AND Kind = \\? AND Series_ID = \\? AND Version < \\?", SyncChangeTable)
+	mock.ExpectExec(q).
+		WithArgs(14, SyncSeries, 3, 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	c := SyncChange{Kind: SyncSeries, SeriesID: 3, Deleted: true, Updated: updated}
+	version, err := NewSyncChange(db, 14, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != 9 {
+		t.Fatal("Expect version 9 was", version)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_GET_SyncChanges_Since(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+	updated := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	q := fmt.Sprintf("FROM %v WHERE User_ID = \\? AND Version > \\?", SyncChangeTable)
+	rows := sqlmock.NewRows(syncChangeColumns).
+		AddRow(6, SyncSeries, 3, true, 0, 0, updated).
+		AddRow(8, SyncWatched, 4, false, 2, 1, updated)
+	mock.ExpectQuery(q).WithArgs(userID, 5, syncPageSize+1).WillReturnRows(rows)
+
+	srv, token := newSignedInServer(t, AppCtx{DB: db}, userID, SyncRoutes)
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("GET", "/sync/changes?since=5", token)
+
+	expect := NewSuccessResponse(SyncPull{
+		Changes: SyncChangeList{
+			{Version: 6, Kind: SyncSeries, SeriesID: 3, Deleted: true, Updated: updated},
+			{Version: 8, Kind: SyncWatched, SeriesID: 4, Session: 2, Episode: 1, Updated: updated},
+		},
+		Cursor: 8,
+	})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_SyncChanges_Resolve(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+	offline := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	server := offline.Add(time.Hour)
+
+	latestQuery := fmt.Sprintf("FROM %v WHERE User_ID = \\? AND Kind = \\? AND Series_ID = \\?", SyncChangeTable)
+	watchedQuery := fmt.Sprintf("SELECT Session, Episode FROM %v", LastWatchedTable)
+
+	// Series 3 was removed later on the server, adding it offline loses.
+	rows := sqlmock.NewRows(syncChangeColumns).
+		AddRow(7, SyncSeries, 3, true, 0, 0, server)
+	mock.ExpectQuery(latestQuery).WithArgs(userID, SyncSeries, 3).WillReturnRows(rows)
+
+	// The offline progress of series 4 is behind the server.
+	rows = sqlmock.NewRows(syncChangeColumns).
+		AddRow(8, SyncWatched, 4, false, 2, 3, server)
+	mock.ExpectQuery(latestQuery).WithArgs(userID, SyncWatched, 4).WillReturnRows(rows)
+	rows = sqlmock.NewRows([]string{"Session", "Episode"}).AddRow(2, 3)
+	mock.ExpectQuery(watchedQuery).WithArgs(userID, 4).WillReturnRows(rows)
+
+	// The offline progress of series 5 is ahead.
+	mock.ExpectQuery(latestQuery).WithArgs(userID, SyncWatched, 5).WillReturnError(sql.ErrNoRows)
+	rows = sqlmock.NewRows([]string{"Session", "Episode"}).AddRow(1, 1)
+	mock.ExpectQuery(watchedQuery).WithArgs(userID, 5).WillReturnRows(rows)
+	mock.ExpectBegin()
+	q := fmt.Sprintf("INTO %v", LastWatchedTable)
+	mock.ExpectExec(q).WithArgs(userID, 5, 1, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 9, SyncWatched, 5)
+	mock.ExpectCommit()
+
+	q = fmt.Sprintf("SELECT Sync_Version FROM %v WHERE ID", UserTable)
+	rows = sqlmock.NewRows([]string{"Sync_Version"}).AddRow(9)
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	srv, token := newSignedInServer(t, AppCtx{DB: db}, userID, SyncRoutes)
+	req := TestRequest{
+		Body: `{"Data": {"Changes": [
+			{"Kind": "series", "SeriesID": 3, "Updated": "2016-03-01T12:00:00Z"},
+			{"Kind": "watched", "SeriesID": 4, "Session": 2, "Episode": 1, "Updated": "2016-03-01T12:00:00Z"},
+			{"Kind": "watched", "SeriesID": 5, "Session": 1, "Episode": 2, "Updated": "2016-03-01T12:00:00Z"}
+		]}}`,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("POST", "/sync/changes", token)
+
+	expect := NewSuccessResponse(SyncPushResult{
+		Applied: SyncChangeList{
+			{Kind: SyncWatched, SeriesID: 5, Session: 1, Episode: 2, Updated: offline},
+		},
+		Rejected: []SyncRejected{
+			{
+				Change:  SyncChange{Kind: SyncSeries, SeriesID: 3, Updated: offline},
+				Reason:  "Changed later on the server",
+				Current: &SyncChange{Version: 7, Kind: SyncSeries, SeriesID: 3, Deleted: true, Updated: server},
+			},
+			{
+				Change:  SyncChange{Kind: SyncWatched, SeriesID: 4, Session: 2, Episode: 1, Updated: offline},
+				Reason:  "Less progress than on the server",
+				Current: &SyncChange{Version: 8, Kind: SyncWatched, SeriesID: 4, Session: 2, Episode: 3, Updated: server},
+			},
+		},
+		Cursor: 9,
+	})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_SyncChanges_RemoveWatched(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+	offline := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	server := offline.Add(-time.Hour)
+
+	q := fmt.Sprintf("FROM %v WHERE User_ID = \\? AND Kind = \\? AND Series_ID = \\?", SyncChangeTable)
+	rows := sqlmock.NewRows(syncChangeColumns).
+		AddRow(8, SyncWatched, 4, false, 2, 3, server)
+	mock.ExpectQuery(q).WithArgs(userID, SyncWatched, 4).WillReturnRows(rows)
+	q = fmt.Sprintf("SELECT Session, Episode FROM %v", LastWatchedTable)
+	rows = sqlmock.NewRows([]string{"Session", "Episode"}).AddRow(2, 3)
+	mock.ExpectQuery(q).WithArgs(userID, 4).WillReturnRows(rows)
+	mock.ExpectBegin()
+	q = fmt.Sprintf("DELETE FROM %v WHERE User_ID = \\? AND Series_ID = \\?", LastWatchedTable)
+	mock.ExpectExec(q).WithArgs(userID, 4).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 9, SyncWatched, 4)
+	mock.ExpectCommit()
+
+	q = fmt.Sprintf("SELECT Sync_Version FROM %v WHERE ID", UserTable)
+	rows = sqlmock.NewRows([]string{"Sync_Version"}).AddRow(9)
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	recorder := &eventRecorder{}
+	srv, token := newSignedInServer(t, AppCtx{DB: db, Events: []EventSink{recorder}}, userID, SyncRoutes)
+	req := TestRequest{
+		Body: `{"Data": {"Resolve": "last-writer-wins", "Changes": [
+			{"Kind": "watched", "SeriesID": 4, "Deleted": true, "Updated": "2016-03-01T12:00:00Z"}
+		]}}`,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("POST", "/sync/changes", token)
+
+	expect := NewSuccessResponse(SyncPushResult{
+		Applied: SyncChangeList{
+			{Kind: SyncWatched, SeriesID: 4, Deleted: true, Updated: offline},
+		},
+		Rejected: []SyncRejected{},
+		Cursor:   9,
+	})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.events) != 1 || recorder.events[0].Type != EventLastWatchedRemoved {
+		t.Fatal("Unexpected events", recorder.events)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
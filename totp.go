@@ -0,0 +1,575 @@
+package sj
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+)
+
+const (
+	TOTPIssuer = "sj"
+	TOTPDigits = 6
+	TOTPPeriod = 30 * time.Second
+
+	// Codes of the previous and the next period are accepted too, so
+	// clocks don't have to be in sync.
+	totpSkew = 1
+
+	RecoveryCodeCount = 10
+
+	xsrfCookie = "XSRF-TOKEN"
+)
+
+var (
+	ErrTOTPRequired       = errors.New("Two-factor code required")
+	ErrInvalidTOTP        = errors.New("Invalid two-factor code")
+	ErrTOTPEnabled        = errors.New("Two-factor authentication is already enabled")
+	ErrTOTPNotEnrolled    = errors.New("Two-factor authentication is not enrolled")
+	ErrInvalidCredentials = errors.New("Wrong name or password")
+
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+type (
+	TOTP struct {
+		UserID      int64
+		Secret      string
+		Enabled     bool
+		LastCounter int64
+		Created     time.Time
+	}
+
+	TOTPEnrollment struct {
+		Secret string
+		URI    string
+	}
+)
+
+// TwoFactorRoutes registers the endpoints to enroll and disable TOTP of the
+// signed in user.
+func TwoFactorRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	r.POST("/2fa/totp", signedIn(NewAppHandler(app, NewTOTPHandler)))
+	r.POST("/2fa/totp/verify", signedIn(NewAppHandler(app, VerifyTOTPHandler)))
+	r.POST("/2fa/totp/disable", signedIn(NewAppHandler(app, DisableTOTPHandler)))
+}
+
+func NewTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// TOTPURI returns the otpauth URI of the secret, authenticator apps read it
+// from a QR code.
+func TOTPURI(account, secret string) string {
+	label := url.PathEscape(TOTPIssuer + ":" + account)
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(TOTPDigits))
+	v.Set("period", strconv.Itoa(int(TOTPPeriod.Seconds())))
+
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// TOTPCode returns the code of the secret for the counter (RFC 6238).
+func TOTPCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", TOTPDigits, n%1000000), nil
+}
+
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod.Seconds())
+}
+
+// ValidateTOTP returns the counter of the code if it is valid at now and
+// newer than last, used codes can't be replayed.
+func ValidateTOTP(secret, code string, now time.Time, last int64) (int64, bool) {
+	code = normalizeCode(code)
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	current := totpCounter(now)
+	for i := -totpSkew; i <= totpSkew; i++ {
+		counter := current + int64(i)
+		if counter <= last {
+			continue
+		}
+
+		expect, err := TOTPCode(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expect), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+func NewRecoveryCodes() ([]string, error) {
+	codes := []string{}
+	for i := 0; i < RecoveryCodeCount; i++ {
+		buf := make([]byte, 5)
+		_, err := rand.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		code := fmt.Sprintf("%x", buf)
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+
+	return codes, nil
+}
+
+func HashRecoveryCode(code string) string {
+	return HashAPIToken(normalizeCode(code))
+}
+
+func normalizeCode(code string) string {
+	r := strings.NewReplacer(" ", "", "-", "")
+	return strings.ToLower(r.Replace(code))
+}
+
+func ReadTOTP(db *sql.DB, userID int64) (TOTP, error) {
+	return ReadTOTPContext(context.Background(), db, userID)
+}
+
+func ReadTOTPContext(ctx context.Context, db *sql.DB, userID int64) (TOTP, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT Secret, Enabled, Last_Counter, Created FROM %v WHERE User_ID = ?"
+	q := fmt.Sprintf(m, quote(TOTPTable))
+
+	t := TOTP{UserID: userID}
+	err := dbQueryRow(ctx, db, q, userID).
+		Scan(&t.Secret, &t.Enabled, &t.LastCounter, &t.Created)
+	if err != nil {
+		return TOTP{}, err
+	}
+
+	return t, nil
+}
+
+// SaveTOTPSecret stores a new secret which is enabled by EnableTOTP.
+func SaveTOTPSecret(db *sql.DB, userID int64, secret string) error {
+	return SaveTOTPSecretContext(context.Background(), db, userID, secret)
+}
+
+func SaveTOTPSecretContext(ctx context.Context, db *sql.DB, userID int64, secret string) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	q := dialect.Upsert(quote(TOTPTable),
+		[]string{"User_ID"},
+		[]string{"Secret", "Enabled", "Last_Counter", "Created"},
+	)
+	created := time.Now().UTC().Truncate(time.Second)
+	_, err := dbExec(ctx, db, q, userID, secret, false, 0, created)
+
+	return err
+}
+
+// EnableTOTP enables the secret and replaces the recovery codes of the
+// user. counter is the one of the code which verified the secret.
+func EnableTOTP(db *sql.DB, userID, counter int64, codes []string) error {
+	return EnableTOTPContext(context.Background(), db, userID, counter, codes)
+}
+
+func EnableTOTPContext(ctx context.Context, db *sql.DB, userID, counter int64, codes []string) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	m := "UPDATE %v SET Enabled = ?, Last_Counter = ? WHERE User_ID = ?"
+	q := fmt.Sprintf(m, quote(TOTPTable))
+	_, err = dbExec(ctx, tx, q, true, counter, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	m = "DELETE FROM %v WHERE User_ID = ?"
+	q = fmt.Sprintf(m, quote(RecoveryCodeTable))
+	_, err = dbExec(ctx, tx, q, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	m = "INSERT INTO %v (User_ID,Code_Hash) VALUES(?, ?)"
+	q = fmt.Sprintf(m, quote(RecoveryCodeTable))
+	for _, code := range codes {
+		_, err = dbExec(ctx, tx, q, userID, HashRecoveryCode(code))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPCounter stores the counter of a used code. It returns false if a
+// code of the counter or a newer one was used in the meantime.
+func UseTOTPCounter(db *sql.DB, userID, counter int64) (bool, error) {
+	return UseTOTPCounterContext(context.Background(), db, userID, counter)
+}
+
+func UseTOTPCounterContext(ctx context.Context, db *sql.DB, userID, counter int64) (bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "UPDATE %v SET Last_Counter = ? WHERE User_ID = ? AND Last_Counter < ?"
+	q := fmt.Sprintf(m, quote(TOTPTable))
+	rsrc, err := dbExec(ctx, db, q, counter, userID, counter)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := rsrc.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+// UseRecoveryCode removes the code of the user and returns whether it
+// existed.
+func UseRecoveryCode(db *sql.DB, userID int64, code string) (bool, error) {
+	return UseRecoveryCodeContext(context.Background(), db, userID, code)
+}
+
+func UseRecoveryCodeContext(ctx context.Context, db *sql.DB, userID int64, code string) (bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "DELETE FROM %v WHERE User_ID = ? AND Code_Hash = ?"
+	q := fmt.Sprintf(m, quote(RecoveryCodeTable))
+	rsrc, err := dbExec(ctx, db, q, userID, HashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := rsrc.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func RemoveTOTP(db *sql.DB, userID int64) error {
+	return RemoveTOTPContext(context.Background(), db, userID)
+}
+
+func RemoveTOTPContext(ctx context.Context, db *sql.DB, userID int64) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{RecoveryCodeTable, TOTPTable} {
+		q := fmt.Sprintf("DELETE FROM %v WHERE User_ID = ?", quote(table))
+		_, err = dbExec(ctx, tx, q, userID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// checkSecondFactor returns nil if the user has no TOTP enabled or code is
+// a valid TOTP or recovery code of the user.
+func checkSecondFactor(ctx context.Context, db *sql.DB, userID int64, code string, now time.Time) error {
+	t, err := ReadTOTPContext(ctx, db, userID)
+	if err == sql.ErrNoRows || (err == nil && !t.Enabled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if code == "" {
+		return ErrTOTPRequired
+	}
+
+	if counter, ok := ValidateTOTP(t.Secret, code, now, t.LastCounter); ok {
+		used, err := UseTOTPCounterContext(ctx, db, userID, counter)
+		if err != nil {
+			return err
+		}
+		if used {
+			return nil
+		}
+	}
+
+	used, err := UseRecoveryCodeContext(ctx, db, userID, code)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidTOTP
+	}
+
+	return nil
+}
+
+// NewLoginHandler returns the login handler of the app. It replaces
+// kauth.Login, which can't ask for the second factor, and creates the
+// session like kauth does.
+func NewLoginHandler(sessionStore kauth.SessionStore, userStore kauth.UserStore) AppHandler {
+	return func(app AppCtx, c *gin.Context) error {
+		ctx := requestContext(app, c)
+
+		data, err := ParseLoginRequest(c)
+		if err != nil {
+			return err
+		}
+
+		kuser, err := userStore.FindUser(data.Name)
+		if err == sql.ErrNoRows {
+			return ErrInvalidCredentials
+		}
+		if err != nil {
+			return err
+		}
+
+		u, ok := kuser.(kauthUser)
+		if !ok {
+			return errors.New("Unknown user store")
+		}
+
+		if !u.passwordMatches(data.Password) {
+			u.failedLogin()
+			return ErrInvalidCredentials
+		}
+
+		err = checkSecondFactor(ctx, app.DB, u.user.ID, data.Code, time.Now())
+		if err == ErrInvalidTOTP {
+			u.failedLogin()
+		}
+		if err != nil {
+			return err
+		}
+
+		u.succeededLogin()
+
+		expires := time.Now().Add(app.Specs.SessionTTL)
+		session, err := newSession(sessionStore, u.ID(), expires, c)
+		if err != nil {
+			return err
+		}
+
+		maxAge := int(app.Specs.SessionTTL.Seconds())
+		secure := c.Request.TLS != nil
+		c.SetCookie(xsrfCookie, session.Token(), maxAge, "/", "", secure, false)
+
+		resp := NewSuccessResponse("")
+		c.JSON(http.StatusOK, resp)
+
+		return nil
+	}
+}
+
+// NewTOTPHandler starts the enrollment with a new secret. It is enabled
+// after a code of it was verified.
+func NewTOTPHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	if _, ok := readAPIToken(c); ok {
+		return ErrAPITokenNotAllowed
+	}
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	t, err := ReadTOTPContext(ctx, app.DB, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if t.Enabled {
+		return ErrTOTPEnabled
+	}
+
+	user, err := ReadUserContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	err = SaveTOTPSecretContext(ctx, app.DB, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(TOTPEnrollment{
+		Secret: secret,
+		URI:    TOTPURI(user.Name, secret),
+	})
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// VerifyTOTPHandler enables the enrolled secret and responds with the
+// recovery codes once.
+func VerifyTOTPHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	if _, ok := readAPIToken(c); ok {
+		return ErrAPITokenNotAllowed
+	}
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	code, err := ParseTOTPCodeRequest(c)
+	if err != nil {
+		return err
+	}
+
+	t, err := ReadTOTPContext(ctx, app.DB, userID)
+	if err == sql.ErrNoRows {
+		return ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	if t.Enabled {
+		return ErrTOTPEnabled
+	}
+
+	counter, ok := ValidateTOTP(t.Secret, code, time.Now(), t.LastCounter)
+	if !ok {
+		return ErrInvalidTOTP
+	}
+
+	codes, err := NewRecoveryCodes()
+	if err != nil {
+		return err
+	}
+
+	err = EnableTOTPContext(ctx, app.DB, userID, counter, codes)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(codes)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// DisableTOTPHandler removes TOTP of the user, a valid code is required so
+// a stolen session can't disable it.
+func DisableTOTPHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	if _, ok := readAPIToken(c); ok {
+		return ErrAPITokenNotAllowed
+	}
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	code, err := ParseTOTPCodeRequest(c)
+	if err != nil {
+		return err
+	}
+
+	err = checkSecondFactor(ctx, app.DB, userID, code, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = RemoveTOTPContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+// AdminResetTOTPHandler removes TOTP of a user who lost the device and the
+// recovery codes.
+func AdminResetTOTPHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	err = RemoveTOTPContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package sj
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+	"github.com/tochti/smem"
+)
+
+// Secret of the test vectors of RFC 6238, "12345678901234567890".
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+var totpColumns = []string{"Secret", "Enabled", "Last_Counter", "Created"}
+
+func Test_TOTPCode_RFC6238(t *testing.T) {
+	tests := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expect := range tests {
+		code, err := TOTPCode(rfcTOTPSecret, totpCounter(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != expect {
+			t.Fatal("Expect", expect, "at", unix, "was", code)
+		}
+	}
+}
+
+func Test_ValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	counter := totpCounter(now)
+
+	prev, err := TOTPCode(rfcTOTPSecret, counter-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c, ok := ValidateTOTP(rfcTOTPSecret, prev, now, 0); !ok || c != counter-1 {
+		t.Fatal("Expect code of the previous period to be valid")
+	}
+
+	if _, ok := ValidateTOTP(rfcTOTPSecret, prev, now, counter-1); ok {
+		t.Fatal("Expect used code to be invalid")
+	}
+
+	if _, ok := ValidateTOTP(rfcTOTPSecret, "081 804", now, 0); !ok {
+		t.Fatal("Expect code with space to be valid")
+	}
+
+	if _, ok := ValidateTOTP(rfcTOTPSecret, "000000", now, 0); ok {
+		t.Fatal("Expect wrong code to be invalid")
+	}
+}
+
+func Test_TOTPURI(t *testing.T) {
+	uri := TOTPURI("jane doe", rfcTOTPSecret)
+	expect := "otpauth://totp/sj:jane%20doe?algorithm=SHA1&digits=6&issuer=sj&period=30&secret=" + rfcTOTPSecret
+	if uri != expect {
+		t.Fatal("Expect", expect, "was", uri)
+	}
+}
+
+func Test_POST_Login_TOTP(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	code, err := TOTPCode(rfcTOTPSecret, totpCounter(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Code   string
+		Expect string
+	}{
+		{"", ErrTOTPRequired.Error()},
+		{code, ""},
+	}
+
+	sessionStore := smem.NewStore()
+	userStore := NewUserStoreWithPolicy(db, LoginPolicy{})
+	app := AppCtx{
+		DB:    db,
+		Specs: Specs{SessionTTL: time.Hour},
+	}
+	srv := gin.New()
+	srv.POST("/login", NewAppHandler(app, NewLoginHandler(&sessionStore, userStore)))
+
+	for _, tc := range tests {
+		q := fmt.Sprintf("SELECT ID,Name,Password,Role,Disabled,Failed_Logins,Locked_Until,Email FROM %v", UserTable)
+		rows := sqlmock.NewRows(userColumns).
+			AddRow(14, "peacemaker", NewSha512Password("secret"), RoleUser, false, 0, nil, "")
+		mock.ExpectQuery(q).WithArgs("peacemaker").WillReturnRows(rows)
+
+		q = fmt.Sprintf("SELECT Secret, Enabled, Last_Counter, Created FROM %v", TOTPTable)
+		rows = sqlmock.NewRows(totpColumns).
+			AddRow(rfcTOTPSecret, true, 0, time.Now())
+		mock.ExpectQuery(q).WithArgs(14).WillReturnRows(rows)
+
+		if tc.Code != "" {
+			q = fmt.Sprintf("UPDATE %v SET Last_Counter", TOTPTable)
+			mock.ExpectExec(q).
+				WithArgs(sqlmock.AnyArg(), 14, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+
+		body := fmt.Sprintf(`{"Data": {"Name": "peacemaker", "Password": "secret", "Code": "%v"}}`, tc.Code)
+		req := TestRequest{
+			Body:    body,
+			Handler: srv,
+		}
+		resp := req.Send("POST", "/login")
+
+		if tc.Expect != "" {
+			if err := EqualResponse(NewFailResponse(ErrTOTPRequired), resp.Body); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		cookie := resp.Header().Get("Set-Cookie")
+		if !strings.HasPrefix(cookie, xsrfCookie+"=") {
+			t.Fatal("Expect session cookie was", cookie)
+		}
+
+		token := strings.TrimPrefix(strings.SplitN(cookie, ";", 2)[0], xsrfCookie+"=")
+		session, ok := sessionStore.ReadSession(token)
+		if !ok || session.UserID() != "14" {
+			t.Fatal("Expect session of user 14 was", session)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_TOTPVerify_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+	code, err := TOTPCode(rfcTOTPSecret, totpCounter(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := fmt.Sprintf("SELECT Secret, Enabled, Last_Counter, Created FROM %v", TOTPTable)
+	rows := sqlmock.NewRows(totpColumns).
+		AddRow(rfcTOTPSecret, false, 0, time.Now())
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	mock.ExpectBegin()
+	q = fmt.Sprintf("UPDATE %v SET Enabled", TOTPTable)
+	mock.ExpectExec(q).
+		WithArgs(true, sqlmock.AnyArg(), userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	q = fmt.Sprintf("DELETE FROM %v WHERE User_ID", RecoveryCodeTable)
+	mock.ExpectExec(q).
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	q = fmt.Sprintf("INSERT INTO %v", RecoveryCodeTable)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		mock.ExpectExec(q).
+			WithArgs(userID, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	sessionStore := smem.NewStore()
+	expires := time.Now().Add(1 * time.Hour)
+	session, err := sessionStore.NewSession(strconv.FormatInt(userID, 10), expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := gin.New()
+	TwoFactorRoutes(srv.Group("/"), AppCtx{DB: db}, kauth.SignedIn(&sessionStore))
+
+	req := TestRequest{
+		Body:    fmt.Sprintf(`{"Data": {"Code": "%v"}}`, code),
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("POST", "/2fa/totp/verify", session.Token())
+
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code)
+	}
+
+	if !strings.Contains(resp.Body.String(), `"Status":"success"`) {
+		t.Fatal("Expect success was", resp.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_RecoveryCode_Login(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("SELECT Secret, Enabled, Last_Counter, Created FROM %v", TOTPTable)
+	rows := sqlmock.NewRows(totpColumns).
+		AddRow(rfcTOTPSecret, true, 0, time.Now())
+	mock.ExpectQuery(q).WithArgs(14).WillReturnRows(rows)
+
+	q = fmt.Sprintf("DELETE FROM %v WHERE User_ID = \\? AND Code_Hash", RecoveryCodeTable)
+	mock.ExpectExec(q).
+		WithArgs(14, HashRecoveryCode("abcde12345")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = checkSecondFactor(context.Background(), db, 14, "ABCDE-12345", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,16 +3,23 @@ package sj
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha512"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/kelseyhightower/envconfig"
@@ -29,11 +36,86 @@ type (
 		DBUser    string `envconfig:"db_user"`
 		DBPass    string `envconfig:"db_pass"`
 		DBName    string `envconfig:"db_name"`
+
+		// LogLevel is one of debug, info, warn or error
+		LogLevel string `envconfig:"log_level" default:"info"`
+
+		// DBDialect is one of mysql or postgres
+		DBDialect string `envconfig:"db_dialect" default:"mysql"`
+		DBSSLMode string `envconfig:"db_sslmode" default:"disable"`
+
+		DBQueryTimeout    time.Duration `envconfig:"db_query_timeout" default:"5s"`
+		DBMaxOpenConns    int           `envconfig:"db_max_open_conns" default:"10"`
+		DBMaxIdleConns    int           `envconfig:"db_max_idle_conns" default:"5"`
+		DBConnMaxLifetime time.Duration `envconfig:"db_conn_max_lifetime" default:"5m"`
+		DBConnMaxIdleTime time.Duration `envconfig:"db_conn_max_idle_time" default:"1m"`
+
+		WebhookInterval    time.Duration `envconfig:"webhook_interval" default:"10s"`
+		WebhookTimeout     time.Duration `envconfig:"webhook_timeout" default:"10s"`
+		WebhookBackoff     time.Duration `envconfig:"webhook_backoff" default:"30s"`
+		WebhookMaxAttempts int           `envconfig:"webhook_max_attempts" default:"8"`
+		// WebhookRetention is how long delivered and failed deliveries are
+		// kept, 0 keeps them forever.
+		WebhookRetention time.Duration `envconfig:"webhook_retention" default:"720h"`
+
+		SessionTTL      time.Duration `envconfig:"session_ttl" default:"24h"`
+		StreamHeartbeat time.Duration `envconfig:"stream_heartbeat" default:"25s"`
+
+		// PublicURL is the address of the app in links of mails. The
+		// mails are only logged without SMTPAddr, their bodies with the
+		// links only at the debug level.
+		PublicURL        string        `envconfig:"public_url"`
+		PasswordResetTTL time.Duration `envconfig:"password_reset_ttl" default:"1h"`
+		EmailVerifyTTL   time.Duration `envconfig:"email_verify_ttl" default:"24h"`
+		SMTPAddr         string        `envconfig:"smtp_addr"`
+		SMTPUser         string        `envconfig:"smtp_user"`
+		SMTPPass         string        `envconfig:"smtp_pass"`
+		MailFrom         string        `envconfig:"mail_from" default:"sj@localhost"`
+
+		// New episodes are notified by mail and by web push if the VAPID
+		// keys are set, see webpush.GenerateVAPIDKeys.
+		NotificationInterval time.Duration `envconfig:"notification_interval" default:"1h"`
+		VAPIDPublicKey       string        `envconfig:"vapid_public_key"`
+		VAPIDPrivateKey      string        `envconfig:"vapid_private_key"`
+		VAPIDSubject         string        `envconfig:"vapid_subject"`
+
+		// OIDC login is enabled by OIDCIssuer. Unknown accounts are linked
+		// to the user with their verified email with OIDCLinkByEmail and
+		// get a new user with OIDCAutoProvision if Registration is open.
+		OIDCIssuer        string   `envconfig:"oidc_issuer"`
+		OIDCClientID      string   `envconfig:"oidc_client_id"`
+		OIDCClientSecret  string   `envconfig:"oidc_client_secret"`
+		OIDCRedirectURL   string   `envconfig:"oidc_redirect_url"`
+		OIDCScopes        []string `envconfig:"oidc_scopes"`
+		OIDCAutoProvision bool     `envconfig:"oidc_auto_provision"`
+		OIDCLinkByEmail   bool     `envconfig:"oidc_link_by_email"`
+		OIDCPostLoginURL  string   `envconfig:"oidc_post_login_url" default:"/"`
+
+		// LoginRate and LoginAccountRate are the logins per minute and
+		// IP or account, SignupRate the new accounts per hour and IP. 0
+		// disables a limit.
+		LoginRate        int           `envconfig:"login_rate" default:"10"`
+		LoginAccountRate int           `envconfig:"login_account_rate" default:"5"`
+		SignupRate       int           `envconfig:"signup_rate" default:"5"`
+		LoginMaxFailures int           `envconfig:"login_max_failures" default:"5"`
+		LoginLockout     time.Duration `envconfig:"login_lockout" default:"15m"`
+		LoginDelay       time.Duration `envconfig:"login_delay" default:"500ms"`
+
+		// Registration is one of open, invite or closed. Admins are
+		// promoted to the admin role when the app starts.
+		Registration       string   `envconfig:"registration"`
+		Admins             []string `envconfig:"admins"`
+		PasswordMinLength  int      `envconfig:"password_min_length"`
+		PasswordMinClasses int      `envconfig:"password_min_classes"`
 	}
 
 	AppCtx struct {
-		Specs Specs
-		DB    *sql.DB
+		Specs  Specs
+		DB     *sql.DB
+		Events []EventSink
+		Broker EventBroker
+		Logger *slog.Logger
+		Mailer Mailer
 	}
 
 	JSONRequest struct {
@@ -43,6 +125,36 @@ type (
 	SeriesListRequestData struct {
 		SeriesID int64
 	}
+
+	RegistrationRequestData struct {
+		User       User
+		InviteCode string
+	}
+
+	AdminUserRequestData struct {
+		NewPassword string
+		Role        string
+		Disabled    bool
+		TargetID    int64
+	}
+
+	AccountRequestData struct {
+		Password    string
+		NewPassword string
+		Name        string
+		Email       string
+	}
+
+	LoginRequestData struct {
+		Name     string
+		Password string
+		Code     string
+	}
+
+	APITokenRequestData struct {
+		Name     string
+		ReadOnly bool
+	}
 )
 
 func NewApp(name string) (AppCtx, error) {
@@ -52,38 +164,83 @@ func NewApp(name string) (AppCtx, error) {
 		return AppCtx{}, err
 	}
 
-	url := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v",
-		specs.DBUser,
-		specs.DBPass,
-		specs.DBHost,
-		specs.DBPort,
-		specs.DBName,
-	)
+	err = ValidateRegistrationMode(specs)
+	if err != nil {
+		return AppCtx{}, err
+	}
+
+	log, err := NewLogger(os.Stderr, specs.LogLevel)
+	if err != nil {
+		return AppCtx{}, err
+	}
 
-	db, err := sql.Open("mysql", url)
+	d, err := DialectByName(specs.DBDialect)
 	if err != nil {
 		return AppCtx{}, err
 	}
+	SetDialect(d)
 
+	db, err := sql.Open(d.DriverName(), d.DSN(specs))
+	if err != nil {
+		return AppCtx{}, err
+	}
+
+	// Broken and stale connections are dropped by the pool, so the data
+	// functions don't need to ping the database before every query.
+	db.SetMaxOpenConns(specs.DBMaxOpenConns)
+	db.SetMaxIdleConns(specs.DBMaxIdleConns)
+	db.SetConnMaxLifetime(specs.DBConnMaxLifetime)
+	db.SetConnMaxIdleTime(specs.DBConnMaxIdleTime)
+
+	err = PromoteAdminsContext(WithQueryTimeout(context.Background(), specs.DBQueryTimeout), db, specs.Admins)
+	if err != nil {
+		return AppCtx{}, err
+	}
+
+	// Series stored before the search columns existed can't be found
+	// until they are folded.
+	n, err := UpdateSearchTitlesContext(context.Background(), db)
+	if err != nil {
+		return AppCtx{}, err
+	}
+	if n > 0 {
+		log.Info("updated search columns", slog.Int("series", n))
+	}
+
+	hub := NewEventHub()
 	ctx := AppCtx{
-		Specs: specs,
-		DB:    db,
+		Specs:  specs,
+		DB:     db,
+		Events: []EventSink{WebhookSink{DB: db}, hub},
+		Broker: hub,
+		Logger: log,
+		Mailer: NewMailer(specs, log),
 	}
 
 	return ctx, nil
 }
 
+// requestContext returns the context of the request with the query timeout
+// of the app. It is canceled as soon as the client goes away.
+func requestContext(app AppCtx, c *gin.Context) context.Context {
+	return WithQueryTimeout(c.Request.Context(), app.Specs.DBQueryTimeout)
+}
+
 func SaveImage(url, p string) (string, error) {
 	resp, err := http.Get(url)
 	if err != nil {
+		imageDownloads.WithLabelValues(imageError).Inc()
 		return "", err
 	}
+	defer resp.Body.Close()
 
 	reader := bufio.NewReader(resp.Body)
 	buf := bytes.NewBuffer([]byte{})
 
-	_, err = reader.WriteTo(buf)
+	n, err := reader.WriteTo(buf)
+	imageDownloadBytes.Add(float64(n))
 	if err != nil {
+		imageDownloads.WithLabelValues(imageError).Inc()
 		return "", err
 	}
 
@@ -96,19 +253,40 @@ func SaveImage(url, p string) (string, error) {
 
 	// If the image already exists we don't need to save it again
 	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		imageDownloads.WithLabelValues(imageExists).Inc()
 		return filename, nil
 	}
 
 	err = ioutil.WriteFile(file, content, 0755)
 	if err != nil {
+		imageDownloads.WithLabelValues(imageError).Inc()
 		return "", err
 	}
 
+	imageDownloads.WithLabelValues(imageSaved).Inc()
 	return filename, nil
 }
 
-func removeImage(p string) error {
-	return os.Remove(p)
+// removeImage removes the image name from dir. Only names created by
+// SaveImage are removed, so a stored name cannot point outside of dir.
+func removeImage(dir, name string) error {
+	if !imageNameRegexp.MatchString(name) {
+		return ErrInvalidImageName
+	}
+
+	return os.Remove(path.Join(dir, name))
+}
+
+// newSecretToken returns 32 random bytes as hex, e.g. for tokens which are
+// sent by mail.
+func newSecretToken() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
 }
 
 func NewSha1Hash(by []byte) string {
@@ -171,44 +349,85 @@ func ParseNewSeriesRequest(c *gin.Context) (Series, error) {
 		return Series{}, errors.New(m)
 	}
 
+	desc := ""
+	if v, exists := tmp["Description"]; exists {
+		desc, ok = v.(string)
+		if !ok {
+			m := "Wrong value in Description"
+			return Series{}, errors.New(m)
+		}
+	}
+
 	s := Series{
-		Title: title,
-		Image: image,
+		Title:       title,
+		Image:       image,
+		Description: desc,
 	}
 
 	return s, nil
 }
 
 func ParseNewUserRequest(c *gin.Context) (User, error) {
-	req, err := ParseJSONRequest(c.Request)
+	data, err := ParseRegistrationRequest(c)
 	if err != nil {
 		return User{}, err
 	}
 
+	return data.User, nil
+}
+
+func ParseRegistrationRequest(c *gin.Context) (RegistrationRequestData, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return RegistrationRequestData{}, err
+	}
+
 	tmp, ok := req.Data.(map[string]interface{})
 	err = ExistsFields(tmp, []string{"Name", "Password"})
 	if err != nil {
-		return User{}, err
+		return RegistrationRequestData{}, err
 	}
 
 	name, ok := tmp["Name"].(string)
 	if !ok {
 		m := "Wrong value in Name"
-		return User{}, errors.New(m)
+		return RegistrationRequestData{}, errors.New(m)
 	}
 
 	pass, ok := tmp["Password"].(string)
 	if !ok {
 		m := "Wrong value in Password"
-		return User{}, errors.New(m)
+		return RegistrationRequestData{}, errors.New(m)
+	}
+
+	code := ""
+	if v, exists := tmp["InviteCode"]; exists {
+		code, ok = v.(string)
+		if !ok {
+			m := "Wrong value in InviteCode"
+			return RegistrationRequestData{}, errors.New(m)
+		}
+	}
+
+	email := ""
+	if v, exists := tmp["Email"]; exists {
+		email, ok = v.(string)
+		if !ok {
+			m := "Wrong value in Email"
+			return RegistrationRequestData{}, errors.New(m)
+		}
 	}
 
-	u := User{
-		Name:     name,
-		Password: pass,
+	data := RegistrationRequestData{
+		User: User{
+			Name:     name,
+			Password: pass,
+			Email:    email,
+		},
+		InviteCode: code,
 	}
 
-	return u, nil
+	return data, nil
 }
 
 func ParseAppendSeriesListRequest(c *gin.Context) (SeriesListRequestData, error) {
@@ -281,3 +500,515 @@ func NewSha512Password(pass string) string {
 	passHash := fmt.Sprintf("%x", tmp)
 	return passHash
 }
+
+func ParseImportRequest(c *gin.Context) (ExportList, error) {
+	contentType := c.Request.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "text/csv") {
+		return ReadExportCSV(c.Request.Body)
+	}
+
+	req := struct {
+		Data ExportList
+	}{}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		return ExportList{}, err
+	}
+
+	if req.Data == nil {
+		return ExportList{}, NewMissingFieldError("Data")
+	}
+
+	return req.Data, nil
+}
+
+// ParseAccountRequest reads the account fields of the request. The current
+// Password is always required, the other fields only if listed in required.
+func ParseAccountRequest(c *gin.Context, required []string) (AccountRequestData, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return AccountRequestData{}, err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, append([]string{"Password"}, required...))
+	if err != nil {
+		return AccountRequestData{}, err
+	}
+
+	data := AccountRequestData{}
+	fields := map[string]*string{
+		"Password":    &data.Password,
+		"NewPassword": &data.NewPassword,
+		"Name":        &data.Name,
+		"Email":       &data.Email,
+	}
+	for name, v := range fields {
+		if _, exists := tmp[name]; !exists {
+			continue
+		}
+
+		*v, ok = tmp[name].(string)
+		if !ok {
+			m := fmt.Sprintf("Wrong value in %v", name)
+			return AccountRequestData{}, errors.New(m)
+		}
+	}
+
+	return data, nil
+}
+
+func ParseAdminUserRequest(c *gin.Context, field string) (AdminUserRequestData, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return AdminUserRequestData{}, err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{field})
+	if err != nil {
+		return AdminUserRequestData{}, err
+	}
+
+	data := AdminUserRequestData{}
+	switch field {
+	case "NewPassword":
+		data.NewPassword, ok = tmp[field].(string)
+	case "Role":
+		data.Role, ok = tmp[field].(string)
+	case "Disabled":
+		data.Disabled, ok = tmp[field].(bool)
+	case "TargetID":
+		var id float64
+		id, ok = tmp[field].(float64)
+		data.TargetID = int64(id)
+	}
+
+	if !ok {
+		m := fmt.Sprintf("Wrong value in %v", field)
+		return AdminUserRequestData{}, errors.New(m)
+	}
+
+	return data, nil
+}
+
+func ParseNewAPITokenRequest(c *gin.Context) (APITokenRequestData, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return APITokenRequestData{}, err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{"Name"})
+	if err != nil {
+		return APITokenRequestData{}, err
+	}
+
+	data := APITokenRequestData{}
+	data.Name, ok = tmp["Name"].(string)
+	if !ok || data.Name == "" {
+		return APITokenRequestData{}, errors.New("Wrong value in Name")
+	}
+
+	if _, exists := tmp["ReadOnly"]; exists {
+		data.ReadOnly, ok = tmp["ReadOnly"].(bool)
+		if !ok {
+			return APITokenRequestData{}, errors.New("Wrong value in ReadOnly")
+		}
+	}
+
+	return data, nil
+}
+
+func ParseLoginRequest(c *gin.Context) (LoginRequestData, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return LoginRequestData{}, err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{"Name", "Password"})
+	if err != nil {
+		return LoginRequestData{}, err
+	}
+
+	data := LoginRequestData{}
+	data.Name, ok = tmp["Name"].(string)
+	if !ok {
+		return LoginRequestData{}, errors.New("Wrong value in Name")
+	}
+
+	data.Password, ok = tmp["Password"].(string)
+	if !ok {
+		return LoginRequestData{}, errors.New("Wrong value in Password")
+	}
+
+	if _, exists := tmp["Code"]; exists {
+		data.Code, ok = tmp["Code"].(string)
+		if !ok {
+			return LoginRequestData{}, errors.New("Wrong value in Code")
+		}
+	}
+
+	return data, nil
+}
+
+func ParsePasswordResetRequest(c *gin.Context) (string, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{"Email"})
+	if err != nil {
+		return "", err
+	}
+
+	email, ok := tmp["Email"].(string)
+	if !ok || ValidateEmail(email) != nil {
+		return "", errors.New("Wrong value in Email")
+	}
+
+	return email, nil
+}
+
+func ParsePasswordResetData(c *gin.Context) (string, string, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return "", "", err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{"Token", "NewPassword"})
+	if err != nil {
+		return "", "", err
+	}
+
+	token, ok := tmp["Token"].(string)
+	if !ok || token == "" {
+		return "", "", errors.New("Wrong value in Token")
+	}
+
+	pass, ok := tmp["NewPassword"].(string)
+	if !ok {
+		return "", "", errors.New("Wrong value in NewPassword")
+	}
+
+	return token, pass, nil
+}
+
+func ParseEmailVerificationRequest(c *gin.Context) (string, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{"Token"})
+	if err != nil {
+		return "", err
+	}
+
+	token, ok := tmp["Token"].(string)
+	if !ok || token == "" {
+		return "", errors.New("Wrong value in Token")
+	}
+
+	return token, nil
+}
+
+func ParseTOTPCodeRequest(c *gin.Context) (string, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{"Code"})
+	if err != nil {
+		return "", err
+	}
+
+	code, ok := tmp["Code"].(string)
+	if !ok || code == "" {
+		return "", errors.New("Wrong value in Code")
+	}
+
+	return code, nil
+}
+
+func ParseNewWebhookRequest(c *gin.Context) (Webhook, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{"URL"})
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	w := Webhook{Events: []string{}}
+	w.URL, ok = tmp["URL"].(string)
+	if !ok {
+		return Webhook{}, errors.New("Wrong value in URL")
+	}
+
+	if _, exists := tmp["Events"]; exists {
+		events, ok := tmp["Events"].([]interface{})
+		if !ok {
+			return Webhook{}, errors.New("Wrong value in Events")
+		}
+
+		for _, e := range events {
+			name, ok := e.(string)
+			if !ok {
+				return Webhook{}, errors.New("Wrong value in Events")
+			}
+			w.Events = append(w.Events, name)
+		}
+	}
+
+	return w, nil
+}
+
+type NotificationPreferenceRequestData struct {
+	Mode  string
+	Email bool
+	Push  bool
+}
+
+func ParseNotificationPreferenceRequest(c *gin.Context) (NotificationPreferenceRequestData, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return NotificationPreferenceRequestData{}, err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{"Mode", "Email", "Push"})
+	if err != nil {
+		return NotificationPreferenceRequestData{}, err
+	}
+
+	data := NotificationPreferenceRequestData{}
+	data.Mode, ok = tmp["Mode"].(string)
+	if !ok || (data.Mode != NotifyOff && data.Mode != NotifyDigest && data.Mode != NotifyEpisode) {
+		return NotificationPreferenceRequestData{}, errors.New("Wrong value in Mode")
+	}
+
+	data.Email, ok = tmp["Email"].(bool)
+	if !ok {
+		return NotificationPreferenceRequestData{}, errors.New("Wrong value in Email")
+	}
+
+	data.Push, ok = tmp["Push"].(bool)
+	if !ok {
+		return NotificationPreferenceRequestData{}, errors.New("Wrong value in Push")
+	}
+
+	return data, nil
+}
+
+// ParsePushSubscriptionRequest reads the JSON of a browser PushSubscription.
+func ParsePushSubscriptionRequest(c *gin.Context) (PushSubscription, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return PushSubscription{}, err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{"endpoint", "keys"})
+	if err != nil {
+		return PushSubscription{}, err
+	}
+
+	s := PushSubscription{}
+	s.Endpoint, ok = tmp["endpoint"].(string)
+	if !ok {
+		return PushSubscription{}, errors.New("Wrong value in endpoint")
+	}
+
+	u, err := url.Parse(s.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return PushSubscription{}, errors.New("Wrong value in endpoint")
+	}
+
+	keys, ok := tmp["keys"].(map[string]interface{})
+	if !ok {
+		return PushSubscription{}, errors.New("Wrong value in keys")
+	}
+
+	s.P256dh, ok = keys["p256dh"].(string)
+	if !ok || s.P256dh == "" {
+		return PushSubscription{}, errors.New("Wrong value in keys")
+	}
+
+	s.Auth, ok = keys["auth"].(string)
+	if !ok || s.Auth == "" {
+		return PushSubscription{}, errors.New("Wrong value in keys")
+	}
+
+	return s, nil
+}
+
+type SyncPushRequestData struct {
+	Changes SyncChangeList
+	Resolve string
+}
+
+// ParseSyncPushRequest reads the changes of a client. Updated is optional
+// and has to be in RFC 3339, changes without it are made now.
+func ParseSyncPushRequest(c *gin.Context) (SyncPushRequestData, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return SyncPushRequestData{}, err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{"Changes"})
+	if err != nil {
+		return SyncPushRequestData{}, err
+	}
+
+	data := SyncPushRequestData{
+		Changes: SyncChangeList{},
+		Resolve: ResolveMaxProgress,
+	}
+
+	if _, exists := tmp["Resolve"]; exists {
+		data.Resolve, ok = tmp["Resolve"].(string)
+		if !ok || (data.Resolve != ResolveMaxProgress && data.Resolve != ResolveLastWriter) {
+			return SyncPushRequestData{}, errors.New("Wrong value in Resolve")
+		}
+	}
+
+	changes, ok := tmp["Changes"].([]interface{})
+	if !ok {
+		return SyncPushRequestData{}, errors.New("Wrong value in Changes")
+	}
+
+	wrong := errors.New("Wrong value in Changes")
+	for _, v := range changes {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return SyncPushRequestData{}, wrong
+		}
+
+		change := SyncChange{}
+		change.Kind, ok = m["Kind"].(string)
+		if !ok || (change.Kind != SyncSeries && change.Kind != SyncWatched) {
+			return SyncPushRequestData{}, wrong
+		}
+
+		seriesID, ok := m["SeriesID"].(float64)
+		if !ok || seriesID < 1 {
+			return SyncPushRequestData{}, wrong
+		}
+		change.SeriesID = int64(seriesID)
+
+		if _, exists := m["Deleted"]; exists {
+			change.Deleted, ok = m["Deleted"].(bool)
+			if !ok {
+				return SyncPushRequestData{}, wrong
+			}
+		}
+
+		if change.Kind == SyncWatched && !change.Deleted {
+			session, ok := m["Session"].(float64)
+			if !ok {
+				return SyncPushRequestData{}, wrong
+			}
+			episode, ok := m["Episode"].(float64)
+			if !ok {
+				return SyncPushRequestData{}, wrong
+			}
+			change.Session = int(session)
+			change.Episode = int(episode)
+		}
+
+		if _, exists := m["Updated"]; exists {
+			updated, ok := m["Updated"].(string)
+			if !ok {
+				return SyncPushRequestData{}, wrong
+			}
+			change.Updated, err = time.Parse(time.RFC3339, updated)
+			if err != nil {
+				return SyncPushRequestData{}, wrong
+			}
+		}
+
+		data.Changes = append(data.Changes, change)
+	}
+
+	return data, nil
+}
+
+type BatchRequestData struct {
+	Operations   []BatchOperation
+	AllOrNothing bool
+}
+
+func ParseBatchRequest(c *gin.Context) (BatchRequestData, error) {
+	req, err := ParseJSONRequest(c.Request)
+	if err != nil {
+		return BatchRequestData{}, err
+	}
+
+	tmp, ok := req.Data.(map[string]interface{})
+	err = ExistsFields(tmp, []string{"Operations"})
+	if err != nil {
+		return BatchRequestData{}, err
+	}
+
+	data := BatchRequestData{Operations: []BatchOperation{}}
+	if _, exists := tmp["AllOrNothing"]; exists {
+		data.AllOrNothing, ok = tmp["AllOrNothing"].(bool)
+		if !ok {
+			return BatchRequestData{}, errors.New("Wrong value in AllOrNothing")
+		}
+	}
+
+	ops, ok := tmp["Operations"].([]interface{})
+	if !ok || len(ops) > batchMaxOperations {
+		return BatchRequestData{}, errors.New("Wrong value in Operations")
+	}
+
+	wrong := errors.New("Wrong value in Operations")
+	for _, v := range ops {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return BatchRequestData{}, wrong
+		}
+
+		op := BatchOperation{}
+		op.Op, ok = m["Op"].(string)
+		if !ok {
+			return BatchRequestData{}, wrong
+		}
+
+		seriesID, ok := m["SeriesID"].(float64)
+		if !ok {
+			return BatchRequestData{}, wrong
+		}
+		op.SeriesID = int64(seriesID)
+
+		if op.Op == BatchUpdateLastWatched {
+			session, ok := m["Session"].(float64)
+			if !ok {
+				return BatchRequestData{}, wrong
+			}
+			episode, ok := m["Episode"].(float64)
+			if !ok {
+				return BatchRequestData{}, wrong
+			}
+			op.Session = int(session)
+			op.Episode = int(episode)
+		}
+
+		data.Operations = append(data.Operations, op)
+	}
+
+	return data, nil
+}
@@ -189,3 +189,26 @@ func Test_SaveImage_OK(t *testing.T) {
 	}
 
 }
+
+func Test_RemoveImage_InvalidName(t *testing.T) {
+	name, err := ioutil.TempDir(".", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+
+	victim := path.Join(name, "victim")
+	err = ioutil.WriteFile(victim, []byte{}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = removeImage(path.Join(name, "images"), "../victim")
+	if err != ErrInvalidImageName {
+		t.Fatal("Expect", ErrInvalidImageName, "was", err)
+	}
+
+	if _, err := os.Stat(victim); err != nil {
+		t.Fatal(err)
+	}
+}
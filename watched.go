@@ -0,0 +1,397 @@
+package sj
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrEpisodeNotFound = errors.New("Cannot found Episode")
+
+type (
+	SeriesProgress struct {
+		SeriesID int64
+		Watched  int
+		Total    int
+		Percent  int
+	}
+
+	SeriesProgressList []SeriesProgress
+
+	// WatchedResult is the state of the series after a toggle. LastWatched
+	// is nil if no episode of the series is watched anymore.
+	WatchedResult struct {
+		SeriesID    int64
+		LastWatched *LastWatched
+
+		// changed is set if the toggle changed LastWatched
+		changed bool
+	}
+)
+
+// WatchedRoutes registers the per-episode watched state. LastWatched is
+// kept at least at the latest watched episode of a series, so the last
+// watched endpoints keep working.
+func WatchedRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	r.PUT("/watched/episodes/:id", signedIn(NewAppHandler(app, WatchEpisodeHandler(true))))
+	r.DELETE("/watched/episodes/:id", signedIn(NewAppHandler(app, WatchEpisodeHandler(false))))
+	r.PUT("/watched/series/:id/sessions/:session", signedIn(NewAppHandler(app, WatchSessionHandler(true))))
+	r.DELETE("/watched/series/:id/sessions/:session", signedIn(NewAppHandler(app, WatchSessionHandler(false))))
+	r.GET("/watched/series/:id", signedIn(NewAppHandler(app, ReadWatchedEpisodesHandler)))
+	r.GET("/watched/progress", signedIn(NewAppHandler(app, SeriesProgressHandler)))
+}
+
+func SetEpisodeWatched(db *sql.DB, userID, episodeID int64, watched bool) (WatchedResult, error) {
+	return SetEpisodeWatchedContext(context.Background(), db, userID, episodeID, watched)
+}
+
+func SetEpisodeWatchedContext(ctx context.Context, db *sql.DB, userID, episodeID int64, watched bool) (WatchedResult, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return WatchedResult{}, err
+	}
+
+	var seriesID int64
+	var episode LastWatched
+	m := "SELECT Series_ID, Session, Episode FROM %v WHERE ID = ?"
+	q := fmt.Sprintf(m, quote(EpisodesTable))
+	err = dbQueryRow(ctx, tx, q, episodeID).Scan(&seriesID, &episode.Session, &episode.Episode)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return WatchedResult{}, ErrEpisodeNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return WatchedResult{}, err
+	}
+
+	var toggled int64
+	var unwatched func(LastWatched) bool
+	if watched {
+		toggled, err = markWatched(ctx, tx, userID, "e.ID = ?", episodeID)
+	} else {
+		m = "DELETE FROM %v WHERE User_ID = ? AND Episode_ID = ?"
+		q = fmt.Sprintf(m, quote(WatchedEpisodeTable))
+		toggled, err = execAffected(ctx, tx, q, userID, episodeID)
+		unwatched = func(w LastWatched) bool {
+			return w.Session == episode.Session && w.Episode == episode.Episode
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return WatchedResult{}, err
+	}
+
+	return commitWatched(ctx, tx, userID, seriesID, toggled, unwatched)
+}
+
+func SetSessionWatched(db *sql.DB, userID, seriesID int64, session int, watched bool) (WatchedResult, error) {
+	return SetSessionWatchedContext(context.Background(), db, userID, seriesID, session, watched)
+}
+
+// SetSessionWatchedContext marks all episodes of the session as watched or
+// not watched. Episodes which are already watched keep their time.
+func SetSessionWatchedContext(ctx context.Context, db *sql.DB, userID, seriesID int64, session int, watched bool) (WatchedResult, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return WatchedResult{}, err
+	}
+
+	var toggled int64
+	var unwatched func(LastWatched) bool
+	if watched {
+		toggled, err = markWatched(ctx, tx, userID, "e.Series_ID = ? AND e.Session = ?", seriesID, session)
+	} else {
+		m := `DELETE FROM %v WHERE User_ID = ? AND Episode_ID IN
+		(SELECT ID FROM %v WHERE Series_ID = ? AND Session = ?)`
+		q := fmt.Sprintf(m, quote(WatchedEpisodeTable), quote(EpisodesTable))
+		toggled, err = execAffected(ctx, tx, q, userID, seriesID, session)
+		unwatched = func(w LastWatched) bool {
+			return w.Session == session
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return WatchedResult{}, err
+	}
+
+	return commitWatched(ctx, tx, userID, seriesID, toggled, unwatched)
+}
+
+// markWatched marks the episodes matching where as watched, unless they
+// are watched already. It returns the number of newly watched episodes.
+func markWatched(ctx context.Context, tx *sql.Tx, userID int64, where string, args ...interface{}) (int64, error) {
+	m := `INSERT INTO %v (User_ID,Episode_ID,Watched)
+	SELECT ?, e.ID, ? FROM %v as e
+	WHERE %v AND NOT EXISTS
+	(SELECT 1 FROM %v as w WHERE w.User_ID = ? AND w.Episode_ID = e.ID)`
+	q := fmt.Sprintf(m, quote(WatchedEpisodeTable), quote(EpisodesTable), where,
+		quote(WatchedEpisodeTable))
+
+	now := time.Now().UTC().Truncate(time.Second)
+	qArgs := append([]interface{}{userID, now}, args...)
+	qArgs = append(qArgs, userID)
+
+	return execAffected(ctx, tx, q, qArgs...)
+}
+
+func execAffected(ctx context.Context, tx *sql.Tx, q string, args ...interface{}) (int64, error) {
+	res, err := dbExec(ctx, tx, q, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// commitWatched updates LastWatched of the series after toggled episodes
+// were marked and commits the transaction. Watching never lowers
+// LastWatched, it may be ahead of the watched episodes by a scrobble or an
+// import. Only if unwatched reports that LastWatched itself was marked as
+// not watched, it falls back to the latest watched episode or is removed
+// if there is none.
+func commitWatched(ctx context.Context, tx *sql.Tx, userID, seriesID int64, toggled int64, unwatched func(LastWatched) bool) (WatchedResult, error) {
+	result := WatchedResult{SeriesID: seriesID}
+
+	current, err := ReadLastWatchedContext(ctx, tx, userID, seriesID)
+	hasCurrent := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return WatchedResult{}, err
+	}
+	if hasCurrent {
+		result.LastWatched = &current
+	}
+
+	if toggled == 0 {
+		return result, tx.Commit()
+	}
+
+	m := `SELECT e.Session, e.Episode FROM %v as e, %v as w
+	WHERE w.User_ID = ? AND w.Episode_ID = e.ID AND e.Series_ID = ?
+	ORDER BY e.Session DESC, e.Episode DESC LIMIT 1`
+	q := fmt.Sprintf(m, quote(EpisodesTable), quote(WatchedEpisodeTable))
+
+	latest := LastWatched{UserID: userID, SeriesID: seriesID}
+	err = dbQueryRow(ctx, tx, q, userID, seriesID).Scan(&latest.Session, &latest.Episode)
+	hasLatest := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return WatchedResult{}, err
+	}
+
+	dropped := hasCurrent && unwatched != nil && unwatched(current)
+	switch {
+	case dropped && !hasLatest:
+		result.LastWatched = nil
+		_, err = RemoveLastWatchedContext(ctx, tx, userID, seriesID)
+	case dropped:
+		result.LastWatched = &latest
+		err = UpdateLastWatchedContext(ctx, tx, latest)
+	case hasLatest && (!hasCurrent || isBehind(current.Session, current.Episode, latest.Session, latest.Episode)):
+		result.LastWatched = &latest
+		err = UpdateLastWatchedContext(ctx, tx, latest)
+	default:
+		return result, tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		return WatchedResult{}, err
+	}
+	result.changed = true
+
+	return result, tx.Commit()
+}
+
+func ReadWatchedEpisodes(db *sql.DB, userID, seriesID int64) ([]int64, error) {
+	return ReadWatchedEpisodesContext(context.Background(), db, userID, seriesID)
+}
+
+// ReadWatchedEpisodesContext returns the IDs of the watched episodes of the
+// series.
+func ReadWatchedEpisodesContext(ctx context.Context, db *sql.DB, userID, seriesID int64) ([]int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `SELECT e.ID FROM %v as e, %v as w
+	WHERE w.User_ID = ? AND w.Episode_ID = e.ID AND e.Series_ID = ?
+	ORDER BY e.Session, e.Episode`
+	q := fmt.Sprintf(m, quote(EpisodesTable), quote(WatchedEpisodeTable))
+	rows, err := dbQuery(ctx, db, q, userID, seriesID)
+	if err != nil {
+		return []int64{}, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return []int64{}, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func ReadSeriesProgress(db *sql.DB, userID int64) (SeriesProgressList, error) {
+	return ReadSeriesProgressContext(context.Background(), db, userID)
+}
+
+// ReadSeriesProgressContext returns the watched episodes of every series
+// in the list of the user. Series without episodes are left out.
+func ReadSeriesProgressContext(ctx context.Context, db *sql.DB, userID int64) (SeriesProgressList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `SELECT e.Series_ID, COUNT(e.ID), COUNT(w.Episode_ID)
+	FROM %v as list
+	JOIN %v as e ON e.Series_ID = list.Series_ID
+	LEFT JOIN %v as w ON w.Episode_ID = e.ID AND w.User_ID = list.User_ID
+	WHERE list.User_ID = ?
+	GROUP BY e.Series_ID
+	ORDER BY e.Series_ID`
+	q := fmt.Sprintf(m, quote(SeriesListTable), quote(EpisodesTable),
+		quote(WatchedEpisodeTable))
+	rows, err := dbQuery(ctx, db, q, userID)
+	if err != nil {
+		return SeriesProgressList{}, err
+	}
+	defer rows.Close()
+
+	pList := SeriesProgressList{}
+	for rows.Next() {
+		p := SeriesProgress{}
+		err := rows.Scan(&p.SeriesID, &p.Total, &p.Watched)
+		if err != nil {
+			return SeriesProgressList{}, err
+		}
+		p.Percent = p.Watched * 100 / p.Total
+		pList = append(pList, p)
+	}
+
+	return pList, rows.Err()
+}
+
+func WatchEpisodeHandler(watched bool) AppHandler {
+	return func(app AppCtx, c *gin.Context) error {
+		ctx := requestContext(app, c)
+
+		userID, err := readSessionUserID(c)
+		if err != nil {
+			return err
+		}
+
+		episodeID, err := readIDParam(c)
+		if err != nil {
+			return err
+		}
+
+		result, err := SetEpisodeWatchedContext(ctx, app.DB, userID, episodeID, watched)
+		if err != nil {
+			return err
+		}
+
+		return respondWatched(ctx, app, c, userID, result)
+	}
+}
+
+func WatchSessionHandler(watched bool) AppHandler {
+	return func(app AppCtx, c *gin.Context) error {
+		ctx := requestContext(app, c)
+
+		userID, err := readSessionUserID(c)
+		if err != nil {
+			return err
+		}
+
+		seriesID, err := readIDParam(c)
+		if err != nil {
+			return err
+		}
+
+		session, err := strconv.Atoi(c.Params.ByName("session"))
+		if err != nil {
+			return errors.New("Wrong value in session")
+		}
+
+		result, err := SetSessionWatchedContext(ctx, app.DB, userID, seriesID, session, watched)
+		if err != nil {
+			return err
+		}
+
+		return respondWatched(ctx, app, c, userID, result)
+	}
+}
+
+func respondWatched(ctx context.Context, app AppCtx, c *gin.Context, userID int64, result WatchedResult) error {
+	switch {
+	case !result.changed:
+	case result.LastWatched != nil:
+		emit(ctx, app, NewEvent(EventEpisodeWatched, userID, *result.LastWatched))
+	default:
+		last := LastWatched{UserID: userID, SeriesID: result.SeriesID}
+		emit(ctx, app, NewEvent(EventLastWatchedRemoved, userID, last))
+	}
+
+	resp := NewSuccessResponse(result)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func ReadWatchedEpisodesHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	seriesID, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	ids, err := ReadWatchedEpisodesContext(ctx, app.DB, userID, seriesID)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(ids)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func SeriesProgressHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	pList, err := ReadSeriesProgressContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(pList)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package sj
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func Test_PUT_WatchedSession_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+	seriesID := int64(3)
+
+	mock.ExpectBegin()
+	q := fmt.Sprintf("INSERT INTO %v \\(User_ID,Episode_ID,Watched\\)", WatchedEpisodeTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, sqlmock.AnyArg(), seriesID, 2, userID).
+		WillReturnResult(sqlmock.NewResult(0, 8))
+	q = fmt.Sprintf("SELECT Session, Episode FROM %v WHERE User_ID", LastWatchedTable)
+	mock.ExpectQuery(q).WithArgs(userID, seriesID).WillReturnError(sql.ErrNoRows)
+	q = fmt.Sprintf("SELECT e.Session, e.Episode FROM %v as e, %v as w", EpisodesTable, WatchedEpisodeTable)
+	rows := sqlmock.NewRows([]string{"Session", "Episode"}).AddRow(2, 8)
+	mock.ExpectQuery(q).WithArgs(userID, seriesID).WillReturnRows(rows)
+	q = fmt.Sprintf("INTO %v", LastWatchedTable)
+	mock.ExpectExec(q).WithArgs(userID, seriesID, 2, 8).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncWatched, seriesID)
+	mock.ExpectCommit()
+
+	recorder := &eventRecorder{}
+	app := AppCtx{DB: db, Events: []EventSink{recorder}}
+	srv, token := newSignedInServer(t, app, userID, WatchedRoutes)
+
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("PUT", "/watched/series/3/sessions/2", token)
+
+	last := LastWatched{UserID: userID, SeriesID: seriesID, Session: 2, Episode: 8}
+	expect := NewSuccessResponse(WatchedResult{SeriesID: seriesID, LastWatched: &last})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.events) != 1 || recorder.events[0].Data != last {
+		t.Fatal("Unexpected events", recorder.events)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_DELETE_WatchedEpisode_Last(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+	seriesID := int64(3)
+	episodeID := int64(21)
+
+	mock.ExpectBegin()
+	q := fmt.Sprintf("SELECT Series_ID, Session, Episode FROM %v WHERE ID", EpisodesTable)
+	rows := sqlmock.NewRows([]string{"Series_ID", "Session", "Episode"}).AddRow(seriesID, 1, 2)
+	mock.ExpectQuery(q).WithArgs(episodeID).WillReturnRows(rows)
+	q = fmt.Sprintf("DELETE FROM %v WHERE User_ID = \\? AND Episode_ID = \\?", WatchedEpisodeTable)
+	mock.ExpectExec(q).WithArgs(userID, episodeID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	q = fmt.Sprintf("SELECT Session, Episode FROM %v WHERE User_ID", LastWatchedTable)
+	rows = sqlmock.NewRows([]string{"Session", "Episode"}).AddRow(1, 2)
+	mock.ExpectQuery(q).WithArgs(userID, seriesID).WillReturnRows(rows)
+	q = fmt.Sprintf("SELECT e.Session, e.Episode FROM %v as e, %v as w", EpisodesTable, WatchedEpisodeTable)
+	mock.ExpectQuery(q).WithArgs(userID, seriesID).WillReturnError(sql.ErrNoRows)
+	q = fmt.Sprintf("DELETE FROM %v WHERE User_ID = \\? AND Series_ID = \\?", LastWatchedTable)
+	mock.ExpectExec(q).WithArgs(userID, seriesID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncWatched, seriesID)
+	mock.ExpectCommit()
+
+	recorder := &eventRecorder{}
+	app := AppCtx{DB: db, Events: []EventSink{recorder}}
+	srv, token := newSignedInServer(t, app, userID, WatchedRoutes)
+
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("DELETE", "/watched/episodes/21", token)
+
+	expect := NewSuccessResponse(WatchedResult{SeriesID: seriesID})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	removed := LastWatched{UserID: userID, SeriesID: seriesID}
+	if len(recorder.events) != 1 ||
+		recorder.events[0].Type != EventLastWatchedRemoved ||
+		recorder.events[0].Data != removed {
+		t.Fatal("Unexpected events", recorder.events)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_DELETE_WatchedEpisode_KeepsLastWatched(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+	seriesID := int64(3)
+	episodeID := int64(21)
+
+	// The episode was never marked, the progress of the series stays.
+	mock.ExpectBegin()
+	q := fmt.Sprintf("SELECT Series_ID, Session, Episode FROM %v WHERE ID", EpisodesTable)
+	rows := sqlmock.NewRows([]string{"Series_ID", "Session", "Episode"}).AddRow(seriesID, 1, 2)
+	mock.ExpectQuery(q).WithArgs(episodeID).WillReturnRows(rows)
+	q = fmt.Sprintf("DELETE FROM %v WHERE User_ID = \\? AND Episode_ID = \\?", WatchedEpisodeTable)
+	mock.ExpectExec(q).WithArgs(userID, episodeID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	q = fmt.Sprintf("SELECT Session, Episode FROM %v WHERE User_ID", LastWatchedTable)
+	rows = sqlmock.NewRows([]string{"Session", "Episode"}).AddRow(1, 2)
+	mock.ExpectQuery(q).WithArgs(userID, seriesID).WillReturnRows(rows)
+	mock.ExpectCommit()
+
+	recorder := &eventRecorder{}
+	app := AppCtx{DB: db, Events: []EventSink{recorder}}
+	srv, token := newSignedInServer(t, app, userID, WatchedRoutes)
+
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("DELETE", "/watched/episodes/21", token)
+
+	last := LastWatched{UserID: userID, SeriesID: seriesID, Session: 1, Episode: 2}
+	expect := NewSuccessResponse(WatchedResult{SeriesID: seriesID, LastWatched: &last})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.events) != 0 {
+		t.Fatal("Expect no events was", recorder.events)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_GET_WatchedProgress_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := int64(14)
+
+	q := fmt.Sprintf("FROM %v as list\\s+JOIN %v as e", SeriesListTable, EpisodesTable)
+	rows := sqlmock.NewRows([]string{"Series_ID", "Total", "Watched"}).
+		AddRow(3, 10, 4).
+		AddRow(5, 3, 0)
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	srv, token := newSignedInServer(t, AppCtx{DB: db}, userID, WatchedRoutes)
+
+	req := TestRequest{
+		Body:    "",
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("GET", "/watched/progress", token)
+
+	expect := NewSuccessResponse(SeriesProgressList{
+		{SeriesID: 3, Watched: 4, Total: 10, Percent: 40},
+		{SeriesID: 5, Watched: 0, Total: 3, Percent: 0},
+	})
+	if err := EqualResponse(expect, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
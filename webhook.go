@@ -0,0 +1,756 @@
+package sj
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+
+	maxWebhookBackoff = 24 * time.Hour
+	webhookBatchSize  = 20
+	webhookLogSize    = 50
+)
+
+var (
+	ErrPrivateAddress = errors.New("Address is not public")
+	ErrNoInterval     = errors.New("Interval has to be greater than 0")
+)
+
+var webhookEvents = []string{
+	EventSeriesAdded,
+	EventSeriesRemoved,
+	EventEpisodeWatched,
+	EventLastWatchedRemoved,
+}
+
+type (
+	Webhook struct {
+		ID      int64
+		UserID  int64
+		URL     string
+		Secret  string
+		Events  []string
+		Created time.Time
+	}
+
+	WebhookList []Webhook
+
+	WebhookDelivery struct {
+		ID           int64
+		WebhookID    int64
+		Event        string
+		Payload      string
+		Status       string
+		Attempts     int
+		NextAttempt  time.Time
+		ResponseCode int
+		LastError    string
+		Created      time.Time
+	}
+
+	WebhookDeliveryList []WebhookDelivery
+
+	// WebhookSink queues a delivery for every webhook of the user which
+	// subscribed to the event.
+	WebhookSink struct {
+		DB *sql.DB
+	}
+
+	// WebhookWorker sends the queued deliveries. Failed deliveries are
+	// retried with exponential backoff until MaxAttempts is reached.
+	// Delivered and failed deliveries are deleted after Retention.
+	WebhookWorker struct {
+		DB          *sql.DB
+		Client      *http.Client
+		Interval    time.Duration
+		Backoff     time.Duration
+		MaxAttempts int
+		Retention   time.Duration
+		Logger      *slog.Logger
+	}
+
+	webhookPayload struct {
+		Event   string
+		Created time.Time
+		Data    interface{}
+	}
+)
+
+// WebhookRoutes registers the endpoints to manage the webhooks of the
+// signed in user.
+func WebhookRoutes(r *gin.RouterGroup, app AppCtx, signedIn func(gin.HandlerFunc) gin.HandlerFunc) {
+	r.GET("/webhooks", signedIn(NewAppHandler(app, ListWebhooksHandler)))
+	r.POST("/webhooks", signedIn(NewAppHandler(app, NewWebhookHandler)))
+	r.DELETE("/webhooks/:id", signedIn(NewAppHandler(app, RemoveWebhookHandler)))
+	r.GET("/webhooks/:id/deliveries", signedIn(NewAppHandler(app, WebhookDeliveriesHandler)))
+}
+
+func NewWebhookWorker(app AppCtx) *WebhookWorker {
+	return &WebhookWorker{
+		DB:          app.DB,
+		Client:      NewPublicClient(app.Specs.WebhookTimeout),
+		Interval:    app.Specs.WebhookInterval,
+		Backoff:     app.Specs.WebhookBackoff,
+		MaxAttempts: app.Specs.WebhookMaxAttempts,
+		Retention:   app.Specs.WebhookRetention,
+		Logger:      logger(app),
+	}
+}
+
+// NewPublicClient returns a client for URLs chosen by users. It only
+// connects to public addresses, which is checked when dialing so a DNS
+// answer cannot change it after validation, and does not follow redirects.
+func NewPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if !publicIP(net.ParseIP(host)) {
+				return ErrPrivateAddress
+			}
+
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func publicIP(ip net.IP) bool {
+	return ip != nil &&
+		!ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() &&
+		!ip.IsUnspecified()
+}
+
+// validatePublicURL checks that the host of u only resolves to public
+// addresses.
+func validatePublicURL(ctx context.Context, u *url.URL) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return ErrPrivateAddress
+		}
+	}
+
+	return nil
+}
+
+// SignWebhook returns the X-SJ-Signature header of the payload.
+func SignWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s WebhookSink) Emit(ctx context.Context, e Event) error {
+	return EnqueueWebhookDeliveriesContext(ctx, s.DB, e)
+}
+
+func EnqueueWebhookDeliveries(db *sql.DB, e Event) error {
+	return EnqueueWebhookDeliveriesContext(context.Background(), db, e)
+}
+
+func EnqueueWebhookDeliveriesContext(ctx context.Context, db *sql.DB, e Event) error {
+	wList, err := ReadWebhookListContext(ctx, db, e.UserID)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range wList {
+		if !w.Subscribed(e.Type) {
+			continue
+		}
+
+		err := NewWebhookDeliveryContext(ctx, db, w.ID, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Subscribed reports if the webhook wants the event. Webhooks without a
+// list of events get all of them.
+func (w Webhook) Subscribed(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func NewWebhook(db *sql.DB, w Webhook) (Webhook, error) {
+	return NewWebhookContext(context.Background(), db, w)
+}
+
+func NewWebhookContext(ctx context.Context, db *sql.DB, w Webhook) (Webhook, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	secret, err := newSecretToken()
+	if err != nil {
+		return Webhook{}, err
+	}
+	w.Secret = secret
+	w.Created = time.Now().UTC().Truncate(time.Second)
+
+	m := "INSERT INTO %v (User_ID,URL,Secret,Events,Created) VALUES(?, ?, ?, ?, ?)"
+	q := fmt.Sprintf(m, quote(WebhookTable))
+	w.ID, err = dbInsertID(ctx, db, q, w.UserID, w.URL, w.Secret,
+		strings.Join(w.Events, ","), w.Created)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return w, nil
+}
+
+func ReadWebhookList(db *sql.DB, userID int64) (WebhookList, error) {
+	return ReadWebhookListContext(context.Background(), db, userID)
+}
+
+func ReadWebhookListContext(ctx context.Context, db *sql.DB, userID int64) (WebhookList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := "SELECT ID, URL, Secret, Events, Created FROM %v WHERE User_ID = ? ORDER BY ID"
+	q := fmt.Sprintf(m, quote(WebhookTable))
+	rows, err := dbQuery(ctx, db, q, userID)
+	if err != nil {
+		return WebhookList{}, err
+	}
+	defer rows.Close()
+
+	wList := WebhookList{}
+	for rows.Next() {
+		w := Webhook{UserID: userID}
+		var events string
+		err := rows.Scan(&w.ID, &w.URL, &w.Secret, &events, &w.Created)
+		if err != nil {
+			return WebhookList{}, err
+		}
+
+		w.Events = []string{}
+		if events != "" {
+			w.Events = strings.Split(events, ",")
+		}
+		wList = append(wList, w)
+	}
+
+	return wList, rows.Err()
+}
+
+// RemoveWebhook deletes the webhook of the user and its delivery log.
+func RemoveWebhook(db *sql.DB, userID, id int64) (int64, error) {
+	return RemoveWebhookContext(context.Background(), db, userID, id)
+}
+
+func RemoveWebhookContext(ctx context.Context, db *sql.DB, userID, id int64) (int64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	s := "DELETE FROM %v WHERE ID = ? AND User_ID = ?"
+	q := fmt.Sprintf(s, quote(WebhookTable))
+	rsrc, err := dbExec(ctx, tx, q, id, userID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	affected, err := rsrc.RowsAffected()
+	if err != nil || affected == 0 {
+		tx.Rollback()
+		return 0, err
+	}
+
+	s = "DELETE FROM %v WHERE Webhook_ID = ?"
+	q = fmt.Sprintf(s, quote(WebhookDeliveryTable))
+	_, err = dbExec(ctx, tx, q, id)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return affected, tx.Commit()
+}
+
+func NewWebhookDelivery(db *sql.DB, webhookID int64, e Event) error {
+	return NewWebhookDeliveryContext(context.Background(), db, webhookID, e)
+}
+
+func NewWebhookDeliveryContext(ctx context.Context, db *sql.DB, webhookID int64, e Event) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	payload, err := json.Marshal(webhookPayload{
+		Event:   e.Type,
+		Created: e.Created,
+		Data:    e.Data,
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	m := `INSERT INTO %v (Webhook_ID,Event,Payload,Status,Attempts,Next_Attempt,Response_Code,Last_Error,Created)
+	VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	q := fmt.Sprintf(m, quote(WebhookDeliveryTable))
+	_, err = dbExec(ctx, db, q, webhookID, e.Type, string(payload),
+		DeliveryPending, 0, now, 0, "", now)
+
+	return err
+}
+
+// ReadWebhookDeliveryList returns the latest deliveries of the webhook of
+// the user.
+func ReadWebhookDeliveryList(db *sql.DB, userID, webhookID int64) (WebhookDeliveryList, error) {
+	return ReadWebhookDeliveryListContext(context.Background(), db, userID, webhookID)
+}
+
+func ReadWebhookDeliveryListContext(ctx context.Context, db *sql.DB, userID, webhookID int64) (WebhookDeliveryList, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	m := `
+	SELECT d.ID, d.Webhook_ID, d.Event, d.Payload, d.Status, d.Attempts,
+	d.Next_Attempt, d.Response_Code, d.Last_Error, d.Created
+	FROM %v as d, %v as w
+	WHERE d.Webhook_ID = ? AND w.ID = d.Webhook_ID AND w.User_ID = ?
+	ORDER BY d.ID DESC
+	LIMIT %v
+	`
+	q := fmt.Sprintf(m, quote(WebhookDeliveryTable), quote(WebhookTable), webhookLogSize)
+	rows, err := dbQuery(ctx, db, q, webhookID, userID)
+	if err != nil {
+		return WebhookDeliveryList{}, err
+	}
+	defer rows.Close()
+
+	dList := WebhookDeliveryList{}
+	for rows.Next() {
+		d := WebhookDelivery{}
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status,
+			&d.Attempts, &d.NextAttempt, &d.ResponseCode, &d.LastError, &d.Created)
+		if err != nil {
+			return WebhookDeliveryList{}, err
+		}
+
+		dList = append(dList, d)
+	}
+
+	return dList, rows.Err()
+}
+
+// Run delivers the due deliveries every Interval until ctx is done.
+func (w *WebhookWorker) Run(ctx context.Context) error {
+	if w.Interval <= 0 {
+		return ErrNoInterval
+	}
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		// Failed deliveries stay pending, so errors are retried on the
+		// next tick.
+		now := time.Now().UTC()
+		_, err := w.DeliverDue(ctx, now)
+		if err != nil {
+			w.logger().Error("webhook worker failed", "error", err.Error())
+		}
+
+		_, err = w.PruneDeliveries(ctx, now)
+		if err != nil {
+			w.logger().Error("webhook worker failed", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue sends the pending deliveries which are due at now and returns
+// how many were sent successfully.
+func (w *WebhookWorker) DeliverDue(ctx context.Context, now time.Time) (int, error) {
+	m := `
+	SELECT d.ID, d.Webhook_ID, d.Event, d.Payload, d.Attempts, d.Next_Attempt,
+	w.URL, w.Secret
+	FROM %v as d, %v as w
+	WHERE d.Status = ? AND d.Next_Attempt <= ? AND w.ID = d.Webhook_ID
+	ORDER BY d.Next_Attempt
+	LIMIT %v
+	`
+	q := fmt.Sprintf(m, quote(WebhookDeliveryTable), quote(WebhookTable), webhookBatchSize)
+
+	type due struct {
+		Delivery WebhookDelivery
+		URL      string
+		Secret   string
+	}
+
+	dList, err := func() ([]due, error) {
+		qctx, cancel := queryContext(ctx)
+		defer cancel()
+
+		rows, err := dbQuery(qctx, w.DB, q, DeliveryPending, now)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		dList := []due{}
+		for rows.Next() {
+			d := due{}
+			err := rows.Scan(&d.Delivery.ID, &d.Delivery.WebhookID, &d.Delivery.Event,
+				&d.Delivery.Payload, &d.Delivery.Attempts, &d.Delivery.NextAttempt,
+				&d.URL, &d.Secret)
+			if err != nil {
+				return nil, err
+			}
+			dList = append(dList, d)
+		}
+
+		return dList, rows.Err()
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, d := range dList {
+		claimed, err := w.claim(ctx, d.Delivery, now)
+		if err != nil {
+			return sent, err
+		}
+		if !claimed {
+			continue
+		}
+
+		code, err := w.send(ctx, d.URL, d.Secret, d.Delivery)
+		if err != nil {
+			w.logger().Warn("webhook delivery failed",
+				"delivery_id", d.Delivery.ID,
+				"webhook_id", d.Delivery.WebhookID,
+				"attempt", d.Delivery.Attempts+1,
+				"error", err.Error(),
+			)
+		}
+
+		err = w.finish(ctx, d.Delivery, now, code, err)
+		if err != nil {
+			return sent, err
+		}
+
+		if code >= 200 && code < 300 {
+			sent++
+		}
+	}
+
+	return sent, nil
+}
+
+// PruneDeliveries deletes the delivered and failed deliveries created
+// before now minus Retention.
+func (w *WebhookWorker) PruneDeliveries(ctx context.Context, now time.Time) (int64, error) {
+	if w.Retention <= 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "DELETE FROM %v WHERE Status <> ? AND Created < ?"
+	q := fmt.Sprintf(s, quote(WebhookDeliveryTable))
+	rsrc, err := dbExec(ctx, w.DB, q, DeliveryPending, now.Add(-w.Retention))
+	if err != nil {
+		return 0, err
+	}
+
+	return rsrc.RowsAffected()
+}
+
+func (w *WebhookWorker) logger() *slog.Logger {
+	if w.Logger == nil {
+		return slog.Default()
+	}
+
+	return w.Logger
+}
+
+// claim moves the next attempt of the delivery into the future, so other
+// workers skip it while it is sent.
+func (w *WebhookWorker) claim(ctx context.Context, d WebhookDelivery, now time.Time) (bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	s := "UPDATE %v SET Next_Attempt = ? WHERE ID = ? AND Next_Attempt = ?"
+	q := fmt.Sprintf(s, quote(WebhookDeliveryTable))
+	lease := now.Add(w.Client.Timeout + w.Interval).Truncate(time.Second)
+	rsrc, err := dbExec(ctx, w.DB, q, lease, d.ID, d.NextAttempt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := rsrc.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func (w *WebhookWorker) send(ctx context.Context, url, secret string, d WebhookDelivery) (int, error) {
+	payload := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sj-webhook")
+	req.Header.Set("X-SJ-Event", d.Event)
+	req.Header.Set("X-SJ-Delivery", fmt.Sprint(d.ID))
+	req.Header.Set("X-SJ-Signature", SignWebhook(secret, payload))
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Unexpected status %v", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// finish logs the attempt and schedules the next one if the delivery
+// failed.
+func (w *WebhookWorker) finish(ctx context.Context, d WebhookDelivery, now time.Time, code int, sendErr error) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	attempts := d.Attempts + 1
+	status := DeliveryDelivered
+	next := now
+	lastError := ""
+	if sendErr != nil {
+		lastError = sendErr.Error()
+		if len(lastError) > 500 {
+			lastError = lastError[:500]
+		}
+
+		status = DeliveryPending
+		next = now.Add(w.backoff(attempts)).Truncate(time.Second)
+		if attempts >= w.MaxAttempts {
+			status = DeliveryFailed
+		}
+	}
+
+	m := `UPDATE %v SET Status = ?, Attempts = ?, Next_Attempt = ?, Response_Code = ?, Last_Error = ?
+	WHERE ID = ?`
+	q := fmt.Sprintf(m, quote(WebhookDeliveryTable))
+	_, err := dbExec(ctx, w.DB, q, status, attempts, next, code, lastError, d.ID)
+
+	return err
+}
+
+func (w *WebhookWorker) backoff(attempts int) time.Duration {
+	d := w.Backoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= maxWebhookBackoff {
+			return maxWebhookBackoff
+		}
+	}
+
+	return d
+}
+
+func ListWebhooksHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	wList, err := ReadWebhookListContext(ctx, app.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(wList)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func NewWebhookHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	w, err := ParseNewWebhookRequest(c)
+	if err != nil {
+		return err
+	}
+
+	err = validateWebhook(ctx, w)
+	if err != nil {
+		return err
+	}
+
+	w.UserID = userID
+	w, err = NewWebhookContext(ctx, app.DB, w)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(w)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func RemoveWebhookHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	affected, err := RemoveWebhookContext(ctx, app.DB, userID, id)
+	if err != nil {
+		return err
+	}
+
+	if affected < 1 {
+		return errors.New("Cannot found webhook")
+	}
+
+	resp := NewSuccessResponse("")
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func WebhookDeliveriesHandler(app AppCtx, c *gin.Context) error {
+	ctx := requestContext(app, c)
+
+	userID, err := readSessionUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	dList, err := ReadWebhookDeliveryListContext(ctx, app.DB, userID, id)
+	if err != nil {
+		return err
+	}
+
+	resp := NewSuccessResponse(dList)
+	c.JSON(http.StatusOK, resp)
+
+	return nil
+}
+
+func validateWebhook(ctx context.Context, w Webhook) error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("Wrong value in URL")
+	}
+
+	err = validatePublicURL(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range w.Events {
+		known := false
+		for _, k := range webhookEvents {
+			known = known || e == k
+		}
+
+		if !known {
+			m := fmt.Sprintf("Unknown event %v", e)
+			return errors.New(m)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,268 @@
+package sj
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tochti/gin-angular-kauth"
+	"github.com/tochti/smem"
+)
+
+var dueDeliveryColumns = []string{
+	"ID", "Webhook_ID", "Event", "Payload", "Attempts", "Next_Attempt", "URL", "Secret",
+}
+
+func Test_WebhookWorker_DeliverDue_OK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	secret := "s3cret"
+	payload := `{"Event":"episode.watched"}`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if sig := r.Header.Get("X-SJ-Signature"); sig != SignWebhook(secret, body) {
+			t.Error("Wrong signature", sig)
+		}
+		if e := r.Header.Get("X-SJ-Event"); e != EventEpisodeWatched {
+			t.Error("Wrong event", e)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	q := fmt.Sprintf("FROM %v as d, %v as w WHERE d.Status", WebhookDeliveryTable, WebhookTable)
+	rows := sqlmock.NewRows(dueDeliveryColumns).
+		AddRow(4, 1, EventEpisodeWatched, payload, 0, now, srv.URL, secret)
+	mock.ExpectQuery(q).WithArgs(DeliveryPending, now).WillReturnRows(rows)
+
+	q = fmt.Sprintf("UPDATE %v SET Next_Attempt", WebhookDeliveryTable)
+	mock.ExpectExec(q).
+		WithArgs(sqlmock.AnyArg(), 4, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	q = fmt.Sprintf("UPDATE %v SET Status", WebhookDeliveryTable)
+	mock.ExpectExec(q).
+		WithArgs(DeliveryDelivered, 1, now, http.StatusNoContent, "", 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := &WebhookWorker{
+		DB:          db,
+		Client:      &http.Client{Timeout: time.Second},
+		Interval:    time.Second,
+		Backoff:     time.Minute,
+		MaxAttempts: 3,
+	}
+	sent, err := w.DeliverDue(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != 1 {
+		t.Fatal("Expect 1 sent delivery was", sent)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_WebhookWorker_DeliverDue_Retry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Attempts int
+		Status   string
+		Next     time.Time
+	}{
+		{1, DeliveryPending, now.Add(2 * time.Minute)},
+		{2, DeliveryFailed, now.Add(4 * time.Minute)},
+	}
+
+	w := &WebhookWorker{
+		DB:          db,
+		Client:      &http.Client{Timeout: time.Second},
+		Interval:    time.Second,
+		Backoff:     time.Minute,
+		MaxAttempts: 3,
+	}
+
+	for _, tc := range tests {
+		q := fmt.Sprintf("FROM %v as d", WebhookDeliveryTable)
+		rows := sqlmock.NewRows(dueDeliveryColumns).
+			AddRow(4, 1, EventSeriesAdded, "{}", tc.Attempts, now, srv.URL, "secret")
+		mock.ExpectQuery(q).WillReturnRows(rows)
+
+		q = fmt.Sprintf("UPDATE %v SET Next_Attempt", WebhookDeliveryTable)
+		mock.ExpectExec(q).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		q = fmt.Sprintf("UPDATE %v SET Status", WebhookDeliveryTable)
+		mock.ExpectExec(q).
+			WithArgs(tc.Status, tc.Attempts+1, tc.Next, http.StatusInternalServerError,
+				"Unexpected status 500 Internal Server Error", 4).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		sent, err := w.DeliverDue(context.Background(), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sent != 0 {
+			t.Fatal("Expect 0 sent deliveries was", sent)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_POST_LastWatched_EmitsWebhook(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := int64(1)
+
+	mock.ExpectBegin()
+	q := fmt.Sprintf("REPLACE INTO %v", LastWatchedTable)
+	mock.ExpectExec(q).
+		WithArgs(userID, 2, 1, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSyncChange(mock, userID, 1, SyncWatched, 2)
+	mock.ExpectCommit()
+
+	q = fmt.Sprintf("SELECT ID, URL, Secret, Events, Created FROM %v", WebhookTable)
+	rows := sqlmock.NewRows([]string{"ID", "URL", "Secret", "Events", "Created"}).
+		AddRow(7, "http://hook", "secret", EventEpisodeWatched, time.Now()).
+		AddRow(8, "http://other", "secret", EventSeriesAdded, time.Now())
+	mock.ExpectQuery(q).WithArgs(userID).WillReturnRows(rows)
+
+	q = fmt.Sprintf("INSERT INTO %v", WebhookDeliveryTable)
+	mock.ExpectExec(q).
+		WithArgs(7, EventEpisodeWatched, sqlmock.AnyArg(), DeliveryPending, 0,
+			sqlmock.AnyArg(), 0, "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	sessionStore := smem.NewStore()
+	expires := time.Now().Add(1 * time.Hour)
+	session, err := sessionStore.NewSession(strconv.FormatInt(userID, 10), expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppCtx{
+		DB:     db,
+		Events: []EventSink{WebhookSink{DB: db}},
+	}
+	srv := gin.New()
+	signedIn := kauth.SignedIn(&sessionStore)
+	srv.POST("/lastwatched", signedIn(NewAppHandler(app, UpdateLastWatchedHandler)))
+
+	req := TestRequest{
+		Body:    `{"Data": {"SeriesID": 2, "Session": 1, "Episode": 3}}`,
+		Handler: srv,
+		Header:  http.Header{},
+	}
+	resp := req.SendWithToken("POST", "/lastwatched", session.Token())
+
+	if 200 != resp.Code {
+		t.Fatal("Expect 200 was", resp.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ValidateWebhook_PrivateAddress(t *testing.T) {
+	for _, u := range []string{
+		"http://127.0.0.1/hook",
+		"http://10.0.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://0.0.0.0/hook",
+	} {
+		err := validateWebhook(context.Background(), Webhook{URL: u})
+		if err != ErrPrivateAddress {
+			t.Fatal("Expect", ErrPrivateAddress, "for", u, "was", err)
+		}
+	}
+
+	err := validateWebhook(context.Background(), Webhook{URL: "https://93.184.216.34/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_PublicClient_PrivateAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expect no request")
+	}))
+	defer srv.Close()
+
+	_, err := NewPublicClient(time.Second).Get(srv.URL)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatal("Expect", ErrPrivateAddress, "was", err)
+	}
+}
+
+func Test_WebhookWorker_Run_NoInterval(t *testing.T) {
+	w := &WebhookWorker{}
+	if err := w.Run(context.Background()); err != ErrNoInterval {
+		t.Fatal("Expect", ErrNoInterval, "was", err)
+	}
+}
+
+func Test_WebhookWorker_PruneDeliveries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Date(2016, 3, 3, 0, 0, 0, 0, time.UTC)
+	q := fmt.Sprintf("DELETE FROM %v WHERE Status <> \\? AND Created < \\?", WebhookDeliveryTable)
+	mock.ExpectExec(q).
+		WithArgs(DeliveryPending, now.AddDate(0, 0, -30)).
+		WillReturnResult(sqlmock.NewResult(0, 7))
+
+	w := &WebhookWorker{DB: db, Retention: 30 * 24 * time.Hour}
+	n, err := w.PruneDeliveries(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Fatal("Expect 7 was", n)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}